@@ -0,0 +1,40 @@
+package aof
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ * AOF 中可以包含以 # 开头的注释行，加载时会被忽略。
+ * 开启 aof-timestamp-enabled 后，每秒第一次写入命令之前会写入一个时间戳注释：
+ *   #TS:1700000000
+ * 将 AOF 截断到某个时间戳注释之前，即可恢复到这一时刻的数据
+ */
+
+const timestampAnnotationPrefix = "#TS:"
+
+func makeTimestampAnnotation(timestamp int64) []byte {
+	return []byte(timestampAnnotationPrefix + strconv.FormatInt(timestamp, 10) + "\r\n")
+}
+
+// isAnnotation 判断解析到的命令是否是一行注释
+func isAnnotation(cmdLine CmdLine) bool {
+	return len(cmdLine) == 1 && len(cmdLine[0]) > 0 && cmdLine[0][0] == '#'
+}
+
+// parseTimestampAnnotation 解析时间戳注释，不是时间戳注释时返回 false
+func parseTimestampAnnotation(cmdLine CmdLine) (int64, bool) {
+	if !isAnnotation(cmdLine) {
+		return 0, false
+	}
+	line := string(cmdLine[0])
+	if !strings.HasPrefix(line, timestampAnnotationPrefix) {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(line[len(timestampAnnotationPrefix):], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ts, true
+}
@@ -1,15 +1,19 @@
 package aof
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"io"
+	"miniRedis/config"
 	"miniRedis/interface/database"
 	"miniRedis/lib/logger"
+	"miniRedis/lib/sync/atomic"
 	"miniRedis/lib/utils"
 	"miniRedis/redis/connection"
-	"miniRedis/redis/parser"
 	"miniRedis/redis/protocol"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -34,12 +38,15 @@ const (
 
 type payload struct { // 用于存储写入AOF文件的相关信息
 	cmdLine CmdLine         // 用于存储一个命令行
+	txLines []CmdLine       // 不为空时表示一个事务中的命令，作为 MULTI ... EXEC 块写入，其中可能有 SELECT
 	dbIndex int             // 对应的数据库下标
 	wg      *sync.WaitGroup // 用于等待多个goroutine完成AOF文件操作
+	flushed chan struct{}   // 不为 nil 时表示这是一个标记，之前的命令都写入文件之后关闭它
 }
 
 type Listener interface {
 	// Callback will be called-back after receiving a aof payload
+	// 命令行中可能包含切换数据库的 SELECT 命令和事务的 MULTI、EXEC 命令，切片在回调返回之后会被复用
 	Callback([]CmdLine)
 }
 
@@ -50,18 +57,30 @@ type Persister struct { // 用于执行持久化的执行者
 	db          database.DBEngine        // 数据库引擎
 	tmpDBMaker  func() database.DBEngine // 临时的数据库创建函数，用于AOF重写的时候创建临时数据库
 	aofChan     chan *payload            // 用于在持久化协程和Redis主协程之间传递任务的通道，一般用于在AOF重写的时候作为临时的重写缓冲区
-	aofFile     *os.File                 // AOF文件。
-	aofFilename string                   // AOF名。
+	aofFile     *os.File                 // 当前写入的增量文件
+	aofFilename string                   // AOF名，AOF 目录中的文件均以它的文件名为前缀
+	aofDir      string                   // AOF 目录，保存 base 文件、增量文件和清单
+	manifest    *manifest                // 当前使用的 AOF 文件，需要在持有 pausingAof 时修改
 	aofFsync    string                   // AOF写入策略（always/everysec/no）
+	// listenOnly 表示没有开启 AOF，命令不写入文件，只通知监听器
+	listenOnly bool
 	// aof goroutine will send msg to main goroutine through this channel when aof tasks finished and ready to shut down
 	// 当aof任务完成并准备关闭时，aof goroutine将通过此通道向main goroutine发送消息。
 	aofFinished chan struct{} // 持久化协程完成后通知Redis主协程的通道
 	// pause aof for start/finish aof rewrite progress
-	pausingAof sync.Mutex            // 锁，用于在AOF重写期间暂停AOF持久化
-	currentDB  int                   // 当前正在使用的数据库编号
-	listeners  map[Listener]struct{} // Redis事件监听器
+	pausingAof sync.Mutex // 锁，用于在AOF重写期间暂停AOF持久化
+	currentDB  int        // 当前正在使用的数据库编号
+	// lastTimestamp 是最近写入的时间戳注释，开启 aof-timestamp-enabled 时每秒最多写入一个注释
+	lastTimestamp int64
+	listeners     map[Listener]struct{} // Redis事件监听器
 	// reuse cmdLine buffer
 	buffer []CmdLine // 命令缓冲区
+	// AOF 重写的状态，用于 INFO 和 metrics
+	rewriting         atomic.Boolean // 是否正在进行重写
+	lastRewriteFailed atomic.Boolean // 最近一次重写是否失败
+	// AOF 目录中所有文件的大小，以及最近一次重写完成（或者启动）时的大小，用于自动触发重写
+	currentSize atomic.Int64
+	baseSize    atomic.Int64
 }
 
 // NewPersister creates a new aof.Persister
@@ -72,10 +91,20 @@ func NewPersister(db database.DBEngine, filename string, load bool, fsync string
 	persister.db = db
 	persister.tmpDBMaker = tmpDBMaker
 	persister.currentDB = 0
+	dirname := config.Properties.AppendDirname
+	if dirname == "" {
+		dirname = "appendonlydir"
+	}
+	persister.aofDir = filepath.Join(filepath.Dir(filename), dirname)
+	if err := persister.initManifest(); err != nil {
+		return nil, err
+	}
 	if load {
-		persister.LoadAof(0)
+		if err := persister.LoadAof(0); err != nil {
+			return nil, err
+		}
 	}
-	aofFile, err := os.OpenFile(persister.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	aofFile, err := persister.openIncrFile()
 	if err != nil {
 		return nil, err
 	}
@@ -92,9 +121,69 @@ func NewPersister(db database.DBEngine, filename string, load bool, fsync string
 	if persister.aofFsync == FsyncEverySec {
 		persister.fsyncEverySecond()
 	}
+	size := persister.filesSize()
+	persister.currentSize.Set(size)
+	persister.baseSize.Set(size)
+	persister.autoRewriteCron()
 	return persister, nil
 }
 
+// NewListenerPersister 创建一个不写入文件的 Persister，用于没有开启 AOF 时把写命令通知给 CDC 等监听器。
+// 命令在调用 SaveCmdLine 的协程中同步通知，监听器看到的顺序和命令执行的顺序一致
+func NewListenerPersister(db database.DBEngine) *Persister {
+	persister := &Persister{
+		db:          db,
+		listenOnly:  true,
+		aofChan:     make(chan *payload, aofQueueSize),
+		aofFinished: make(chan struct{}),
+		listeners:   make(map[Listener]struct{}),
+	}
+	go func() {
+		persister.listenCmd()
+	}()
+	persister.ctx, persister.cancel = context.WithCancel(context.Background())
+	return persister
+}
+
+// AppendOnly returns whether commands are written into aof files
+func (persister *Persister) AppendOnly() bool {
+	return !persister.listenOnly
+}
+
+// QueueLen returns the number of commands waiting to be written into aof file
+func (persister *Persister) QueueLen() int {
+	return len(persister.aofChan)
+}
+
+// IsRewriting returns whether an aof rewrite is in progress
+func (persister *Persister) IsRewriting() bool {
+	return persister.rewriting.Get()
+}
+
+// CurrentSize returns the total size of the aof files
+func (persister *Persister) CurrentSize() int64 {
+	return persister.currentSize.Get()
+}
+
+// BaseSize returns the size of the aof files after the latest rewrite or startup
+func (persister *Persister) BaseSize() int64 {
+	return persister.baseSize.Get()
+}
+
+// LastRewriteFailed returns whether the last aof rewrite failed
+func (persister *Persister) LastRewriteFailed() bool {
+	return persister.lastRewriteFailed.Get()
+}
+
+// AddListener 注册一个监听器，之后写入的命令都会回调监听器。
+// 监听器首先收到一个 SELECT 命令，表示之后的命令所在的数据库
+func (persister *Persister) AddListener(listener Listener) {
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	persister.listeners[listener] = struct{}{}
+	listener.Callback([]CmdLine{utils.ToCmdLine("SELECT", strconv.Itoa(persister.currentDB))})
+}
+
 func (persister *Persister) RemoveListener(listener Listener) {
 	persister.pausingAof.Lock()
 	defer persister.pausingAof.Unlock()
@@ -107,7 +196,7 @@ func (persister *Persister) SaveCmdLine(dbIndex int, cmdLine CmdLine) {
 		return
 	}
 	// FsyncAlways 策略表示每个命令都要进行AOF操作
-	if persister.aofFsync == FsyncAlways {
+	if persister.aofFsync == FsyncAlways || persister.listenOnly {
 		p := &payload{
 			cmdLine: cmdLine,
 			dbIndex: dbIndex,
@@ -121,24 +210,81 @@ func (persister *Persister) SaveCmdLine(dbIndex int, cmdLine CmdLine) {
 	}
 }
 
+// SaveTransaction 将一个事务中的命令作为一个整体写入 AOF，其它命令不会插入到事务块中间
+func (persister *Persister) SaveTransaction(dbIndex int, cmdLines []CmdLine) {
+	if persister.aofChan == nil {
+		return
+	}
+	p := &payload{
+		txLines: cmdLines,
+		dbIndex: dbIndex,
+	}
+	if persister.aofFsync == FsyncAlways || persister.listenOnly {
+		persister.writeAof(p)
+		return
+	}
+	persister.aofChan <- p
+}
+
 func (persister *Persister) listenCmd() {
 	for p := range persister.aofChan {
+		if p.flushed != nil {
+			close(p.flushed)
+			continue
+		}
 		persister.writeAof(p)
 	}
 	persister.aofFinished <- struct{}{}
 }
 
+// flushQueue 等待队列中已有的命令都写入文件
+func (persister *Persister) flushQueue() {
+	flushed := make(chan struct{})
+	persister.aofChan <- &payload{flushed: flushed}
+	<-flushed
+}
+
+// Fsync 等待之前提交的命令写入文件并刷新到磁盘，用于 appendfsync 不是 always 时也不能丢失的命令
+func (persister *Persister) Fsync() {
+	if persister.listenOnly || persister.aofChan == nil || persister.aofFsync == FsyncAlways {
+		return
+	}
+	persister.flushQueue()
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	if err := persister.aofFile.Sync(); err != nil {
+		logger.Errorf("fsync failed: %v", err)
+	}
+}
+
 func (persister *Persister) writeAof(p *payload) {
-	persister.buffer = persister.buffer[:0] // 清空缓冲区以便后续复用
-	persister.pausingAof.Lock()             // prevent other goroutines from pausing aof
+	persister.pausingAof.Lock() // prevent other goroutines from pausing aof
 	defer persister.pausingAof.Unlock()
+	// FsyncAlways 策略下多个协程会同时调用 writeAof，缓冲区需要在持有锁之后清空
+	persister.buffer = persister.buffer[:0] // 清空缓冲区以便后续复用
+	if persister.listenOnly {
+		persister.notifyListeners(p)
+		return
+	}
+	if config.Properties.AofTimestampEnabled {
+		if now := time.Now().Unix(); now > persister.lastTimestamp {
+			n, err := persister.aofFile.Write(makeTimestampAnnotation(now))
+			persister.currentSize.Add(int64(n))
+			if err != nil {
+				logger.Warn(err)
+				return // skip this command
+			}
+			persister.lastTimestamp = now
+		}
+	}
 	// ensure aof is in the right database
 	if p.dbIndex != persister.currentDB {
 		// 修改数据库
 		selectCmd := utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))
 		persister.buffer = append(persister.buffer, selectCmd)
 		data := protocol.MakeMultiBulkReply(selectCmd).ToBytes()
-		_, err := persister.aofFile.Write(data)
+		n, err := persister.aofFile.Write(data)
+		persister.currentSize.Add(int64(n))
 		if err != nil {
 			logger.Warn(err)
 			return // skip this command
@@ -147,9 +293,24 @@ func (persister *Persister) writeAof(p *payload) {
 	}
 
 	// save command
-	data := protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
-	persister.buffer = append(persister.buffer, p.cmdLine)
-	_, err := persister.aofFile.Write(data)
+	var data []byte
+	if len(p.txLines) > 0 {
+		// 事务块一次写入，加载时会丢弃文件末尾不完整的事务块
+		lines := make([]CmdLine, 0, len(p.txLines)+2)
+		lines = append(lines, utils.ToCmdLine("MULTI"))
+		lines = append(lines, p.txLines...)
+		lines = append(lines, utils.ToCmdLine("EXEC"))
+		for _, line := range lines {
+			data = append(data, protocol.MakeMultiBulkReply(line).ToBytes()...)
+		}
+		persister.buffer = append(persister.buffer, lines...)
+		persister.currentDB = lastSelectedDB(persister.currentDB, p.txLines)
+	} else {
+		data = protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
+		persister.buffer = append(persister.buffer, p.cmdLine)
+	}
+	n, err := persister.aofFile.Write(data)
+	persister.currentSize.Add(int64(n))
 	if err != nil {
 		logger.Warn(err)
 	}
@@ -161,8 +322,128 @@ func (persister *Persister) writeAof(p *payload) {
 	}
 }
 
-// 将aof文件加载到内存
-func (persister *Persister) LoadAof(maxBytes int) {
+// notifyListeners 不写入文件，只把命令通知给监听器，调用者需要持有 pausingAof
+func (persister *Persister) notifyListeners(p *payload) {
+	if len(persister.listeners) == 0 {
+		return
+	}
+	if p.dbIndex != persister.currentDB {
+		persister.buffer = append(persister.buffer, utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex)))
+		persister.currentDB = p.dbIndex
+	}
+	if len(p.txLines) > 0 {
+		persister.buffer = append(persister.buffer, utils.ToCmdLine("MULTI"))
+		persister.buffer = append(persister.buffer, p.txLines...)
+		persister.buffer = append(persister.buffer, utils.ToCmdLine("EXEC"))
+		persister.currentDB = lastSelectedDB(persister.currentDB, p.txLines)
+	} else {
+		persister.buffer = append(persister.buffer, p.cmdLine)
+	}
+	for listener := range persister.listeners {
+		listener.Callback(persister.buffer)
+	}
+}
+
+// lastSelectedDB 返回事务中最后一个 SELECT 选择的数据库，事务中没有 SELECT 时返回 dbIndex
+func lastSelectedDB(dbIndex int, txLines []CmdLine) int {
+	for _, line := range txLines {
+		if len(line) == 2 && strings.ToLower(string(line[0])) == "select" {
+			if index, err := strconv.Atoi(string(line[1])); err == nil {
+				dbIndex = index
+			}
+		}
+	}
+	return dbIndex
+}
+
+// filesSize 返回清单中所有文件的大小
+func (persister *Persister) filesSize() int64 {
+	var size int64
+	for _, f := range persister.manifest.files() {
+		if info, err := os.Stat(filepath.Join(persister.aofDir, f.name)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// baseName 返回 AOF 目录中文件名的前缀
+func (persister *Persister) baseName() string {
+	return filepath.Base(persister.aofFilename)
+}
+
+// initManifest 读取 AOF 目录中的清单。清单不存在而旧的单文件 AOF 存在时，
+// 将旧文件作为第一个 base 文件移入 AOF 目录
+func (persister *Persister) initManifest() error {
+	if err := os.MkdirAll(persister.aofDir, 0755); err != nil {
+		return err
+	}
+	m, err := readManifest(persister.aofDir, persister.baseName())
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &manifest{}
+		if info, err := os.Stat(persister.aofFilename); err == nil && !info.IsDir() {
+			m.baseSeq = 1
+			m.base = &aofFileInfo{name: baseFileName(persister.baseName(), 1, false), seq: 1, fileType: aofFileTypeBase}
+			// 先写入清单再移动文件，移动之前退出时下次启动会继续移动
+			if err := writeManifest(persister.aofDir, persister.baseName(), m); err != nil {
+				return err
+			}
+			logger.Info("upgrade " + persister.aofFilename + " to multi part aof in " + persister.aofDir)
+		}
+	}
+	if m.base != nil && m.base.seq == 1 {
+		basePath := filepath.Join(persister.aofDir, m.base.name)
+		if _, err := os.Stat(basePath); os.IsNotExist(err) {
+			if _, err := os.Stat(persister.aofFilename); err == nil {
+				if err := os.Rename(persister.aofFilename, basePath); err != nil {
+					return err
+				}
+				syncDir(persister.aofDir)
+			}
+		}
+	}
+	persister.manifest = m
+	return nil
+}
+
+// openIncrFile 打开清单中最后一个增量文件用于追加，没有增量文件时创建一个
+func (persister *Persister) openIncrFile() (*os.File, error) {
+	incrs := persister.manifest.incrs
+	if len(incrs) == 0 {
+		return persister.createIncrFile()
+	}
+	name := filepath.Join(persister.aofDir, incrs[len(incrs)-1].name)
+	return os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+}
+
+// createIncrFile 创建一个新的增量文件并加入清单，调用者需要持有 pausingAof 或者 AOF 还没有开始写入
+func (persister *Persister) createIncrFile() (*os.File, error) {
+	m := persister.manifest.copy()
+	m.incrSeq++
+	info := &aofFileInfo{name: incrFileName(persister.baseName(), m.incrSeq), seq: m.incrSeq, fileType: aofFileTypeIncr}
+	m.incrs = append(m.incrs, info)
+	path := filepath.Join(persister.aofDir, info.name)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeManifest(persister.aofDir, persister.baseName(), m); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+	persister.manifest = m
+	return file, nil
+}
+
+// LoadAof 按照清单的顺序加载 base 文件和增量文件，maxBytes 大于 0 时最多加载这么多字节。
+// 开启 aof-load-truncated 时，最后一个文件末尾不完整的命令会被截断，其它的数据损坏都会返回错误。
+// 设置了 aof-truncate-to-timestamp 时，AOF 中存在晚于它的时间戳注释会返回错误，拒绝启动。
+// 服务器不会截断 AOF，需要先使用 miniredis-check-aof --truncate-to-timestamp 恢复到这一时刻
+func (persister *Persister) LoadAof(maxBytes int) error {
 	// persister.db.Exec may call persister.addAof
 	// delete aofChan to prevent loaded commands back into aofChan
 	aofChan := persister.aofChan // 备份aofChan
@@ -171,61 +452,168 @@ func (persister *Persister) LoadAof(maxBytes int) {
 		persister.aofChan = aofChan // 恢复aofchan
 	}(aofChan)
 
-	file, err := os.Open(persister.aofFilename)
+	if persister.manifest == nil {
+		return nil
+	}
+	return persister.loadFiles(persister.manifest.files(), int64(maxBytes), true)
+}
+
+// loadFiles 依次加载文件，repair 为 true 表示启动时加载：
+// 按照 aof-load-truncated 截断最后一个文件末尾不完整的命令，并检查 aof-truncate-to-timestamp
+func (persister *Persister) loadFiles(files []*aofFileInfo, maxBytes int64, repair bool) error {
+	var timestamp int64
+	if repair {
+		// 重写时加载的文件包含启动之后写入的命令，它们的时间戳必然晚于 aof-truncate-to-timestamp
+		timestamp = int64(config.Properties.AofTruncateToTimestamp)
+	}
+	for i, f := range files {
+		filename := filepath.Join(persister.aofDir, f.name)
+		loaded, err := persister.loadFile(filename, maxBytes, timestamp)
+		if terr, ok := err.(*timestampReachedError); ok {
+			return fmt.Errorf("aof file %s has data later than aof-truncate-to-timestamp %d from offset %d, "+
+				"use miniredis-check-aof --truncate-to-timestamp %d to restore the aof to this timestamp before starting",
+				filename, timestamp, terr.offset, timestamp)
+		}
+		if err != nil {
+			cerr, ok := err.(*CorruptionError)
+			if !ok || !cerr.Truncated || !repair || i != len(files)-1 || !config.Properties.AofLoadTruncated {
+				return err
+			}
+			logger.Warn(fmt.Sprintf("!!! Warning: %s, truncating %s to offset %d", cerr.Reason, filename, cerr.Offset))
+			return os.Truncate(filename, cerr.Offset)
+		}
+		if maxBytes > 0 {
+			maxBytes -= loaded
+			if maxBytes <= 0 {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// loadFile 加载一个 AOF 文件，文件可以以 RDB 格式的数据开头，返回读取的字节数。
+// 每个文件开始时都使用 0 号数据库。文件损坏时返回 *CorruptionError，之前的命令已经执行。
+// timestamp 大于 0 时遇到晚于它的时间戳注释会停止加载并返回 *timestampReachedError
+func (persister *Persister) loadFile(filename string, maxBytes int64, timestamp int64) (int64, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
+		if os.IsNotExist(err) {
+			logger.Warn("aof file not found: " + filename)
+			return 0, nil
 		}
-		logger.Warn(err)
-		return
+		return 0, err
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := info.Size()
+	limited := maxBytes > 0 && maxBytes < end // 如果为 true 说明只需要读取一部分
+	if limited {
+		end = maxBytes
+	}
+	fakeConn := connection.NewFakeConn() // 创建一个虚拟连接，只用于保存当前的 dbIndex
+	// 和主服务器的连接一样重放已经执行过的写命令，可以执行 LOCKSET 等只用于重放的命令
+	fakeConn.SetMaster()
+	persister.currentDB = 0
 
-	var reader io.Reader
-	if maxBytes > 0 { // 如果大于0说明只需要读取一部分
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else {
-		reader = file
+	var start int64
+	counter := &countingReader{r: io.NewSectionReader(file, 0, end)}
+	bufReader := bufio.NewReader(counter)
+	if isRDBFile(bufReader) {
+		err := ReadRDB(bufReader, func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) error {
+			fakeConn.SelectDB(dbIndex)
+			if cmd := EntityToCmd(key, entity); cmd != nil {
+				persister.db.Exec(fakeConn, cmd.Args)
+			}
+			if expiration != nil {
+				persister.db.Exec(fakeConn, MakeExpireCmd(key, *expiration).Args)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("load rdb preamble of %s failed: %v", filename, err)
+		}
+		start = counter.n - int64(bufReader.Buffered())
+		fakeConn.SelectDB(0)
 	}
 
-	// 返回的ch是Payload类型，存储服务器解析到的数据
-	ch := parser.ParseStream(reader)
-	fakeConn := connection.NewFakeConn() // 创建一个虚拟连接，只用于保存当前的 dbIndex
-	for p := range ch {
-		if p.Err != nil {
-			if p.Err == io.EOF { // 如果是读到了文件末尾则退出
-				break
+	reader := newCommandReader(filename, file, start, end)
+	defer reader.close()
+	for {
+		cmdLine, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// 写入事务块的过程中宕机，事务中的命令还在队列中没有执行，直接丢弃
+			fakeConn.SetMultiState(false)
+			if limited && err.(*CorruptionError).Truncated {
+				return end, nil
 			}
-			logger.Error("parse error: " + p.Err.Error())
-			continue
+			return reader.offset, err
 		}
-		if p.Data == nil { // 读到了空命令
-			logger.Error("empty payload")
+		if ts, ok := parseTimestampAnnotation(cmdLine); ok {
+			if timestamp > 0 && ts > timestamp {
+				return reader.start, &timestampReachedError{offset: reader.start}
+			}
 			continue
 		}
-		r, ok := p.Data.(*protocol.MultiBulkReply) // 解析到MultiBulkReply
-		if !ok {
-			logger.Error("require multi bulk protocol")
+		if isAnnotation(cmdLine) {
 			continue
 		}
-		ret := persister.db.Exec(fakeConn, r.Args)
+		ret := persister.db.Exec(fakeConn, cmdLine)
 		if protocol.IsErrorReply(ret) {
 			logger.Error("exec err", string(ret.ToBytes()))
 		}
-		if strings.ToLower(string(r.Args[0])) == "select" {
+		if strings.ToLower(string(cmdLine[0])) == "select" {
 			// execSelect success, here must be no error
-			dbIndex, err := strconv.Atoi(string(r.Args[1]))
+			dbIndex, err := strconv.Atoi(string(cmdLine[1]))
 			if err == nil {
 				persister.currentDB = dbIndex
 			}
 		}
 	}
+	if cerr := reader.unfinishedMulti(); cerr != nil {
+		fakeConn.SetMultiState(false)
+		if limited {
+			return end, nil
+		}
+		return reader.offset, cerr
+	}
+	return end, nil
+}
+
+// timestampReachedError 表示遇到了晚于 aof-truncate-to-timestamp 的时间戳注释，之后的命令没有加载
+type timestampReachedError struct {
+	offset int64
+}
+
+func (e *timestampReachedError) Error() string {
+	return "aof truncate timestamp reached at offset " + strconv.FormatInt(e.offset, 10)
+}
+
+// countingReader 记录读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func (persister *Persister) Close() {
-	if persister.aofFile != nil {
+	if persister.aofFile != nil || persister.listenOnly {
+		// 只通知监听者的 Persister 也启动了 listenCmd 协程，关闭 aofChan 使它退出
 		close(persister.aofChan)
 		<-persister.aofFinished // wait for aof finished
+	}
+	if persister.aofFile != nil {
 		err := persister.aofFile.Close()
 		if err != nil {
 			logger.Warn(err)
@@ -250,3 +638,45 @@ func (persister *Persister) fsyncEverySecond() {
 		}
 	}()
 }
+
+// autoRewriteCron 每秒检查一次 AOF 的大小，超过 auto-aof-rewrite-min-size 并且相对于上次重写之后的大小
+// 增长超过 auto-aof-rewrite-percentage 时自动重写。重写失败之后等待一分钟再重试
+func (persister *Persister) autoRewriteCron() {
+	ticker := time.NewTicker(time.Second)
+	go func() {
+		defer ticker.Stop()
+		var lastFailure time.Time
+		for {
+			select {
+			case <-ticker.C:
+				if !persister.needAutoRewrite() || time.Since(lastFailure) < time.Minute {
+					continue
+				}
+				logger.Info(fmt.Sprintf("starting automatic rewriting of AOF on %d%% growth",
+					config.Properties.AutoAofRewritePercentage))
+				if err := persister.Rewrite(); err != nil && err != ErrRewriteInProgress {
+					logger.Error("automatic aof rewrite failed: " + err.Error())
+					lastFailure = time.Now()
+				}
+			case <-persister.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (persister *Persister) needAutoRewrite() bool {
+	percentage := int64(config.Properties.AutoAofRewritePercentage)
+	if percentage <= 0 || persister.IsRewriting() {
+		return false
+	}
+	current := persister.currentSize.Get()
+	if current < int64(config.Properties.AutoAofRewriteMinSize) {
+		return false
+	}
+	base := persister.baseSize.Get()
+	if base <= 0 {
+		base = 1
+	}
+	return (current-base)*100/base >= percentage
+}
@@ -0,0 +1,237 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"miniRedis/redis/parser"
+	"miniRedis/redis/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CorruptionError 表示 AOF 文件从 Offset 开始的数据无法加载
+type CorruptionError struct {
+	Filename string
+	Offset   int64 // 第一个错误命令的位置，之前的数据都是完整的
+	// Truncated 表示错误只是文件末尾的命令或者事务不完整，通常是写入时宕机造成的，截断到 Offset 即可恢复
+	Truncated bool
+	Reason    string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("bad aof file %s at offset %d: %s", e.Filename, e.Offset, e.Reason)
+}
+
+// commandReader 使用 parser.ParseStream 依次读取 AOF 文件中的命令。
+// 解析器会跳过空行等不符合格式的数据，所以每个命令都要和文件中的原始数据比较，
+// 以便得到命令的准确位置，不一致说明文件已经损坏
+type commandReader struct {
+	filename string
+	ch       <-chan *parser.Payload
+	raw      *bufio.Reader
+	offset   int64 // 已经读取的完整命令的结束位置
+	start    int64 // 最近读取的命令的起始位置
+	end      int64
+	// multiOffset 是尚未遇到 EXEC 的 MULTI 命令的位置，没有未完成的事务时为 -1
+	multiOffset int64
+	buf         []byte
+}
+
+// newCommandReader 读取文件 [start, end) 范围内的命令
+func newCommandReader(filename string, file io.ReaderAt, start int64, end int64) *commandReader {
+	return &commandReader{
+		filename:    filename,
+		ch:          parser.ParseStream(io.NewSectionReader(file, start, end-start)),
+		raw:         bufio.NewReader(io.NewSectionReader(file, start, end-start)),
+		offset:      start,
+		end:         end,
+		multiOffset: -1,
+	}
+}
+
+// next 返回下一个命令或者注释，读完时返回 io.EOF，数据损坏时返回 *CorruptionError
+func (r *commandReader) next() (CmdLine, error) {
+	p, ok := <-r.ch
+	if !ok || p.Err == io.EOF || p.Err == io.ErrUnexpectedEOF {
+		if r.offset == r.end {
+			return nil, io.EOF
+		}
+		// 剩下的数据不能组成一个完整的命令
+		return nil, r.corrupted(true, "unexpected end of file")
+	}
+	if p.Err != nil {
+		return nil, r.corrupted(false, p.Err.Error())
+	}
+	reply, ok := p.Data.(*protocol.MultiBulkReply)
+	if !ok || len(reply.Args) == 0 {
+		return nil, r.corrupted(false, "require multi bulk protocol")
+	}
+	var data []byte
+	if isAnnotation(reply.Args) {
+		// 注释是以 # 开头的一行文本，解析器把它当作内联命令处理
+		data = append(append(data, reply.Args[0]...), '\r', '\n')
+	} else {
+		data = reply.ToBytes()
+	}
+	if cap(r.buf) < len(data) {
+		r.buf = make([]byte, len(data))
+	}
+	raw := r.buf[:len(data)]
+	if _, err := io.ReadFull(r.raw, raw); err != nil || !bytes.Equal(raw, data) {
+		return nil, r.corrupted(false, "malformed command")
+	}
+	switch strings.ToLower(string(reply.Args[0])) {
+	case "multi":
+		r.multiOffset = r.offset
+	case "exec", "discard":
+		r.multiOffset = -1
+	}
+	r.start = r.offset
+	r.offset += int64(len(data))
+	return reply.Args, nil
+}
+
+func (r *commandReader) corrupted(truncated bool, reason string) *CorruptionError {
+	offset := r.offset
+	if truncated && r.multiOffset >= 0 {
+		// 不完整的命令属于一个事务，需要连同事务一起丢弃
+		offset = r.multiOffset
+	}
+	return &CorruptionError{Filename: r.filename, Offset: offset, Truncated: truncated, Reason: reason}
+}
+
+// unfinishedMulti 在读完所有命令之后检查文件是否以不完整的事务结束
+func (r *commandReader) unfinishedMulti() *CorruptionError {
+	if r.multiOffset < 0 {
+		return nil
+	}
+	return &CorruptionError{Filename: r.filename, Offset: r.multiOffset, Truncated: true, Reason: "unfinished MULTI"}
+}
+
+// close 读完解析器剩余的数据，使解析协程退出
+func (r *commandReader) close() {
+	for range r.ch {
+	}
+}
+
+// rdbPreambleSize 返回文件开头 RDB 格式数据的长度，没有时返回 0
+func rdbPreambleSize(file io.ReaderAt, end int64) (int64, error) {
+	counter := &countingReader{r: io.NewSectionReader(file, 0, end)}
+	reader := bufio.NewReader(counter)
+	if !isRDBFile(reader) {
+		return 0, nil
+	}
+	err := ReadRDB(reader, nil)
+	if err != nil {
+		return 0, err
+	}
+	return counter.n - int64(reader.Buffered()), nil
+}
+
+// CheckResult 是检查一个 AOF 文件的结果
+type CheckResult struct {
+	Filename string
+	Size     int64
+	RDBSize  int64 // 文件开头 RDB 格式数据的长度，没有时为 0
+	Commands int   // 完整命令的数量
+	// RDBErr 表示开头的 RDB 格式的数据损坏，无法通过截断修复
+	RDBErr error
+	// Err 是 AOF 格式部分的第一个错误，文件完整时为 nil
+	Err *CorruptionError
+}
+
+// Valid 返回文件是否完整
+func (r *CheckResult) Valid() bool {
+	return r.RDBErr == nil && r.Err == nil
+}
+
+// CheckFile 检查一个 AOF 文件，文件可以以 RDB 格式的数据开头
+func CheckFile(filename string) (*CheckResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result := &CheckResult{Filename: filename, Size: info.Size()}
+	result.RDBSize, result.RDBErr = rdbPreambleSize(file, result.Size)
+	if result.RDBErr != nil {
+		return result, nil
+	}
+	reader := newCommandReader(filename, file, result.RDBSize, result.Size)
+	defer reader.close()
+	for {
+		cmdLine, err := reader.next()
+		if err == io.EOF {
+			result.Err = reader.unfinishedMulti()
+			return result, nil
+		}
+		if err != nil {
+			result.Err = err.(*CorruptionError)
+			return result, nil
+		}
+		if !isAnnotation(cmdLine) {
+			result.Commands++
+		}
+	}
+}
+
+// TimestampOffset 返回文件中第一个晚于 timestamp 的时间戳注释的位置，没有时返回 -1。
+// 将文件截断到这个位置即可恢复到 timestamp 时的数据
+func TimestampOffset(filename string, timestamp int64) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	start, err := rdbPreambleSize(file, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	reader := newCommandReader(filename, file, start, info.Size())
+	defer reader.close()
+	for {
+		cmdLine, err := reader.next()
+		if err == io.EOF {
+			return -1, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ts, ok := parseTimestampAnnotation(cmdLine); ok && ts > timestamp {
+			return reader.start, nil
+		}
+	}
+}
+
+// ManifestFiles 返回清单中按照加载顺序排列的文件路径
+func ManifestFiles(manifestPath string) ([]string, error) {
+	dir := filepath.Dir(manifestPath)
+	name := filepath.Base(manifestPath)
+	if !strings.HasSuffix(name, manifestSuffix) {
+		return nil, errors.New("not a manifest file: " + manifestPath)
+	}
+	m, err := readManifest(dir, strings.TrimSuffix(name, manifestSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, errors.New("manifest not found: " + manifestPath)
+	}
+	var files []string
+	for _, f := range m.files() {
+		files = append(files, filepath.Join(dir, f.name))
+	}
+	return files, nil
+}
@@ -0,0 +1,168 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// resp 把命令编码为 AOF 中的格式
+func resp(args ...string) string {
+	var sb strings.Builder
+	sb.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		sb.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return sb.String()
+}
+
+func writeAofFile(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestCheckFile(t *testing.T) {
+	set := resp("SET", "k", "v")
+	incr := resp("INCR", "n")
+	multi := resp("MULTI")
+	exec := resp("EXEC")
+	ts := string(makeTimestampAnnotation(1700000000))
+	tests := []struct {
+		name      string
+		content   string
+		commands  int
+		valid     bool
+		offset    int64 // 第一个错误的位置
+		truncated bool
+	}{
+		{name: "empty", content: "", valid: true},
+		{name: "complete", content: set + incr, commands: 2, valid: true},
+		{name: "annotations are not commands", content: ts + set + ts + incr, commands: 2, valid: true},
+		{name: "complete transaction", content: set + multi + incr + exec, commands: 4, valid: true},
+		{name: "discarded transaction", content: multi + incr + resp("DISCARD") + set, commands: 4, valid: true},
+		{
+			name:      "torn tail in bulk",
+			content:   set + incr[:len(incr)-3],
+			commands:  1,
+			offset:    int64(len(set)),
+			truncated: true,
+		},
+		{
+			name:      "torn tail in header",
+			content:   set + "*2\r\n$4",
+			commands:  1,
+			offset:    int64(len(set)),
+			truncated: true,
+		},
+		{
+			name:      "torn tail after annotation",
+			content:   set + ts + incr[:5],
+			commands:  1,
+			offset:    int64(len(set) + len(ts)),
+			truncated: true,
+		},
+		{
+			name:      "torn tail inside transaction rewinds to MULTI",
+			content:   set + multi + incr + exec[:4],
+			commands:  3,
+			offset:    int64(len(set)),
+			truncated: true,
+		},
+		{
+			name:      "unfinished MULTI rewinds to MULTI",
+			content:   set + ts + multi + incr + set,
+			commands:  4,
+			offset:    int64(len(set) + len(ts)),
+			truncated: true,
+		},
+		{
+			name:     "corruption in the middle",
+			content:  set + "*2\r\n$4\r\nINCR\r\n$1\r\nnn\r\n" + incr,
+			commands: 1,
+			offset:   int64(len(set)),
+		},
+		{
+			name:     "bad bulk length in the middle",
+			content:  set + "*1\r\n$x\r\n" + set,
+			commands: 1,
+			offset:   int64(len(set)),
+		},
+		{
+			name:     "blank line in the middle",
+			content:  set + "\r\n" + incr,
+			commands: 1,
+			offset:   int64(len(set)),
+		},
+		{
+			name:     "corruption inside transaction is not rewound",
+			content:  multi + incr + "*1\r\n$x\r\n" + exec,
+			commands: 2,
+			offset:   int64(len(multi) + len(incr)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := writeAofFile(t, tt.content)
+			result, err := CheckFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.RDBSize != 0 || result.RDBErr != nil {
+				t.Fatalf("unexpected rdb preamble: size %d, err %v", result.RDBSize, result.RDBErr)
+			}
+			if result.Commands != tt.commands {
+				t.Errorf("got %d commands, want %d", result.Commands, tt.commands)
+			}
+			if result.Valid() != tt.valid {
+				t.Fatalf("got valid=%v, want %v, err: %v", result.Valid(), tt.valid, result.Err)
+			}
+			if tt.valid {
+				return
+			}
+			if result.Err.Offset != tt.offset {
+				t.Errorf("got offset %d, want %d: %v", result.Err.Offset, tt.offset, result.Err)
+			}
+			if result.Err.Truncated != tt.truncated {
+				t.Errorf("got truncated=%v, want %v: %v", result.Err.Truncated, tt.truncated, result.Err)
+			}
+		})
+	}
+}
+
+func TestTimestampOffset(t *testing.T) {
+	set := resp("SET", "k", "v")
+	ts1 := string(makeTimestampAnnotation(100))
+	ts2 := string(makeTimestampAnnotation(200))
+	content := ts1 + set + set + ts2 + set
+	filename := writeAofFile(t, content)
+	tests := []struct {
+		timestamp int64
+		want      int64
+	}{
+		{50, 0},
+		{100, int64(len(ts1) + 2*len(set))},
+		{150, int64(len(ts1) + 2*len(set))},
+		{200, -1},
+	}
+	for _, tt := range tests {
+		got, err := TimestampOffset(filename, tt.timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("timestamp %d: got offset %d, want %d", tt.timestamp, got, tt.want)
+		}
+	}
+
+	// 时间戳之前的数据损坏时返回错误
+	filename = writeAofFile(t, ts1+"*1\r\n$x\r\n"+ts2)
+	if _, err := TimestampOffset(filename, 150); err == nil {
+		t.Error("expected an error for corrupted file")
+	}
+}
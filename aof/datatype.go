@@ -0,0 +1,72 @@
+package aof
+
+import (
+	"errors"
+	"sync"
+)
+
+/*
+ * 由模块注册的数据类型。内置类型在 EntityToCmd、DumpEntity 中直接处理，
+ * 其它类型通过注册的钩子转换为 AOF 中的命令以及 DUMP/RDB 使用的二进制数据
+ */
+
+// DataType 描述一种由模块提供的数据类型
+type DataType struct {
+	// Name 是 TYPE 命令返回的类型名，同时写入序列化数据中用于恢复时查找类型，长度不能超过 255
+	Name string
+	// Match 判断 DataEntity.Data 是否属于该类型
+	Match func(data interface{}) bool
+	// ToCmd 返回重建该 key 的命令，在 AOF 重写时使用
+	ToCmd func(key string, data interface{}) CmdLine
+	// Marshal 将数据序列化，用于 DUMP 和 RDB
+	Marshal func(data interface{}) []byte
+	// Unmarshal 从 Marshal 的结果中恢复数据
+	Unmarshal func(payload []byte) (interface{}, error)
+}
+
+var (
+	dataTypes   []*DataType
+	dataTypeMap = make(map[string]*DataType)
+	dataTypesMu sync.RWMutex
+)
+
+// builtinTypeNames 是内置类型的名字，模块不能注册同名的类型
+var builtinTypeNames = map[string]bool{
+	"string": true, "list": true, "set": true, "zset": true, "hash": true, "none": true,
+}
+
+// RegisterDataType 注册一种数据类型，类型名重复或者缺少钩子时返回错误
+func RegisterDataType(t *DataType) error {
+	if t == nil || t.Name == "" || len(t.Name) > 255 {
+		return errors.New("invalid data type name")
+	}
+	if t.Match == nil || t.ToCmd == nil || t.Marshal == nil || t.Unmarshal == nil {
+		return errors.New("data type " + t.Name + " must provide Match, ToCmd, Marshal and Unmarshal")
+	}
+	dataTypesMu.Lock()
+	defer dataTypesMu.Unlock()
+	if builtinTypeNames[t.Name] || dataTypeMap[t.Name] != nil {
+		return errors.New("data type " + t.Name + " already exists")
+	}
+	dataTypes = append(dataTypes, t)
+	dataTypeMap[t.Name] = t
+	return nil
+}
+
+// DataTypeOf 返回数据所属的已注册类型，不属于任何注册类型时返回 nil
+func DataTypeOf(data interface{}) *DataType {
+	dataTypesMu.RLock()
+	defer dataTypesMu.RUnlock()
+	for _, t := range dataTypes {
+		if t.Match(data) {
+			return t
+		}
+	}
+	return nil
+}
+
+func lookupDataType(name string) *DataType {
+	dataTypesMu.RLock()
+	defer dataTypesMu.RUnlock()
+	return dataTypeMap[name]
+}
@@ -0,0 +1,231 @@
+package aof
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"math"
+	"miniRedis/datastruct/dict"
+	List "miniRedis/datastruct/list"
+	"miniRedis/datastruct/set"
+	SortedSet "miniRedis/datastruct/sortedset"
+	"miniRedis/interface/database"
+)
+
+/*
+ * DUMP 命令的序列化格式：
+ *   | type (1 byte) | value ... | version (2 bytes, little endian) | crc64 (8 bytes, little endian) |
+ * 其中 value 中的长度均使用 uvarint 编码，字符串为 长度 + 内容，分值为 float64 的 IEEE754 表示。
+ * crc64 覆盖 type、value 以及 version，恢复时版本号或校验和不一致都会被拒绝。
+ */
+
+// DumpVersion 是序列化格式的版本号，格式发生不兼容的变化时需要增加
+const DumpVersion uint16 = 1
+
+const (
+	dumpTypeString byte = iota
+	dumpTypeList
+	dumpTypeSet
+	dumpTypeZSet
+	dumpTypeHash
+)
+
+// dumpTypeModule 表示模块注册的类型，value 为 类型名 + Marshal 的结果
+const dumpTypeModule byte = 0x80
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// ErrDumpPayload 表示序列化数据的版本号或者校验和错误
+var ErrDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// ErrBadDumpFormat 表示序列化数据的格式错误
+var ErrBadDumpFormat = errors.New("ERR Bad data format")
+
+// DumpEntity 将数据实体序列化为 DUMP 命令所返回的数据
+func DumpEntity(entity *database.DataEntity) []byte {
+	if entity == nil {
+		return nil
+	}
+	var buf []byte
+	switch val := entity.Data.(type) {
+	case []byte:
+		buf = append(buf, dumpTypeString)
+		buf = appendBytes(buf, val)
+	case List.List:
+		buf = append(buf, dumpTypeList)
+		buf = appendUvarint(buf, uint64(val.Len()))
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			buf = appendBytes(buf, bytes)
+			return true
+		})
+	case *set.Set:
+		buf = append(buf, dumpTypeSet)
+		buf = appendUvarint(buf, uint64(val.Len()))
+		val.ForEach(func(member string) bool {
+			buf = appendBytes(buf, []byte(member))
+			return true
+		})
+	case *SortedSet.SortedSet:
+		buf = append(buf, dumpTypeZSet)
+		buf = appendUvarint(buf, uint64(val.Len()))
+		val.ForEach(int64(0), val.Len(), false, func(element *SortedSet.Element) bool {
+			buf = appendBytes(buf, []byte(element.Member))
+			buf = appendUint64(buf, math.Float64bits(element.Score))
+			return true
+		})
+	case dict.Dict:
+		buf = append(buf, dumpTypeHash)
+		buf = appendUvarint(buf, uint64(val.Len()))
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			buf = appendBytes(buf, []byte(field))
+			buf = appendBytes(buf, bytes)
+			return true
+		})
+	default:
+		t := DataTypeOf(val)
+		if t == nil {
+			return nil
+		}
+		buf = append(buf, dumpTypeModule)
+		buf = appendBytes(buf, []byte(t.Name))
+		buf = appendBytes(buf, t.Marshal(val))
+	}
+	buf = append(buf, byte(DumpVersion), byte(DumpVersion>>8))
+	buf = appendUint64(buf, crc64.Checksum(buf, crcTable))
+	return buf
+}
+
+// RestoreEntity 校验并反序列化 DUMP 命令生成的数据
+func RestoreEntity(payload []byte) (*database.DataEntity, error) {
+	// type + version + crc64
+	if len(payload) < 1+2+8 {
+		return nil, ErrDumpPayload
+	}
+	footer := len(payload) - 10
+	version := binary.LittleEndian.Uint16(payload[footer:])
+	checksum := binary.LittleEndian.Uint64(payload[footer+2:])
+	if version > DumpVersion || crc64.Checksum(payload[:footer+2], crcTable) != checksum {
+		return nil, ErrDumpPayload
+	}
+
+	r := &dumpReader{data: payload[1:footer]}
+	var data interface{}
+	switch payload[0] {
+	case dumpTypeString:
+		data = r.readBytes()
+	case dumpTypeList:
+		list := List.NewQuickList()
+		n := r.readLen()
+		for i := 0; i < n && r.err == nil; i++ {
+			list.Add(r.readBytes())
+		}
+		data = list
+	case dumpTypeSet:
+		s := set.Make()
+		n := r.readLen()
+		for i := 0; i < n && r.err == nil; i++ {
+			s.Add(string(r.readBytes()))
+		}
+		data = s
+	case dumpTypeZSet:
+		zset := SortedSet.Make()
+		n := r.readLen()
+		for i := 0; i < n && r.err == nil; i++ {
+			member := string(r.readBytes())
+			score := r.readFloat()
+			zset.Add(member, score)
+		}
+		data = zset
+	case dumpTypeHash:
+		hash := dict.MakeSimple()
+		n := r.readLen()
+		for i := 0; i < n && r.err == nil; i++ {
+			field := string(r.readBytes())
+			hash.Put(field, r.readBytes())
+		}
+		data = hash
+	case dumpTypeModule:
+		t := lookupDataType(string(r.readBytes()))
+		raw := r.readBytes()
+		if r.err != nil || t == nil {
+			return nil, ErrBadDumpFormat
+		}
+		value, err := t.Unmarshal(raw)
+		if err != nil {
+			return nil, ErrBadDumpFormat
+		}
+		data = value
+	default:
+		return nil, ErrBadDumpFormat
+	}
+	if r.err != nil || len(r.data) > 0 {
+		return nil, ErrBadDumpFormat
+	}
+	return &database.DataEntity{Data: data}, nil
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(tmp[:], n)
+	return append(buf, tmp[:size]...)
+}
+
+func appendUint64(buf []byte, n uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], n)
+	return append(buf, tmp[:]...)
+}
+
+func appendBytes(buf []byte, bytes []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(bytes)))
+	return append(buf, bytes...)
+}
+
+// dumpReader 按顺序读取序列化数据，遇到错误后后续读取均返回零值
+type dumpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *dumpReader) readLen() int {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(r.data)
+	if size <= 0 || n > uint64(len(r.data)) {
+		r.err = ErrBadDumpFormat
+		return 0
+	}
+	r.data = r.data[size:]
+	return int(n)
+}
+
+func (r *dumpReader) readBytes() []byte {
+	n := r.readLen()
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = ErrBadDumpFormat
+		return nil
+	}
+	bytes := make([]byte, n)
+	copy(bytes, r.data[:n])
+	r.data = r.data[n:]
+	return bytes
+}
+
+func (r *dumpReader) readFloat() float64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 8 {
+		r.err = ErrBadDumpFormat
+		return 0
+	}
+	bits := binary.LittleEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return math.Float64frombits(bits)
+}
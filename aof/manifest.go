@@ -0,0 +1,195 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * 与 Redis 7 相同的多文件 AOF。AOF 目录中包含：
+ *   appendonly.aof.1.base.rdb    base 文件，重写时生成的数据快照，RDB 或者 AOF 格式
+ *   appendonly.aof.1.incr.aof    增量文件，base 之后执行的写命令，可能有多个
+ *   appendonly.aof.manifest      清单，记录当前使用的文件及其顺序
+ * 加载时依次加载 base 和所有增量文件。重写开始时打开一个新的增量文件，之后的命令写入新文件，
+ * 重写完成后用新的 base 和新的增量文件替换清单中的旧文件。清单通过临时文件和 rename 原子地更新
+ */
+
+const (
+	aofFileTypeBase = "b"
+	aofFileTypeIncr = "i"
+	// aofFileTypeHistory 表示已经被替换、等待删除的文件，加载时会被忽略
+	aofFileTypeHistory = "h"
+
+	baseSuffix     = ".base"
+	incrSuffix     = ".incr"
+	rdbFormatExt   = ".rdb"
+	aofFormatExt   = ".aof"
+	manifestSuffix = ".manifest"
+)
+
+// aofFileInfo 是清单中的一个文件
+type aofFileInfo struct {
+	name     string
+	seq      int
+	fileType string
+}
+
+// manifest 记录 AOF 目录中正在使用的文件
+type manifest struct {
+	base    *aofFileInfo
+	incrs   []*aofFileInfo
+	baseSeq int // 最近一个 base 文件的序号
+	incrSeq int // 最近一个增量文件的序号
+}
+
+func (m *manifest) copy() *manifest {
+	c := *m
+	c.incrs = append([]*aofFileInfo(nil), m.incrs...)
+	return &c
+}
+
+// files 返回按照加载顺序排列的文件
+func (m *manifest) files() []*aofFileInfo {
+	files := make([]*aofFileInfo, 0, len(m.incrs)+1)
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *manifest) String() string {
+	var sb strings.Builder
+	for _, f := range m.files() {
+		sb.WriteString(fmt.Sprintf("file %s seq %d type %s\n", f.name, f.seq, f.fileType))
+	}
+	return sb.String()
+}
+
+func manifestName(baseName string) string {
+	return baseName + manifestSuffix
+}
+
+func baseFileName(baseName string, seq int, rdb bool) string {
+	ext := aofFormatExt
+	if rdb {
+		ext = rdbFormatExt
+	}
+	return baseName + "." + strconv.Itoa(seq) + baseSuffix + ext
+}
+
+func incrFileName(baseName string, seq int) string {
+	return baseName + "." + strconv.Itoa(seq) + incrSuffix + aofFormatExt
+}
+
+// parseManifest 解析清单文件，每行的格式为 file <name> seq <seq> type <b|i|h>
+func parseManifest(data string) (*manifest, error) {
+	m := &manifest{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid aof manifest line %d: %s", lineNo, line)
+		}
+		info := &aofFileInfo{seq: -1}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[i+1])
+				if err != nil || seq < 0 {
+					return nil, fmt.Errorf("invalid aof manifest line %d: %s", lineNo, line)
+				}
+				info.seq = seq
+			case "type":
+				info.fileType = fields[i+1]
+			}
+		}
+		if info.name == "" || info.seq < 0 || strings.ContainsAny(info.name, "/\\") {
+			return nil, fmt.Errorf("invalid aof manifest line %d: %s", lineNo, line)
+		}
+		switch info.fileType {
+		case aofFileTypeBase:
+			if m.base != nil {
+				return nil, errors.New("invalid aof manifest: found duplicate base file information")
+			}
+			m.base = info
+			m.baseSeq = info.seq
+		case aofFileTypeIncr:
+			if info.seq <= m.incrSeq && len(m.incrs) > 0 {
+				return nil, errors.New("invalid aof manifest: incr files are out of order")
+			}
+			m.incrs = append(m.incrs, info)
+			m.incrSeq = info.seq
+		case aofFileTypeHistory:
+		default:
+			return nil, fmt.Errorf("invalid aof manifest line %d: unknown file type %s", lineNo, info.fileType)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// readManifest 读取 AOF 目录中的清单，清单不存在时返回 nil
+func readManifest(dir string, baseName string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestName(baseName)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(string(data))
+}
+
+// writeManifest 原子地更新清单：先写入临时文件并同步到磁盘，然后 rename 覆盖原来的清单
+func writeManifest(dir string, baseName string, m *manifest) error {
+	tmp, err := ioutil.TempFile(dir, "temp-"+manifestName(baseName)+"-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	_, err = tmp.WriteString(m.String())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(dir, manifestName(baseName)))
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir 将目录项的修改（创建、rename）同步到磁盘，部分平台不支持对目录 fsync，忽略错误
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
+
+// isRDBFile 判断文件是否以 RDB 格式的数据开头
+func isRDBFile(r *bufio.Reader) bool {
+	head, err := r.Peek(len(rdbMagic))
+	return err == nil && string(head) == rdbMagic
+}
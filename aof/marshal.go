@@ -28,6 +28,11 @@ func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkRep
 		cmd = hashToCmd(key, val)
 	case *SortedSet.SortedSet:
 		cmd = zSetToCmd(key, val)
+	default:
+		// 模块注册的类型
+		if t := DataTypeOf(val); t != nil {
+			cmd = protocol.MakeMultiBulkReply(t.ToCmd(key, val))
+		}
 	}
 	return cmd
 }
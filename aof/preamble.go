@@ -0,0 +1,512 @@
+package aof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"io"
+	"math"
+	"miniRedis/datastruct/dict"
+	List "miniRedis/datastruct/list"
+	"miniRedis/datastruct/set"
+	SortedSet "miniRedis/datastruct/sortedset"
+	"miniRedis/interface/database"
+	"strconv"
+	"time"
+)
+
+/*
+ * RDB 格式的 AOF base 文件（aof-use-rdb-preamble）。只使用 Redis RDB 9 中最基本的编码：
+ *   "REDIS0009" | AUX* | (SELECTDB | RESIZEDB | ([EXPIRETIME_MS] type key value)*)* | EOF | crc64
+ * 字符串不压缩，list/set/hash 使用元素逐个保存的编码，zset 使用二进制分值（ZSET_2），
+ * 因此生成的文件可以被 Redis 加载。模块类型使用 Redis 中不存在的类型编号，只有 miniRedis 能够读取。
+ * 读取时只支持上述编码以及整数编码的字符串
+ */
+
+const rdbMagic = "REDIS"
+
+const rdbVersion = 9
+
+const (
+	rdbTypeString byte = 0
+	rdbTypeList   byte = 1
+	rdbTypeSet    byte = 2
+	rdbTypeHash   byte = 4
+	rdbTypeZSet2  byte = 5
+	// rdbTypeModule 是 miniRedis 私有的类型编号，value 为 类型名 + Marshal 的结果
+	rdbTypeModule byte = 0x80
+
+	rdbOpAux          byte = 0xFA
+	rdbOpResizeDB     byte = 0xFB
+	rdbOpExpireTimeMs byte = 0xFC
+	rdbOpExpireTime   byte = 0xFD
+	rdbOpSelectDB     byte = 0xFE
+	rdbOpEOF          byte = 0xFF
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+)
+
+// Redis 使用的 CRC64 (Jones) 的反转多项式，初始值和结果均不取反
+var rdbCrcTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+func rdbChecksum(crc uint64, p []byte) uint64 {
+	// crc64.Update 会对初始值和结果取反，这里抵消掉
+	return ^crc64.Update(^crc, rdbCrcTable, p)
+}
+
+// ErrBadRDBFormat 表示 RDB 数据格式错误或者使用了不支持的编码
+var ErrBadRDBFormat = errors.New("bad rdb format")
+
+// rdbWriter 写入 RDB 数据并计算校验和
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func newRDBWriter(w io.Writer) *rdbWriter {
+	return &rdbWriter{w: bufio.NewWriter(w)}
+}
+
+func (rw *rdbWriter) write(p []byte) {
+	if rw.err != nil {
+		return
+	}
+	rw.crc = rdbChecksum(rw.crc, p)
+	_, rw.err = rw.w.Write(p)
+}
+
+func (rw *rdbWriter) writeByte(b byte) {
+	rw.write([]byte{b})
+}
+
+func (rw *rdbWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		rw.writeByte(byte(n))
+	case n < 1<<14:
+		rw.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		var buf [5]byte
+		buf[0] = 0x80
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		rw.write(buf[:])
+	default:
+		var buf [9]byte
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], n)
+		rw.write(buf[:])
+	}
+}
+
+func (rw *rdbWriter) writeString(s []byte) {
+	rw.writeLen(uint64(len(s)))
+	rw.write(s)
+}
+
+func (rw *rdbWriter) writeHeader() {
+	rw.write([]byte(rdbMagic + "000" + strconv.Itoa(rdbVersion)))
+	rw.writeAux("redis-ver", "7.0.0")
+	rw.writeAux("redis-bits", "64")
+	rw.writeAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	rw.writeAux("aof-base", "1")
+}
+
+func (rw *rdbWriter) writeAux(key, value string) {
+	rw.writeByte(rdbOpAux)
+	rw.writeString([]byte(key))
+	rw.writeString([]byte(value))
+}
+
+func (rw *rdbWriter) writeSelectDB(dbIndex int, size int, expires int) {
+	rw.writeByte(rdbOpSelectDB)
+	rw.writeLen(uint64(dbIndex))
+	rw.writeByte(rdbOpResizeDB)
+	rw.writeLen(uint64(size))
+	rw.writeLen(uint64(expires))
+}
+
+func rdbTypeOf(data interface{}) (byte, bool) {
+	switch data.(type) {
+	case []byte:
+		return rdbTypeString, true
+	case List.List:
+		return rdbTypeList, true
+	case *set.Set:
+		return rdbTypeSet, true
+	case *SortedSet.SortedSet:
+		return rdbTypeZSet2, true
+	case dict.Dict:
+		return rdbTypeHash, true
+	}
+	return rdbTypeModule, DataTypeOf(data) != nil
+}
+
+// writeEntry 写入一个 key，不支持的类型会被跳过
+func (rw *rdbWriter) writeEntry(key string, entity *database.DataEntity, expiration *time.Time) {
+	typ, ok := rdbTypeOf(entity.Data)
+	if !ok {
+		return
+	}
+	if expiration != nil {
+		var ms [9]byte
+		ms[0] = rdbOpExpireTimeMs
+		binary.LittleEndian.PutUint64(ms[1:], uint64(expiration.UnixNano()/1e6))
+		rw.write(ms[:])
+	}
+	rw.writeByte(typ)
+	rw.writeString([]byte(key))
+	switch val := entity.Data.(type) {
+	case []byte:
+		rw.writeString(val)
+	case List.List:
+		rw.writeLen(uint64(val.Len()))
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			rw.writeString(bytes)
+			return true
+		})
+	case *set.Set:
+		rw.writeLen(uint64(val.Len()))
+		val.ForEach(func(member string) bool {
+			rw.writeString([]byte(member))
+			return true
+		})
+	case *SortedSet.SortedSet:
+		rw.writeLen(uint64(val.Len()))
+		val.ForEach(int64(0), val.Len(), false, func(element *SortedSet.Element) bool {
+			rw.writeString([]byte(element.Member))
+			var score [8]byte
+			binary.LittleEndian.PutUint64(score[:], math.Float64bits(element.Score))
+			rw.write(score[:])
+			return true
+		})
+	case dict.Dict:
+		rw.writeLen(uint64(val.Len()))
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			rw.writeString([]byte(field))
+			rw.writeString(bytes)
+			return true
+		})
+	default:
+		t := DataTypeOf(val)
+		rw.writeString([]byte(t.Name))
+		rw.writeString(t.Marshal(val))
+	}
+}
+
+// finish 写入 EOF 和校验和
+func (rw *rdbWriter) finish() error {
+	rw.writeByte(rdbOpEOF)
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], rw.crc)
+	rw.write(sum[:])
+	if rw.err != nil {
+		return rw.err
+	}
+	return rw.w.Flush()
+}
+
+// WriteRDB 将数据库中的所有数据以 RDB 格式写入 w
+func WriteRDB(w io.Writer, db database.KeyIterator, databases int) error {
+	rw := newRDBWriter(w)
+	rw.writeHeader()
+	for i := 0; i < databases; i++ {
+		size, expires := db.GetDBSize(i)
+		if size == 0 {
+			continue
+		}
+		rw.writeSelectDB(i, size, expires)
+		db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			rw.writeEntry(key, entity, expiration)
+			return rw.err == nil
+		})
+	}
+	return rw.finish()
+}
+
+// rdbReader 读取 RDB 数据并计算校验和
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (rr *rdbReader) readFull(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rr.crc = rdbChecksum(rr.crc, buf)
+	return buf, nil
+}
+
+func (rr *rdbReader) readByte() (byte, error) {
+	buf, err := rr.readFull(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// readLen 读取长度，special 为 true 时 n 是字符串的特殊编码
+func (rr *rdbReader) readLen() (n uint64, special bool, err error) {
+	first, err := rr.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3f), false, nil
+	case 1:
+		next, err := rr.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3f)<<8 | uint64(next), false, nil
+	case 2:
+		switch first {
+		case 0x80:
+			buf, err := rr.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := rr.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, ErrBadRDBFormat
+	}
+	return uint64(first & 0x3f), true, nil
+}
+
+func (rr *rdbReader) readCount() (int, error) {
+	n, special, err := rr.readLen()
+	if err != nil {
+		return 0, err
+	}
+	if special || n > math.MaxInt32 {
+		return 0, ErrBadRDBFormat
+	}
+	return int(n), nil
+}
+
+func (rr *rdbReader) readString() ([]byte, error) {
+	n, special, err := rr.readLen()
+	if err != nil {
+		return nil, err
+	}
+	if !special {
+		if n > math.MaxInt32 {
+			return nil, ErrBadRDBFormat
+		}
+		return rr.readFull(int(n))
+	}
+	var value int64
+	switch n {
+	case rdbEncInt8:
+		buf, err := rr.readFull(1)
+		if err != nil {
+			return nil, err
+		}
+		value = int64(int8(buf[0]))
+	case rdbEncInt16:
+		buf, err := rr.readFull(2)
+		if err != nil {
+			return nil, err
+		}
+		value = int64(int16(binary.LittleEndian.Uint16(buf)))
+	case rdbEncInt32:
+		buf, err := rr.readFull(4)
+		if err != nil {
+			return nil, err
+		}
+		value = int64(int32(binary.LittleEndian.Uint32(buf)))
+	default:
+		// LZF 压缩的字符串
+		return nil, ErrBadRDBFormat
+	}
+	return []byte(strconv.FormatInt(value, 10)), nil
+}
+
+func (rr *rdbReader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case rdbTypeString:
+		return rr.readString()
+	case rdbTypeList:
+		n, err := rr.readCount()
+		if err != nil {
+			return nil, err
+		}
+		list := List.NewQuickList()
+		for i := 0; i < n; i++ {
+			item, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			list.Add(item)
+		}
+		return list, nil
+	case rdbTypeSet:
+		n, err := rr.readCount()
+		if err != nil {
+			return nil, err
+		}
+		s := set.Make()
+		for i := 0; i < n; i++ {
+			member, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			s.Add(string(member))
+		}
+		return s, nil
+	case rdbTypeZSet2:
+		n, err := rr.readCount()
+		if err != nil {
+			return nil, err
+		}
+		zset := SortedSet.Make()
+		for i := 0; i < n; i++ {
+			member, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			score, err := rr.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			zset.Add(string(member), math.Float64frombits(binary.LittleEndian.Uint64(score)))
+		}
+		return zset, nil
+	case rdbTypeHash:
+		n, err := rr.readCount()
+		if err != nil {
+			return nil, err
+		}
+		hash := dict.MakeSimple()
+		for i := 0; i < n; i++ {
+			field, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := rr.readString()
+			if err != nil {
+				return nil, err
+			}
+			hash.Put(string(field), value)
+		}
+		return hash, nil
+	case rdbTypeModule:
+		name, err := rr.readString()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := rr.readString()
+		if err != nil {
+			return nil, err
+		}
+		t := lookupDataType(string(name))
+		if t == nil {
+			return nil, errors.New("unknown module data type " + string(name))
+		}
+		return t.Unmarshal(raw)
+	}
+	return nil, errors.New("unsupported rdb type " + strconv.Itoa(int(typ)))
+}
+
+// ReadRDB 从 r 中读取 RDB 数据，每读到一个 key 调用一次 cb，cb 为 nil 时只检查数据。
+// r 中的 RDB 数据之后可以有其它数据（例如 AOF 命令），读取结束时 r 正好位于 RDB 数据之后
+func ReadRDB(r *bufio.Reader, cb func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) error) error {
+	rr := &rdbReader{r: r}
+	header, err := rr.readFull(len(rdbMagic) + 4)
+	if err != nil {
+		return err
+	}
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return ErrBadRDBFormat
+	}
+	if version, err := strconv.Atoi(string(header[len(rdbMagic):])); err != nil || version < 1 || version > 10 {
+		return errors.New("unsupported rdb version " + string(header[len(rdbMagic):]))
+	}
+	dbIndex := 0
+	var expiration *time.Time
+	for {
+		typ, err := rr.readByte()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case rdbOpEOF:
+			expected := rr.crc
+			sum, err := rr.readFull(8)
+			if err != nil {
+				return err
+			}
+			// 校验和为 0 表示写入时没有计算校验和
+			if actual := binary.LittleEndian.Uint64(sum); actual != 0 && actual != expected {
+				return errors.New("rdb checksum mismatch")
+			}
+			return nil
+		case rdbOpAux:
+			if _, err := rr.readString(); err != nil {
+				return err
+			}
+			if _, err := rr.readString(); err != nil {
+				return err
+			}
+		case rdbOpSelectDB:
+			n, err := rr.readCount()
+			if err != nil {
+				return err
+			}
+			dbIndex = n
+		case rdbOpResizeDB:
+			if _, err := rr.readCount(); err != nil {
+				return err
+			}
+			if _, err := rr.readCount(); err != nil {
+				return err
+			}
+		case rdbOpExpireTimeMs:
+			buf, err := rr.readFull(8)
+			if err != nil {
+				return err
+			}
+			t := time.Unix(0, int64(binary.LittleEndian.Uint64(buf))*int64(time.Millisecond))
+			expiration = &t
+		case rdbOpExpireTime:
+			buf, err := rr.readFull(4)
+			if err != nil {
+				return err
+			}
+			t := time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+			expiration = &t
+		default:
+			key, err := rr.readString()
+			if err != nil {
+				return err
+			}
+			value, err := rr.readValue(typ)
+			if err != nil {
+				return err
+			}
+			if cb != nil {
+				if err := cb(dbIndex, string(key), &database.DataEntity{Data: value}, expiration); err != nil {
+					return err
+				}
+			}
+			expiration = nil
+		}
+	}
+}
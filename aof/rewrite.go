@@ -1,7 +1,7 @@
 package aof
 
 import (
-	"io"
+	"errors"
 	"io/ioutil"
 	"miniRedis/config"
 	"miniRedis/interface/database"
@@ -9,6 +9,7 @@ import (
 	"miniRedis/lib/utils"
 	"miniRedis/redis/protocol"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 )
@@ -16,30 +17,54 @@ import (
 func (persister *Persister) newRewriteHandler() *Persister {
 	h := &Persister{}
 	h.aofFilename = persister.aofFilename
+	h.aofDir = persister.aofDir
 	h.db = persister.tmpDBMaker()
 	return h
 }
 
 // RewriteCtx holds context of an AOF rewriting procedure
 type RewriteCtx struct {
-	tmpFile  *os.File // 重写过程中创建的临时文件指针，用于写入重写后的AOF文件
-	fileSize int64    // 当前AOF文件的大小，用于限制重写的最大长度
-	dbIdx    int      // 重写过程中选择的数据库索引
+	tmpFile  *os.File  // 在 AOF 目录中创建的临时文件，重写完成后成为新的 base 文件
+	manifest *manifest // 开始重写时清单中的文件，重写完成后被新的 base 文件替换
+	// snapshot 是开始重写时的数据快照，数据库不支持快照时为 nil，需要重新加载 manifest 中的文件
+	snapshot database.Snapshot
 }
 
+// ErrRewriteInProgress 表示已经有一个重写正在进行
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// ErrAofDisabled 表示没有开启 AOF，没有可以重写的文件
+var ErrAofDisabled = errors.New("ERR append only file is disabled")
+
 // Rewrite carries out AOF rewrite
 func (persister *Persister) Rewrite() error {
+	if persister.listenOnly {
+		return ErrAofDisabled
+	}
+	if !persister.rewriting.CompareAndSwap(false, true) {
+		return ErrRewriteInProgress
+	}
+	defer persister.rewriting.Set(false)
+	err := persister.rewrite()
+	persister.lastRewriteFailed.Set(err != nil)
+	return err
+}
+
+func (persister *Persister) rewrite() error {
 	ctx, err := persister.StartRewrite()
 	if err != nil {
 		return err
 	}
 	err = persister.DoRewrite(ctx)
+	if ctx.snapshot != nil {
+		ctx.snapshot.Release()
+	}
 	if err != nil {
+		_ = ctx.tmpFile.Close()
+		_ = os.Remove(ctx.tmpFile.Name())
 		return err
 	}
-
-	persister.FinishRewrite(ctx)
-	return nil
+	return persister.FinishRewrite(ctx)
 }
 
 // DoRewrite actually rewrite aof file
@@ -47,10 +72,31 @@ func (persister *Persister) Rewrite() error {
 func (persister *Persister) DoRewrite(ctx *RewriteCtx) error {
 	tmpFile := ctx.tmpFile
 
-	// load aof tmpFile
-	tmpAof := persister.newRewriteHandler()
-	tmpAof.LoadAof(int(ctx.fileSize))
+	var source database.KeyIterator = ctx.snapshot
+	if ctx.snapshot == nil {
+		// 数据库不支持快照，在临时数据库中加载开始重写时的所有文件
+		tmpAof := persister.newRewriteHandler()
+		if err := tmpAof.loadFiles(ctx.manifest.files(), 0, false); err != nil {
+			return err
+		}
+		source = tmpAof.db
+	}
 
+	if config.Properties.AofUseRdbPreamble {
+		if err := WriteRDB(tmpFile, source, config.Properties.Databases); err != nil {
+			return err
+		}
+		// RDB 格式的数据之后可以继续写入命令
+		if err := persister.writeLockTokens(tmpFile); err != nil {
+			return err
+		}
+		return tmpFile.Sync()
+	}
+	if config.Properties.AofTimestampEnabled {
+		if _, err := tmpFile.Write(makeTimestampAnnotation(time.Now().Unix())); err != nil {
+			return err
+		}
+	}
 	// rewrite aof tmpFile
 	for i := 0; i < config.Properties.Databases; i++ {
 		// select db
@@ -60,25 +106,88 @@ func (persister *Persister) DoRewrite(ctx *RewriteCtx) error {
 			return err
 		}
 		// dump db
-		tmpAof.db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+		source.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
 			cmd := EntityToCmd(key, entity)
 			if cmd != nil {
-				_, _ = tmpFile.Write(cmd.ToBytes())
+				_, err = tmpFile.Write(cmd.ToBytes())
 			}
-			if expiration != nil {
+			if expiration != nil && err == nil {
 				cmd := MakeExpireCmd(key, *expiration)
 				if cmd != nil {
-					_, _ = tmpFile.Write(cmd.ToBytes())
+					_, err = tmpFile.Write(cmd.ToBytes())
 				}
 			}
-			return true
+			return err == nil
 		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := persister.writeLockTokens(tmpFile); err != nil {
+		return err
+	}
+	return tmpFile.Sync()
+}
+
+// writeLockTokens 以 LOCKTOKEN 命令保存每个数据库的锁令牌计数器，计数器不属于任何 key，不在数据快照中。
+// 这里读取的是数据库当前的计数器，不会小于开始重写时的值，多出来的令牌只是不会再被发出
+func (persister *Persister) writeLockTokens(file *os.File) error {
+	engine, ok := persister.db.(database.LockTokenEngine)
+	if !ok {
+		return nil
+	}
+	for i := 0; i < config.Properties.Databases; i++ {
+		token := engine.LockToken(i)
+		if token == 0 {
+			continue
+		}
+		data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes()
+		data = append(data, protocol.MakeMultiBulkReply(utils.ToCmdLine("LOCKTOKEN", strconv.FormatInt(token, 10))).ToBytes()...)
+		if _, err := file.Write(data); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // StartRewrite prepares rewrite procedure
 func (persister *Persister) StartRewrite() (*RewriteCtx, error) {
+	ctx := &RewriteCtx{}
+	if engine, ok := persister.db.(database.SnapshotEngine); ok {
+		// 生成快照时暂停写命令并切换增量文件，快照正好包含旧文件中的所有命令
+		snapshot, err := engine.MakeSnapshot(func() error {
+			var err error
+			ctx.manifest, err = persister.switchIncrFile()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		ctx.snapshot = snapshot
+	} else {
+		var err error
+		ctx.manifest, err = persister.switchIncrFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 临时文件和 AOF 位于同一个目录，保证 rename 不会跨越文件系统
+	file, err := ioutil.TempFile(persister.aofDir, "temp-rewriteaof-*.aof")
+	if err != nil {
+		logger.Warn("tmp file create failed")
+		if ctx.snapshot != nil {
+			ctx.snapshot.Release()
+		}
+		return nil, err
+	}
+	ctx.tmpFile = file
+	return ctx, nil
+}
+
+// switchIncrFile 将队列中的命令写入当前文件，之后的命令写入新的增量文件，返回切换之前的清单
+func (persister *Persister) switchIncrFile() (*manifest, error) {
+	persister.flushQueue()
 	persister.pausingAof.Lock() // pausing aof
 	defer persister.pausingAof.Unlock()
 
@@ -87,77 +196,64 @@ func (persister *Persister) StartRewrite() (*RewriteCtx, error) {
 		logger.Warn("fsync failed")
 		return nil, err
 	}
+	snapshot := persister.manifest.copy()
 
-	// get current aof file size
-	fileInfo, _ := os.Stat(persister.aofFilename) // 获取文件信息
-	filesize := fileInfo.Size()
-
-	// create tmp file
-	file, err := ioutil.TempFile("", "*.aof")
+	// 之后的命令写入新的增量文件，重写完成时不需要再复制旧文件的末尾
+	incrFile, err := persister.createIncrFile()
 	if err != nil {
-		logger.Warn("tmp file create failed")
+		logger.Warn("create incr aof file failed: " + err.Error())
 		return nil, err
 	}
-	return &RewriteCtx{
-		tmpFile:  file,
-		fileSize: filesize,
-		dbIdx:    persister.currentDB,
-	}, nil
+	_ = persister.aofFile.Close()
+	persister.aofFile = incrFile
+	persister.currentDB = 0     // 加载时每个文件都从 0 号数据库开始
+	persister.lastTimestamp = 0 // 新的增量文件以时间戳注释开始
+	// 新的文件中不会再写入 SELECT 0，需要单独通知监听器
+	for listener := range persister.listeners {
+		listener.Callback([]CmdLine{utils.ToCmdLine("SELECT", "0")})
+	}
+	return snapshot, nil
 }
 
 // FinishRewrite finish rewrite procedure
-func (persister *Persister) FinishRewrite(ctx *RewriteCtx) {
+func (persister *Persister) FinishRewrite(ctx *RewriteCtx) error {
 	persister.pausingAof.Lock() // 确保重写期间没有其他写操作，保证数据一致性
 	defer persister.pausingAof.Unlock()
 
-	tmpFile := ctx.tmpFile
+	tmpFileName := ctx.tmpFile.Name()
+	_ = ctx.tmpFile.Close()
 
-	src, err := os.Open(persister.aofFilename)
-	if err != nil {
-		logger.Error("open aofFilename failed: " + err.Error())
-		return
-	}
-	defer func() {
-		_ = src.Close()
-	}()
-	_, err = src.Seek(ctx.fileSize, 0) // seek函数用于修改文件指针的位置，在前面复制完成之后，要在结尾加上SELECT语句
-	if err != nil {
-		logger.Error("seek failed: " + err.Error())
-		return
+	m := persister.manifest.copy()
+	m.baseSeq++
+	base := &aofFileInfo{
+		name:     baseFileName(persister.baseName(), m.baseSeq, config.Properties.AofUseRdbPreamble),
+		seq:      m.baseSeq,
+		fileType: aofFileTypeBase,
 	}
-
-	// 修改为之前未选择的数据库
-	data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(ctx.dbIdx))).ToBytes()
-	_, err = tmpFile.Write(data)
-	if err != nil {
-		logger.Error("tmp file rewrite failed: " + err.Error())
-		return
-	}
-
-	// 将原有的AOF文件的剩余内容复制到tmpFIle中
-	_, err = io.Copy(tmpFile, src)
-	if err != nil {
-		logger.Error("copy aof filed failed: " + err.Error())
-		return
+	basePath := filepath.Join(persister.aofDir, base.name)
+	if err := os.Rename(tmpFileName, basePath); err != nil {
+		logger.Error("rename rewritten aof failed: " + err.Error())
+		_ = os.Remove(tmpFileName)
+		return err
 	}
-
-	tmpFileName := tmpFile.Name()
-	_ = tmpFile.Close()
-	// 使用临时的文件代替AOF文件
-	_ = persister.aofFile.Close()
-	_ = os.Rename(tmpFileName, persister.aofFilename)
-
-	// 修改当前的AOF文件并打开以便后续的操作
-	aofFile, err := os.OpenFile(persister.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
+	// 开始重写之前的增量文件已经包含在新的 base 文件中
+	m.base = base
+	m.incrs = m.incrs[len(ctx.manifest.incrs):]
+	if err := writeManifest(persister.aofDir, persister.baseName(), m); err != nil {
+		logger.Error("update aof manifest failed: " + err.Error())
+		_ = os.Remove(basePath)
+		return err
 	}
-	persister.aofFile = aofFile
+	persister.manifest = m
 
-	// 确保当前的数据库和AOF文件中的是同一个数据库索引
-	data = protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(persister.currentDB))).ToBytes()
-	_, err = persister.aofFile.Write(data)
-	if err != nil {
-		panic(err)
+	// 删除被替换的文件
+	for _, f := range ctx.manifest.files() {
+		if err := os.Remove(filepath.Join(persister.aofDir, f.name)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("remove history aof file failed: " + err.Error())
+		}
 	}
+	size := persister.filesSize()
+	persister.currentSize.Set(size)
+	persister.baseSize.Set(size)
+	return nil
 }
@@ -0,0 +1,234 @@
+package cdc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * cdc 包实现变更数据捕获（Change Data Capture）：Feed 作为 aof.Listener 接收所有已经提交的写命令，
+ * 为每个命令生成一个带有递增偏移量的事件，并在内存中保留最近的事件。
+ * 消费者从某个偏移量开始订阅，按照提交的顺序依次收到之后的事件，不需要轮询。
+ *
+ * 偏移量从 1 开始，只在一个进程内有效，重启之后重新计数
+ */
+
+// Event 是一个已经提交的写命令
+type Event struct {
+	Offset  uint64
+	DBIndex int
+	Command string   // 小写的命令名
+	Keys    []string // 命令修改的 key，FLUSHDB 等命令没有 key
+	CmdLine [][]byte // 完整的命令行，与写入 AOF 的命令一致
+}
+
+// KeyExtractor 返回命令修改的 key
+type KeyExtractor func(cmdLine [][]byte) []string
+
+var (
+	// ErrClosed 表示 Feed 或者订阅已经关闭
+	ErrClosed = errors.New("cdc: closed")
+	// ErrLagged 表示消费者太慢，需要的事件已经被新的事件覆盖
+	ErrLagged = errors.New("cdc: consumer lagged behind, events have been discarded")
+)
+
+// OutOfRangeError 表示订阅的偏移量已经不在保留的事件中
+type OutOfRangeError struct {
+	Offset uint64
+	Oldest uint64
+}
+
+func (e *OutOfRangeError) Error() string {
+	return fmt.Sprintf("cdc: offset %d is out of range, the oldest available offset is %d", e.Offset, e.Oldest)
+}
+
+// Feed 保存最近的事件，并通知等待中的订阅者
+type Feed struct {
+	mu     sync.Mutex
+	events []*Event // 环形缓冲区，偏移量为 n 的事件保存在 events[n%len(events)]
+	next   uint64   // 下一个事件的偏移量
+	// notify 在有新的事件或者 Feed 关闭时被关闭并替换
+	notify chan struct{}
+	closed bool
+
+	keys      KeyExtractor
+	currentDB int // 回调中最近一个 SELECT 命令选择的数据库
+}
+
+// NewFeed 创建一个最多保留 size 个事件的 Feed
+func NewFeed(size int, keys KeyExtractor) *Feed {
+	if size <= 0 {
+		size = 1
+	}
+	return &Feed{
+		events: make([]*Event, size),
+		next:   1,
+		notify: make(chan struct{}),
+		keys:   keys,
+	}
+}
+
+// Callback 实现 aof.Listener，一次回调中的命令（例如一个事务）作为连续的事件发布
+func (f *Feed) Callback(cmdLines [][][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	published := false
+	for _, cmdLine := range cmdLines {
+		if len(cmdLine) == 0 {
+			continue
+		}
+		name := strings.ToLower(string(cmdLine[0]))
+		switch name {
+		case "select":
+			if len(cmdLine) == 2 {
+				if index, err := strconv.Atoi(string(cmdLine[1])); err == nil {
+					f.currentDB = index
+				}
+			}
+			continue
+		case "multi", "exec":
+			continue
+		}
+		event := &Event{
+			Offset:  f.next,
+			DBIndex: f.currentDB,
+			Command: name,
+			CmdLine: cmdLine,
+		}
+		if f.keys != nil {
+			event.Keys = f.keys(cmdLine)
+		}
+		f.events[f.next%uint64(len(f.events))] = event
+		f.next++
+		published = true
+	}
+	if published {
+		close(f.notify)
+		f.notify = make(chan struct{})
+	}
+}
+
+// Offset 返回下一个事件的偏移量，从这个偏移量开始订阅只会收到之后提交的写命令
+func (f *Feed) Offset() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.next
+}
+
+// Oldest 返回保留的最早的事件的偏移量
+func (f *Feed) Oldest() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.oldest()
+}
+
+func (f *Feed) oldest() uint64 {
+	size := uint64(len(f.events))
+	if f.next-1 <= size {
+		return 1
+	}
+	return f.next - size
+}
+
+// Subscribe 从偏移量 from 开始订阅，from 为 0 时从保留的最早的事件开始。
+// from 早于保留的最早的事件时返回 *OutOfRangeError，晚于下一个事件的偏移量时等待事件到达
+func (f *Feed) Subscribe(from uint64) (*Subscriber, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, ErrClosed
+	}
+	oldest := f.oldest()
+	if from == 0 {
+		from = oldest
+	}
+	if from < oldest {
+		return nil, &OutOfRangeError{Offset: from, Oldest: oldest}
+	}
+	return &Subscriber{
+		feed: f,
+		next: from,
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Close 关闭 Feed，等待中的订阅者收到 ErrClosed
+func (f *Feed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	close(f.notify)
+}
+
+// Subscriber 按照偏移量顺序读取事件，一个 Subscriber 只能被一个协程使用
+type Subscriber struct {
+	feed      *Feed
+	next      uint64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Next 返回下一个事件，没有新的事件时阻塞，直到事件到达、ctx 结束或者订阅关闭
+func (s *Subscriber) Next(ctx context.Context) (*Event, error) {
+	for {
+		event, notify, err := s.poll()
+		if event != nil || err != nil {
+			return event, err
+		}
+		select {
+		case <-notify:
+		case <-s.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// poll 返回下一个事件，没有新的事件时返回用于等待的 channel
+func (s *Subscriber) poll() (*Event, <-chan struct{}, error) {
+	f := s.feed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil, nil, ErrClosed
+	default:
+	}
+	if s.next < f.oldest() {
+		return nil, nil, ErrLagged
+	}
+	if s.next < f.next {
+		event := f.events[s.next%uint64(len(f.events))]
+		s.next++
+		return event, nil, nil
+	}
+	if f.closed {
+		return nil, nil, ErrClosed
+	}
+	return nil, f.notify, nil
+}
+
+// Offset 返回下一个要读取的事件的偏移量
+func (s *Subscriber) Offset() uint64 {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	return s.next
+}
+
+// Close 关闭订阅，阻塞在 Next 中的调用返回 ErrClosed
+func (s *Subscriber) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/client"
+	"miniRedis/redis/protocol"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * miniredis-benchmark 用于衡量 ConcurrentDict、锁以及协议解析等改动对性能的影响，用法与 redis-benchmark 类似：
+ *   miniredis-benchmark -c 50 -n 100000 -P 16 -t set,get
+ *   miniredis-benchmark --mix get=9,set=1 -r 100000 -d 16 --dmax 256 --json
+ *   miniredis-benchmark -r 1000 HSET myhash field:__rand_int__ value
+ */
+
+const defaultTests = "ping,set,get,incr,lpush,zadd,mset"
+
+var (
+	host     = flag.String("h", "127.0.0.1", "Server hostname")
+	port     = flag.Int("p", 6379, "Server port")
+	password = flag.String("a", "", "Password for AUTH")
+	clients  = flag.Int("c", 50, "Number of parallel connections")
+	requests = flag.Int("n", 100000, "Total number of requests of each test")
+	pipeline = flag.Int("P", 1, "Pipeline <numreq> requests")
+	keyspace = flag.Int("r", 0, "Use random keys in the range [0, keyspacelen), and replace __rand_int__ in custom commands")
+	dataSize = flag.Int("d", 3, "Data size of SET/LPUSH/MSET value in bytes")
+	dataMax  = flag.Int("dmax", 0, "If greater than -d, value sizes are uniformly distributed in [d, dmax]")
+	msetKeys = flag.Int("mset-keys", 10, "Number of keys of each MSET command")
+	tests    = flag.String("t", defaultTests, "Comma separated list of tests, each test is run separately")
+	mixSpec  = flag.String("mix", "", "Run a single mixed workload, for example get=9,set=1")
+	quiet    = flag.Bool("q", false, "Quiet, just show query/sec values")
+	csvOut   = flag.Bool("csv", false, "Output in CSV format")
+	jsonOut  = flag.Bool("json", false, "Output in JSON format")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: miniredis-benchmark [OPTIONS] [command [arg ...]]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *clients <= 0 || *requests <= 0 || *pipeline <= 0 {
+		fmt.Fprintln(os.Stderr, "-c, -n and -P must be positive")
+		os.Exit(1)
+	}
+
+	w := &workload{
+		keyspace:     *keyspace,
+		valueSize:    *dataSize,
+		valueSizeMax: *dataMax,
+		msetKeys:     *msetKeys,
+	}
+	var mixes []*mix
+	if flag.NArg() > 0 {
+		w.custom = utils.ToCmdLine(flag.Args()...)
+		mixes = append(mixes, &mix{
+			name:    strings.Join(flag.Args(), " "),
+			names:   []string{"custom"},
+			weights: []int{1},
+			total:   1,
+		})
+	} else if *mixSpec != "" {
+		m, err := parseMix(*mixSpec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		mixes = append(mixes, m)
+	} else {
+		for _, test := range strings.Split(*tests, ",") {
+			m, err := parseMix(test)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			mixes = append(mixes, m)
+		}
+	}
+
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	results := make([]*result, 0, len(mixes))
+	for _, m := range mixes {
+		r, err := run(addr, m, w)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !*csvOut && !*jsonOut {
+			printText(os.Stdout, r, *quiet)
+		}
+		results = append(results, r)
+	}
+
+	var err error
+	if *csvOut {
+		err = writeCSV(os.Stdout, results)
+	} else if *jsonOut {
+		err = writeJSON(os.Stdout, results)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run 使用 clients 个连接执行一项测试，每个连接每次通过 pipeline 发送 P 条命令，
+// 同一批命令的延迟都记为整批命令从发送到收到全部回复的时间
+func run(addr string, m *mix, w *workload) (*result, error) {
+	conns := make([]*client.Client, *clients)
+	defer func() {
+		for _, cl := range conns {
+			if cl != nil {
+				cl.Close()
+			}
+		}
+	}()
+	for i := range conns {
+		cl, err := connect(addr)
+		if err != nil {
+			return nil, err
+		}
+		conns[i] = cl
+	}
+
+	total := int64(*requests)
+	var issued, errs int64
+	histograms := make([]*histogram, len(conns))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, cl := range conns {
+		wg.Add(1)
+		histograms[i] = &histogram{samples: make([]time.Duration, 0, total/int64(len(conns))+1)}
+		go func(cl *client.Client, h *histogram, seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			batch := make([][][]byte, 0, *pipeline)
+			for {
+				// 领取一批请求，最后一批可能不足 P 条
+				end := atomic.AddInt64(&issued, int64(*pipeline))
+				n := int64(*pipeline)
+				if end > total {
+					n -= end - total
+				}
+				if n <= 0 {
+					return
+				}
+				batch = batch[:0]
+				for j := int64(0); j < n; j++ {
+					batch = append(batch, m.next(w, r))
+				}
+				begin := time.Now()
+				replies := cl.Pipeline(batch)
+				h.record(time.Since(begin), len(replies))
+				for _, reply := range replies {
+					if isError(reply) {
+						atomic.AddInt64(&errs, 1)
+					}
+				}
+			}
+		}(cl, histograms[i], start.UnixNano()+int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	h := &histogram{samples: make([]time.Duration, 0, total)}
+	for _, other := range histograms {
+		h.merge(other)
+	}
+	return makeResult(m.name, int(total), int(errs), elapsed, h), nil
+}
+
+func connect(addr string) (*client.Client, error) {
+	cl, err := client.MakeClient(addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %v", addr, err)
+	}
+	cl.Start()
+	if *password != "" {
+		if reply := cl.Send(utils.ToCmdLine("AUTH", *password)); isError(reply) {
+			cl.Close()
+			return nil, errors.New("AUTH failed: " + string(reply.ToBytes()))
+		}
+	}
+	return cl, nil
+}
+
+func isError(reply interface{}) bool {
+	_, ok := reply.(protocol.ErrorReply)
+	return ok
+}
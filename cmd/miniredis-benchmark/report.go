@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// histogram 记录每个请求的延迟，测试结束后排序计算分位数
+type histogram struct {
+	samples []time.Duration
+}
+
+func (h *histogram) record(d time.Duration, n int) {
+	for i := 0; i < n; i++ {
+		h.samples = append(h.samples, d)
+	}
+}
+
+func (h *histogram) merge(other *histogram) {
+	h.samples = append(h.samples, other.samples...)
+}
+
+func (h *histogram) sort() {
+	sort.Slice(h.samples, func(i, j int) bool {
+		return h.samples[i] < h.samples[j]
+	})
+}
+
+// percentile 返回分位数 p (0-100) 对应的延迟，需要先调用 sort
+func (h *histogram) percentile(p float64) time.Duration {
+	if len(h.samples) == 0 {
+		return 0
+	}
+	i := int(float64(len(h.samples))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(h.samples) {
+		i = len(h.samples) - 1
+	}
+	return h.samples[i]
+}
+
+func (h *histogram) average() time.Duration {
+	if len(h.samples) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range h.samples {
+		total += d
+	}
+	return total / time.Duration(len(h.samples))
+}
+
+// result 是一项测试的结果，所有的延迟以毫秒为单位输出
+type result struct {
+	Test        string  `json:"test"`
+	Requests    int     `json:"requests"`
+	Errors      int     `json:"errors"`
+	Clients     int     `json:"clients"`
+	Pipeline    int     `json:"pipeline"`
+	Seconds     float64 `json:"seconds"`
+	RPS         float64 `json:"rps"`
+	AvgLatency  float64 `json:"avg_latency_ms"`
+	MinLatency  float64 `json:"min_latency_ms"`
+	P50Latency  float64 `json:"p50_latency_ms"`
+	P99Latency  float64 `json:"p99_latency_ms"`
+	P999Latency float64 `json:"p999_latency_ms"`
+	MaxLatency  float64 `json:"max_latency_ms"`
+
+	histogram *histogram
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func makeResult(test string, requests, errs int, elapsed time.Duration, h *histogram) *result {
+	h.sort()
+	return &result{
+		Test:        test,
+		Requests:    requests,
+		Errors:      errs,
+		Clients:     *clients,
+		Pipeline:    *pipeline,
+		Seconds:     elapsed.Seconds(),
+		RPS:         float64(requests) / elapsed.Seconds(),
+		AvgLatency:  toMillis(h.average()),
+		MinLatency:  toMillis(h.percentile(0)),
+		P50Latency:  toMillis(h.percentile(50)),
+		P99Latency:  toMillis(h.percentile(99)),
+		P999Latency: toMillis(h.percentile(99.9)),
+		MaxLatency:  toMillis(h.percentile(100)),
+		histogram:   h,
+	}
+}
+
+// printText 输出与 redis-benchmark 类似的报告，quiet 模式下只输出吞吐量
+func printText(w io.Writer, r *result, quiet bool) {
+	if quiet {
+		fmt.Fprintf(w, "%s: %.2f requests per second, p50=%.3f msec\n", r.Test, r.RPS, r.P50Latency)
+		return
+	}
+	fmt.Fprintf(w, "====== %s ======\n", r.Test)
+	fmt.Fprintf(w, "  %d requests completed in %.2f seconds\n", r.Requests, r.Seconds)
+	fmt.Fprintf(w, "  %d parallel clients\n", r.Clients)
+	fmt.Fprintf(w, "  %d commands per pipeline\n", r.Pipeline)
+	if r.Errors > 0 {
+		fmt.Fprintf(w, "  %d errors\n", r.Errors)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Latency by percentile distribution:")
+	for _, p := range []float64{0, 50, 75, 90, 95, 99, 99.9, 99.99, 100} {
+		fmt.Fprintf(w, "%.3f%% <= %.3f milliseconds\n", p, toMillis(r.histogram.percentile(p)))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Summary:")
+	fmt.Fprintf(w, "  throughput summary: %.2f requests per second\n", r.RPS)
+	fmt.Fprintln(w, "  latency summary (msec):")
+	fmt.Fprintf(w, "  %9s %9s %9s %9s %9s %9s\n", "avg", "min", "p50", "p99", "p99.9", "max")
+	fmt.Fprintf(w, "  %9.3f %9.3f %9.3f %9.3f %9.3f %9.3f\n\n",
+		r.AvgLatency, r.MinLatency, r.P50Latency, r.P99Latency, r.P999Latency, r.MaxLatency)
+}
+
+var csvHeader = []string{"test", "requests", "errors", "clients", "pipeline", "rps",
+	"avg_latency_ms", "min_latency_ms", "p50_latency_ms", "p99_latency_ms", "p999_latency_ms", "max_latency_ms"}
+
+func writeCSV(w io.Writer, results []*result) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+	format := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 3, 64)
+	}
+	for _, r := range results {
+		record := []string{r.Test, strconv.Itoa(r.Requests), strconv.Itoa(r.Errors),
+			strconv.Itoa(r.Clients), strconv.Itoa(r.Pipeline), format(r.RPS),
+			format(r.AvgLatency), format(r.MinLatency), format(r.P50Latency),
+			format(r.P99Latency), format(r.P999Latency), format(r.MaxLatency)}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeJSON(w io.Writer, results []*result) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
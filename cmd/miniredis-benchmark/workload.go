@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const randPlaceholder = "__rand_int__"
+
+// generator 生成一条用于测试的命令
+type generator func(w *workload, r *rand.Rand) [][]byte
+
+// workload 描述了测试中使用的 key 空间和 value 大小
+type workload struct {
+	keyspace     int // 随机 key 的数量，0 表示所有命令使用同一个 key
+	valueSize    int
+	valueSizeMax int // 大于 valueSize 时 value 的大小在 [valueSize, valueSizeMax] 中均匀分布
+	msetKeys     int
+	custom       [][]byte
+}
+
+func (w *workload) randInt(r *rand.Rand) string {
+	if w.keyspace <= 0 {
+		return "000000000000"
+	}
+	return strconv.FormatInt(int64(r.Intn(w.keyspace)), 10)
+}
+
+func (w *workload) key(r *rand.Rand, prefix string) []byte {
+	return []byte(prefix + w.randInt(r))
+}
+
+func (w *workload) value(r *rand.Rand) []byte {
+	size := w.valueSize
+	if w.valueSizeMax > w.valueSize {
+		size += r.Intn(w.valueSizeMax - w.valueSize + 1)
+	}
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = 'a' + byte(r.Intn(26))
+	}
+	return value
+}
+
+var generators = map[string]generator{
+	"ping": func(w *workload, r *rand.Rand) [][]byte {
+		return [][]byte{[]byte("PING")}
+	},
+	"set": func(w *workload, r *rand.Rand) [][]byte {
+		return [][]byte{[]byte("SET"), w.key(r, "key:"), w.value(r)}
+	},
+	"get": func(w *workload, r *rand.Rand) [][]byte {
+		return [][]byte{[]byte("GET"), w.key(r, "key:")}
+	},
+	"incr": func(w *workload, r *rand.Rand) [][]byte {
+		return [][]byte{[]byte("INCR"), w.key(r, "counter:")}
+	},
+	"lpush": func(w *workload, r *rand.Rand) [][]byte {
+		return [][]byte{[]byte("LPUSH"), w.key(r, "mylist:"), w.value(r)}
+	},
+	"zadd": func(w *workload, r *rand.Rand) [][]byte {
+		score := strconv.Itoa(r.Intn(1000000))
+		return [][]byte{[]byte("ZADD"), []byte("myzset"), []byte(score), w.key(r, "element:")}
+	},
+	"mset": func(w *workload, r *rand.Rand) [][]byte {
+		args := make([][]byte, 0, 1+2*w.msetKeys)
+		args = append(args, []byte("MSET"))
+		for i := 0; i < w.msetKeys; i++ {
+			args = append(args, w.key(r, "key:"), w.value(r))
+		}
+		return args
+	},
+	"custom": func(w *workload, r *rand.Rand) [][]byte {
+		args := make([][]byte, len(w.custom))
+		for i, arg := range w.custom {
+			if strings.Contains(string(arg), randPlaceholder) {
+				arg = []byte(strings.ReplaceAll(string(arg), randPlaceholder, w.randInt(r)))
+			}
+			args[i] = arg
+		}
+		return args
+	},
+}
+
+// mix 按照权重随机地选择命令，只有一种命令时就是单一命令的测试
+type mix struct {
+	name    string
+	names   []string
+	weights []int
+	total   int
+}
+
+// parseMix 解析 "get=9,set=1" 形式的命令组合，省略权重时权重为 1
+func parseMix(spec string) (*mix, error) {
+	m := &mix{name: strings.ToUpper(spec)}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(strings.ToLower(item))
+		if item == "" {
+			continue
+		}
+		name, weight := item, 1
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			var err error
+			name = item[:i]
+			weight, err = strconv.Atoi(item[i+1:])
+			if err != nil || weight <= 0 {
+				return nil, errors.New("invalid weight of " + name)
+			}
+		}
+		if _, ok := generators[name]; !ok {
+			return nil, errors.New("unknown test " + name)
+		}
+		m.names = append(m.names, name)
+		m.weights = append(m.weights, weight)
+		m.total += weight
+	}
+	if len(m.names) == 0 {
+		return nil, errors.New("no test specified")
+	}
+	return m, nil
+}
+
+func (m *mix) next(w *workload, r *rand.Rand) [][]byte {
+	n := r.Intn(m.total)
+	for i, weight := range m.weights {
+		if n < weight {
+			return generators[m.names[i]](w, r)
+		}
+		n -= weight
+	}
+	return generators[m.names[len(m.names)-1]](w, r)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"miniRedis/aof"
+	"os"
+	"strings"
+)
+
+/*
+ * miniredis-check-aof 检查 AOF 文件是否完整，用法与 redis-check-aof 类似：
+ *   miniredis-check-aof appendonlydir/appendonly.aof.manifest      按照清单检查所有文件
+ *   miniredis-check-aof appendonlydir/appendonly.aof.1.incr.aof    检查一个文件
+ *   miniredis-check-aof --fix <file>                               将文件截断到第一个错误命令之前
+ *   miniredis-check-aof --truncate-to-timestamp 1700000000 <file>  将文件截断到这个时间戳之前，恢复到这一时刻的数据
+ * 以 RDB 格式开头的 base 文件会校验 RDB 的 CRC64 校验和
+ */
+
+var (
+	fix        = flag.Bool("fix", false, "Truncate the AOF file at the first bad command")
+	truncateTo = flag.Int64("truncate-to-timestamp", 0, "Truncate the AOF file at the first timestamp annotation later than the given unix time")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: miniredis-check-aof [--fix|--truncate-to-timestamp <timestamp>] <file.manifest|file.aof>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	filename := flag.Arg(0)
+	files := []string{filename}
+	if strings.HasSuffix(filename, ".manifest") {
+		var err error
+		files, err = aof.ManifestFiles(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	for i, f := range files {
+		if !checkFile(f, i == len(files)-1) {
+			os.Exit(1)
+		}
+	}
+	if *truncateTo > 0 && !truncateToTimestamp(files, *truncateTo) {
+		os.Exit(1)
+	}
+}
+
+// truncateToTimestamp 将文件截断到第一个晚于 timestamp 的时间戳注释之前，只能截断最后一个文件
+func truncateToTimestamp(files []string, timestamp int64) bool {
+	for i, f := range files {
+		offset, err := aof.TimestampOffset(f, timestamp)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		if offset < 0 {
+			continue
+		}
+		if i != len(files)-1 {
+			fmt.Printf("Timestamp %d is in AOF %s which is not the last file, can not truncate\n", timestamp, f)
+			return false
+		}
+		if err := os.Truncate(f, offset); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to truncate AOF %s: %v\n", f, err)
+			return false
+		}
+		fmt.Printf("Successfully truncated AOF %s to timestamp %d at offset %d\n", f, timestamp, offset)
+		return true
+	}
+	fmt.Printf("No timestamp annotation later than %d, nothing to truncate\n", timestamp)
+	return true
+}
+
+// checkFile 检查一个文件，文件完整或者修复成功时返回 true。
+// 只有最后一个文件可以截断，截断中间的文件会丢失之后文件所依赖的数据
+func checkFile(filename string, last bool) bool {
+	result, err := aof.CheckFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	if result.RDBErr != nil {
+		fmt.Printf("RDB preamble of AOF %s is not valid: %v\n", filename, result.RDBErr)
+		fmt.Println("RDB preamble can not be fixed")
+		return false
+	}
+	okUpTo := result.Size
+	if result.Err != nil {
+		okUpTo = result.Err.Offset
+	}
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, rdb_preamble=%d, commands=%d, ok_up_to=%d, diff=%d\n",
+		filename, result.Size, result.RDBSize, result.Commands, okUpTo, result.Size-okUpTo)
+	if result.Valid() {
+		fmt.Printf("AOF %s is valid\n", filename)
+		return true
+	}
+	fmt.Printf("Bad command at offset %d: %s\n", result.Err.Offset, result.Err.Reason)
+	if !*fix {
+		fmt.Printf("AOF %s is not valid. Use the --fix option to try fixing it.\n", filename)
+		return false
+	}
+	if !last {
+		fmt.Printf("AOF %s is not the last file in the manifest and can not be fixed\n", filename)
+		return false
+	}
+	if err := os.Truncate(filename, result.Err.Offset); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to truncate AOF %s: %v\n", filename, err)
+		return false
+	}
+	fmt.Printf("Successfully truncated AOF %s to offset %d\n", filename, result.Err.Offset)
+	return true
+}
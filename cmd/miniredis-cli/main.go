@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/client"
+	"miniRedis/redis/parser"
+	"miniRedis/redis/protocol"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * miniredis-cli 是 miniRedis 的命令行客户端，用法与 redis-cli 类似：
+ *   miniredis-cli                          进入交互模式
+ *   miniredis-cli [options] cmd [arg ...]  执行一条命令后退出，可以配合 -r/-i 重复执行
+ *   miniredis-cli --pipe < data.resp       批量导入 RESP 格式的命令
+ *   miniredis-cli --scan --pattern 'user:*'
+ *   miniredis-cli --bigkeys
+ */
+
+var (
+	host     = flag.String("h", "127.0.0.1", "Server hostname")
+	port     = flag.Int("p", 6379, "Server port")
+	password = flag.String("a", "", "Password to use when connecting to the server")
+	dbIndex  = flag.Int("n", 0, "Database number")
+	repeat   = flag.Int("r", 1, "Execute specified command N times, negative means forever")
+	interval = flag.Float64("i", 0, "When -r is used, waits <interval> seconds per command")
+	rawMode  = flag.Bool("raw", false, "Use raw formatting for replies (default when STDOUT is not a tty)")
+	pipeMode = flag.Bool("pipe", false, "Transfer raw Redis protocol from stdin to server")
+	scanMode = flag.Bool("scan", false, "List all keys using the SCAN command")
+	pattern  = flag.String("pattern", "*", "Keys pattern when using the --scan or --bigkeys options")
+	count    = flag.Int("count", 100, "Count option when using the --scan or --bigkeys options")
+	bigKeys  = flag.Bool("bigkeys", false, "Sample Redis keys looking for keys with many elements (complexity)")
+)
+
+// cli 保存与服务器的连接以及连接的状态，断线后会使用相同的密码和数据库重新连接
+type cli struct {
+	addr     string
+	password string
+	db       int
+	raw      bool
+	client   *client.Client
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: miniredis-cli [OPTIONS] [cmd [arg [arg ...]]]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	c := &cli{
+		addr:     net.JoinHostPort(*host, strconv.Itoa(*port)),
+		password: *password,
+		db:       *dbIndex,
+		raw:      *rawMode || !isTerminal(os.Stdout),
+	}
+	var err error
+	switch {
+	case *pipeMode:
+		err = c.pipe(os.Stdin)
+	case *scanMode:
+		err = c.scan(*pattern, *count)
+	case *bigKeys:
+		err = c.findBigKeys(*pattern, *count)
+	case flag.NArg() > 0:
+		err = c.runCommand(toCmdLine(flag.Args()), *repeat, time.Duration(*interval*float64(time.Second)))
+	default:
+		c.repl()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// connect 建立连接并恢复认证和数据库选择
+func (c *cli) connect() error {
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+	cl, err := client.MakeClient(c.addr)
+	if err != nil {
+		return fmt.Errorf("Could not connect to Redis at %s: %v", c.addr, err)
+	}
+	cl.Start()
+	if c.password != "" {
+		if reply := cl.Send(utils.ToCmdLine("AUTH", c.password)); isError(reply) {
+			cl.Close()
+			return fmt.Errorf("AUTH failed: %s", reply.(protocol.ErrorReply).Error())
+		}
+	}
+	if c.db != 0 {
+		if reply := cl.Send(utils.ToCmdLine("SELECT", strconv.Itoa(c.db))); isError(reply) {
+			cl.Close()
+			return fmt.Errorf("SELECT failed: %s", reply.(protocol.ErrorReply).Error())
+		}
+	}
+	c.client = cl
+	return nil
+}
+
+// send 发送一条命令，未连接或者连接已经关闭时先尝试重新连接
+func (c *cli) send(args [][]byte) (redis.Reply, error) {
+	if c.client == nil || c.client.IsClosed() {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	// 和 redis-cli 一样一直等待回复，BLPOP、LOCK ... WAIT 等命令可能阻塞很久
+	reply := c.client.SendWithTimeout(args, 0)
+	if strings.EqualFold(string(args[0]), "select") && len(args) == 2 && !isError(reply) {
+		c.db, _ = strconv.Atoi(string(args[1]))
+	}
+	return reply, nil
+}
+
+// runCommand 执行一条命令 times 次，times 为负数时一直执行
+func (c *cli) runCommand(args [][]byte, times int, wait time.Duration) error {
+	if isSubscribeCommand(args) {
+		return c.subscribe(args)
+	}
+	for i := 0; times < 0 || i < times; i++ {
+		reply, err := c.send(args)
+		if err != nil {
+			return err
+		}
+		fmt.Print(formatReply(reply, c.raw))
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return nil
+}
+
+func isSubscribeCommand(args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	return name == "subscribe" || name == "psubscribe"
+}
+
+// subscribe 进入订阅模式，使用单独的连接输出收到的所有消息，直到连接断开或者进程被中断
+func (c *cli) subscribe(args [][]byte) error {
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return fmt.Errorf("Could not connect to Redis at %s: %v", c.addr, err)
+	}
+	defer conn.Close()
+	if c.password != "" {
+		if _, err = conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("AUTH", c.password)).ToBytes()); err != nil {
+			return err
+		}
+	}
+	if _, err = conn.Write(protocol.MakeMultiBulkReply(args).ToBytes()); err != nil {
+		return err
+	}
+	if !c.raw {
+		fmt.Println("Reading messages... (press Ctrl-C to quit)")
+	}
+	authReplied := c.password == ""
+	for payload := range parser.ParseStream(conn) {
+		if payload.Err != nil {
+			return payload.Err
+		}
+		if !authReplied {
+			authReplied = true
+			if isError(payload.Data) {
+				return errors.New(payload.Data.(protocol.ErrorReply).Error())
+			}
+			continue
+		}
+		fmt.Print(formatReply(payload.Data, c.raw))
+	}
+	return nil
+}
+
+func toCmdLine(args []string) [][]byte {
+	return utils.ToCmdLine(args...)
+}
+
+func isError(reply redis.Reply) bool {
+	_, ok := reply.(protocol.ErrorReply)
+	return ok
+}
+
+// isTerminal 判断文件是否是终端，用于决定是否显示提示符以及回复的格式
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"miniRedis/interface/redis"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// formatReply 将回复转换为适合阅读的文本，raw 为 true 时输出原始内容，便于在脚本中使用
+func formatReply(reply redis.Reply, raw bool) string {
+	if raw {
+		return formatRaw(reply)
+	}
+	return formatTTY(reply, "")
+}
+
+// toReplies 将 MultiBulkReply 中的元素统一转换为 reply，nil 元素表示空值
+func toReplies(args [][]byte) []redis.Reply {
+	replies := make([]redis.Reply, len(args))
+	for i, arg := range args {
+		if arg == nil {
+			replies[i] = protocol.MakeNullBulkReply()
+		} else {
+			replies[i] = protocol.MakeBulkReply(arg)
+		}
+	}
+	return replies
+}
+
+// formatTTY 使用与 redis-cli 相同的格式输出，嵌套数组的元素按照序号缩进对齐
+func formatTTY(reply redis.Reply, prefix string) string {
+	if errReply, ok := reply.(protocol.ErrorReply); ok {
+		return "(error) " + errReply.Error() + "\n"
+	}
+	switch r := reply.(type) {
+	case *protocol.StatusReply:
+		return r.Status + "\n"
+	case *protocol.IntReply:
+		return "(integer) " + strconv.FormatInt(r.Code, 10) + "\n"
+	case *protocol.BulkReply:
+		return repr(r.Arg) + "\n"
+	case *protocol.NullBulkReply, *protocol.NullMultiBulkReply:
+		return "(nil)\n"
+	case *protocol.EmptyMultiBulkReply:
+		return "(empty array)\n"
+	case *protocol.MultiBulkReply:
+		return formatArray(toReplies(r.Args), prefix)
+	case *protocol.MultiRawReply:
+		return formatArray(r.Replies, prefix)
+	}
+	// 其余的回复类型直接使用协议内容
+	return strings.TrimRight(string(reply.ToBytes()), "\r\n") + "\n"
+}
+
+func formatArray(replies []redis.Reply, prefix string) string {
+	if len(replies) == 0 {
+		return "(empty array)\n"
+	}
+	width := len(strconv.Itoa(len(replies)))
+	var sb strings.Builder
+	for i, element := range replies {
+		index := strconv.Itoa(i + 1)
+		index = strings.Repeat(" ", width-len(index)) + index + ") "
+		if i > 0 {
+			sb.WriteString(prefix)
+		}
+		sb.WriteString(index)
+		sb.WriteString(formatTTY(element, prefix+strings.Repeat(" ", len(index))))
+	}
+	return sb.String()
+}
+
+func formatRaw(reply redis.Reply) string {
+	if errReply, ok := reply.(protocol.ErrorReply); ok {
+		return errReply.Error() + "\n"
+	}
+	switch r := reply.(type) {
+	case *protocol.StatusReply:
+		return r.Status + "\n"
+	case *protocol.IntReply:
+		return strconv.FormatInt(r.Code, 10) + "\n"
+	case *protocol.BulkReply:
+		return string(r.Arg) + "\n"
+	case *protocol.NullBulkReply, *protocol.NullMultiBulkReply, *protocol.EmptyMultiBulkReply:
+		return "\n"
+	case *protocol.MultiBulkReply:
+		return formatRawArray(toReplies(r.Args))
+	case *protocol.MultiRawReply:
+		return formatRawArray(r.Replies)
+	}
+	return strings.TrimRight(string(reply.ToBytes()), "\r\n") + "\n"
+}
+
+func formatRawArray(replies []redis.Reply) string {
+	var sb strings.Builder
+	for _, element := range replies {
+		sb.WriteString(formatRaw(element))
+	}
+	return sb.String()
+}
+
+// repr 返回带引号的字符串，不可打印的字符使用转义表示
+func repr(s []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString("\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case '\t':
+			sb.WriteString("\\t")
+		case '\a':
+			sb.WriteString("\\a")
+		case '\b':
+			sb.WriteString("\\b")
+		default:
+			if c >= 0x20 && c < 0x7f {
+				sb.WriteByte(c)
+			} else {
+				sb.WriteString("\\x")
+				sb.WriteString(strconv.FormatUint(uint64(c)>>4, 16))
+				sb.WriteString(strconv.FormatUint(uint64(c)&0xf, 16))
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
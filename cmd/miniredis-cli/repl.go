@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	historyFileName = ".miniredis_cli_history"
+	maxHistory      = 1000
+)
+
+// history 保存交互模式下输入过的命令，并持久化到用户目录下的文件中
+// 由于没有使用行编辑库，历史命令通过 HISTORY 查看，并通过 !! 或 !<n> 重新执行
+type history struct {
+	lines []string
+	file  *os.File
+}
+
+func loadHistory() *history {
+	h := &history{}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return h
+	}
+	path := filepath.Join(home, historyFileName)
+	if data, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				h.lines = append(h.lines, line)
+			}
+		}
+		if len(h.lines) > maxHistory {
+			h.lines = h.lines[len(h.lines)-maxHistory:]
+		}
+	}
+	h.file, _ = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	return h
+}
+
+func (h *history) add(line string) {
+	if len(h.lines) > 0 && h.lines[len(h.lines)-1] == line {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if len(h.lines) > maxHistory {
+		h.lines = h.lines[1:]
+	}
+	if h.file != nil {
+		_, _ = h.file.WriteString(line + "\n")
+	}
+}
+
+// expand 将 !! 和 !<n> 替换为对应的历史命令
+func (h *history) expand(line string) (string, error) {
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+	if len(h.lines) == 0 {
+		return "", fmt.Errorf("%s: event not found", line)
+	}
+	if line == "!!" {
+		return h.lines[len(h.lines)-1], nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(h.lines) {
+		return "", fmt.Errorf("%s: event not found", line)
+	}
+	return h.lines[n-1], nil
+}
+
+func (h *history) print() {
+	for i, line := range h.lines {
+		fmt.Printf("%5d  %s\n", i+1, line)
+	}
+}
+
+func (h *history) close() {
+	if h.file != nil {
+		_ = h.file.Close()
+	}
+}
+
+func (c *cli) prompt() string {
+	if c.client == nil || c.client.IsClosed() {
+		return "not connected> "
+	}
+	if c.db != 0 {
+		return fmt.Sprintf("%s[%d]> ", c.addr, c.db)
+	}
+	return c.addr + "> "
+}
+
+// repl 逐行读取标准输入并执行，标准输入不是终端时不输出提示符，也不记录历史
+func (c *cli) repl() {
+	interactive := isTerminal(os.Stdin)
+	var hist *history
+	if interactive {
+		hist = loadHistory()
+		defer hist.close()
+	}
+	if err := c.connect(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), 512*1024*1024)
+	for {
+		if interactive {
+			fmt.Print(c.prompt())
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if hist != nil {
+			expanded, err := hist.expand(line)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if expanded != line {
+				fmt.Println(expanded)
+				line = expanded
+			}
+			hist.add(line)
+		}
+
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToLower(string(args[0])) {
+		case "quit", "exit":
+			return
+		case "clear":
+			fmt.Print("\033[H\033[2J")
+			continue
+		case "history":
+			if hist != nil {
+				hist.print()
+			}
+			continue
+		}
+
+		// 与 redis-cli 相同，以数字开头的命令会被重复执行指定的次数
+		times := 1
+		if n, err := strconv.Atoi(string(args[0])); err == nil && len(args) > 1 {
+			times = n
+			args = args[1:]
+		}
+		if err := c.runCommand(args, times, time.Duration(*interval*float64(time.Second))); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
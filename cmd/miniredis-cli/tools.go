@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/parser"
+	"miniRedis/redis/protocol"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// pipe 将 reader 中的 RESP 数据原样发送给服务器，最后发送一个带随机标记的 PING，
+// 收到标记的回复说明之前的命令都已经执行完毕
+func (c *cli) pipe(reader io.Reader) error {
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return fmt.Errorf("Could not connect to Redis at %s: %v", c.addr, err)
+	}
+	defer conn.Close()
+
+	mark := utils.RandString(20)
+	writeErr := make(chan error, 1)
+	go func() {
+		if c.password != "" {
+			if _, err := conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("AUTH", c.password)).ToBytes()); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		if _, err := io.Copy(conn, reader); err != nil {
+			writeErr <- err
+			return
+		}
+		_, err := conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("PING", mark)).ToBytes())
+		if err == nil {
+			fmt.Fprintln(os.Stderr, "All data transferred. Waiting for the last reply...")
+		}
+		writeErr <- err
+	}()
+
+	authReplied := c.password == ""
+	var replies, errs int64
+	done := false
+	for payload := range parser.ParseStream(conn) {
+		if payload.Err != nil {
+			return payload.Err
+		}
+		if !authReplied {
+			authReplied = true
+			if isError(payload.Data) {
+				return errors.New(payload.Data.(protocol.ErrorReply).Error())
+			}
+			continue
+		}
+		if status, ok := payload.Data.(*protocol.StatusReply); ok && status.Status == mark {
+			done = true
+			break
+		}
+		replies++
+		if isError(payload.Data) {
+			errs++
+			fmt.Fprint(os.Stderr, formatReply(payload.Data, true))
+		}
+	}
+	if err := <-writeErr; err != nil {
+		return err
+	}
+	if !done {
+		return errors.New("connection closed before the last reply")
+	}
+	fmt.Fprintln(os.Stderr, "Last reply received from server.")
+	fmt.Fprintf(os.Stderr, "errors: %d, replies: %d\n", errs, replies)
+	if errs > 0 {
+		return errors.New("some commands failed")
+	}
+	return nil
+}
+
+// scanKeys 使用 SCAN 命令遍历所有匹配的 key，每一批 key 交给 fn 处理
+func (c *cli) scanKeys(pattern string, count int, fn func(keys [][]byte) error) error {
+	cursor := "0"
+	for {
+		reply, err := c.send(utils.ToCmdLine("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(count)))
+		if err != nil {
+			return err
+		}
+		if errReply, ok := reply.(protocol.ErrorReply); ok {
+			return errors.New(errReply.Error())
+		}
+		raw, ok := reply.(*protocol.MultiRawReply)
+		if !ok || len(raw.Replies) != 2 {
+			return errors.New("unexpected reply of SCAN: " + string(reply.ToBytes()))
+		}
+		next, ok := raw.Replies[0].(*protocol.BulkReply)
+		if !ok {
+			return errors.New("unexpected cursor of SCAN: " + string(raw.Replies[0].ToBytes()))
+		}
+		var keys [][]byte
+		switch r := raw.Replies[1].(type) {
+		case *protocol.MultiBulkReply:
+			keys = r.Args
+		case *protocol.MultiRawReply:
+			for _, element := range r.Replies {
+				if bulk, ok := element.(*protocol.BulkReply); ok {
+					keys = append(keys, bulk.Arg)
+				}
+			}
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		cursor = string(next.Arg)
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+func (c *cli) scan(pattern string, count int) error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+	return c.scanKeys(pattern, count, func(keys [][]byte) error {
+		for _, key := range keys {
+			fmt.Println(string(key))
+		}
+		return nil
+	})
+}
+
+// bigKeyType 描述每种数据结构的统计方式
+type bigKeyType struct {
+	name    string
+	sizeCmd string
+	unit    string
+}
+
+var bigKeyTypes = []*bigKeyType{
+	{name: "string", sizeCmd: "STRLEN", unit: "bytes"},
+	{name: "list", sizeCmd: "LLEN", unit: "items"},
+	{name: "set", sizeCmd: "SCARD", unit: "members"},
+	{name: "zset", sizeCmd: "ZCARD", unit: "members"},
+	{name: "hash", sizeCmd: "HLEN", unit: "fields"},
+}
+
+type bigKeyStat struct {
+	count     int64
+	totalSize int64
+	biggest   string
+	maxSize   int64
+}
+
+// findBigKeys 遍历所有 key，找出每种数据结构中最大的 key，并统计每种数据结构的数量和平均大小
+// 每批 key 的 TYPE 和长度命令都使用 pipeline 发送
+func (c *cli) findBigKeys(pattern string, count int) error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Println("# Scanning the entire keyspace to find biggest keys as well as")
+	fmt.Println("# average sizes per key type.")
+	fmt.Println()
+
+	types := make(map[string]*bigKeyType)
+	stats := make(map[string]*bigKeyStat)
+	for _, t := range bigKeyTypes {
+		types[t.name] = t
+		stats[t.name] = &bigKeyStat{}
+	}
+	var sampled, totalKeyLen int64
+	err := c.scanKeys(pattern, count, func(keys [][]byte) error {
+		cmdLines := make([][][]byte, len(keys))
+		for i, key := range keys {
+			cmdLines[i] = [][]byte{[]byte("TYPE"), key}
+		}
+		typeReplies := c.client.Pipeline(cmdLines)
+
+		sizeKeys := make([][]byte, 0, len(keys))
+		sizeTypes := make([]*bigKeyType, 0, len(keys))
+		cmdLines = cmdLines[:0]
+		for i, reply := range typeReplies {
+			status, ok := reply.(*protocol.StatusReply)
+			if !ok {
+				continue
+			}
+			t, ok := types[status.Status]
+			if !ok {
+				continue // key 已经被删除或者是未知的类型
+			}
+			sizeKeys = append(sizeKeys, keys[i])
+			sizeTypes = append(sizeTypes, t)
+			cmdLines = append(cmdLines, [][]byte{[]byte(t.sizeCmd), keys[i]})
+		}
+		sizeReplies := c.client.Pipeline(cmdLines)
+
+		for i, reply := range sizeReplies {
+			intReply, ok := reply.(*protocol.IntReply)
+			if !ok {
+				continue
+			}
+			t, key, size := sizeTypes[i], string(sizeKeys[i]), intReply.Code
+			stat := stats[t.name]
+			sampled++
+			totalKeyLen += int64(len(key))
+			stat.count++
+			stat.totalSize += size
+			if stat.biggest == "" || size > stat.maxSize {
+				stat.biggest, stat.maxSize = key, size
+				fmt.Printf("Biggest %-6s found so far %s with %d %s\n", t.name, repr([]byte(key)), size, t.unit)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Println("-------- summary -------")
+	fmt.Println()
+	fmt.Printf("Sampled %d keys in the keyspace!\n", sampled)
+	fmt.Printf("Total key length in bytes is %d (avg len %.2f)\n", totalKeyLen, average(totalKeyLen, sampled))
+	fmt.Println()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if stat := stats[name]; stat.biggest != "" {
+			fmt.Printf("Biggest %6s found %s has %d %s\n", name, repr([]byte(stat.biggest)), stat.maxSize, types[name].unit)
+		}
+	}
+	fmt.Println()
+	for _, name := range names {
+		stat := stats[name]
+		fmt.Printf("%d %ss with %d %s (%.2f%% of keys, avg size %.2f)\n",
+			stat.count, name, stat.totalSize, types[name].unit,
+			average(stat.count*100, sampled), average(stat.totalSize, stat.count))
+	}
+	return nil
+}
+
+func average(total, n int64) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(total) / float64(n)
+}
@@ -26,6 +26,25 @@ type ServerProperties struct {
 	SlaveAnnouncePort int    `cfg:"slave-announce-port"` // 从服务器向主服务器宣告自己的端口号。
 	SlaveAnnounceIP   string `cfg:"slave-announce-ip"`   // 从服务器向主服务器宣告自己的 IP 地址。
 	ReplTimeout       int    `cfg:"repl-timeout"`        //主从复制模式下复制超时时间。
+	MetricsPort       int    `cfg:"metrics-port"`        // Prometheus 指标的 HTTP 端口，为 0 时不开启。
+
+	// AOF 持久化的配置属性
+	AppendDirname            string `cfg:"appenddirname"`               // 保存 AOF base 文件、增量文件和清单的目录。
+	AofUseRdbPreamble        bool   `cfg:"aof-use-rdb-preamble"`        // AOF 重写时是否以 RDB 格式保存 base 文件。
+	AofLoadTruncated         bool   `cfg:"aof-load-truncated"`          // AOF 末尾的命令不完整时是否截断后继续启动。
+	AofTimestampEnabled      bool   `cfg:"aof-timestamp-enabled"`       // 是否在 AOF 中写入时间戳注释。
+	AofTruncateToTimestamp   int    `cfg:"aof-truncate-to-timestamp"`   // AOF 中有晚于这个时间戳的数据时拒绝启动，为 0 时不检查。截断需要使用 miniredis-check-aof。
+	AutoAofRewritePercentage int    `cfg:"auto-aof-rewrite-percentage"` // AOF 相对于上次重写之后增长的百分比超过这个值时自动重写，为 0 时不自动重写。
+	AutoAofRewriteMinSize    int    `cfg:"auto-aof-rewrite-min-size"`   // 自动重写时 AOF 的最小字节数。
+
+	// RDB 持久化的配置属性
+	Save                    string `cfg:"save"`                        // 自动保存 RDB 的条件，格式为 "<seconds> <changes> ..."，为空时不自动保存。
+	Dir                     string `cfg:"dir"`                         // 保存带时间戳的 RDB 文件的目录，为空时使用 dbfilename 所在的目录。
+	RDBRetention            int    `cfg:"rdb-retention"`               // 保留最近几个带时间戳的 RDB 文件，为 0 时只保存 dbfilename。
+	StopWritesOnBgsaveError bool   `cfg:"stop-writes-on-bgsave-error"` // 配置了自动保存并且上次保存失败时是否拒绝写命令。
+
+	// CDC 的配置属性
+	CDCBacklogSize int `cfg:"cdc-backlog-size"` // 在内存中保留的 CDC 事件数量，为 0 时不开启 CDC。
 
 	// 集群模式下的配置属性
 	ClusterEnabled string   `cfg:"cluster-enabled"` // 是否开启集群模式。
@@ -50,9 +69,16 @@ func init() {
 	}
 
 	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
-		RunID:      utils.RandString(40),
+		Bind:                     "127.0.0.1",
+		Port:                     6379,
+		AppendOnly:               false,
+		AppendFilename:           "appendonly.aof",
+		AppendDirname:            "appendonlydir",
+		AofUseRdbPreamble:        true,
+		AofLoadTruncated:         true,
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    64 << 20,
+		StopWritesOnBgsaveError:  true,
+		RunID:                    utils.RandString(40),
 	}
 }
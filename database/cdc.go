@@ -0,0 +1,187 @@
+package database
+
+import (
+	"context"
+	"miniRedis/cdc"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/logger"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+/*
+ * CDC 命令将变更事件推送给客户端，用法与 SUBSCRIBE 类似，连接进入推送模式之后应当只用于接收事件：
+ *   CDC FROM <offset>  从 offset 开始推送事件，offset 为 0 时从保留的最早的事件开始
+ *   CDC STOP           停止推送，返回下一个未推送的事件的偏移量
+ *   CDC OFFSET         返回下一个事件的偏移量
+ * 推送的事件格式为 ["event", offset, db, command, [keys...], [command line...]]
+ */
+
+// cdcStream 是一个连接上正在进行的事件推送
+type cdcStream struct {
+	subscriber *cdc.Subscriber
+	connClosed <-chan struct{} // 开始推送时连接的 CloseNotify
+	stopped    chan struct{}
+}
+
+// ChangeFeed 返回变更事件的 Feed，没有开启 CDC 时返回 nil
+func (server *Server) ChangeFeed() *cdc.Feed {
+	return server.changeFeed
+}
+
+// commandKeys 使用命令的 prepare 函数找出写命令修改的 key
+func commandKeys(cmdLine [][]byte) []string {
+	cmd := lookupCommand(string(cmdLine[0]))
+	if cmd == nil || cmd.prepare == nil || !validateArity(cmd.arity, cmdLine) {
+		return nil
+	}
+	write, _ := cmd.prepare(cmdLine[1:])
+	return write
+}
+
+func makeCDCEvent(event *cdc.Event) []byte {
+	keys := make([][]byte, len(event.Keys))
+	for i, key := range event.Keys {
+		keys[i] = []byte(key)
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("event")),
+		protocol.MakeIntReply(int64(event.Offset)),
+		protocol.MakeIntReply(int64(event.DBIndex)),
+		protocol.MakeBulkReply([]byte(event.Command)),
+		protocol.MakeMultiBulkReply(keys),
+		protocol.MakeMultiBulkReply(event.CmdLine),
+	}).ToBytes()
+}
+
+func makeCDCOffsetReply(kind string, offset uint64) redis.Reply {
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(kind)),
+		protocol.MakeIntReply(int64(offset)),
+	})
+}
+
+func (server *Server) execCDC(c redis.Connection, args [][]byte) redis.Reply {
+	if server.changeFeed == nil {
+		return protocol.MakeErrReply("ERR CDC is disabled, set cdc-backlog-size to enable it")
+	}
+	if c != nil && c.InMultiState() {
+		return protocol.MakeErrReply("ERR command 'CDC' cannot be used in MULTI")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "from":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("cdc|from")
+		}
+		from, err := strconv.ParseUint(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		return server.startCDCStream(c, from)
+	case "stop":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("cdc|stop")
+		}
+		offset, ok := server.stopCDCStream(c)
+		if !ok {
+			return protocol.MakeErrReply("ERR no CDC stream on this connection")
+		}
+		return makeCDCOffsetReply("stop", offset)
+	case "offset":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("cdc|offset")
+		}
+		return protocol.MakeIntReply(int64(server.changeFeed.Offset()))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CDC FROM, CDC STOP, CDC OFFSET.")
+}
+
+// startCDCStream 在后台协程中将事件写入连接，连接关闭或者写入失败时结束推送
+func (server *Server) startCDCStream(c redis.Connection, from uint64) redis.Reply {
+	subscriber, err := server.changeFeed.Subscribe(from)
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + strings.TrimPrefix(err.Error(), "cdc: "))
+	}
+	stream := &cdcStream{
+		subscriber: subscriber,
+		connClosed: c.CloseNotify(),
+		stopped:    make(chan struct{}),
+	}
+	server.cdcMu.Lock()
+	if old, ok := server.cdcStreams[c]; ok && !old.isConnClosed() {
+		server.cdcMu.Unlock()
+		subscriber.Close()
+		return protocol.MakeErrReply("ERR CDC stream is already started on this connection")
+	}
+	// 连接对象会被复用，已经关闭的连接上的推送可能还没有退出
+	server.cdcStreams[c] = stream
+	server.cdcMu.Unlock()
+
+	// 先写入确认消息，保证它在所有事件之前
+	_, _ = c.Write(makeCDCOffsetReply("from", subscriber.Offset()).ToBytes())
+	go server.runCDCStream(c, stream)
+	return &protocol.NoReply{}
+}
+
+func (server *Server) runCDCStream(c redis.Connection, stream *cdcStream) {
+	defer close(stream.stopped)
+	defer func() {
+		server.cdcMu.Lock()
+		if server.cdcStreams[c] == stream {
+			delete(server.cdcStreams, c)
+		}
+		server.cdcMu.Unlock()
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if stream.connClosed != nil {
+		go func() {
+			select {
+			case <-stream.connClosed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	for {
+		event, err := stream.subscriber.Next(ctx)
+		if err == cdc.ErrClosed || err == context.Canceled {
+			return
+		}
+		if err != nil {
+			logger.Warn("cdc stream of " + c.Name() + " stopped: " + err.Error())
+			_, _ = c.Write(protocol.MakeErrReply("ERR " + strings.TrimPrefix(err.Error(), "cdc: ")).ToBytes())
+			return
+		}
+		if stream.isConnClosed() {
+			return
+		}
+		if _, err := c.Write(makeCDCEvent(event)); err != nil {
+			return
+		}
+	}
+}
+
+func (stream *cdcStream) isConnClosed() bool {
+	select {
+	case <-stream.connClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopCDCStream 停止连接上的推送，返回下一个未推送的事件的偏移量
+func (server *Server) stopCDCStream(c redis.Connection) (uint64, bool) {
+	server.cdcMu.Lock()
+	stream, ok := server.cdcStreams[c]
+	server.cdcMu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	stream.subscriber.Close()
+	<-stream.stopped
+	return stream.subscriber.Offset(), true
+}
@@ -0,0 +1,352 @@
+package database
+
+import (
+	"miniRedis/interface/redis"
+	"miniRedis/lib/wildcard"
+	"miniRedis/redis/protocol"
+	"sort"
+	"strings"
+)
+
+/*
+ * COMMAND 命令返回命令的元信息：参数数量、标志、key 的位置、key spec 和 ACL 分类，
+ * 客户端（例如集群代理）可以据此在不理解命令语义的情况下找到命令中的 key
+ */
+
+// flagNoData 表示命令不访问数据库中的数据，例如 PING、SELECT，COMMAND 不会将它们标记为 readonly
+const flagNoData = 2
+
+// systemCmdTable 记录由 Server.Exec 和 DB.Exec 直接处理、没有注册到 cmdTable 中的命令，
+// 这些命令的 executor 为空，只用于命令统计和 COMMAND 命令
+var systemCmdTable = make(map[string]*command)
+
+func registerSystemCommand(name string, prepare PreFunc, arity int, flags int, category string) *command {
+	cmd := &command{
+		name:     name,
+		prepare:  prepare,
+		arity:    arity,
+		flags:    flags,
+		category: category,
+	}
+	systemCmdTable[name] = cmd
+	return cmd
+}
+
+// prepareCopy COPY source destination [DB destination-db] [REPLACE]
+func prepareCopy(args [][]byte) ([]string, []string) {
+	return []string{string(args[1])}, []string{string(args[0])}
+}
+
+func init() {
+	const noData = flagReadOnly | flagNoData
+	registerSystemCommand("ping", noPrepare, -1, noData, "connection").attachFlags("fast", "stale")
+	registerSystemCommand("auth", noPrepare, -2, noData, "connection").attachFlags("noscript", "loading", "stale", "fast")
+	registerSystemCommand("info", noPrepare, -1, noData, "dangerous").attachFlags("loading", "stale")
+	registerSystemCommand("command", noPrepare, -1, noData, "connection").attachFlags("loading", "stale")
+	registerSystemCommand("module", noPrepare, -2, noData, "dangerous").attachFlags("admin", "noscript")
+	registerSystemCommand("select", noPrepare, 2, noData, "connection").attachFlags("noscript", "loading", "stale", "fast")
+	registerSystemCommand("subscribe", noPrepare, -2, noData, "pubsub").attachFlags("pubsub", "noscript", "loading", "stale")
+	registerSystemCommand("unsubscribe", noPrepare, -1, noData, "pubsub").attachFlags("pubsub", "noscript", "loading", "stale")
+	registerSystemCommand("publish", noPrepare, 3, noData, "pubsub").attachFlags("pubsub", "loading", "stale", "fast")
+	registerSystemCommand("bgrewriteaof", noPrepare, 1, noData, "dangerous").attachFlags("admin", "noscript")
+	registerSystemCommand("rewriteaof", noPrepare, 1, noData, "dangerous").attachFlags("admin", "noscript")
+	registerSystemCommand("save", noPrepare, 1, noData, "dangerous").attachFlags("admin", "noscript")
+	registerSystemCommand("bgsave", noPrepare, -1, noData, "dangerous").attachFlags("admin", "noscript")
+	registerSystemCommand("cdc", noPrepare, -2, noData, "dangerous").attachFlags("admin", "noscript", "loading", "stale")
+	registerSystemCommand("lastsave", noPrepare, 1, noData, "dangerous").attachFlags("loading", "stale", "fast")
+	registerSystemCommand("multi", noPrepare, 1, noData, "transaction").attachFlags("noscript", "loading", "stale", "fast")
+	registerSystemCommand("exec", noPrepare, 1, noData, "transaction").attachFlags("noscript", "loading", "stale")
+	registerSystemCommand("discard", noPrepare, 1, noData, "transaction").attachFlags("noscript", "loading", "stale", "fast")
+	registerSystemCommand("watch", readAllKeys, -2, flagReadOnly, "transaction").
+		attachKeys(1, -1, 1).attachFlags("noscript", "loading", "stale", "fast")
+	registerSystemCommand("unwatch", noPrepare, 1, noData, "transaction").attachFlags("noscript", "loading", "stale", "fast")
+	// 以下命令由 Server 直接处理，不经过脚本加锁的数据库，因此不允许在脚本中调用
+	registerSystemCommand("flushall", noPrepare, -1, flagWrite, "keyspace").attachFlags("noscript")
+	registerSystemCommand("flushdb", noPrepare, -1, flagWrite, "keyspace").attachFlags("noscript")
+	registerSystemCommand("swapdb", noPrepare, 3, flagWrite, "keyspace").attachFlags("noscript", "fast")
+	registerSystemCommand("copy", prepareCopy, -3, flagWrite, "keyspace").attachKeys(1, 2, 1).attachFlags("noscript")
+	registerSystemCommand("move", writeFirstKey, 3, flagWrite, "keyspace").attachKeys(1, 1, 1).attachFlags("noscript", "fast")
+	registerSystemCommand("eval", prepareEval, -3, noData, "scripting").attachMovableKeys().
+		attachFlags("noscript", "stale", "skip_monitor", "may_replicate", "no_mandatory_keys")
+	registerSystemCommand("evalsha", prepareEval, -3, noData, "scripting").attachMovableKeys().
+		attachFlags("noscript", "stale", "skip_monitor", "may_replicate", "no_mandatory_keys")
+	registerSystemCommand("script", noPrepare, -2, noData, "scripting").attachFlags("noscript")
+}
+
+// allCommands 返回所有命令，按照命令名排序
+func allCommands() []*command {
+	cmds := make([]*command, 0, len(cmdTable)+len(systemCmdTable))
+	for _, cmd := range cmdTable {
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range systemCmdTable {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].name < cmds[j].name
+	})
+	return cmds
+}
+
+func (cmd *command) flagNames() []string {
+	var names []string
+	if cmd.flags&flagReadOnly == 0 {
+		names = append(names, "write")
+	} else if cmd.flags&flagNoData == 0 {
+		names = append(names, "readonly")
+	}
+	names = append(names, cmd.extraFlags...)
+	if cmd.movableKeys {
+		names = append(names, "movablekeys")
+	}
+	return names
+}
+
+func (cmd *command) categories() []string {
+	var categories []string
+	if cmd.flags&flagNoData == 0 {
+		if cmd.flags&flagReadOnly == 0 {
+			categories = append(categories, "@write")
+		} else {
+			categories = append(categories, "@read")
+		}
+	}
+	if cmd.category != "" {
+		categories = append(categories, "@"+cmd.category)
+	}
+	for _, flag := range cmd.extraFlags {
+		switch flag {
+		case "fast":
+			categories = append(categories, "@fast")
+		case "admin":
+			categories = append(categories, "@admin")
+		}
+	}
+	return categories
+}
+
+func makeStatusArray(values []string) redis.Reply {
+	replies := make([]redis.Reply, len(values))
+	for i, v := range values {
+		replies[i] = protocol.MakeStatusReply(v)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+func makeBulkArray(values []string) redis.Reply {
+	args := make([][]byte, len(values))
+	for i, v := range values {
+		args[i] = []byte(v)
+	}
+	return protocol.MakeMultiBulkReply(args)
+}
+
+// keySpecs 根据 key 的位置生成 key spec，key 位置不固定的命令使用 unknown 类型，需要通过 GETKEYS 获得 key
+func (cmd *command) keySpecs() redis.Reply {
+	if cmd.firstKey == 0 && !cmd.movableKeys {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	access := []string{"RO", "ACCESS"}
+	if cmd.flags&flagReadOnly == 0 {
+		access = []string{"RW", "UPDATE"}
+	}
+	var beginSearch, findKeys redis.Reply
+	if cmd.firstKey > 0 {
+		beginSearch = protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("type")), protocol.MakeBulkReply([]byte("index")),
+			protocol.MakeBulkReply([]byte("spec")), protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("index")), protocol.MakeIntReply(int64(cmd.firstKey)),
+			}),
+		})
+		lastKey := cmd.lastKey
+		if lastKey > 0 {
+			lastKey -= cmd.firstKey
+		}
+		findKeys = protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("type")), protocol.MakeBulkReply([]byte("range")),
+			protocol.MakeBulkReply([]byte("spec")), protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("lastkey")), protocol.MakeIntReply(int64(lastKey)),
+				protocol.MakeBulkReply([]byte("keystep")), protocol.MakeIntReply(int64(cmd.keyStep)),
+				protocol.MakeBulkReply([]byte("limit")), protocol.MakeIntReply(0),
+			}),
+		})
+	} else {
+		beginSearch = protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("type")), protocol.MakeBulkReply([]byte("unknown")),
+			protocol.MakeBulkReply([]byte("spec")), protocol.MakeEmptyMultiBulkReply(),
+		})
+		findKeys = protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("type")), protocol.MakeBulkReply([]byte("unknown")),
+			protocol.MakeBulkReply([]byte("spec")), protocol.MakeEmptyMultiBulkReply(),
+		})
+	}
+	spec := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("flags")), makeStatusArray(access),
+		protocol.MakeBulkReply([]byte("begin_search")), beginSearch,
+		protocol.MakeBulkReply([]byte("find_keys")), findKeys,
+	})
+	return protocol.MakeMultiRawReply([]redis.Reply{spec})
+}
+
+// infoReply 返回 COMMAND INFO 中一个命令的描述：
+// name, arity, flags, first key, last key, step, ACL categories, tips, key specs, subcommands
+func (cmd *command) infoReply() redis.Reply {
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(cmd.name)),
+		protocol.MakeIntReply(int64(cmd.arity)),
+		makeStatusArray(cmd.flagNames()),
+		protocol.MakeIntReply(int64(cmd.firstKey)),
+		protocol.MakeIntReply(int64(cmd.lastKey)),
+		protocol.MakeIntReply(int64(cmd.keyStep)),
+		makeStatusArray(cmd.categories()),
+		protocol.MakeEmptyMultiBulkReply(),
+		cmd.keySpecs(),
+		protocol.MakeEmptyMultiBulkReply(),
+	})
+}
+
+// docsReply 返回 COMMAND DOCS 中一个命令的文档，目前只有 group 和 arity
+func (cmd *command) docsReply() redis.Reply {
+	group := cmd.category
+	if cmd.module != "" {
+		group = "module"
+	} else if group == "" {
+		group = "generic"
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("group")), protocol.MakeBulkReply([]byte(group)),
+		protocol.MakeBulkReply([]byte("arity")), protocol.MakeIntReply(int64(cmd.arity)),
+	})
+}
+
+// execCommand COMMAND [COUNT | INFO [name ...] | DOCS [name ...] | GETKEYS cmd [arg ...] | LIST [FILTERBY ...]]
+func execCommand(args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		cmds := allCommands()
+		replies := make([]redis.Reply, len(cmds))
+		for i, cmd := range cmds {
+			replies[i] = cmd.infoReply()
+		}
+		return protocol.MakeMultiRawReply(replies)
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "count":
+		if len(args) != 1 {
+			return protocol.MakeErrReply("ERR wrong number of arguments for 'command|count' command")
+		}
+		return protocol.MakeIntReply(int64(len(cmdTable) + len(systemCmdTable)))
+	case "info", "docs":
+		var cmds []*command
+		if len(args) == 1 {
+			cmds = allCommands()
+		} else {
+			cmds = make([]*command, len(args)-1)
+			for i, arg := range args[1:] {
+				cmds[i] = lookupCommand(string(arg))
+			}
+		}
+		if subCmd == "info" {
+			replies := make([]redis.Reply, len(cmds))
+			for i, cmd := range cmds {
+				if cmd == nil {
+					replies[i] = protocol.MakeNullBulkReply()
+					continue
+				}
+				replies[i] = cmd.infoReply()
+			}
+			return protocol.MakeMultiRawReply(replies)
+		}
+		// DOCS 返回 name -> doc 的映射，不存在的命令直接忽略
+		replies := make([]redis.Reply, 0, len(cmds)*2)
+		for _, cmd := range cmds {
+			if cmd == nil {
+				continue
+			}
+			replies = append(replies, protocol.MakeBulkReply([]byte(cmd.name)), cmd.docsReply())
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "getkeys":
+		if len(args) < 2 {
+			return protocol.MakeErrReply("ERR wrong number of arguments for 'command|getkeys' command")
+		}
+		return execCommandGetKeys(args[1:])
+	case "list":
+		return execCommandList(args[1:])
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try COMMAND HELP.")
+}
+
+// execCommandGetKeys 使用命令的 PreFunc 找到命令行中的 key，按照 key 在命令行中出现的顺序返回
+func execCommandGetKeys(cmdLine [][]byte) redis.Reply {
+	cmd := lookupCommand(string(cmdLine[0]))
+	if cmd == nil {
+		return protocol.MakeErrReply("ERR Invalid command specified")
+	}
+	if !validateArity(cmd.arity, cmdLine) {
+		return protocol.MakeErrReply("ERR Invalid number of arguments specified for command")
+	}
+	if cmd.prepare == nil || (cmd.firstKey == 0 && !cmd.movableKeys) {
+		return protocol.MakeErrReply("ERR The command has no key arguments")
+	}
+	writeKeys, readKeys := cmd.prepare(cmdLine[1:])
+	isKey := make(map[string]bool, len(writeKeys)+len(readKeys))
+	for _, key := range writeKeys {
+		isKey[key] = true
+	}
+	for _, key := range readKeys {
+		isKey[key] = true
+	}
+	keys := make([]string, 0, len(isKey))
+	for _, arg := range cmdLine[1:] {
+		if isKey[string(arg)] {
+			keys = append(keys, string(arg))
+			// 同一个 key 在命令行中出现多次时只返回一次，例如 SMOVE key key member
+			delete(isKey, string(arg))
+		}
+	}
+	if len(keys) == 0 {
+		return protocol.MakeErrReply("ERR The command has no key arguments")
+	}
+	return makeBulkArray(keys)
+}
+
+// execCommandList COMMAND LIST [FILTERBY MODULE module-name | ACLCAT category | PATTERN pattern]
+func execCommandList(args [][]byte) redis.Reply {
+	filter := func(cmd *command) bool { return true }
+	if len(args) > 0 {
+		if len(args) != 3 || strings.ToLower(string(args[0])) != "filterby" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		value := string(args[2])
+		switch strings.ToLower(string(args[1])) {
+		case "module":
+			filter = func(cmd *command) bool { return cmd.module == value }
+		case "aclcat":
+			category := "@" + strings.ToLower(value)
+			filter = func(cmd *command) bool {
+				for _, c := range cmd.categories() {
+					if c == category {
+						return true
+					}
+				}
+				return false
+			}
+		case "pattern":
+			pattern, err := wildcard.CompilePattern(strings.ToLower(value))
+			if err != nil {
+				return protocol.MakeErrReply("ERR " + err.Error())
+			}
+			filter = func(cmd *command) bool { return pattern.IsMatch(cmd.name) }
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	var names []string
+	for _, cmd := range allCommands() {
+		if filter(cmd) {
+			names = append(names, cmd.name)
+		}
+	}
+	return makeBulkArray(names)
+}
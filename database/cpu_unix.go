@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package database
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuUsage returns system and user CPU time used by the process
+func cpuUsage() (sys time.Duration, user time.Duration) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	return time.Duration(usage.Stime.Nano()), time.Duration(usage.Utime.Nano())
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package database
+
+import "time"
+
+// cpuUsage is not supported on windows
+func cpuUsage() (sys time.Duration, user time.Duration) {
+	return 0, 0
+}
@@ -9,6 +9,7 @@ import (
 	"miniRedis/lib/timewheel"
 	"miniRedis/redis/protocol"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,13 +29,25 @@ type DB struct {
 	data dict.Dict
 	// key -> expireTime (time.Time)
 	ttlMap dict.Dict
-	// key -> version(uint32)
+	// key -> version(uint32)，属于数据库编号而不是 DB 对象，FLUSHDB、SWAPDB 替换 DB 之后仍然保留
 	versionMap dict.Dict
 
 	// dict.Dict will ensure concurrent-safety of its method
 	// use this mutex for complicated command only, eg. rpush, incr ...
 	locker *lock.Locks
 	addAof func(CmdLine)
+	// addTxAof 将一个事务的所有命令作为 MULTI ... EXEC 块写入 AOF
+	addTxAof func([]CmdLine)
+	// snapshots 用于 AOF 重写时生成数据快照，被一个 Server 的所有数据库共享
+	snapshots *snapshotBarrier
+	// dirty 指向 Server 中这个编号的数据库上次保存 RDB 之后修改的 key 的数量
+	dirty *int64
+	// lockWaiters 用于唤醒 LOCK ... WAIT 中等待锁释放的客户端
+	lockWaiters *lockWaiters
+	// lockToken 指向这个编号的数据库最近发出的锁令牌，属于数据库编号而不是 DB 对象，需要通过原子操作读写
+	lockToken *int64
+	// pendingEvents 不为 nil 时 keyspace 事件先收集起来，事务提交之后再通知订阅者
+	pendingEvents *[]*KeyspaceEvent
 }
 
 // CmdLine 一个CmdLIne表示一个命令行，因为命令行是多行的，所以使用二维数组
@@ -54,28 +67,45 @@ type UndoFunc func(db *DB, args [][]byte) []CmdLine
 // makeDB create DB instance
 func makeDB() *DB {
 	db := &DB{
-		data:       dict.MakeConcurrent(dataDictSize),
-		ttlMap:     dict.MakeConcurrent(ttlDictSize),
-		versionMap: dict.MakeConcurrent(dataDictSize),
-		locker:     lock.Make(lockerSize),
-		addAof:     func(line CmdLine) {},
+		data:        dict.MakeConcurrent(dataDictSize),
+		ttlMap:      dict.MakeConcurrent(ttlDictSize),
+		versionMap:  dict.MakeConcurrent(dataDictSize),
+		locker:      lock.Make(lockerSize),
+		addAof:      func(line CmdLine) {},
+		addTxAof:    func(lines []CmdLine) {},
+		lockWaiters: makeLockWaiters(),
+		lockToken:   new(int64),
 	}
 	return db
 }
 
 func makeBasicDB() *DB {
 	db := &DB{
-		data:       dict.MakeSimple(),
-		ttlMap:     dict.MakeSimple(),
-		versionMap: dict.MakeSimple(),
-		locker:     lock.Make(1),
-		addAof:     func(line CmdLine) {},
+		data:        dict.MakeSimple(),
+		ttlMap:      dict.MakeSimple(),
+		versionMap:  dict.MakeSimple(),
+		locker:      lock.Make(1),
+		addAof:      func(line CmdLine) {},
+		addTxAof:    func(lines []CmdLine) {},
+		lockWaiters: makeLockWaiters(),
+		lockToken:   new(int64),
 	}
 	return db
 }
 
 // Exec 执行命令
 func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
+	if errReply := checkReplayOnly(c, strings.ToLower(string(cmdLine[0]))); errReply != nil {
+		if c != nil && c.InMultiState() {
+			c.AddTxError(errReply)
+		}
+		return errReply
+	}
+	// 脚本中调用的命令，key 已经由脚本加锁。使用脚本加锁的数据库执行，
+	// 脚本执行期间其它客户端的 SWAPDB 可能让 Server 选择到另一个数据库
+	if sc, ok := c.(*scriptConn); ok {
+		return sc.script.db.execScriptCommand(sc, cmdLine)
+	}
 	// transaction control commands and other commands which cannot execute within transaction
 	cmdName := strings.ToLower(string(cmdLine[0]))
 	if cmdName == "multi" {
@@ -91,18 +121,22 @@ func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
 		}
 		// 关闭事务
 		return DiscardMulti(c)
-	} else if cmdName == "exec" {
-		if len(cmdLine) != 1 {
-			return protocol.MakeArgNumErrReply(cmdName)
-		}
-		// 执行事务
-		return execMulti(db, c)
 	} else if cmdName == "watch" {
 		if !validateArity(-2, cmdLine) {
 			return protocol.MakeArgNumErrReply(cmdName)
 		}
 		// watch key
 		return Watch(db, c, cmdLine[1:])
+	} else if cmdName == "unwatch" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		if c.InMultiState() {
+			// 事务中的 UNWATCH 入队，EXEC 时已经不需要做任何事情
+			c.EnqueueCmd(cmdLine)
+			return protocol.MakeQueuedReply()
+		}
+		return UnWatch(c)
 	}
 	if c != nil && c.InMultiState() {
 		// 入队
@@ -127,10 +161,23 @@ func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 	prepare := cmd.prepare
 	write, read := prepare(cmdLine[1:])
 	db.addVersion(write...)
-	db.RWLocks(write, read)
-	defer db.RWUnLocks(write, read)
+	if cmd.needLockAll(cmdLine[1:]) {
+		db.RWLocksAll(write)
+		defer db.RWUnLocksAll(write)
+	} else {
+		db.RWLocks(write, read)
+		defer db.RWUnLocks(write, read)
+	}
+	if len(write) > 0 {
+		defer db.enterWrite(write)()
+	}
 	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	reply := fun(db, cmdLine[1:])
+	if !protocol.IsErrorReply(reply) {
+		db.addDirty(len(write))
+		db.notifyWrite(cmd, cmdLine, write)
+	}
+	return reply
 }
 
 // execWithLock 执行普通的Redis命令并且使用锁保证数据原子性
@@ -144,7 +191,11 @@ func (db *DB) execWithLock(cmdLine [][]byte) redis.Reply {
 		return protocol.MakeArgNumErrReply(cmdName)
 	}
 	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	reply := fun(db, cmdLine[1:])
+	if !protocol.IsErrorReply(reply) {
+		db.notifyWrite(cmd, cmdLine, nil)
+	}
+	return reply
 }
 
 // validateArity 检查参数是否正确
@@ -158,8 +209,20 @@ func validateArity(arity int, cmdArgs [][]byte) bool {
 
 /* ---- Data Access 数据操作入口----- */
 
-// GetEntity 返回key所对应的数据实体
+// GetEntity 返回key所对应的数据实体，并记录一次访问
 func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
+	entity, ok := db.peekEntity(key)
+	if !ok {
+		atomic.AddInt64(&stats.keyspaceMisses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&stats.keyspaceHits, 1)
+	touchEntity(entity)
+	return entity, true
+}
+
+// peekEntity 返回key所对应的数据实体，不会更新实体的访问信息
+func (db *DB) peekEntity(key string) (*database.DataEntity, bool) {
 	raw, ok := db.data.Get(key)
 	if !ok {
 		return nil, false
@@ -173,14 +236,17 @@ func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
 
 // PutEntity 将k-v放入数据库中
 func (db *DB) PutEntity(key string, entity *database.DataEntity) int {
+	initEntityAccess(entity)
 	return db.data.Put(key, entity)
 }
 
 func (db *DB) PutIfExists(key string, entity *database.DataEntity) int {
+	initEntityAccess(entity)
 	return db.data.PutIfExists(key, entity)
 }
 
 func (db *DB) PutIfAbsent(key string, entity *database.DataEntity) int {
+	initEntityAccess(entity)
 	return db.data.PutIfAbsent(key, entity)
 }
 
@@ -220,6 +286,15 @@ func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
 	db.locker.RWUnLocks(writeKeys, readKeys)
 }
 
+// RWLocksAll 给 writeKeys 加写锁，给数据库中其它所有 key 加读锁，用于执行之前无法确定会读取哪些 key 的命令
+func (db *DB) RWLocksAll(writeKeys []string) {
+	db.locker.RWLocksAll(writeKeys)
+}
+
+func (db *DB) RWUnLocksAll(writeKeys []string) {
+	db.locker.RWUnLocksAll(writeKeys)
+}
+
 // 生成某个键的过期时间任务
 func genExpireTask(key string) string {
 	return "expire:" + key
@@ -246,6 +321,9 @@ func (db *DB) Expire(key string, expireTime time.Time) {
 		expired := time.Now().After(expireTime)
 		if expired {
 			db.Remove(key)
+			db.addVersion(key)
+			atomic.AddInt64(&stats.expiredKeys, 1)
+			db.notifyKeyspaceEvent("expired", key)
 		}
 	})
 
@@ -268,6 +346,10 @@ func (db *DB) IsExpired(key string) bool {
 	expired := time.Now().After(expireTime)
 	if expired {
 		db.Remove(key)
+		// 过期删除也是修改，WATCH 这个 key 的事务需要失败
+		db.addVersion(key)
+		atomic.AddInt64(&stats.expiredKeys, 1)
+		db.notifyKeyspaceEvent("expired", key)
 	}
 	return expired
 }
@@ -281,6 +363,14 @@ func (db *DB) addVersion(keys ...string) {
 	}
 }
 
+// touchAllKeys 增加 from 中所有的 key 在 db 中的版本
+func touchAllKeys(db *DB, from *DB) {
+	from.data.ForEach(func(key string, val interface{}) bool {
+		db.addVersion(key)
+		return true
+	})
+}
+
 func (db *DB) GetVersion(key string) uint32 {
 	entity, ok := db.versionMap.Get(key)
 	if !ok {
@@ -0,0 +1,387 @@
+package database
+
+import (
+	"fmt"
+	"miniRedis/config"
+	"miniRedis/datastruct/dict"
+	"miniRedis/datastruct/list"
+	"miniRedis/datastruct/set"
+	"miniRedis/datastruct/sortedset"
+	"miniRedis/interface/database"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * INFO 命令中除了 server、clients、cluster 之外的 section，数据来自 stats 中的计数器和运行时信息
+ */
+
+var (
+	defaultInfoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication",
+		"cpu", "errorstats", "cluster", "keyspace"}
+	allInfoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication",
+		"cpu", "commandstats", "errorstats", "cluster", "keyspace"}
+)
+
+const (
+	// 估算数据集大小时每个数据库抽样的 key 数量，以及每个集合抽样的元素数量
+	datasetSampleKeys     = 16
+	datasetSampleElements = 32
+	// 每个元素在字典、跳表等结构中的额外开销的粗略估计
+	elementOverhead = 48
+)
+
+// peakMemory 记录 INFO 观察到的最大内存使用量
+var peakMemory uint64
+
+// genInfoString 返回一个 section 的内容，未知的 section 返回空
+func (server *Server) genInfoString(section string) []byte {
+	switch section {
+	case "server", "cluster":
+		return GenGodisInfoString(section)
+	case "clients", "client":
+		return GenGodisInfoString("client")
+	case "memory":
+		return server.genMemoryInfo()
+	case "persistence":
+		return server.genPersistenceInfo()
+	case "stats":
+		return server.genStatsInfo()
+	case "replication":
+		return genReplicationInfo()
+	case "cpu":
+		return genCPUInfo()
+	case "commandstats":
+		return genCommandStatsInfo()
+	case "errorstats":
+		return genErrorStatsInfo()
+	case "keyspace":
+		return server.genKeyspaceInfo()
+	}
+	return nil
+}
+
+// bytesToHuman 与 redis 相同，将字节数转换为 1.50K、2.00M 这样的形式
+func bytesToHuman(n uint64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", float64(n)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2fG", float64(n)/(1024*1024*1024))
+	}
+}
+
+func (server *Server) genMemoryInfo() []byte {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	used := m.HeapAlloc
+	for {
+		peak := atomic.LoadUint64(&peakMemory)
+		if used <= peak || atomic.CompareAndSwapUint64(&peakMemory, peak, used) {
+			break
+		}
+	}
+	peak := atomic.LoadUint64(&peakMemory)
+	dataset := server.estimateDatasetBytes()
+	datasetPerc := 0.0
+	if used > 0 {
+		datasetPerc = float64(dataset) * 100 / float64(used)
+	}
+	s := fmt.Sprintf("# Memory\r\n"+
+		"used_memory:%d\r\n"+
+		"used_memory_human:%s\r\n"+
+		"used_memory_rss:%d\r\n"+
+		"used_memory_rss_human:%s\r\n"+
+		"used_memory_peak:%d\r\n"+
+		"used_memory_peak_human:%s\r\n"+
+		"used_memory_dataset:%d\r\n"+
+		"used_memory_dataset_perc:%.2f%%\r\n"+
+		"mem_heap_objects:%d\r\n"+
+		"mem_gc_count:%d\r\n"+
+		"mem_gc_pause_total_ns:%d\r\n"+
+		"maxmemory:0\r\n"+
+		"maxmemory_policy:noeviction\r\n",
+		used, bytesToHuman(used),
+		m.Sys, bytesToHuman(m.Sys),
+		peak, bytesToHuman(peak),
+		dataset, datasetPerc,
+		m.HeapObjects,
+		m.NumGC,
+		m.PauseTotalNs,
+	)
+	return []byte(s)
+}
+
+// estimateDatasetBytes 抽样估算所有数据库中数据占用的内存，遍历全部数据的代价太高
+func (server *Server) estimateDatasetBytes() uint64 {
+	var total uint64
+	for i := range server.dbSet {
+		db := server.mustSelectDB(i)
+		size := db.data.Len()
+		if size == 0 {
+			continue
+		}
+		keys := db.data.RandomDistinctKeys(datasetSampleKeys)
+		var sampled, sampledBytes uint64
+		for _, key := range keys {
+			n, ok := estimateKeyBytes(db, key)
+			if !ok {
+				continue
+			}
+			sampled++
+			sampledBytes += n
+		}
+		if sampled > 0 {
+			total += sampledBytes * uint64(size) / sampled
+		}
+	}
+	return total
+}
+
+// estimateKeyBytes 在 key 的读锁中估算 key 占用的内存，集合类型的底层是 map，遍历时不能有并发的写入
+func estimateKeyBytes(db *DB, key string) (uint64, bool) {
+	keys := []string{key}
+	db.RWLocks(nil, keys)
+	defer db.RWUnLocks(nil, keys)
+	raw, ok := db.data.Get(key)
+	if !ok {
+		return 0, false
+	}
+	entity, _ := raw.(*database.DataEntity)
+	return uint64(len(key)) + estimateEntityBytes(entity), true
+}
+
+// estimateEntityBytes 估算一个数据实体占用的内存，集合类型只抽样一部分元素，调用者需要持有 key 的读锁
+func estimateEntityBytes(entity *database.DataEntity) uint64 {
+	if entity == nil {
+		return 0
+	}
+	var sampled, sampledBytes uint64
+	var size int
+	switch val := entity.Data.(type) {
+	case []byte:
+		return uint64(len(val))
+	case list.List:
+		size = val.Len()
+		val.ForEach(func(i int, v interface{}) bool {
+			b, _ := v.([]byte)
+			sampled++
+			sampledBytes += uint64(len(b))
+			return sampled < datasetSampleElements
+		})
+	case *set.Set:
+		size = val.Len()
+		val.ForEach(func(member string) bool {
+			sampled++
+			sampledBytes += uint64(len(member))
+			return sampled < datasetSampleElements
+		})
+	case *sortedset.SortedSet:
+		size = int(val.Len())
+		if size == 0 {
+			return 0
+		}
+		stop := int64(datasetSampleElements)
+		if stop > int64(size) {
+			stop = int64(size)
+		}
+		val.ForEach(0, stop, false, func(element *sortedset.Element) bool {
+			sampled++
+			sampledBytes += uint64(len(element.Member)) + 8
+			return true
+		})
+	case dict.Dict:
+		size = val.Len()
+		val.ForEach(func(key string, v interface{}) bool {
+			b, _ := v.([]byte)
+			sampled++
+			sampledBytes += uint64(len(key) + len(b))
+			return sampled < datasetSampleElements
+		})
+	}
+	if sampled == 0 {
+		return 0
+	}
+	return (sampledBytes/sampled + elementOverhead) * uint64(size)
+}
+
+func (server *Server) genPersistenceInfo() []byte {
+	aofEnabled, rewriting, queueLen := 0, 0, 0
+	var aofCurrentSize, aofBaseSize int64
+	rewriteStatus := "ok"
+	if server.aofEnabled() {
+		aofEnabled = 1
+		queueLen = server.persister.QueueLen()
+		aofCurrentSize = server.persister.CurrentSize()
+		aofBaseSize = server.persister.BaseSize()
+		if server.persister.IsRewriting() {
+			rewriting = 1
+		}
+		if server.persister.LastRewriteFailed() {
+			rewriteStatus = "err"
+		}
+	}
+	saveStatus := "ok"
+	if atomic.LoadInt32(&server.lastSaveFailed) != 0 {
+		saveStatus = "err"
+	}
+	s := fmt.Sprintf("# Persistence\r\n"+
+		"loading:0\r\n"+
+		"rdb_changes_since_last_save:%d\r\n"+
+		"rdb_bgsave_in_progress:%d\r\n"+
+		"rdb_last_save_time:%d\r\n"+
+		"rdb_last_bgsave_status:%s\r\n"+
+		"aof_enabled:%d\r\n"+
+		"aof_rewrite_in_progress:%d\r\n"+
+		"aof_last_bgrewrite_status:%s\r\n"+
+		"aof_buffer_length:%d\r\n"+
+		"aof_current_size:%d\r\n"+
+		"aof_base_size:%d\r\n",
+		server.dirtyCount(),
+		atomic.LoadInt32(&server.bgSaving),
+		atomic.LoadInt64(&server.lastSaveTime),
+		saveStatus,
+		aofEnabled,
+		rewriting,
+		rewriteStatus,
+		queueLen,
+		aofCurrentSize,
+		aofBaseSize,
+	)
+	return []byte(s)
+}
+
+func (server *Server) genStatsInfo() []byte {
+	s := fmt.Sprintf("# Stats\r\n"+
+		"total_connections_received:%d\r\n"+
+		"total_commands_processed:%d\r\n"+
+		"instantaneous_ops_per_sec:%d\r\n"+
+		"total_net_input_bytes:%d\r\n"+
+		"total_net_output_bytes:%d\r\n"+
+		"instantaneous_input_kbps:%.2f\r\n"+
+		"instantaneous_output_kbps:%.2f\r\n"+
+		"expired_keys:%d\r\n"+
+		"evicted_keys:%d\r\n"+
+		"keyspace_hits:%d\r\n"+
+		"keyspace_misses:%d\r\n"+
+		"pubsub_channels:%d\r\n"+
+		"total_error_replies:%d\r\n",
+		atomic.LoadInt64(&stats.totalConnections),
+		atomic.LoadInt64(&stats.totalCommands),
+		int64(stats.opsSampler.rate()),
+		atomic.LoadInt64(&stats.netInputBytes),
+		atomic.LoadInt64(&stats.netOutputBytes),
+		stats.inputSampler.rate()/1024,
+		stats.outputSampler.rate()/1024,
+		atomic.LoadInt64(&stats.expiredKeys),
+		atomic.LoadInt64(&stats.evictedKeys),
+		atomic.LoadInt64(&stats.keyspaceHits),
+		atomic.LoadInt64(&stats.keyspaceMisses),
+		server.hub.ChannelCount(),
+		totalErrorReplies(),
+	)
+	return []byte(s)
+}
+
+func totalErrorReplies() int64 {
+	var total int64
+	stats.forEachError(func(prefix string, count int64) {
+		total += count
+	})
+	return total
+}
+
+// genReplicationInfo 目前只支持作为 master 运行
+func genReplicationInfo() []byte {
+	s := fmt.Sprintf("# Replication\r\n"+
+		"role:master\r\n"+
+		"connected_slaves:0\r\n"+
+		"master_replid:%s\r\n"+
+		"master_repl_offset:0\r\n",
+		config.Properties.RunID,
+	)
+	return []byte(s)
+}
+
+func genCPUInfo() []byte {
+	sys, user := cpuUsage()
+	s := fmt.Sprintf("# CPU\r\n"+
+		"used_cpu_sys:%.6f\r\n"+
+		"used_cpu_user:%.6f\r\n"+
+		"goroutines:%d\r\n",
+		sys.Seconds(),
+		user.Seconds(),
+		runtime.NumGoroutine(),
+	)
+	return []byte(s)
+}
+
+func genCommandStatsInfo() []byte {
+	var sb strings.Builder
+	sb.WriteString("# Commandstats\r\n")
+	stats.forEachCommand(func(name string, stat *commandStat) {
+		calls := atomic.LoadInt64(&stat.calls)
+		usec := atomic.LoadInt64(&stat.usec)
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		sb.WriteString(fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=0,failed_calls=%d\r\n",
+			name, calls, usec, perCall, atomic.LoadInt64(&stat.failedCalls)))
+	})
+	return []byte(sb.String())
+}
+
+func genErrorStatsInfo() []byte {
+	var sb strings.Builder
+	sb.WriteString("# Errorstats\r\n")
+	stats.forEachError(func(prefix string, count int64) {
+		sb.WriteString(fmt.Sprintf("errorstat_%s:count=%d\r\n", prefix, count))
+	})
+	return []byte(sb.String())
+}
+
+// genKeyspaceInfo 只列出非空的数据库，avg_ttl 是抽样的 key 剩余生存时间的平均值（毫秒）
+func (server *Server) genKeyspaceInfo() []byte {
+	var sb strings.Builder
+	sb.WriteString("# Keyspace\r\n")
+	for i := range server.dbSet {
+		keys, expires := server.GetDBSize(i)
+		if keys == 0 {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=%d\r\n",
+			i, keys, expires, server.mustSelectDB(i).sampleAvgTTL()))
+	}
+	return []byte(sb.String())
+}
+
+// sampleAvgTTL 抽样计算设置了过期时间的 key 的平均剩余时间
+func (db *DB) sampleAvgTTL() int64 {
+	if db.ttlMap.Len() == 0 {
+		return 0
+	}
+	now := time.Now()
+	var total, n int64
+	for _, key := range db.ttlMap.RandomDistinctKeys(datasetSampleKeys) {
+		raw, ok := db.ttlMap.Get(key)
+		if !ok {
+			continue
+		}
+		expireTime, _ := raw.(time.Time)
+		if ttl := expireTime.Sub(now); ttl > 0 {
+			total += ttl.Milliseconds()
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / n
+}
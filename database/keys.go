@@ -1,18 +1,31 @@
 package database
 
 import (
+	"errors"
 	"miniRedis/aof"
 	"miniRedis/datastruct/dict"
+	"miniRedis/datastruct/list"
 	"miniRedis/datastruct/set"
 	"miniRedis/datastruct/sortedset"
+	"miniRedis/interface/database"
 	"miniRedis/interface/redis"
 	"miniRedis/lib/utils"
+	"miniRedis/lib/wildcard"
 	"miniRedis/redis/protocol"
 	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	randomKeyMaxTries = 100
+	// lazyFreeThreshold UNLINK 时元素个数超过该值的数据会在后台释放
+	lazyFreeThreshold = 64
+	lazyFreeQueueSize = 1024
+)
+
+var lazyFreeQueue = make(chan *database.DataEntity, lazyFreeQueueSize)
+
 // execDel removes a key from db
 func execDel(db *DB, args [][]byte) redis.Reply {
 	keys := make([]string, len(args))
@@ -61,25 +74,38 @@ func execType(db *DB, args [][]byte) redis.Reply {
 	if !exists {
 		return protocol.MakeStatusReply("none")
 	}
+	typeName := entityTypeName(entity)
+	if typeName == "" {
+		return &protocol.UnknownErrReply{}
+	}
+	return protocol.MakeStatusReply(typeName)
+}
+
+// entityTypeName 返回 TYPE 命令中数据结构的名称，未知的类型返回空字符串
+func entityTypeName(entity *database.DataEntity) string {
 	switch entity.Data.(type) {
 	case []byte:
-		return protocol.MakeStatusReply("string")
+		return "string"
 	case list.List:
-		return protocol.MakeStatusReply("list")
+		return "list"
 	case dict.Dict:
-		return protocol.MakeStatusReply("hash")
+		return "hash"
 	case *set.Set:
-		return protocol.MakeStatusReply("set")
+		return "set"
 	case *sortedset.SortedSet:
-		return protocol.MakeStatusReply("zset")
+		return "zset"
+	}
+	if t := aof.DataTypeOf(entity.Data); t != nil {
+		return t.Name
 	}
-	return &protocol.UnknownErrReply{}
+	return ""
 }
 
 func prepareRename(args [][]byte) ([]string, []string) {
 	src := string(args[0])
 	dest := string(args[1])
-	return []string{dest}, []string{src}
+	// src 会被删除，也需要加写锁并增加版本
+	return []string{src, dest}, nil
 }
 
 // execRename a key
@@ -94,6 +120,9 @@ func execRename(db *DB, args [][]byte) redis.Reply {
 	if !ok {
 		return protocol.MakeErrReply("no such key")
 	}
+	if isLockEntity(entity) {
+		return makeLockTransferErrReply()
+	}
 	rawTTL, hasTTL := db.ttlMap.Get(src)
 	db.PutEntity(dest, entity)
 	db.Remove(src)
@@ -126,6 +155,9 @@ func execRenameNx(db *DB, args [][]byte) redis.Reply {
 	if !ok {
 		return protocol.MakeErrReply("no such key")
 	}
+	if isLockEntity(entity) {
+		return makeLockTransferErrReply()
+	}
 	rawTTL, hasTTL := db.ttlMap.Get(src)
 	db.Removes(src, dest) // clean src and dest with their ttl
 	db.PutEntity(dest, entity)
@@ -139,28 +171,86 @@ func execRenameNx(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(1)
 }
 
-// execExpire sets a key's time to live in seconds
-func execExpire(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
+const (
+	expireFlagNX = 1 << iota // 仅当 key 没有过期时间时设置
+	expireFlagXX             // 仅当 key 已有过期时间时设置
+	expireFlagGT             // 仅当新的过期时间大于当前过期时间时设置
+	expireFlagLT             // 仅当新的过期时间小于当前过期时间时设置
+)
 
-	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+// parseExpireFlags parses NX|XX|GT|LT options of EXPIRE family commands
+func parseExpireFlags(args [][]byte) (int, protocol.ErrorReply) {
+	flags := 0
+	for _, arg := range args {
+		switch strings.ToUpper(string(arg)) {
+		case "NX":
+			flags |= expireFlagNX
+		case "XX":
+			flags |= expireFlagXX
+		case "GT":
+			flags |= expireFlagGT
+		case "LT":
+			flags |= expireFlagLT
+		default:
+			return 0, protocol.MakeErrReply("ERR Unsupported option " + string(arg))
+		}
 	}
-	ttl := time.Duration(ttlArg) * time.Second
+	if flags&expireFlagNX > 0 && flags&(expireFlagXX|expireFlagGT|expireFlagLT) > 0 {
+		return 0, protocol.MakeErrReply("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if flags&expireFlagGT > 0 && flags&expireFlagLT > 0 {
+		return 0, protocol.MakeErrReply("ERR GT and LT options at the same time are not compatible")
+	}
+	return flags, nil
+}
 
+// expire0 sets expireAt for the key if the NX|XX|GT|LT condition is satisfied.
+// A key without ttl is treated as having an infinite ttl when comparing with GT or LT
+func expire0(db *DB, key string, expireAt time.Time, flags int) redis.Reply {
 	_, exists := db.GetEntity(key)
 	if !exists {
 		return protocol.MakeIntReply(0)
 	}
+	raw, hasTTL := db.ttlMap.Get(key)
+	if flags&expireFlagNX > 0 && hasTTL {
+		return protocol.MakeIntReply(0)
+	}
+	if flags&expireFlagXX > 0 && !hasTTL {
+		return protocol.MakeIntReply(0)
+	}
+	if flags&expireFlagGT > 0 {
+		if !hasTTL || !expireAt.After(raw.(time.Time)) {
+			return protocol.MakeIntReply(0)
+		}
+	}
+	if flags&expireFlagLT > 0 && hasTTL && !expireAt.Before(raw.(time.Time)) {
+		return protocol.MakeIntReply(0)
+	}
 
-	expireAt := time.Now().Add(ttl)
 	db.Expire(key, expireAt)
 	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
 	return protocol.MakeIntReply(1)
 }
 
+// execExpire sets a key's time to live in seconds
+// EXPIRE key seconds [NX | XX | GT | LT]
+func execExpire(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+
+	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	flags, errReply := parseExpireFlags(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	ttl := time.Duration(ttlArg) * time.Second
+	return expire0(db, key, time.Now().Add(ttl), flags)
+}
+
 // execExpireAt sets a key's expiration in unix timestamp
+// EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
 func execExpireAt(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 
@@ -168,16 +258,11 @@ func execExpireAt(db *DB, args [][]byte) redis.Reply {
 	if err != nil {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
-	expireAt := time.Unix(raw, 0)
-
-	_, exists := db.GetEntity(key)
-	if !exists {
-		return protocol.MakeIntReply(0)
+	flags, errReply := parseExpireFlags(args[2:])
+	if errReply != nil {
+		return errReply
 	}
-
-	db.Expire(key, expireAt)
-	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
-	return protocol.MakeIntReply(1)
+	return expire0(db, key, time.Unix(raw, 0), flags)
 }
 
 // execExpireTime returns the absolute Unix expiration timestamp in seconds at which the given key will expire.
@@ -198,6 +283,7 @@ func execExpireTime(db *DB, args [][]byte) redis.Reply {
 }
 
 // execPExpire sets a key's time to live in milliseconds
+// PEXPIRE key milliseconds [NX | XX | GT | LT]
 func execPExpire(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 
@@ -205,20 +291,16 @@ func execPExpire(db *DB, args [][]byte) redis.Reply {
 	if err != nil {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
-	ttl := time.Duration(ttlArg) * time.Millisecond
-
-	_, exists := db.GetEntity(key)
-	if !exists {
-		return protocol.MakeIntReply(0)
+	flags, errReply := parseExpireFlags(args[2:])
+	if errReply != nil {
+		return errReply
 	}
-
-	expireAt := time.Now().Add(ttl)
-	db.Expire(key, expireAt)
-	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
-	return protocol.MakeIntReply(1)
+	ttl := time.Duration(ttlArg) * time.Millisecond
+	return expire0(db, key, time.Now().Add(ttl), flags)
 }
 
 // execPExpireAt sets a key's expiration in unix timestamp specified in milliseconds
+// PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
 func execPExpireAt(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 
@@ -226,18 +308,13 @@ func execPExpireAt(db *DB, args [][]byte) redis.Reply {
 	if err != nil {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
-	expireAt := time.Unix(0, raw*int64(time.Millisecond))
-
-	_, exists := db.GetEntity(key)
-	if !exists {
-		return protocol.MakeIntReply(0)
+	flags, errReply := parseExpireFlags(args[2:])
+	if errReply != nil {
+		return errReply
 	}
-
-	db.Expire(key, expireAt)
-
-	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
-	return protocol.MakeIntReply(1)
+	return expire0(db, key, time.Unix(0, raw*int64(time.Millisecond)), flags)
 }
+
 func execPExpireTime(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	_, exists := db.GetEntity(key)
@@ -306,21 +383,87 @@ func execPersist(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(1)
 }
 
-/*// execKeys returns all keys matching the given pattern
+// execKeys returns all keys matching the given pattern
 func execKeys(db *DB, args [][]byte) redis.Reply {
 	pattern, err := wildcard.CompilePattern(string(args[0]))
 	if err != nil {
 		return protocol.MakeErrReply("ERR illegal wildcard")
 	}
+	now := time.Now()
 	result := make([][]byte, 0)
-	db.data.ForEach(func(key string, val interface{}) bool {
+	db.ForEach(func(key string, data *database.DataEntity, expiration *time.Time) bool {
+		// 遍历时持有分片的锁，不能在这里删除过期的 key
+		if expiration != nil && now.After(*expiration) {
+			return true
+		}
 		if pattern.IsMatch(key) {
 			result = append(result, []byte(key))
 		}
 		return true
 	})
 	return protocol.MakeMultiBulkReply(result)
-}*/
+}
+
+const defaultScanCount = 10
+
+// execScan iterates keys: SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func execScan(db *DB, args [][]byte) redis.Reply {
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	count := defaultScanCount
+	var pattern *wildcard.Pattern
+	typeName := ""
+	for i := 1; i < len(args); i++ {
+		arg := strings.ToLower(string(args[i]))
+		if i+1 >= len(args) {
+			return protocol.MakeSyntaxErrReply()
+		}
+		switch arg {
+		case "match":
+			pattern, err = wildcard.CompilePattern(string(args[i+1]))
+			if err != nil {
+				return protocol.MakeErrReply("ERR illegal wildcard")
+			}
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return protocol.MakeSyntaxErrReply()
+			}
+		case "type":
+			typeName = strings.ToLower(string(args[i+1]))
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+		i++
+	}
+
+	var match func(key string) bool
+	if pattern != nil {
+		match = pattern.IsMatch
+	}
+	keys, nextCursor := db.data.DictScan(cursor, count, match)
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		// peekEntity 会顺带删除过期的 key，且不影响 key 的访问时间
+		entity, exists := db.peekEntity(key)
+		if !exists {
+			continue
+		}
+		if typeName != "" && entityTypeName(entity) != typeName {
+			continue
+		}
+		result = append(result, []byte(key))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(strconv.Itoa(nextCursor))),
+		protocol.MakeMultiBulkReply(result),
+	})
+}
 
 func toTTLCmd(db *DB, key string) *protocol.MultiBulkReply {
 	raw, exists := db.ttlMap.Get(key)
@@ -341,79 +484,415 @@ func undoExpire(db *DB, args [][]byte) []CmdLine {
 }
 
 func execCopy(mdb *Server, conn redis.Connection, args [][]byte) redis.Reply {
-	dbIndex := conn.GetDBIndex()
-	db := mdb.mustSelectDB(dbIndex) // Current DB
-	replaceFlag := false
+	srcIndex := conn.GetDBIndex()
+	destIndex, replaceFlag, errReply := mdb.parseCopyArgs(srcIndex, args)
+	if errReply != nil {
+		return errReply
+	}
+	db := mdb.mustSelectDB(srcIndex) // Current DB
+	destDB := mdb.mustSelectDB(destIndex)
 	srcKey := string(args[0])
 	destKey := string(args[1])
 
-	// Parse options
-	if len(args) > 2 {
-		for i := 2; i < len(args); i++ {
-			arg := strings.ToLower(string(args[i]))
-			if arg == "db" {
-				if i+1 >= len(args) {
-					return &protocol.SyntaxErrReply{}
-				}
-				idx, err := strconv.Atoi(string(args[i+1]))
-				if err != nil {
-					return &protocol.SyntaxErrReply{}
-				}
-				if idx >= len(mdb.dbSet) || idx < 0 {
-					return protocol.MakeErrReply("ERR DB index is out of range")
-				}
-				dbIndex = idx
-				i++
-			} else if arg == "replace" {
-				replaceFlag = true
-			} else {
-				return &protocol.SyntaxErrReply{}
+	// 写锁加在目标 key 上，跨数据库时按照数据库编号顺序加锁，避免互相等待
+	srcKeys, destKeys := []string{srcKey}, []string{destKey}
+	if destDB == db {
+		db.RWLocks(destKeys, srcKeys)
+		defer db.RWUnLocks(destKeys, srcKeys)
+	} else if srcIndex < destIndex {
+		db.RWLocks(nil, srcKeys)
+		defer db.RWUnLocks(nil, srcKeys)
+		destDB.RWLocks(destKeys, nil)
+		defer destDB.RWUnLocks(destKeys, nil)
+	} else {
+		destDB.RWLocks(destKeys, nil)
+		defer destDB.RWUnLocks(destKeys, nil)
+		db.RWLocks(nil, srcKeys)
+		defer db.RWUnLocks(nil, srcKeys)
+	}
+
+	copied, errReply := copyKey(db, destDB, srcKey, destKey, replaceFlag, args)
+	if errReply != nil {
+		return errReply
+	}
+	if !copied {
+		return protocol.MakeIntReply(0)
+	}
+	destDB.addDirty(1)
+	return protocol.MakeIntReply(1)
+}
+
+// parseCopyArgs 解析 COPY source destination [DB destination-db] [REPLACE]，返回目标数据库的编号
+func (mdb *Server) parseCopyArgs(srcIndex int, args [][]byte) (int, bool, redis.Reply) {
+	destIndex := srcIndex
+	replaceFlag := false
+	for i := 2; i < len(args); i++ {
+		arg := strings.ToLower(string(args[i]))
+		if arg == "db" {
+			if i+1 >= len(args) {
+				return 0, false, &protocol.SyntaxErrReply{}
+			}
+			idx, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return 0, false, &protocol.SyntaxErrReply{}
+			}
+			if idx >= len(mdb.dbSet) || idx < 0 {
+				return 0, false, protocol.MakeErrReply("ERR DB index is out of range")
 			}
+			destIndex = idx
+			i++
+		} else if arg == "replace" {
+			replaceFlag = true
+		} else {
+			return 0, false, &protocol.SyntaxErrReply{}
 		}
 	}
-
-	if srcKey == destKey && dbIndex == conn.GetDBIndex() {
-		return protocol.MakeErrReply("ERR source and destination objects are the same")
+	if string(args[0]) == string(args[1]) && destIndex == srcIndex {
+		return 0, false, protocol.MakeErrReply("ERR source and destination objects are the same")
 	}
+	return destIndex, replaceFlag, nil
+}
 
+// copyKey 把 srcDB 中的 srcKey 复制到 destDB 中的 destKey，调用者需要持有 srcKey 的读锁和 destKey 的写锁。
+// AOF 中的 COPY 命令记录在 srcDB 上，无法复制的数据类型返回错误
+func copyKey(srcDB *DB, destDB *DB, srcKey string, destKey string, replace bool, args [][]byte) (bool, protocol.ErrorReply) {
 	// source key does not exist
-	src, exists := db.GetEntity(srcKey)
+	src, exists := srcDB.GetEntity(srcKey)
 	if !exists {
-		return protocol.MakeIntReply(0)
+		return false, nil
 	}
-
-	destDB := mdb.mustSelectDB(dbIndex)
-	if _, exists = destDB.GetEntity(destKey); exists != false {
+	if isLockEntity(src) {
+		return false, makeLockTransferErrReply()
+	}
+	if _, exists = destDB.GetEntity(destKey); exists && !replace {
 		// If destKey exists and there is no "replace" option
-		if replaceFlag == false {
-			return protocol.MakeIntReply(0)
-		}
+		return false, nil
+	}
+	copied, err := copyEntity(src)
+	if err != nil {
+		return false, protocol.MakeErrReply(err.Error())
 	}
 
-	destDB.PutEntity(destKey, src)
-	raw, exists := db.ttlMap.Get(srcKey)
+	destDB.saveForSnapshot([]string{destKey})
+	destDB.PutEntity(destKey, copied)
+	raw, exists := srcDB.ttlMap.Get(srcKey)
 	if exists {
 		expire := raw.(time.Time)
 		destDB.Expire(destKey, expire)
 	}
-	mdb.AddAof(conn.GetDBIndex(), utils.ToCmdLine3("copy", args...))
+	srcDB.addAof(utils.ToCmdLine3("copy", args...))
+	return true, nil
+}
+
+// execRandomKey returns a random key from the db
+func execRandomKey(db *DB, args [][]byte) redis.Reply {
+	// 随机到的 key 可能已经过期（过期的 key 会被顺带删除），因此最多尝试有限次
+	for i := 0; i < randomKeyMaxTries; i++ {
+		keys := db.data.RandomKeys(1)
+		if len(keys) == 0 {
+			return protocol.MakeNullBulkReply()
+		}
+		if _, exists := db.peekEntity(keys[0]); exists {
+			return protocol.MakeBulkReply([]byte(keys[0]))
+		}
+	}
+	return protocol.MakeNullBulkReply()
+}
+
+// execTouch updates the last access time of the given keys, returns the number of existing keys
+func execTouch(db *DB, args [][]byte) redis.Reply {
+	result := int64(0)
+	for _, arg := range args {
+		if _, exists := db.GetEntity(string(arg)); exists {
+			result++
+		}
+	}
+	return protocol.MakeIntReply(result)
+}
+
+// execUnlink removes keys like DEL, but large values are released by the lazy free goroutine
+func execUnlink(db *DB, args [][]byte) redis.Reply {
+	deleted := 0
+	for _, arg := range args {
+		key := string(arg)
+		entity, exists := db.peekEntity(key)
+		if !exists {
+			continue
+		}
+		db.Remove(key)
+		deleted++
+		lazyFree(entity)
+	}
+	if deleted > 0 {
+		db.addAof(utils.ToCmdLine3("unlink", args...))
+	}
+	return protocol.MakeIntReply(int64(deleted))
+}
+
+// lazyFree 将元素较多的数据交给后台 goroutine 释放，避免阻塞当前命令；队列已满时在当前 goroutine 中释放
+func lazyFree(entity *database.DataEntity) {
+	if entitySize(entity) <= lazyFreeThreshold {
+		return
+	}
+	select {
+	case lazyFreeQueue <- entity:
+	default:
+		freeEntity(entity)
+	}
+}
+
+// entitySize 返回数据实体中的元素个数
+func entitySize(entity *database.DataEntity) int {
+	switch val := entity.Data.(type) {
+	case list.List:
+		return val.Len()
+	case *set.Set:
+		return val.Len()
+	case *sortedset.SortedSet:
+		return int(val.Len())
+	case dict.Dict:
+		return val.Len()
+	}
+	return 1
+}
+
+// freeEntity 断开数据实体对数据的引用，较大的 hash 会先清空，以便尽快被 GC 回收
+func freeEntity(entity *database.DataEntity) {
+	if hash, ok := entity.Data.(dict.Dict); ok {
+		hash.Clear()
+	}
+	entity.Data = nil
+}
+
+func init() {
+	go func() {
+		for entity := range lazyFreeQueue {
+			freeEntity(entity)
+		}
+	}()
+}
+
+// execDBSize returns the number of keys in the db
+func execDBSize(db *DB, args [][]byte) redis.Reply {
+	return protocol.MakeIntReply(int64(db.data.Len()))
+}
+
+// execDump serializes the value stored at key in a versioned and checksummed format
+func execDump(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	if isLockEntity(entity) {
+		return makeLockTransferErrReply()
+	}
+	return protocol.MakeBulkReply(aof.DumpEntity(entity))
+}
+
+// execRestore creates a key from the value serialized by DUMP
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func execRestore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	payload := args[2]
+
+	replace := false
+	absTTL := false
+	var idleTime int64 = -1
+	var freq int64 = -1
+	for i := 3; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch {
+		case arg == "REPLACE":
+			replace = true
+		case arg == "ABSTTL":
+			absTTL = true
+		case arg == "IDLETIME" && i+1 < len(args) && freq == -1:
+			idleTime, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if idleTime < 0 {
+				return protocol.MakeErrReply("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			i++
+		case arg == "FREQ" && i+1 < len(args) && idleTime == -1:
+			freq, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > lfuCounterMax {
+				return protocol.MakeErrReply("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			i++
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+
+	if _, exists := db.GetEntity(key); exists && !replace {
+		return protocol.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	entity, err := aof.RestoreEntity(payload)
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	if isLockEntity(entity) {
+		return makeLockTransferErrReply()
+	}
+
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.Unix(0, ttl*int64(time.Millisecond))
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if expireAt.Before(time.Now()) {
+			// 已经过期的 key 不需要恢复，但是仍然要删除被替换的旧值
+			if db.Removes(key) > 0 {
+				db.addAof(utils.ToCmdLine("del", key))
+			}
+			return protocol.MakeOkReply()
+		}
+	}
+
+	db.Remove(key)
+	if idleTime >= 0 {
+		entity.AccessTime = time.Now().UnixMilli() - idleTime*1000
+		entity.AccessFreq = lfuInitVal
+	}
+	if freq >= 0 {
+		entity.AccessTime = time.Now().UnixMilli()
+		entity.AccessFreq = uint32(freq)
+	}
+	db.PutEntity(key, entity)
+	db.addAof(utils.ToCmdLine3("restore", args[0], []byte("0"), payload, []byte("REPLACE")))
+	if ttl > 0 {
+		db.Expire(key, expireAt)
+		db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
+	}
+	return protocol.MakeOkReply()
+}
+
+var errCopyUnsupported = errors.New("ERR the value of this type can not be copied")
+
+// copyEntity 深拷贝数据实体，保证每个 key 都持有独立的数据，DumpEntity 不支持的类型返回错误
+func copyEntity(entity *database.DataEntity) (*database.DataEntity, error) {
+	payload := aof.DumpEntity(entity)
+	if payload == nil {
+		return nil, errCopyUnsupported
+	}
+	return aof.RestoreEntity(payload)
+}
+
+// execMove moves a key from the selected database to the given database
+// MOVE key db
+func execMove(mdb *Server, conn redis.Connection, args [][]byte) redis.Reply {
+	srcIndex := conn.GetDBIndex()
+	dbIndex, errReply := mdb.parseMoveDB(srcIndex, args)
+	if errReply != nil {
+		return errReply
+	}
+	srcDB := mdb.mustSelectDB(srcIndex)
+	destDB := mdb.mustSelectDB(dbIndex)
+
+	// 按照数据库编号顺序加锁，避免相反方向的 MOVE 互相等待
+	key := string(args[0])
+	keys := []string{key}
+	first, second := srcDB, destDB
+	if srcIndex > dbIndex {
+		first, second = destDB, srcDB
+	}
+	first.RWLocks(keys, nil)
+	defer first.RWUnLocks(keys, nil)
+	second.RWLocks(keys, nil)
+	defer second.RWUnLocks(keys, nil)
+
+	moved, errReply := moveKey(srcDB, destDB, key, args)
+	if errReply != nil {
+		return errReply
+	}
+	if !moved {
+		return protocol.MakeIntReply(0)
+	}
+	srcDB.addVersion(key)
+	destDB.addVersion(key)
+	srcDB.addDirty(1)
+	destDB.addDirty(1)
 	return protocol.MakeIntReply(1)
 }
 
+// parseMoveDB 解析 MOVE key db 的目标数据库编号
+func (mdb *Server) parseMoveDB(srcIndex int, args [][]byte) (int, redis.Reply) {
+	dbIndex, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if dbIndex >= len(mdb.dbSet) || dbIndex < 0 {
+		return 0, protocol.MakeErrReply("ERR DB index is out of range")
+	}
+	if srcIndex == dbIndex {
+		return 0, protocol.MakeErrReply("ERR source and destination objects are the same")
+	}
+	return dbIndex, nil
+}
+
+// moveKey 把 key 从 srcDB 移动到 destDB，调用者需要持有两个数据库中 key 的写锁。
+// AOF 中的 MOVE 命令记录在 srcDB 上，不能移动的数据类型返回错误
+func moveKey(srcDB *DB, destDB *DB, key string, args [][]byte) (bool, protocol.ErrorReply) {
+	entity, exists := srcDB.GetEntity(key)
+	if !exists {
+		return false, nil
+	}
+	if isLockEntity(entity) {
+		return false, makeLockTransferErrReply()
+	}
+	if _, exists = destDB.GetEntity(key); exists {
+		return false, nil
+	}
+	keys := []string{key}
+	srcDB.saveForSnapshot(keys)
+	destDB.saveForSnapshot(keys)
+	rawTTL, hasTTL := srcDB.ttlMap.Get(key)
+	// 过期任务以 key 命名，必须先从源数据库删除再在目标数据库中设置过期时间
+	srcDB.Remove(key)
+	destDB.PutEntity(key, entity)
+	if hasTTL {
+		destDB.Expire(key, rawTTL.(time.Time))
+	}
+	srcDB.addAof(utils.ToCmdLine3("move", args...))
+	return true, nil
+}
+
 func init() {
-	RegisterCommand("Del", execDel, writeAllKeys, undoDel, -2, flagWrite)
-	RegisterCommand("Expire", execExpire, writeFirstKey, undoExpire, 3, flagWrite)
-	RegisterCommand("ExpireAt", execExpireAt, writeFirstKey, undoExpire, 3, flagWrite)
-	RegisterCommand("ExpireTime", execExpireTime, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("PExpire", execPExpire, writeFirstKey, undoExpire, 3, flagWrite)
-	RegisterCommand("PExpireAt", execPExpireAt, writeFirstKey, undoExpire, 3, flagWrite)
-	RegisterCommand("PExpireTime", execPExpireTime, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("TTL", execTTL, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("PTTL", execPTTL, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("Persist", execPersist, writeFirstKey, undoExpire, 2, flagWrite)
-	RegisterCommand("Exists", execExists, readAllKeys, nil, -2, flagReadOnly)
-	RegisterCommand("Type", execType, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("Rename", execRename, prepareRename, undoRename, 3, flagReadOnly)
-	RegisterCommand("RenameNx", execRenameNx, prepareRename, undoRename, 3, flagReadOnly)
-	//RegisterCommand("Keys", execKeys, noPrepare, nil, 2, flagReadOnly)
+	registerCommand("Del", execDel, writeAllKeys, undoDel, -2, flagWrite).attachKeys(1, -1, 1).attachCategory("keyspace")
+	registerCommand("Expire", execExpire, writeFirstKey, undoExpire, -3, flagWrite).attachCategory("keyspace")
+	registerCommand("ExpireAt", execExpireAt, writeFirstKey, undoExpire, -3, flagWrite).attachCategory("keyspace")
+	registerCommand("ExpireTime", execExpireTime, readFirstKey, nil, 2, flagReadOnly).attachCategory("keyspace")
+	registerCommand("PExpire", execPExpire, writeFirstKey, undoExpire, -3, flagWrite).attachCategory("keyspace")
+	registerCommand("PExpireAt", execPExpireAt, writeFirstKey, undoExpire, -3, flagWrite).attachCategory("keyspace")
+	registerCommand("PExpireTime", execPExpireTime, readFirstKey, nil, 2, flagReadOnly).attachCategory("keyspace")
+	registerCommand("TTL", execTTL, readFirstKey, nil, 2, flagReadOnly).attachCategory("keyspace")
+	registerCommand("PTTL", execPTTL, readFirstKey, nil, 2, flagReadOnly).attachCategory("keyspace")
+	registerCommand("Persist", execPersist, writeFirstKey, undoExpire, 2, flagWrite).attachCategory("keyspace")
+	registerCommand("Exists", execExists, readAllKeys, nil, -2, flagReadOnly).attachKeys(1, -1, 1).attachCategory("keyspace")
+	registerCommand("Type", execType, readFirstKey, nil, 2, flagReadOnly).attachCategory("keyspace")
+	registerCommand("Rename", execRename, prepareRename, undoRename, 3, flagWrite).attachKeys(1, 2, 1).attachCategory("keyspace")
+	registerCommand("RenameNx", execRenameNx, prepareRename, undoRename, 3, flagWrite).attachKeys(1, 2, 1).attachCategory("keyspace")
+	registerCommand("Keys", execKeys, noPrepare, nil, 2, flagReadOnly).attachKeys(0, 0, 0).attachCategory("keyspace")
+	registerCommand("Scan", execScan, noPrepare, nil, -2, flagReadOnly).attachKeys(0, 0, 0).attachCategory("keyspace")
+	registerCommand("RandomKey", execRandomKey, noPrepare, nil, 1, flagReadOnly).attachKeys(0, 0, 0).attachCategory("keyspace")
+	registerCommand("Touch", execTouch, readAllKeys, nil, -2, flagReadOnly).attachKeys(1, -1, 1).attachCategory("keyspace")
+	registerCommand("Unlink", execUnlink, writeAllKeys, undoDel, -2, flagWrite).attachKeys(1, -1, 1).attachCategory("keyspace")
+	registerCommand("DBSize", execDBSize, noPrepare, nil, 1, flagReadOnly).attachKeys(0, 0, 0).attachCategory("keyspace")
+	registerCommand("Dump", execDump, readFirstKey, nil, 2, flagReadOnly).attachCategory("keyspace")
+	registerCommand("Restore", execRestore, writeFirstKey, rollbackFirstKey, -4, flagWrite).attachCategory("keyspace")
 }
@@ -511,16 +511,16 @@ func execRPushX(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand("LPush", execLPush, writeFirstKey, undoLPush, -3, flagWrite)
-	RegisterCommand("LPushX", execLPushX, writeFirstKey, undoLPush, -3, flagWrite)
-	RegisterCommand("RPush", execRPush, writeFirstKey, undoRPush, -3, flagWrite)
-	RegisterCommand("RPushX", execRPushX, writeFirstKey, undoRPush, -3, flagWrite)
-	RegisterCommand("LPop", execLPop, writeFirstKey, undoLPop, 2, flagWrite)
-	RegisterCommand("RPop", execRPop, writeFirstKey, undoRPop, 2, flagWrite)
-	RegisterCommand("RPopLPush", execRPopLPush, prepareRPopLPush, undoRPopLPush, 3, flagWrite)
-	RegisterCommand("LRem", execLRem, writeFirstKey, rollbackFirstKey, 4, flagWrite)
-	RegisterCommand("LLen", execLLen, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("LIndex", execLIndex, readFirstKey, nil, 3, flagReadOnly)
-	RegisterCommand("LSet", execLSet, writeFirstKey, undoLSet, 4, flagWrite)
-	RegisterCommand("LRange", execLRange, readFirstKey, nil, 4, flagReadOnly)
+	registerCommand("LPush", execLPush, writeFirstKey, undoLPush, -3, flagWrite).attachCategory("list")
+	registerCommand("LPushX", execLPushX, writeFirstKey, undoLPush, -3, flagWrite).attachCategory("list")
+	registerCommand("RPush", execRPush, writeFirstKey, undoRPush, -3, flagWrite).attachCategory("list")
+	registerCommand("RPushX", execRPushX, writeFirstKey, undoRPush, -3, flagWrite).attachCategory("list")
+	registerCommand("LPop", execLPop, writeFirstKey, undoLPop, 2, flagWrite).attachCategory("list")
+	registerCommand("RPop", execRPop, writeFirstKey, undoRPop, 2, flagWrite).attachCategory("list")
+	registerCommand("RPopLPush", execRPopLPush, prepareRPopLPush, undoRPopLPush, 3, flagWrite).attachKeys(1, 2, 1).attachCategory("list")
+	registerCommand("LRem", execLRem, writeFirstKey, rollbackFirstKey, 4, flagWrite).attachCategory("list")
+	registerCommand("LLen", execLLen, readFirstKey, nil, 2, flagReadOnly).attachCategory("list")
+	registerCommand("LIndex", execLIndex, readFirstKey, nil, 3, flagReadOnly).attachCategory("list")
+	registerCommand("LSet", execLSet, writeFirstKey, undoLSet, 4, flagWrite).attachCategory("list")
+	registerCommand("LRange", execLRange, readFirstKey, nil, 4, flagReadOnly).attachCategory("list")
 }
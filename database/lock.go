@@ -0,0 +1,448 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"miniRedis/aof"
+	"miniRedis/interface/database"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * 分布式锁，每个锁是数据库中一个 lock 类型的 key：
+ *   LOCK key milliseconds [WAIT timeout]  加锁成功返回令牌，锁被占用时返回 nil。
+ *                                         WAIT 表示最多等待 timeout 毫秒，0 表示一直等待
+ *   UNLOCK key token                      令牌与当前持有者一致时释放锁，返回 1，否则返回 0
+ *   EXTEND key token milliseconds         令牌与当前持有者一致时将租约延长到 milliseconds 毫秒之后
+ *
+ * 令牌（fencing token）由每个编号的数据库中只增不减的计数器生成。计数器和 WATCH 使用的版本一样属于数据库编号，
+ * 不属于任何 key，DEL、EXPIRE、FLUSHDB、FLUSHALL 不会重置计数器，SWAPDB 之后两个数据库的计数器都取较大的值。
+ * 锁只能由 LOCK、UNLOCK、EXTEND 修改，不能 DUMP、RESTORE、COPY、MOVE 或者 RENAME，
+ * 否则其它 key 或者数据库中会出现令牌小于已发出令牌的租约。
+ * 租约的 key 在租约到期时过期删除，UNLOCK 直接删除 key。
+ * 加锁、释放和延长都以 LOCKSET key token deadline 的形式写入 AOF 和复制流，
+ * deadline 是租约到期的 unix 毫秒时间，0 表示已经释放，重放时不依赖当时的时间。
+ * 重写 AOF 时以 LOCKTOKEN token 保存计数器，重放 LOCKSET 和 LOCKTOKEN 时计数器只会增大。
+ * 事务和脚本之外的 LOCK 在返回令牌之前等待 AOF 刷新到磁盘，重启之后不会再次发出同一个令牌
+ */
+
+// lockState 是 lock 类型的值，只在持有 key 的锁时访问
+type lockState struct {
+	token    int64     // 持有者的令牌
+	deadline time.Time // 租约到期的时间，零值表示锁已经释放
+}
+
+func (state *lockState) isHeld(now time.Time) bool {
+	return !state.deadline.IsZero() && now.Before(state.deadline)
+}
+
+func (state *lockState) deadlineMillis() int64 {
+	if state.deadline.IsZero() {
+		return 0
+	}
+	return state.deadline.UnixNano() / int64(time.Millisecond)
+}
+
+var errBadLockPayload = errors.New("bad lock payload")
+
+func init() {
+	err := aof.RegisterDataType(&aof.DataType{
+		Name: "lock",
+		Match: func(data interface{}) bool {
+			_, ok := data.(*lockState)
+			return ok
+		},
+		ToCmd: func(key string, data interface{}) aof.CmdLine {
+			return makeLockSetCmd(key, data.(*lockState))
+		},
+		Marshal: func(data interface{}) []byte {
+			state := data.(*lockState)
+			payload := make([]byte, 16)
+			binary.BigEndian.PutUint64(payload, uint64(state.token))
+			binary.BigEndian.PutUint64(payload[8:], uint64(state.deadlineMillis()))
+			return payload
+		},
+		Unmarshal: func(payload []byte) (interface{}, error) {
+			if len(payload) != 16 {
+				return nil, errBadLockPayload
+			}
+			token := int64(binary.BigEndian.Uint64(payload))
+			deadline := int64(binary.BigEndian.Uint64(payload[8:]))
+			if token <= 0 || deadline < 0 {
+				return nil, errBadLockPayload
+			}
+			return makeLockState(token, deadline), nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	RegisterCommand("Lock", execLock, writeFirstKey, rollbackFirstKey, -3, flagWrite)
+	RegisterCommand("Unlock", execUnlock, writeFirstKey, rollbackFirstKey, 3, flagWrite)
+	RegisterCommand("Extend", execExtend, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	// LOCKSET 和 LOCKTOKEN 可以伪造令牌，只用于重放 AOF 和主服务器传播的命令
+	registerCommand("LockSet", execLockSet, writeFirstKey, rollbackFirstKey, 4, flagWrite).
+		attachReplayOnly()
+	registerCommand("LockToken", execLockToken, noPrepare, nil, 2, flagWrite).
+		attachKeys(0, 0, 0).
+		attachReplayOnly()
+}
+
+func makeLockState(token int64, deadline int64) *lockState {
+	state := &lockState{token: token}
+	if deadline > 0 {
+		state.deadline = time.Unix(0, deadline*int64(time.Millisecond))
+	}
+	return state
+}
+
+func makeLockSetCmd(key string, state *lockState) CmdLine {
+	return utils.ToCmdLine("LOCKSET", key,
+		strconv.FormatInt(state.token, 10), strconv.FormatInt(state.deadlineMillis(), 10))
+}
+
+func makeLockTokenCmd(token int64) CmdLine {
+	return utils.ToCmdLine("LOCKTOKEN", strconv.FormatInt(token, 10))
+}
+
+// nextLockToken 返回数据库的下一个令牌，不会小于 key 上已有的令牌。
+// 计数器达到 int64 的最大值之后不再发出令牌，返回 false
+func (db *DB) nextLockToken(state *lockState) (int64, bool) {
+	if state != nil {
+		// 从 RDB 文件加载的 key 可能带有大于计数器的令牌
+		raiseLockToken(db.lockToken, state.token)
+	}
+	for {
+		token := atomic.LoadInt64(db.lockToken)
+		if token == math.MaxInt64 {
+			return 0, false
+		}
+		if atomic.CompareAndSwapInt64(db.lockToken, token, token+1) {
+			return token + 1, true
+		}
+	}
+}
+
+// raiseLockToken 将计数器增大到 token，计数器已经不小于 token 时不做修改
+func raiseLockToken(counter *int64, token int64) {
+	for {
+		current := atomic.LoadInt64(counter)
+		if current >= token || atomic.CompareAndSwapInt64(counter, current, token) {
+			return
+		}
+	}
+}
+
+// putLockState 保存锁的状态，租约到期时 key 过期删除
+func (db *DB) putLockState(key string, state *lockState) {
+	db.PutEntity(key, &database.DataEntity{Data: state})
+	db.Expire(key, state.deadline)
+}
+
+// isLockEntity 判断数据实体是否是锁
+func isLockEntity(entity *database.DataEntity) bool {
+	_, ok := entity.Data.(*lockState)
+	return ok
+}
+
+func makeLockTransferErrReply() protocol.ErrorReply {
+	return protocol.MakeErrReply("ERR lock values can only be changed by LOCK, UNLOCK and EXTEND")
+}
+
+func (db *DB) getLockState(key string) (*lockState, protocol.ErrorReply) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil, nil
+	}
+	state, ok := entity.Data.(*lockState)
+	if !ok {
+		return nil, &protocol.WrongTypeErrReply{}
+	}
+	return state, nil
+}
+
+// parseLockArgs 解析 LOCK key milliseconds [WAIT timeout]，block 表示是否需要等待
+func parseLockArgs(args [][]byte) (ttl time.Duration, wait time.Duration, block bool, errReply protocol.ErrorReply) {
+	ttl, errReply = parseLockTTL(args[1])
+	if errReply != nil {
+		return 0, 0, false, errReply
+	}
+	if len(args) == 2 {
+		return ttl, 0, false, nil
+	}
+	if len(args) != 4 || strings.ToLower(string(args[2])) != "wait" {
+		return 0, 0, false, &protocol.SyntaxErrReply{}
+	}
+	timeout, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil || timeout < 0 {
+		return 0, 0, false, protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	return ttl, time.Duration(timeout) * time.Millisecond, true, nil
+}
+
+func parseLockTTL(arg []byte) (time.Duration, protocol.ErrorReply) {
+	ttl, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || ttl <= 0 {
+		return 0, protocol.MakeErrReply("ERR invalid expire time in 'lock' command")
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+func parseLockToken(arg []byte) (int64, protocol.ErrorReply) {
+	token, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || token <= 0 {
+		return 0, protocol.MakeErrReply("ERR token is not an integer or out of range")
+	}
+	return token, nil
+}
+
+// execLock 尝试加锁，不会等待。LOCK ... WAIT 由 Server.execLock 重试
+func execLock(db *DB, args [][]byte) redis.Reply {
+	ttl, _, _, errReply := parseLockArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+	key := string(args[0])
+	state, errReply := db.getLockState(key)
+	if errReply != nil {
+		return errReply
+	}
+	now := time.Now()
+	if state != nil && state.isHeld(now) {
+		return protocol.MakeNullBulkReply()
+	}
+	token, ok := db.nextLockToken(state)
+	if !ok {
+		return protocol.MakeErrReply("ERR fencing tokens of this database are exhausted")
+	}
+	state = &lockState{token: token, deadline: now.Add(ttl)}
+	db.putLockState(key, state)
+	db.addAof(makeLockSetCmd(key, state))
+	return protocol.MakeIntReply(state.token)
+}
+
+// execUnlock UNLOCK key token
+func execUnlock(db *DB, args [][]byte) redis.Reply {
+	token, errReply := parseLockToken(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	key := string(args[0])
+	state, errReply := db.getLockState(key)
+	if errReply != nil {
+		return errReply
+	}
+	if state == nil || state.token != token || !state.isHeld(time.Now()) {
+		return protocol.MakeIntReply(0)
+	}
+	db.Remove(key)
+	db.addAof(makeLockSetCmd(key, &lockState{token: token}))
+	db.lockWaiters.wake(key)
+	return protocol.MakeIntReply(1)
+}
+
+// execExtend EXTEND key token milliseconds，租约已经到期的锁不能再延长
+func execExtend(db *DB, args [][]byte) redis.Reply {
+	token, errReply := parseLockToken(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	ttl, errReply := parseLockTTL(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	key := string(args[0])
+	state, errReply := db.getLockState(key)
+	if errReply != nil {
+		return errReply
+	}
+	now := time.Now()
+	if state == nil || state.token != token || !state.isHeld(now) {
+		return protocol.MakeIntReply(0)
+	}
+	state = &lockState{token: token, deadline: now.Add(ttl)}
+	db.putLockState(key, state)
+	db.addAof(makeLockSetCmd(key, state))
+	return protocol.MakeIntReply(1)
+}
+
+// execLockSet LOCKSET key token deadline 直接设置锁的状态，用于 AOF 和复制，令牌不能小于已有的令牌。
+// 租约已经到期或者释放时删除 key，只增大计数器
+func execLockSet(db *DB, args [][]byte) redis.Reply {
+	token, errReply := parseLockToken(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	deadline, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil || deadline < 0 {
+		return protocol.MakeErrReply("ERR deadline is not an integer or out of range")
+	}
+	key := string(args[0])
+	state, errReply := db.getLockState(key)
+	if errReply != nil {
+		return errReply
+	}
+	if state != nil && token < state.token {
+		return protocol.MakeErrReply("ERR fencing token can not go backwards")
+	}
+	raiseLockToken(db.lockToken, token)
+	newState := makeLockState(token, deadline)
+	if newState.isHeld(time.Now()) {
+		db.putLockState(key, newState)
+	} else {
+		db.Remove(key)
+		db.lockWaiters.wake(key)
+	}
+	db.addAof(makeLockSetCmd(key, newState))
+	return protocol.MakeOkReply()
+}
+
+// execLockToken LOCKTOKEN token 将数据库的令牌计数器增大到 token，用于 AOF 和复制
+func execLockToken(db *DB, args [][]byte) redis.Reply {
+	token, errReply := parseLockToken(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	raiseLockToken(db.lockToken, token)
+	db.addAof(makeLockTokenCmd(token))
+	return protocol.MakeOkReply()
+}
+
+// lockLease 返回锁的租约剩余的时间，锁没有被持有时返回 0
+func (db *DB) lockLease(key string, now time.Time) time.Duration {
+	keys := []string{key}
+	db.RWLocks(nil, keys)
+	defer db.RWUnLocks(nil, keys)
+	entity, ok := db.peekEntity(key)
+	if !ok {
+		return 0
+	}
+	state, ok := entity.Data.(*lockState)
+	if !ok || !state.isHeld(now) {
+		return 0
+	}
+	return state.deadline.Sub(now)
+}
+
+// execLock 执行 LOCK，带有 WAIT 时在锁被释放或者租约到期之后重试。
+// 等待期间不持有 key 的锁，每次重试都重新选择数据库，FLUSHDB、SWAPDB 之后使用新的数据库
+func (server *Server) execLock(c redis.Connection, cmdLine [][]byte) redis.Reply {
+	if !validateArity(-3, cmdLine) {
+		return protocol.MakeArgNumErrReply("lock")
+	}
+	_, wait, block, errReply := parseLockArgs(cmdLine[1:])
+	if errReply != nil {
+		return errReply
+	}
+	var waitUntil time.Time
+	if wait > 0 {
+		waitUntil = time.Now().Add(wait)
+	}
+	key := string(cmdLine[1])
+	for {
+		db, errReply := server.selectDB(c.GetDBIndex())
+		if errReply != nil {
+			return errReply
+		}
+		// 先开始等待再尝试加锁，不会错过两者之间的释放
+		released, cancel := db.lockWaiters.wait(key)
+		reply := db.Exec(c, cmdLine)
+		if _, ok := reply.(*protocol.IntReply); ok {
+			cancel()
+			// 令牌写入磁盘之后才返回，重启之后计数器不会回退
+			if server.persister != nil {
+				server.persister.Fsync()
+			}
+			return reply
+		}
+		now := time.Now()
+		if protocol.IsErrorReply(reply) || !block || (wait > 0 && !now.Before(waitUntil)) {
+			cancel()
+			return reply
+		}
+		// 租约到期时锁自动释放，没有 UNLOCK 通知，最多等到租约到期再重试
+		timeout := db.lockLease(key, now)
+		if timeout <= 0 {
+			timeout = time.Millisecond
+		}
+		if wait > 0 && waitUntil.Sub(now) < timeout {
+			timeout = waitUntil.Sub(now)
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case <-released:
+		case <-timer.C:
+		case <-c.CloseNotify():
+			timer.Stop()
+			cancel()
+			return reply
+		}
+		timer.Stop()
+		cancel()
+	}
+}
+
+// lockWaiters 通知 LOCK ... WAIT 中等待的客户端锁已经释放
+type lockWaiters struct {
+	mu      sync.Mutex
+	waiting map[string]*lockWaiter
+}
+
+type lockWaiter struct {
+	released chan struct{}
+	refs     int
+}
+
+func makeLockWaiters() *lockWaiters {
+	return &lockWaiters{waiting: make(map[string]*lockWaiter)}
+}
+
+// wait 返回一个在 key 上的锁释放时关闭的 channel，不再等待时需要调用 cancel
+func (w *lockWaiters) wait(key string) (<-chan struct{}, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiter, ok := w.waiting[key]
+	if !ok {
+		waiter = &lockWaiter{released: make(chan struct{})}
+		w.waiting[key] = waiter
+	}
+	waiter.refs++
+	once := sync.Once{}
+	return waiter.released, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			waiter.refs--
+			if waiter.refs == 0 && w.waiting[key] == waiter {
+				delete(w.waiting, key)
+			}
+		})
+	}
+}
+
+func (w *lockWaiters) wake(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if waiter, ok := w.waiting[key]; ok {
+		close(waiter.released)
+		delete(w.waiting, key)
+	}
+}
+
+// wakeAll 唤醒所有等待的客户端，数据库被替换时调用
+func (w *lockWaiters) wakeAll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, waiter := range w.waiting {
+		close(waiter.released)
+		delete(w.waiting, key)
+	}
+}
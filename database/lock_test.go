@@ -0,0 +1,92 @@
+package database
+
+import (
+	"miniRedis/aof"
+	"miniRedis/interface/database"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/connection"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"testing"
+)
+
+func execCmd(server *Server, conn redis.Connection, args ...string) redis.Reply {
+	return server.Exec(conn, utils.ToCmdLine(args...))
+}
+
+func assertIntReply(t *testing.T, reply redis.Reply, want int64) {
+	t.Helper()
+	intReply, ok := reply.(*protocol.IntReply)
+	if !ok {
+		t.Fatalf("expected int reply %d, got %s", want, reply.ToBytes())
+	}
+	if intReply.Code != want {
+		t.Fatalf("expected %d, got %d", want, intReply.Code)
+	}
+}
+
+func assertErrReply(t *testing.T, reply redis.Reply) {
+	t.Helper()
+	if !protocol.IsErrorReply(reply) {
+		t.Fatalf("expected error reply, got %s", reply.ToBytes())
+	}
+}
+
+// lockAndUnlock 加锁再释放，返回发出的令牌
+func lockAndUnlock(t *testing.T, server *Server, conn redis.Connection, key string) int64 {
+	t.Helper()
+	reply := execCmd(server, conn, "LOCK", key, "10000")
+	token, ok := reply.(*protocol.IntReply)
+	if !ok {
+		t.Fatalf("lock failed: %s", reply.ToBytes())
+	}
+	assertIntReply(t, execCmd(server, conn, "UNLOCK", key, strconv.FormatInt(token.Code, 10)), 1)
+	return token.Code
+}
+
+func TestLockNotTransferable(t *testing.T) {
+	server := NewStandaloneServer()
+	conn := connection.NewFakeConn()
+	lockAndUnlock(t, server, conn, "k")
+	lockAndUnlock(t, server, conn, "k")
+	assertIntReply(t, execCmd(server, conn, "LOCK", "k", "10000"), 3)
+	assertIntReply(t, execCmd(server, conn, "LOCK", "held", "10000"), 4)
+
+	assertErrReply(t, execCmd(server, conn, "MOVE", "k", "1"))
+	assertErrReply(t, execCmd(server, conn, "COPY", "k", "k", "DB", "1"))
+	assertErrReply(t, execCmd(server, conn, "COPY", "k", "held", "REPLACE"))
+	assertErrReply(t, execCmd(server, conn, "RENAME", "k", "k2"))
+	assertErrReply(t, execCmd(server, conn, "RENAMENX", "k", "k2"))
+	assertErrReply(t, execCmd(server, conn, "DUMP", "k"))
+
+	// 锁仍然在原来的 key 上，释放之后令牌继续增长
+	assertIntReply(t, execCmd(server, conn, "UNLOCK", "k", "3"), 1)
+	assertIntReply(t, execCmd(server, conn, "LOCK", "k", "10000"), 5)
+	assertIntReply(t, execCmd(server, conn, "EXTEND", "held", "4", "10000"), 1)
+
+	// 事务中的 MOVE 和 COPY 同样被拒绝
+	execCmd(server, conn, "MULTI")
+	execCmd(server, conn, "MOVE", "k", "1")
+	execCmd(server, conn, "COPY", "k", "k", "DB", "1")
+	execCmd(server, conn, "EXEC")
+	conn.SelectDB(1)
+	assertIntReply(t, execCmd(server, conn, "EXISTS", "k"), 0)
+}
+
+func TestRestoreLockPayload(t *testing.T) {
+	server := NewStandaloneServer()
+	conn := connection.NewFakeConn()
+	assertIntReply(t, execCmd(server, conn, "LOCK", "k", "10000"), 1)
+
+	// 伪造一个令牌为 100、租约到 2100 年的锁
+	payload := aof.DumpEntity(&database.DataEntity{Data: makeLockState(100, 4102444800000)})
+	if payload == nil {
+		t.Fatal("lock values should be serializable for rdb")
+	}
+	assertErrReply(t, execCmd(server, conn, "RESTORE", "forged", "0", string(payload)))
+	assertErrReply(t, execCmd(server, conn, "RESTORE", "k", "0", string(payload), "REPLACE"))
+	assertIntReply(t, execCmd(server, conn, "EXISTS", "forged"), 0)
+	assertIntReply(t, execCmd(server, conn, "UNLOCK", "k", "1"), 1)
+	assertIntReply(t, execCmd(server, conn, "LOCK", "k", "10000"), 2)
+}
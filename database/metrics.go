@@ -0,0 +1,161 @@
+package database
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"miniRedis/config"
+	"miniRedis/lib/logger"
+	"miniRedis/tcp"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ * 以 Prometheus 文本格式导出服务器的运行指标，通过配置 metrics-port 开启
+ */
+
+const metricsPath = "/metrics"
+
+// startMetricsServer 在 metrics-port 上启动 HTTP 服务，监听失败只记录日志，不影响数据库的启动
+func (server *Server) startMetricsServer(port int) {
+	addr := net.JoinHostPort(config.Properties.Bind, strconv.Itoa(port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("start metrics server failed: " + err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		server.WriteMetrics(w)
+	})
+	server.metricsServer = &http.Server{Handler: mux}
+	logger.Info("metrics server listening on " + addr + metricsPath)
+	go func() {
+		if err := server.metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("metrics server stopped: " + err.Error())
+		}
+	}()
+}
+
+// metricsWriter 负责输出指标的 HELP/TYPE 注释以及样本
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw *metricsWriter) sample(name string, labels string, value interface{}) {
+	if labels != "" {
+		fmt.Fprintf(mw.w, "%s{%s} %v\n", name, labels, value)
+	} else {
+		fmt.Fprintf(mw.w, "%s %v\n", name, value)
+	}
+}
+
+func (mw *metricsWriter) single(name, typ, help string, value interface{}) {
+	mw.header(name, typ, help)
+	mw.sample(name, "", value)
+}
+
+// label 生成一个标签，值中的反斜杠、引号和换行需要转义
+func label(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteMetrics writes all metrics in prometheus text format
+func (server *Server) WriteMetrics(out io.Writer) {
+	mw := &metricsWriter{w: bufio.NewWriter(out)}
+	defer mw.w.Flush()
+
+	mw.single("miniredis_uptime_seconds", "gauge", "Number of seconds since the server started.",
+		int64(getMiniRedisRunningTime()))
+	mw.single("miniredis_connected_clients", "gauge", "Number of client connections.", tcp.ClientCounter)
+	// 目前没有实现阻塞命令
+	mw.single("miniredis_blocked_clients", "gauge", "Number of clients pending on a blocking call.", 0)
+
+	// keyspace
+	mw.header("miniredis_db_keys", "gauge", "Number of keys in each database.")
+	for i := range server.dbSet {
+		keys, _ := server.GetDBSize(i)
+		mw.sample("miniredis_db_keys", label("db", "db"+strconv.Itoa(i)), keys)
+	}
+	mw.header("miniredis_db_keys_expiring", "gauge", "Number of keys with an expiration in each database.")
+	for i := range server.dbSet {
+		_, expires := server.GetDBSize(i)
+		mw.sample("miniredis_db_keys_expiring", label("db", "db"+strconv.Itoa(i)), expires)
+	}
+	mw.single("miniredis_keyspace_hits_total", "counter", "Number of successful lookups of keys.",
+		atomic.LoadInt64(&stats.keyspaceHits))
+	mw.single("miniredis_keyspace_misses_total", "counter", "Number of failed lookups of keys.",
+		atomic.LoadInt64(&stats.keyspaceMisses))
+	mw.single("miniredis_expired_keys_total", "counter", "Number of keys removed because of expiration.",
+		atomic.LoadInt64(&stats.expiredKeys))
+	mw.single("miniredis_evicted_keys_total", "counter", "Number of keys evicted due to maxmemory limit.",
+		atomic.LoadInt64(&stats.evictedKeys))
+
+	// pubsub
+	mw.single("miniredis_pubsub_channels", "gauge", "Number of channels with at least one subscriber.",
+		server.hub.ChannelCount())
+
+	// aof
+	aofEnabled, queueLen, rewriting, lastRewriteFailed := false, 0, false, false
+	var aofCurrentSize int64
+	if server.aofEnabled() {
+		aofEnabled = true
+		queueLen = server.persister.QueueLen()
+		aofCurrentSize = server.persister.CurrentSize()
+		rewriting = server.persister.IsRewriting()
+		lastRewriteFailed = server.persister.LastRewriteFailed()
+	}
+	mw.single("miniredis_aof_enabled", "gauge", "Whether AOF persistence is enabled.", boolToInt(aofEnabled))
+	mw.single("miniredis_aof_buffer_length", "gauge", "Number of commands waiting to be written into the AOF file.", queueLen)
+	mw.single("miniredis_aof_rewrite_in_progress", "gauge", "Whether an AOF rewrite is in progress.", boolToInt(rewriting))
+	mw.single("miniredis_aof_last_rewrite_success", "gauge", "Whether the last AOF rewrite succeeded.", boolToInt(!lastRewriteFailed))
+	mw.single("miniredis_aof_current_size_bytes", "gauge", "Total size of the AOF files.", aofCurrentSize)
+
+	// commands
+	mw.single("miniredis_commands_processed_total", "counter", "Total number of commands processed.",
+		atomic.LoadInt64(&stats.totalCommands))
+	mw.header("miniredis_commands_total", "counter", "Number of calls of each command.")
+	stats.forEachCommand(func(name string, stat *commandStat) {
+		mw.sample("miniredis_commands_total", label("cmd", name), atomic.LoadInt64(&stat.calls))
+	})
+	mw.header("miniredis_commands_failed_total", "counter", "Number of failed calls of each command.")
+	stats.forEachCommand(func(name string, stat *commandStat) {
+		mw.sample("miniredis_commands_failed_total", label("cmd", name), atomic.LoadInt64(&stat.failedCalls))
+	})
+	mw.header("miniredis_command_duration_seconds", "histogram", "Latency of each command.")
+	stats.forEachCommand(func(name string, stat *commandStat) {
+		cmdLabel := label("cmd", name)
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += atomic.LoadInt64(&stat.buckets[i])
+			le := strconv.FormatFloat(float64(bound)/1e6, 'g', -1, 64)
+			mw.sample("miniredis_command_duration_seconds_bucket", cmdLabel+","+label("le", le), cumulative)
+		}
+		cumulative += atomic.LoadInt64(&stat.buckets[len(latencyBuckets)])
+		mw.sample("miniredis_command_duration_seconds_bucket", cmdLabel+","+label("le", "+Inf"), cumulative)
+		mw.sample("miniredis_command_duration_seconds_sum", cmdLabel,
+			strconv.FormatFloat(float64(atomic.LoadInt64(&stat.usec))/1e6, 'g', -1, 64))
+		mw.sample("miniredis_command_duration_seconds_count", cmdLabel, cumulative)
+	})
+	mw.header("miniredis_errors_total", "counter", "Number of error replies grouped by error prefix.")
+	stats.forEachError(func(prefix string, count int64) {
+		mw.sample("miniredis_errors_total", label("error", prefix), count)
+	})
+}
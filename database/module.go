@@ -0,0 +1,183 @@
+package database
+
+import (
+	"errors"
+	"miniRedis/interface/redis"
+	"miniRedis/redis/protocol"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+ * 模块在编译时链接进服务器，并在 init 中通过 miniRedis/module 包注册命令和数据类型，
+ * 这里维护已加载的模块，并将模块的命令加入 cmdTable
+ */
+
+// ModuleCommand 描述模块提供的一个命令
+type ModuleCommand struct {
+	Name     string
+	Executor ExecFunc
+	// Prepare 返回命令写入和读取的 key，用于加锁、事务和 COMMAND GETKEYS。
+	// 为 nil 时根据 FirstKey、LastKey 和 KeyStep 得到 key，只读命令的 key 视为读取，否则视为写入
+	Prepare PreFunc
+	// Undo 返回事务回滚时撤销该命令的命令，为 nil 时写命令会恢复所有写入的 key
+	Undo     UndoFunc
+	Arity    int
+	ReadOnly bool
+	// key 的位置，含义与 COMMAND INFO 相同，FirstKey 为 0 表示没有 key
+	FirstKey    int
+	LastKey     int
+	KeyStep     int
+	MovableKeys bool
+	Flags       []string // COMMAND INFO 中读写标志以外的标志，例如 fast
+}
+
+type moduleInfo struct {
+	name     string
+	version  int
+	commands []string
+}
+
+var (
+	loadedModules = make(map[string]*moduleInfo)
+	modulesMu     sync.Mutex
+)
+
+// LoadModule 注册模块提供的命令，需要在服务器启动之前调用。
+// 模块名或者命令名与已有的重复时返回错误，并且不会注册模块的任何命令
+func LoadModule(name string, version int, commands []*ModuleCommand) error {
+	if name == "" {
+		return errors.New("module name is empty")
+	}
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	if loadedModules[name] != nil {
+		return errors.New("module " + name + " already loaded")
+	}
+	cmds := make([]*command, 0, len(commands))
+	seen := make(map[string]bool, len(commands))
+	for _, spec := range commands {
+		cmd, err := makeModuleCommand(name, spec)
+		if err != nil {
+			return err
+		}
+		if seen[cmd.name] || lookupCommand(cmd.name) != nil {
+			return errors.New("command " + cmd.name + " already exists")
+		}
+		seen[cmd.name] = true
+		cmds = append(cmds, cmd)
+	}
+	info := &moduleInfo{name: name, version: version}
+	for _, cmd := range cmds {
+		cmdTable[cmd.name] = cmd
+		info.commands = append(info.commands, cmd.name)
+	}
+	loadedModules[name] = info
+	return nil
+}
+
+func makeModuleCommand(module string, spec *ModuleCommand) (*command, error) {
+	if spec == nil || spec.Name == "" || spec.Executor == nil {
+		return nil, errors.New("module " + module + " registers a command without name or executor")
+	}
+	if spec.Arity == 0 {
+		return nil, errors.New("arity of command " + spec.Name + " must not be 0")
+	}
+	flags := flagWrite
+	if spec.ReadOnly {
+		flags = flagReadOnly
+	}
+	cmd := &command{
+		name:        strings.ToLower(spec.Name),
+		executor:    spec.Executor,
+		prepare:     spec.Prepare,
+		undo:        spec.Undo,
+		arity:       spec.Arity,
+		flags:       flags,
+		firstKey:    spec.FirstKey,
+		lastKey:     spec.LastKey,
+		keyStep:     spec.KeyStep,
+		movableKeys: spec.MovableKeys,
+		extraFlags:  spec.Flags,
+		module:      module,
+	}
+	if cmd.keyStep == 0 && cmd.firstKey > 0 {
+		cmd.keyStep = 1
+	}
+	if cmd.prepare == nil {
+		cmd.prepare = keyRangePrepare(cmd.firstKey, cmd.lastKey, cmd.keyStep, spec.ReadOnly)
+	}
+	if cmd.undo == nil && !spec.ReadOnly {
+		prepare := cmd.prepare
+		cmd.undo = func(db *DB, args [][]byte) []CmdLine {
+			writeKeys, _ := prepare(args)
+			return rollbackGivenKeys(db, writeKeys...)
+		}
+	}
+	return cmd, nil
+}
+
+// keyRangePrepare 根据 COMMAND INFO 中的 key 位置生成 PreFunc，位置从命令名开始计算
+func keyRangePrepare(firstKey, lastKey, keyStep int, readOnly bool) PreFunc {
+	if firstKey <= 0 {
+		return noPrepare
+	}
+	return func(args [][]byte) ([]string, []string) {
+		last := lastKey
+		if last < 0 {
+			last = len(args) + 1 + last
+		}
+		var keys []string
+		for i := firstKey; i <= last && i <= len(args); i += keyStep {
+			keys = append(keys, string(args[i-1]))
+		}
+		if readOnly {
+			return nil, keys
+		}
+		return keys, nil
+	}
+}
+
+// execModule MODULE LIST
+// 模块只能在编译时链接，不支持 LOAD 和 UNLOAD
+func execModule(args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("module")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "list":
+		if len(args) != 1 {
+			return protocol.MakeErrReply("ERR wrong number of arguments for 'module|list' command")
+		}
+		modulesMu.Lock()
+		infos := make([]*moduleInfo, 0, len(loadedModules))
+		for _, info := range loadedModules {
+			infos = append(infos, info)
+		}
+		modulesMu.Unlock()
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].name < infos[j].name
+		})
+		replies := make([]redis.Reply, len(infos))
+		for i, info := range infos {
+			replies[i] = protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("name")), protocol.MakeBulkReply([]byte(info.name)),
+				protocol.MakeBulkReply([]byte("ver")), protocol.MakeIntReply(int64(info.version)),
+				protocol.MakeBulkReply([]byte("path")), protocol.MakeBulkReply([]byte("builtin")),
+				protocol.MakeBulkReply([]byte("args")), protocol.MakeEmptyMultiBulkReply(),
+				protocol.MakeBulkReply([]byte("commands")), makeBulkArray(info.commands),
+			})
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "load", "loadex", "unload":
+		return protocol.MakeErrReply("ERR modules are linked at build time, MODULE " + strings.ToUpper(subCmd) + " is not supported")
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try MODULE HELP.")
+}
+
+// AddAof 将命令写入 AOF，模块的写命令需要通过它持久化修改
+func (db *DB) AddAof(cmdLine CmdLine) {
+	db.addAof(cmdLine)
+}
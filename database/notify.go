@@ -0,0 +1,85 @@
+package database
+
+import (
+	"miniRedis/lib/logger"
+	"sync"
+)
+
+/*
+ * keyspace 事件：写命令执行成功或者 key 过期后通知订阅者，供模块维护索引、统计等附加状态。
+ * 订阅者在持有 key 锁的协程中被同步调用，因此不能再通过 Exec 访问数据库，耗时的工作应当交给其它协程
+ */
+
+// KeyspaceEvent 表示一次对 key 的修改
+type KeyspaceEvent struct {
+	DBIndex int
+	Event   string // 修改 key 的命令名（小写），过期删除时为 expired
+	Key     string
+}
+
+// KeyspaceListener 接收 keyspace 事件
+type KeyspaceListener func(event *KeyspaceEvent)
+
+var (
+	keyspaceListeners   []KeyspaceListener
+	keyspaceListenersMu sync.RWMutex
+)
+
+// SubscribeKeyspaceEvents 订阅所有数据库的 keyspace 事件
+func SubscribeKeyspaceEvents(listener KeyspaceListener) {
+	keyspaceListenersMu.Lock()
+	defer keyspaceListenersMu.Unlock()
+	keyspaceListeners = append(keyspaceListeners, listener)
+}
+
+func hasKeyspaceListeners() bool {
+	keyspaceListenersMu.RLock()
+	defer keyspaceListenersMu.RUnlock()
+	return len(keyspaceListeners) > 0
+}
+
+func (db *DB) notifyKeyspaceEvent(event string, keys ...string) {
+	if len(keys) == 0 || !hasKeyspaceListeners() {
+		return
+	}
+	events := make([]*KeyspaceEvent, len(keys))
+	for i, key := range keys {
+		events[i] = &KeyspaceEvent{DBIndex: db.index, Event: event, Key: key}
+	}
+	// 事务中的修改可能被回滚，提交之后再通知。过期删除不会被回滚，
+	// 而且事务中设置的过期任务会在事务结束之后才执行，所以总是立即通知
+	if db.pendingEvents != nil && event != "expired" {
+		*db.pendingEvents = append(*db.pendingEvents, events...)
+		return
+	}
+	dispatchKeyspaceEvents(events)
+}
+
+// dispatchKeyspaceEvents 按照顺序将事件发送给所有的订阅者
+func dispatchKeyspaceEvents(events []*KeyspaceEvent) {
+	keyspaceListenersMu.RLock()
+	listeners := keyspaceListeners
+	keyspaceListenersMu.RUnlock()
+	// 订阅者的错误不应该影响命令的执行
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error(err)
+		}
+	}()
+	for _, e := range events {
+		for _, listener := range listeners {
+			listener(e)
+		}
+	}
+}
+
+// notifyWrite 在写命令执行成功后通知命令修改的 key
+func (db *DB) notifyWrite(cmd *command, cmdLine [][]byte, writeKeys []string) {
+	if cmd.flags&flagReadOnly != 0 || !hasKeyspaceListeners() {
+		return
+	}
+	if writeKeys == nil {
+		writeKeys, _ = cmd.prepare(cmdLine[1:])
+	}
+	db.notifyKeyspaceEvent(cmd.name, writeKeys...)
+}
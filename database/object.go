@@ -0,0 +1,209 @@
+package database
+
+import (
+	"math/rand"
+	"miniRedis/datastruct/dict"
+	List "miniRedis/datastruct/list"
+	"miniRedis/datastruct/set"
+	SortedSet "miniRedis/datastruct/sortedset"
+	"miniRedis/interface/database"
+	"miniRedis/interface/redis"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * object.go 记录每个数据实体的访问信息，并实现 OBJECT 命令
+ * 访问频率使用与 redis 相同的对数计数器（LFU）：计数越大，再次增加的概率越小；空闲一段时间后计数会衰减
+ */
+
+const (
+	lfuInitVal    = 5  // 新建实体的初始计数，避免新写入的 key 立刻被认为是冷数据
+	lfuLogFactor  = 10 // 对数因子，越大计数器增长得越慢
+	lfuDecayTime  = 1  // 每空闲多少分钟计数器减一
+	lfuCounterMax = 255
+
+	// 以下阈值与 redis 默认配置一致，仅用于 OBJECT ENCODING 的展示
+	embstrSizeLimit     = 44
+	listpackMaxEntries  = 128
+	listpackMaxValueLen = 64
+	intsetMaxEntries    = 512
+)
+
+// initEntityAccess 初始化新放入数据库的实体的访问信息
+func initEntityAccess(entity *database.DataEntity) {
+	if atomic.LoadInt64(&entity.AccessTime) != 0 {
+		// 例如 rename 时实体被移动到新的 key 下，保留原有的访问信息
+		return
+	}
+	atomic.StoreUint32(&entity.AccessFreq, lfuInitVal)
+	atomic.StoreInt64(&entity.AccessTime, time.Now().UnixMilli())
+}
+
+// touchEntity 更新实体的访问时间及访问频率
+func touchEntity(entity *database.DataEntity) {
+	now := time.Now().UnixMilli()
+	counter := lfuLogIncr(lfuDecr(entity, now))
+	atomic.StoreUint32(&entity.AccessFreq, counter)
+	atomic.StoreInt64(&entity.AccessTime, now)
+}
+
+// lfuDecr 根据空闲时间返回衰减后的访问计数，不会修改实体
+func lfuDecr(entity *database.DataEntity, now int64) uint32 {
+	counter := atomic.LoadUint32(&entity.AccessFreq)
+	idle := now - atomic.LoadInt64(&entity.AccessTime)
+	periods := uint32(idle / int64(time.Minute/time.Millisecond) / lfuDecayTime)
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// lfuLogIncr 以对数概率增加访问计数
+func lfuLogIncr(counter uint32) uint32 {
+	if counter >= lfuCounterMax {
+		return lfuCounterMax
+	}
+	baseVal := float64(0)
+	if counter > lfuInitVal {
+		baseVal = float64(counter - lfuInitVal)
+	}
+	p := 1.0 / (baseVal*lfuLogFactor + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+// objectEncoding 返回实体在 redis 中对应的编码方式
+func objectEncoding(entity *database.DataEntity) string {
+	switch val := entity.Data.(type) {
+	case []byte:
+		if len(val) <= 20 {
+			if _, err := strconv.ParseInt(string(val), 10, 64); err == nil {
+				return "int"
+			}
+		}
+		if len(val) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case List.List:
+		if val.Len() <= listpackMaxEntries {
+			return "listpack"
+		}
+		return "quicklist"
+	case *set.Set:
+		if val.Len() <= intsetMaxEntries {
+			allInt := true
+			val.ForEach(func(member string) bool {
+				_, err := strconv.ParseInt(member, 10, 64)
+				allInt = err == nil
+				return allInt
+			})
+			if allInt {
+				return "intset"
+			}
+		}
+		if val.Len() <= listpackMaxEntries {
+			return "listpack"
+		}
+		return "hashtable"
+	case *SortedSet.SortedSet:
+		if val.Len() > listpackMaxEntries {
+			return "skiplist"
+		}
+		small := true
+		val.ForEach(0, val.Len(), false, func(element *SortedSet.Element) bool {
+			small = len(element.Member) <= listpackMaxValueLen
+			return small
+		})
+		if small {
+			return "listpack"
+		}
+		return "skiplist"
+	case dict.Dict:
+		if val.Len() > listpackMaxEntries {
+			return "hashtable"
+		}
+		small := true
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			small = len(field) <= listpackMaxValueLen && len(bytes) <= listpackMaxValueLen
+			return small
+		})
+		if small {
+			return "listpack"
+		}
+		return "hashtable"
+	}
+	return "unknown"
+}
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+func prepareObject(args [][]byte) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return nil, []string{string(args[1])}
+}
+
+// execObject inspects the internals of the value stored at key, it does not count as an access of the key
+// OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT key
+// OBJECT HELP
+func execObject(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToUpper(string(args[0]))
+	if subCmd == "HELP" && len(args) == 1 {
+		lines := make([]redis.Reply, len(objectHelp))
+		for i, line := range objectHelp {
+			lines[i] = protocol.MakeStatusReply(line)
+		}
+		return protocol.MakeMultiRawReply(lines)
+	}
+	if len(args) != 2 {
+		return protocol.MakeErrReply("ERR unknown subcommand or wrong number of arguments for '" +
+			string(args[0]) + "'. Try OBJECT HELP.")
+	}
+
+	entity, exists := db.peekEntity(string(args[1]))
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	switch subCmd {
+	case "ENCODING":
+		return protocol.MakeBulkReply([]byte(objectEncoding(entity)))
+	case "IDLETIME":
+		idle := time.Now().UnixMilli() - atomic.LoadInt64(&entity.AccessTime)
+		return protocol.MakeIntReply(idle / 1000)
+	case "FREQ":
+		return protocol.MakeIntReply(int64(lfuDecr(entity, time.Now().UnixMilli())))
+	case "REFCOUNT":
+		// 数据实体不会在多个 key 之间共享
+		return protocol.MakeIntReply(1)
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try OBJECT HELP.")
+}
+
+func init() {
+	registerCommand("Object", execObject, prepareObject, nil, -2, flagReadOnly).attachKeys(2, 2, 1).attachCategory("keyspace")
+}
@@ -1,16 +1,34 @@
 package database
 
-import "strings"
+import (
+	"miniRedis/interface/redis"
+	"miniRedis/redis/protocol"
+	"strings"
+)
 
 var cmdTable = make(map[string]*command)
 
 // 用于实现一个Redis的命令解析和执行，每一个命令都对应一个command结构体
 type command struct {
+	name     string
 	executor ExecFunc // 执行的函数
 	prepare  PreFunc  // 用于准备相关命令操作的函数（例如加锁）
 	undo     UndoFunc // 撤销命令的函数
 	arity    int      // 表示命令所需参数的数量，允许负数，负数表示参数的数量至少为该值的绝对值
 	flags    int      // 表示命令的标志，用于标识命令的属性，例如是否支持事务、是否支持读写等
+	// lockAll 返回 true 时命令会读取 prepare 返回值以外的 key（例如 SORT 的 BY 和 GET），执行时需要给所有 key 加读锁
+	lockAll func(args [][]byte) bool
+	// replayOnly 表示命令只能由加载 AOF 的连接和主服务器的连接执行，例如直接设置锁令牌的 LOCKSET
+	replayOnly bool
+
+	// 以下字段只用于 COMMAND 命令的返回值
+	firstKey    int      // 第一个 key 在命令行中的位置，0 表示没有 key
+	lastKey     int      // 最后一个 key 的位置，负数表示从命令行末尾开始计算
+	keyStep     int      // 相邻两个 key 之间的间隔
+	movableKeys bool     // key 的位置取决于其它参数（例如 numkeys），需要通过 COMMAND GETKEYS 获得
+	extraFlags  []string // 读写标志以外的标志，例如 fast、admin
+	category    string   // 命令所属的 ACL 分类，例如 string、keyspace
+	module      string   // 提供该命令的模块，内置命令为空
 }
 
 const (
@@ -22,14 +40,88 @@ const (
 // arity means allowed number of cmdArgs, arity < 0 means len(args) >= -arity.
 // for example: the arity of `get` is 2, `mget` is -2
 func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, rollback UndoFunc, arity int, flags int) {
+	registerCommand(name, executor, prepare, rollback, arity, flags)
+}
+
+// registerCommand 注册命令并返回它，用于通过 attach* 补充 COMMAND 命令需要的信息。
+// 默认第一个参数是命令唯一的 key，其它情况需要通过 attachKeys 或 attachMovableKeys 说明
+func registerCommand(name string, executor ExecFunc, prepare PreFunc, rollback UndoFunc, arity int, flags int) *command {
 	name = strings.ToLower(name)
-	cmdTable[name] = &command{
+	cmd := &command{
+		name:     name,
 		executor: executor,
 		prepare:  prepare,
 		undo:     rollback,
 		arity:    arity,
 		flags:    flags,
+		firstKey: 1,
+		lastKey:  1,
+		keyStep:  1,
+	}
+	cmdTable[name] = cmd
+	return cmd
+}
+
+// attachKeys 设置 key 在命令行中的位置，lastKey 为 -1 表示一直到最后一个参数
+func (cmd *command) attachKeys(firstKey, lastKey, keyStep int) *command {
+	cmd.firstKey = firstKey
+	cmd.lastKey = lastKey
+	cmd.keyStep = keyStep
+	return cmd
+}
+
+// attachMovableKeys 表示 key 的数量和位置由 numkeys 等参数决定
+func (cmd *command) attachMovableKeys() *command {
+	cmd.firstKey, cmd.lastKey, cmd.keyStep = 0, 0, 0
+	cmd.movableKeys = true
+	return cmd
+}
+
+// attachLockAll 设置判断命令执行时是否需要锁住整个数据库的函数
+func (cmd *command) attachLockAll(lockAll func(args [][]byte) bool) *command {
+	cmd.lockAll = lockAll
+	return cmd
+}
+
+// attachReplayOnly 禁止普通客户端执行命令
+func (cmd *command) attachReplayOnly() *command {
+	cmd.replayOnly = true
+	return cmd
+}
+
+// checkReplayOnly 普通客户端执行只用于重放的命令时返回错误
+func checkReplayOnly(c redis.Connection, cmdName string) protocol.ErrorReply {
+	cmd, ok := cmdTable[cmdName]
+	if !ok || !cmd.replayOnly || (c != nil && c.IsMaster()) {
+		return nil
+	}
+	return protocol.MakeErrReply("ERR command '" + cmdName + "' can only be replayed from the AOF or the master")
+}
+
+// needLockAll 返回执行 args 时是否需要给数据库中所有的 key 加读锁
+func (cmd *command) needLockAll(args [][]byte) bool {
+	return cmd.lockAll != nil && cmd.lockAll(args)
+}
+
+// attachCategory 设置命令所属的 ACL 分类
+func (cmd *command) attachCategory(category string) *command {
+	cmd.category = category
+	return cmd
+}
+
+// attachFlags 增加读写标志以外的命令标志
+func (cmd *command) attachFlags(flags ...string) *command {
+	cmd.extraFlags = append(cmd.extraFlags, flags...)
+	return cmd
+}
+
+// lookupCommand 查找注册的命令或者由 Server 直接处理的命令
+func lookupCommand(name string) *command {
+	name = strings.ToLower(name)
+	if cmd, ok := cmdTable[name]; ok {
+		return cmd
 	}
+	return systemCmdTable[name]
 }
 
 func isReadOnlyCommand(name string) bool {
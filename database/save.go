@@ -0,0 +1,322 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"miniRedis/aof"
+	"miniRedis/config"
+	"miniRedis/interface/database"
+	"miniRedis/lib/logger"
+	"miniRedis/redis/protocol"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * RDB 自动保存：每个数据库记录上次保存之后修改的 key 的数量，满足任意一个 save <seconds> <changes>
+ * 条件（距离上次保存超过 seconds 秒并且至少修改了 changes 个 key）时在后台保存 RDB。
+ * 保存使用 AOF 重写的数据快照，不会阻塞写命令。
+ *
+ * 配置了 rdb-retention 时每次保存先写入 dir 目录中带时间戳的文件，再替换 dbfilename，并且只保留最近的几个带时间戳的文件
+ */
+
+// bgSaveRetryDelay 后台保存失败之后，至少等待这么多秒再自动重试
+const bgSaveRetryDelay = 5
+
+type savePoint struct {
+	seconds int64
+	changes int64
+}
+
+// parseSavePoints 解析 save 配置，例如 "900 1 300 10 60 10000"
+func parseSavePoints(s string) ([]savePoint, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("invalid save parameters: " + s)
+	}
+	points := make([]savePoint, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("invalid save parameters: " + s)
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, errors.New("invalid save parameters: " + s)
+		}
+		points = append(points, savePoint{seconds: seconds, changes: changes})
+	}
+	return points, nil
+}
+
+// addDirty 记录修改了 n 个 key
+func (db *DB) addDirty(n int) {
+	if db.dirty != nil && n > 0 {
+		atomic.AddInt64(db.dirty, int64(n))
+	}
+}
+
+// dirtyCounts 返回每个数据库上次保存之后修改的 key 的数量
+func (server *Server) dirtyCounts() []int64 {
+	counts := make([]int64, len(server.dirty))
+	for i := range server.dirty {
+		counts[i] = atomic.LoadInt64(&server.dirty[i])
+	}
+	return counts
+}
+
+// dirtyCount 返回所有数据库上次保存之后修改的 key 的数量
+func (server *Server) dirtyCount() int64 {
+	var total int64
+	for _, n := range server.dirtyCounts() {
+		total += n
+	}
+	return total
+}
+
+// rdbFilename 返回 RDB 文件的路径
+func rdbFilename() string {
+	if config.Properties.RDBFilename == "" {
+		return "dump.rdb"
+	}
+	return config.Properties.RDBFilename
+}
+
+// makeRDBSnapshot 生成用于保存 RDB 的数据快照，同时返回快照时每个数据库的修改计数
+func (server *Server) makeRDBSnapshot() (database.Snapshot, []int64, error) {
+	var dirty []int64
+	snapshot, err := server.MakeSnapshot(func() error {
+		// 生成快照时没有正在执行的写命令，计数和快照中的数据一致
+		dirty = server.dirtyCounts()
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return snapshot, dirty, nil
+}
+
+// saveRDB 将快照保存为 RDB 文件并记录保存的结果
+func (server *Server) saveRDB(snapshot database.Snapshot, dirty []int64) error {
+	defer snapshot.Release()
+	atomic.StoreInt64(&server.lastSaveTry, time.Now().Unix())
+	err := writeRDBSnapshot(snapshot, len(server.dbSet))
+	server.recordSave(dirty, err)
+	return err
+}
+
+// bgSave 在后台保存 RDB，快照在返回之前生成，之后的写命令不会出现在这次保存的文件中
+func (server *Server) bgSave() error {
+	if !atomic.CompareAndSwapInt32(&server.bgSaving, 0, 1) {
+		return errors.New("ERR Background save already in progress")
+	}
+	snapshot, dirty, err := server.makeRDBSnapshot()
+	if err != nil {
+		atomic.StoreInt32(&server.bgSaving, 0)
+		return err
+	}
+	go func() {
+		defer atomic.StoreInt32(&server.bgSaving, 0)
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+				atomic.StoreInt32(&server.lastSaveFailed, 1)
+			}
+		}()
+		if err := server.saveRDB(snapshot, dirty); err != nil {
+			logger.Error("background saving failed: " + err.Error())
+			return
+		}
+		logger.Info("background saving terminated with success")
+	}()
+	return nil
+}
+
+// writeRDBSnapshot 将快照写入 RDB 文件，配置了 rdb-retention 时保留带时间戳的副本
+func writeRDBSnapshot(snapshot database.Snapshot, databases int) error {
+	filename := rdbFilename()
+	if config.Properties.RDBRetention <= 0 {
+		return writeRDBFile(filename, snapshot, databases)
+	}
+	dir, prefix, ext := retentionPattern(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	timestamped := filepath.Join(dir, prefix+strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)+ext)
+	if err := writeRDBFile(timestamped, snapshot, databases); err != nil {
+		return err
+	}
+	if err := installRDBFile(timestamped, filename); err != nil {
+		return err
+	}
+	pruneRDBFiles(dir, prefix, ext, config.Properties.RDBRetention)
+	return nil
+}
+
+// writeRDBFile 先写入临时文件再重命名，保存失败时不会破坏原来的文件
+func writeRDBFile(filename string, snapshot database.Snapshot, databases int) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	writer := bufio.NewWriter(tmpFile)
+	err = aof.WriteRDB(writer, snapshot, databases)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// installRDBFile 用带时间戳的文件替换 dbfilename，优先使用硬链接，不支持时复制文件
+func installRDBFile(src string, dst string) error {
+	tmpName := dst + ".tmp"
+	_ = os.Remove(tmpName)
+	if err := os.Link(src, tmpName); err != nil {
+		if err := copyFile(src, tmpName); err != nil {
+			_ = os.Remove(tmpName)
+			return err
+		}
+	}
+	return os.Rename(tmpName, dst)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// retentionPattern 返回带时间戳的 RDB 文件所在的目录和文件名的前缀、后缀，例如 dump-1700000000000.rdb
+func retentionPattern(filename string) (dir string, prefix string, ext string) {
+	dir = config.Properties.Dir
+	if dir == "" {
+		dir = filepath.Dir(filename)
+	}
+	base := filepath.Base(filename)
+	ext = filepath.Ext(base)
+	return dir, strings.TrimSuffix(base, ext) + "-", ext
+}
+
+// pruneRDBFiles 删除 dir 中除了最近 keep 个之外的带时间戳的 RDB 文件
+func pruneRDBFiles(dir string, prefix string, ext string, keep int) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logger.Warn("list rdb files failed: " + err.Error())
+		return
+	}
+	type rdbFile struct {
+		name      string
+		timestamp int64
+	}
+	var files []rdbFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, rdbFile{name: name, timestamp: timestamp})
+	}
+	if len(files) <= keep {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].timestamp < files[j].timestamp
+	})
+	for _, f := range files[:len(files)-keep] {
+		if err := os.Remove(filepath.Join(dir, f.name)); err != nil {
+			logger.Warn("remove rdb file failed: " + err.Error())
+		}
+	}
+}
+
+// startSaveCron 每秒检查一次是否满足自动保存的条件
+func (server *Server) startSaveCron() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			server.saveCron()
+		}
+	}()
+}
+
+func (server *Server) saveCron() {
+	if atomic.LoadInt32(&server.bgSaving) != 0 {
+		return
+	}
+	now := time.Now().Unix()
+	if atomic.LoadInt32(&server.lastSaveFailed) != 0 &&
+		now-atomic.LoadInt64(&server.lastSaveTry) < bgSaveRetryDelay {
+		return
+	}
+	dirty := server.dirtyCount()
+	lastSave := atomic.LoadInt64(&server.lastSaveTime)
+	for _, point := range server.savePoints {
+		if dirty < point.changes || now-lastSave < point.seconds {
+			continue
+		}
+		logger.Info(fmt.Sprintf("%d changes in %d seconds. Saving...", point.changes, point.seconds))
+		if err := server.bgSave(); err != nil {
+			// 例如 AOF 重写正在使用快照，下一秒再尝试
+			logger.Info("background saving delayed: " + err.Error())
+		}
+		return
+	}
+}
+
+// checkWritable 配置了自动保存并且上次保存失败时拒绝写命令，避免用户以为数据已经持久化。
+// EVAL、EVALSHA 没有写标志，脚本中的写命令由 runningScript.call 检查
+func (server *Server) checkWritable(cmdName string) protocol.ErrorReply {
+	if !config.Properties.StopWritesOnBgsaveError || len(server.savePoints) == 0 ||
+		atomic.LoadInt32(&server.lastSaveFailed) == 0 {
+		return nil
+	}
+	cmd := lookupCommand(cmdName)
+	if cmd == nil || cmd.flags&flagReadOnly != 0 {
+		return nil
+	}
+	return protocol.MakeErrReply("MISCONF Errors writing the RDB snapshot to disk. " +
+		"Commands that may modify the data set are disabled, because this instance is configured to report errors " +
+		"during writes if RDB snapshotting fails (stop-writes-on-bgsave-error option). " +
+		"Please check the logs for details about the RDB error.")
+}
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"miniRedis/config"
+	"miniRedis/redis/connection"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMisconfRefusesScriptWrites(t *testing.T) {
+	stopWrites := config.Properties.StopWritesOnBgsaveError
+	defer func() { config.Properties.StopWritesOnBgsaveError = stopWrites }()
+	config.Properties.StopWritesOnBgsaveError = true
+
+	server := NewStandaloneServer()
+	conn := connection.NewFakeConn()
+	execCmd(server, conn, "SET", "k", "v")
+	// 模拟一次失败的自动保存
+	server.savePoints = []savePoint{{seconds: 1, changes: 1}}
+	atomic.StoreInt32(&server.lastSaveFailed, 1)
+
+	tests := []struct {
+		name   string
+		args   []string
+		errMsg string // 为空表示命令应当成功
+	}{
+		{"write command", []string{"SET", "k", "x"}, "MISCONF"},
+		{"script call", []string{"EVAL", "return redis.call('set', KEYS[1], 'x')", "1", "k"}, "MISCONF"},
+		{"script pcall", []string{"EVAL", "local r = redis.pcall('set', KEYS[1], 'x') return r.err", "1", "k"}, ""},
+		{"read only script", []string{"EVAL", "return redis.call('get', KEYS[1])", "1", "k"}, ""},
+	}
+	for _, tt := range tests {
+		reply := string(execCmd(server, conn, tt.args...).ToBytes())
+		if tt.errMsg == "" && strings.HasPrefix(reply, "-") {
+			t.Errorf("%s: unexpected error %q", tt.name, reply)
+		}
+		if tt.errMsg != "" && !strings.HasPrefix(reply, "-"+tt.errMsg) {
+			t.Errorf("%s: got %q, want error %s", tt.name, reply, tt.errMsg)
+		}
+	}
+	if got := string(execCmd(server, conn, "GET", "k").ToBytes()); got != "$1\r\nv\r\n" {
+		t.Errorf("value was modified: %q", got)
+	}
+}
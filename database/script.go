@@ -0,0 +1,530 @@
+package database
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/logger"
+	"miniRedis/lib/lua"
+	"miniRedis/redis/parser"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * 服务端脚本：EVAL、EVALSHA 和 SCRIPT 命令，脚本由 lib/lua 中的解释器执行。
+ * 执行脚本前对 KEYS 中声明的 key 加写锁，脚本通过 redis.call 调用的命令同样经过 Server.Exec，
+ * DB.Exec 识别出来自脚本的调用后不再加锁，所以脚本只能访问声明过的 key。
+ * 脚本中的写命令和事务一样作为一个 MULTI ... EXEC 块写入 AOF，AOF 和副本收到的是脚本的效果而不是脚本本身，
+ * 重放的结果是确定的，崩溃时也不会只留下脚本的一部分效果
+ */
+
+// script 是编译后的脚本，以 SHA1 为 key 缓存
+type script struct {
+	sha    string
+	source string
+	proto  *lua.Proto
+}
+
+var (
+	scriptCache   = make(map[string]*script)
+	scriptCacheMu sync.RWMutex
+	// runningScripts 记录正在执行的脚本，用于 SCRIPT KILL
+	runningScripts sync.Map // *runningScript -> struct{}
+)
+
+// runningScript 是一次脚本执行的上下文
+type runningScript struct {
+	server *Server
+	db     *DB
+	sha    string
+	keys   map[string]struct{}
+	state  *lua.State
+
+	mu     sync.Mutex
+	wrote  bool // 执行过写命令的脚本不能被 SCRIPT KILL 中断
+	killed bool
+}
+
+// scriptConn 是脚本调用命令时使用的连接，除了标记调用来自脚本外与发起 EVAL 的连接相同
+type scriptConn struct {
+	redis.Connection
+	script *runningScript
+}
+
+func sha1hex(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadScript 编译脚本并加入缓存
+func loadScript(source string) (*script, redis.Reply) {
+	sha := sha1hex(source)
+	scriptCacheMu.RLock()
+	s := scriptCache[sha]
+	scriptCacheMu.RUnlock()
+	if s != nil {
+		return s, nil
+	}
+	proto, err := lua.Compile(source, "user_script")
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR Error compiling script (new function): " + err.Error())
+	}
+	s = &script{sha: sha, source: source, proto: proto}
+	scriptCacheMu.Lock()
+	scriptCache[sha] = s
+	scriptCacheMu.Unlock()
+	return s, nil
+}
+
+func lookupScript(sha string) *script {
+	scriptCacheMu.RLock()
+	defer scriptCacheMu.RUnlock()
+	return scriptCache[strings.ToLower(sha)]
+}
+
+// parseScriptNumKeys 解析 EVAL script numkeys [key ...] [arg ...] 中的 numkeys
+func parseScriptNumKeys(args [][]byte) (int, redis.Reply) {
+	numKeys, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return 0, protocol.MakeErrReply("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-2 {
+		return 0, protocol.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	return numKeys, nil
+}
+
+// prepareEval 返回脚本声明的 key，脚本可能写入其中任意一个 key
+func prepareEval(args [][]byte) ([]string, []string) {
+	numKeys, errReply := parseScriptNumKeys(args)
+	if errReply != nil {
+		return nil, nil
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[2+i])
+	}
+	return keys, nil
+}
+
+// execEval EVAL script numkeys [key ...] [arg ...] / EVALSHA sha1 numkeys [key ...] [arg ...]
+func (server *Server) execEval(c redis.Connection, cmdName string, args [][]byte) redis.Reply {
+	numKeys, errReply := parseScriptNumKeys(args)
+	if errReply != nil {
+		return errReply
+	}
+	var s *script
+	if cmdName == "eval" {
+		s, errReply = loadScript(string(args[0]))
+		if errReply != nil {
+			return errReply
+		}
+	} else {
+		s = lookupScript(string(args[0]))
+		if s == nil {
+			return protocol.MakeErrReply("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	}
+	db, selectErr := server.selectDB(c.GetDBIndex())
+	if selectErr != nil {
+		return selectErr
+	}
+	return db.runScript(server, c, s, args[2:2+numKeys], args[2+numKeys:])
+}
+
+func (db *DB) runScript(server *Server, c redis.Connection, s *script, keys [][]byte, argv [][]byte) redis.Reply {
+	keyList := make([]string, len(keys))
+	keySet := make(map[string]struct{}, len(keys))
+	for i, key := range keys {
+		keyList[i] = string(key)
+		keySet[keyList[i]] = struct{}{}
+	}
+	db.RWLocks(keyList, nil)
+	defer db.RWUnLocks(keyList, nil)
+	// 脚本可以修改 KEYS 中的任何 key，也可以执行 FLUSHDB 等命令，整个执行期间都持有快照的读锁
+	defer db.enterWrite(keyList)()
+
+	// 和 multiTx.txDB 一样，脚本在共享数据的 DB 副本上执行，写入 AOF 的命令先收集起来，
+	// 脚本结束之后在释放锁之前作为一个块写入。脚本没有回滚，出错之前的效果同样需要写入
+	var aofLines []CmdLine
+	scriptDB := *db
+	scriptDB.addAof = func(line CmdLine) {
+		aofLines = append(aofLines, line)
+	}
+	defer func() {
+		if len(aofLines) > 0 {
+			db.addTxAof(aofLines)
+		}
+	}()
+
+	L := lua.NewState("user_script")
+	rs := &runningScript{
+		server: server,
+		db:     &scriptDB,
+		sha:    s.sha,
+		keys:   keySet,
+		state:  L,
+	}
+	L.SetGlobal("KEYS", bytesToLuaArray(keys))
+	L.SetGlobal("ARGV", bytesToLuaArray(argv))
+	L.SetGlobal("redis", rs.redisLib(&scriptConn{Connection: c, script: rs}))
+	L.SetStrictGlobals(true)
+
+	runningScripts.Store(rs, struct{}{})
+	defer runningScripts.Delete(rs)
+	rets, err := L.Run(s.proto)
+	if err == lua.ErrInterrupted {
+		return protocol.MakeErrReply("ERR Script killed by user with SCRIPT KILL...")
+	}
+	if err != nil {
+		value := err.(*lua.Error).Value
+		if t, ok := value.(*lua.Table); ok {
+			if msg, ok := t.Get("err").(string); ok {
+				return protocol.MakeErrReply(msg)
+			}
+		}
+		return protocol.MakeErrReply(fmt.Sprintf("ERR Error running script (call to f_%s): %s", s.sha, lua.ToString(value)))
+	}
+	if len(rets) == 0 {
+		return luaToReply(nil)
+	}
+	return luaToReply(rets[0])
+}
+
+// beginWrite 在脚本执行写命令之前调用，脚本已经被 SCRIPT KILL 中断时返回 false
+func (rs *runningScript) beginWrite() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.killed {
+		return false
+	}
+	rs.wrote = true
+	return true
+}
+
+// kill 中断还没有执行过写命令的脚本
+func (rs *runningScript) kill() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.wrote {
+		return false
+	}
+	rs.killed = true
+	rs.state.Interrupt()
+	return true
+}
+
+// execScriptCommand 执行脚本通过 redis.call 调用的命令，key 已经在 runScript 中加锁
+func (db *DB) execScriptCommand(sc *scriptConn, cmdLine [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd, ok := cmdTable[cmdName]
+	if !ok {
+		return protocol.MakeErrReply("ERR unknown command '" + cmdName + "'")
+	}
+	if !validateArity(cmd.arity, cmdLine) {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	write, read := cmd.prepare(cmdLine[1:])
+	for _, keys := range [][]string{write, read} {
+		for _, key := range keys {
+			if _, declared := sc.script.keys[key]; !declared {
+				return protocol.MakeErrReply("ERR Script attempted to access key '" + key + "' which was not declared in KEYS")
+			}
+		}
+	}
+	if cmd.needLockAll(cmdLine[1:]) {
+		return protocol.MakeErrReply("ERR Script attempted to access keys by pattern which can not be declared in KEYS")
+	}
+	if cmd.flags&flagReadOnly == 0 && !sc.script.beginWrite() {
+		return protocol.MakeErrReply("ERR Script killed by user with SCRIPT KILL...")
+	}
+	db.addVersion(write...)
+	reply := db.execWithLock(cmdLine)
+	if !protocol.IsErrorReply(reply) {
+		db.addDirty(len(write))
+	}
+	return reply
+}
+
+func bytesToLuaArray(args [][]byte) *lua.Table {
+	t := lua.NewTable(len(args), 0)
+	for _, arg := range args {
+		t.Append(string(arg))
+	}
+	return t
+}
+
+func hasExtraFlag(cmd *command, flag string) bool {
+	for _, f := range cmd.extraFlags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// redisLib 创建脚本中的 redis 表
+func (rs *runningScript) redisLib(conn *scriptConn) *lua.Table {
+	lib := lua.NewTable(0, 16)
+	register := func(name string, fn func(L *lua.State, args []lua.Value) []lua.Value) {
+		_ = lib.Set(name, &lua.GoFunction{Name: name, Fn: fn})
+	}
+	register("call", func(L *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{rs.call(L, conn, args, true)}
+	})
+	register("pcall", func(L *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{rs.call(L, conn, args, false)}
+	})
+	register("sha1hex", func(L *lua.State, args []lua.Value) []lua.Value {
+		if len(args) != 1 {
+			L.RaiseError("wrong number of arguments")
+		}
+		return []lua.Value{sha1hex(lua.ToString(args[0]))}
+	})
+	register("error_reply", func(L *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{makeLuaReplyTable(L, "err", args)}
+	})
+	register("status_reply", func(L *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{makeLuaReplyTable(L, "ok", args)}
+	})
+	register("log", func(L *lua.State, args []lua.Value) []lua.Value {
+		if len(args) < 2 {
+			L.RaiseError("redis.log() requires two arguments or more.")
+		}
+		level, ok := args[0].(float64)
+		if !ok {
+			L.RaiseError("First argument must be a number (log level).")
+		}
+		parts := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			parts = append(parts, lua.ToString(arg))
+		}
+		msg := "script: " + strings.Join(parts, " ")
+		switch int(level) {
+		case 0, 1:
+			logger.Debug(msg)
+		case 2:
+			logger.Info(msg)
+		case 3:
+			logger.Warn(msg)
+		default:
+			L.RaiseError("Invalid debug level.")
+		}
+		return nil
+	})
+	// 脚本总是以效果的形式写入 AOF，保留这个函数只是为了兼容为旧版 Redis 编写的脚本
+	register("replicate_commands", func(L *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{true}
+	})
+	_ = lib.Set("LOG_DEBUG", float64(0))
+	_ = lib.Set("LOG_VERBOSE", float64(1))
+	_ = lib.Set("LOG_NOTICE", float64(2))
+	_ = lib.Set("LOG_WARNING", float64(3))
+	return lib
+}
+
+func makeLuaReplyTable(L *lua.State, field string, args []lua.Value) *lua.Table {
+	if len(args) != 1 {
+		L.RaiseError("wrong number or type of arguments")
+	}
+	msg, ok := args[0].(string)
+	if !ok {
+		L.RaiseError("wrong number or type of arguments")
+	}
+	t := lua.NewTable(0, 1)
+	_ = t.Set(field, msg)
+	return t
+}
+
+// call 执行 redis.call 和 redis.pcall，raise 为 true 时命令返回的错误会中断脚本
+func (rs *runningScript) call(L *lua.State, conn *scriptConn, args []lua.Value, raise bool) lua.Value {
+	fail := func(msg string) lua.Value {
+		t := lua.NewTable(0, 1)
+		_ = t.Set("err", msg)
+		if raise {
+			L.Raise(t)
+		}
+		return t
+	}
+	if len(args) == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+	cmdLine := make(CmdLine, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			cmdLine[i] = []byte(v)
+		case float64:
+			cmdLine[i] = []byte(lua.NumberToString(v))
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	cmd := lookupCommand(strings.ToLower(string(cmdLine[0])))
+	if cmd == nil {
+		return fail("ERR Unknown Redis command called from script")
+	}
+	if hasExtraFlag(cmd, "noscript") {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+	// EVAL 本身不会被 MISCONF 拒绝，只读的脚本仍然可以执行，脚本中的每个写命令都需要检查
+	if errReply := rs.server.checkWritable(cmd.name); errReply != nil {
+		return fail(errReply.Error())
+	}
+	result := replyToLua(rs.server.Exec(conn, cmdLine))
+	if t, ok := result.(*lua.Table); ok && raise && t.Get("err") != nil {
+		L.Raise(t)
+	}
+	return result
+}
+
+// replyToLua 按照 Redis 的规则将命令的回复转换为 Lua 值
+func replyToLua(reply redis.Reply) lua.Value {
+	switch r := reply.(type) {
+	case *protocol.IntReply:
+		return float64(r.Code)
+	case *protocol.BulkReply:
+		if r.Arg == nil {
+			return false
+		}
+		return string(r.Arg)
+	case *protocol.NullBulkReply, *protocol.NullMultiBulkReply:
+		return false
+	case *protocol.StatusReply:
+		t := lua.NewTable(0, 1)
+		_ = t.Set("ok", r.Status)
+		return t
+	case *protocol.MultiBulkReply:
+		t := lua.NewTable(len(r.Args), 0)
+		for i, arg := range r.Args {
+			if arg == nil {
+				_ = t.Set(float64(i+1), false)
+			} else {
+				_ = t.Set(float64(i+1), string(arg))
+			}
+		}
+		return t
+	case *protocol.MultiRawReply:
+		t := lua.NewTable(len(r.Replies), 0)
+		for i, item := range r.Replies {
+			_ = t.Set(float64(i+1), replyToLua(item))
+		}
+		return t
+	case *protocol.EmptyMultiBulkReply:
+		return lua.NewTable(0, 0)
+	case protocol.ErrorReply:
+		t := lua.NewTable(0, 1)
+		_ = t.Set("err", r.Error())
+		return t
+	}
+	// OkReply、PongReply 等固定的回复，解析序列化后的结果
+	parsed, err := parser.ParseOne(reply.ToBytes())
+	if err != nil {
+		return false
+	}
+	return replyToLua(parsed)
+}
+
+// luaToReply 按照 Redis 的规则将脚本的返回值转换为回复
+func luaToReply(value lua.Value) redis.Reply {
+	switch v := value.(type) {
+	case string:
+		return protocol.MakeBulkReply([]byte(v))
+	case float64:
+		return protocol.MakeIntReply(int64(v))
+	case bool:
+		if v {
+			return protocol.MakeIntReply(1)
+		}
+		return protocol.MakeNullBulkReply()
+	case *lua.Table:
+		if msg, ok := v.Get("err").(string); ok {
+			return protocol.MakeErrReply(msg)
+		}
+		if status, ok := v.Get("ok").(string); ok {
+			return protocol.MakeStatusReply(status)
+		}
+		// 数组在第一个 nil 处截断
+		replies := make([]redis.Reply, 0, v.Len())
+		for i := 1; ; i++ {
+			item := v.Get(float64(i))
+			if item == nil {
+				break
+			}
+			replies = append(replies, luaToReply(item))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	}
+	return protocol.MakeNullBulkReply()
+}
+
+// execScript SCRIPT LOAD|EXISTS|FLUSH|KILL
+func execScript(args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "load":
+		if len(args) != 2 {
+			return protocol.MakeErrReply("ERR unknown subcommand or wrong number of arguments for 'load'")
+		}
+		s, errReply := loadScript(string(args[1]))
+		if errReply != nil {
+			return errReply
+		}
+		return protocol.MakeBulkReply([]byte(s.sha))
+	case "exists":
+		if len(args) < 2 {
+			return protocol.MakeErrReply("ERR unknown subcommand or wrong number of arguments for 'exists'")
+		}
+		replies := make([]redis.Reply, 0, len(args)-1)
+		for _, sha := range args[1:] {
+			exists := int64(0)
+			if lookupScript(string(sha)) != nil {
+				exists = 1
+			}
+			replies = append(replies, protocol.MakeIntReply(exists))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "flush":
+		if len(args) > 2 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		if len(args) == 2 {
+			mode := strings.ToLower(string(args[1]))
+			if mode != "async" && mode != "sync" {
+				return protocol.MakeErrReply("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+			}
+		}
+		scriptCacheMu.Lock()
+		scriptCache = make(map[string]*script)
+		scriptCacheMu.Unlock()
+		return protocol.MakeOkReply()
+	case "kill":
+		if len(args) != 1 {
+			return protocol.MakeErrReply("ERR unknown subcommand or wrong number of arguments for 'kill'")
+		}
+		running, killed := 0, 0
+		runningScripts.Range(func(key, value interface{}) bool {
+			running++
+			if key.(*runningScript).kill() {
+				killed++
+			}
+			return true
+		})
+		if running == 0 {
+			return protocol.MakeErrReply("NOTBUSY No scripts in execution right now.")
+		}
+		if killed == 0 {
+			return protocol.MakeErrReply("UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+				"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+		}
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try SCRIPT HELP.")
+}
@@ -3,16 +3,20 @@ package database
 import (
 	"fmt"
 	"miniRedis/aof"
+	"miniRedis/cdc"
 	"miniRedis/config"
+	"miniRedis/datastruct/dict"
 	"miniRedis/interface/database"
 	"miniRedis/interface/redis"
 	"miniRedis/lib/logger"
 	"miniRedis/lib/utils"
 	"miniRedis/pubsub"
 	"miniRedis/redis/protocol"
+	"net/http"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -30,6 +34,27 @@ type Server struct {
 	hub *pubsub.Hub
 	// handle aof persistence
 	persister *aof.Persister
+	// changeFeed 将写命令转换为 CDC 事件，没有开启 CDC 时为 nil
+	changeFeed *cdc.Feed
+	cdcMu      sync.Mutex
+	cdcStreams map[redis.Connection]*cdcStream
+	// snapshots 用于 AOF 重写时生成数据快照
+	snapshots *snapshotBarrier
+	// serve prometheus metrics, nil if metrics-port is not set
+	metricsServer *http.Server
+
+	// rdb save status, reported by INFO persistence
+	lastSaveTime   int64 // unix time of the last successful save
+	lastSaveTry    int64 // unix time of the last save attempt
+	lastSaveFailed int32
+	bgSaving       int32
+	// dirty 记录每个编号的数据库上次保存之后修改的 key 的数量
+	dirty      []int64
+	savePoints []savePoint
+	// versions 保存每个编号的数据库中 key 的版本，替换数据库时保留，WATCH 的 key 不会因为 FLUSHDB 而回到旧的版本
+	versions []dict.Dict
+	// lockTokens 保存每个编号的数据库最近发出的锁令牌，替换数据库时保留，令牌不会因为 FLUSHDB 而回退
+	lockTokens []int64
 
 	// for replication
 	role int32
@@ -39,14 +64,25 @@ type Server struct {
 
 // NewStandaloneServer creates a standalone redis server, with multi database and all other funtions
 func NewStandaloneServer() *Server {
-	server := &Server{}
+	server := &Server{
+		lastSaveTime: time.Now().Unix(),
+		snapshots:    &snapshotBarrier{},
+	}
 	if config.Properties.Databases == 0 {
 		config.Properties.Databases = 16
 	}
 	server.dbSet = make([]*atomic.Value, config.Properties.Databases)
+	server.dirty = make([]int64, config.Properties.Databases)
+	server.versions = make([]dict.Dict, config.Properties.Databases)
+	server.lockTokens = make([]int64, config.Properties.Databases)
 	for i := range server.dbSet {
 		singleDB := makeDB()
 		singleDB.index = i
+		singleDB.snapshots = server.snapshots
+		singleDB.dirty = &server.dirty[i]
+		server.versions[i] = singleDB.versionMap
+		singleDB.lockToken = &server.lockTokens[i]
+		server.bindTxAof(singleDB)
 		holder := &atomic.Value{}
 		holder.Store(singleDB)
 		server.dbSet[i] = holder
@@ -62,6 +98,15 @@ func NewStandaloneServer() *Server {
 		server.bindPersister(aofHandler)
 		validAof = true
 	}
+	if config.Properties.CDCBacklogSize > 0 {
+		if server.persister == nil {
+			// 没有开启 AOF 时使用不写文件的 Persister，只把写命令通知给 CDC
+			server.bindPersister(aof.NewListenerPersister(server))
+		}
+		server.changeFeed = cdc.NewFeed(config.Properties.CDCBacklogSize, commandKeys)
+		server.cdcStreams = make(map[redis.Connection]*cdcStream)
+		server.persister.AddListener(server.changeFeed)
+	}
 
 	//TODO
 	// RDB
@@ -72,6 +117,18 @@ func NewStandaloneServer() *Server {
 			logger.Error(err)
 		}
 	}
+	if config.Properties.Save != "" {
+		points, err := parseSavePoints(config.Properties.Save)
+		if err != nil {
+			logger.Error(err)
+		} else {
+			server.savePoints = points
+			server.startSaveCron()
+		}
+	}
+	if config.Properties.MetricsPort > 0 {
+		server.startMetricsServer(config.Properties.MetricsPort)
+	}
 	server.slaveStatus = initReplSlaveStatus()
 	server.initMaster()
 	server.startReplCron()
@@ -82,6 +139,12 @@ func NewStandaloneServer() *Server {
 // Exec executes command
 // parameter `cmdLine` contains command and its arguments, for example: "set key value"
 func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Reply) {
+	start := time.Now()
+	defer func() {
+		if len(cmdLine) > 0 {
+			stats.recordCommand(strings.ToLower(string(cmdLine[0])), time.Since(start), result)
+		}
+	}()
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
@@ -100,11 +163,17 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 	}
 	// info
 	if cmdName == "info" {
-		return Info(c, cmdLine)
+		return Info(server, c, cmdLine)
 	}
 	if !isAuthenticated(c) {
 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	}
+	if errReply := server.checkWritable(cmdName); errReply != nil {
+		if c != nil && c.InMultiState() {
+			c.AddTxError(errReply)
+		}
+		return errReply
+	}
 	// TODO
 	// slaveof
 	//if cmdName == "slaveof" {
@@ -139,9 +208,27 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 	} else if cmdName == "bgrewriteaof" {
 		// aof.go imports router.go, router.go cannot import BGRewriteAOF from aof.go
 		return BGRewriteAOF(server, cmdLine[1:])
+	} else if cmdName == "command" {
+		return execCommand(cmdLine[1:])
+	} else if cmdName == "module" {
+		return execModule(cmdLine[1:])
+	} else if cmdName == "eval" || cmdName == "evalsha" {
+		if !validateArity(-3, cmdLine) {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		if c != nil && c.InMultiState() {
+			return protocol.MakeErrReply("ERR command '" + cmdName + "' cannot be used in MULTI")
+		}
+		return server.execEval(c, cmdName, cmdLine[1:])
+	} else if cmdName == "script" {
+		if !validateArity(-2, cmdLine) {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execScript(cmdLine[1:])
 	} else if cmdName == "rewriteaof" {
 		return RewriteAOF(server, cmdLine[1:])
 	} else if cmdName == "flushall" {
+		defer server.enterWrite(c)()
 		return server.flushAll()
 	} else if cmdName == "flushdb" {
 		if !validateArity(1, cmdLine) {
@@ -150,30 +237,75 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 		if c.InMultiState() {
 			return protocol.MakeErrReply("ERR command 'FlushDB' cannot be used in MULTI")
 		}
+		defer server.enterWrite(c)()
 		return server.execFlushDB(c.GetDBIndex())
 	} else if cmdName == "save" {
 		return SaveRDB(server, cmdLine[1:])
 	} else if cmdName == "bgsave" {
 		return BGSaveRDB(server, cmdLine[1:])
+	} else if cmdName == "cdc" {
+		if !validateArity(-2, cmdLine) {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return server.execCDC(c, cmdLine[1:])
+	} else if cmdName == "lastsave" {
+		if !validateArity(1, cmdLine) {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return protocol.MakeIntReply(atomic.LoadInt64(&server.lastSaveTime))
+	} else if cmdName == "exec" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		// 执行事务，事务中可能切换数据库
+		return server.execMulti(c)
 	} else if cmdName == "select" {
+		// SELECT、COPY、MOVE 在事务中入队，由 ExecMulti 在相应的数据库中执行
 		if c != nil && c.InMultiState() {
-			return protocol.MakeErrReply("cannot select database within multi")
+			return server.enqueueServerCmd(c, cmdLine)
 		}
 		if len(cmdLine) != 2 {
 			return protocol.MakeArgNumErrReply("select")
 		}
 		return execSelect(c, server, cmdLine[1:])
 	} else if cmdName == "copy" {
+		if c != nil && c.InMultiState() {
+			return server.enqueueServerCmd(c, cmdLine)
+		}
 		if len(cmdLine) < 3 {
 			return protocol.MakeArgNumErrReply("copy")
 		}
+		defer server.enterWrite(c)()
 		return execCopy(server, c, cmdLine[1:])
+	} else if cmdName == "move" {
+		if c != nil && c.InMultiState() {
+			return server.enqueueServerCmd(c, cmdLine)
+		}
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply("move")
+		}
+		defer server.enterWrite(c)()
+		return execMove(server, c, cmdLine[1:])
+	} else if cmdName == "swapdb" {
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply("swapdb")
+		}
+		if c != nil && c.InMultiState() {
+			return protocol.MakeErrReply("ERR command 'SwapDB' cannot be used in MULTI")
+		}
+		defer server.enterWrite(c)()
+		return server.execSwapDB(cmdLine[1:])
 	} else if cmdName == "replconf" {
 		//return server.execReplConf(c, cmdLine[1:])
 	} else if cmdName == "psync" {
 		//return server.execPSync(c, cmdLine[1:])
 	}
-	// todo: support multi database transaction
+	// LOCK ... WAIT 在等待期间不能持有 key 的锁，事务和脚本中的 LOCK 不会等待
+	if cmdName == "lock" && !c.InMultiState() {
+		if _, ok := c.(*scriptConn); !ok {
+			return server.execLock(c, cmdLine)
+		}
+	}
 
 	// normal commands
 	dbIndex := c.GetDBIndex()
@@ -184,22 +316,20 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 	return selectedDB.Exec(c, cmdLine)
 }
 
-// TODO 集群模式下的优雅退出
-/*// AfterClientClose does some clean after client close connection
+// AfterClientClose does some clean after client close connection
 func (server *Server) AfterClientClose(c redis.Connection) {
 	pubsub.UnsubscribeAll(server.hub, c)
 }
 
 // Close graceful shutdown database
 func (server *Server) Close() {
-	// stop slaveStatus first
-	server.slaveStatus.close()
 	if server.persister != nil {
 		server.persister.Close()
 	}
-	server.stopMaster()
+	if server.metricsServer != nil {
+		_ = server.metricsServer.Close()
+	}
 }
-*/
 
 func execSelect(c redis.Connection, mdb *Server, args [][]byte) redis.Reply {
 	dbIndex, err := strconv.Atoi(string(args[0]))
@@ -224,6 +354,8 @@ func (server *Server) flushDB(dbIndex int) redis.Reply {
 	if dbIndex >= len(server.dbSet) || dbIndex < 0 {
 		return protocol.MakeErrReply("ERR DB index is out of range")
 	}
+	oldDB := server.mustSelectDB(dbIndex)
+	oldDB.addDirty(oldDB.data.Len())
 	newDB := makeDB()
 	server.loadDB(dbIndex, newDB)
 	return &protocol.OkReply{}
@@ -236,10 +368,89 @@ func (server *Server) loadDB(dbIndex int, newDB *DB) redis.Reply {
 	oldDB := server.mustSelectDB(dbIndex)
 	newDB.index = dbIndex
 	newDB.addAof = oldDB.addAof // inherit oldDB
+	newDB.snapshots = server.snapshots
+	if server.dirty != nil {
+		newDB.dirty = &server.dirty[dbIndex]
+	}
+	if server.versions != nil {
+		newDB.versionMap = server.versions[dbIndex]
+		// 和 Redis 一样，替换前后存在的 key 都被视为修改过，WATCH 它们的事务需要失败
+		touchAllKeys(newDB, oldDB)
+		touchAllKeys(newDB, newDB)
+	}
+	if server.lockTokens != nil {
+		newDB.lockToken = &server.lockTokens[dbIndex]
+	}
+	server.bindTxAof(newDB)
 	server.dbSet[dbIndex].Store(newDB)
+	// 等待旧数据库中锁的客户端在新的数据库中重试
+	oldDB.lockWaiters.wakeAll()
+	return &protocol.OkReply{}
+}
+
+// execSwapDB swaps two databases, clients connected to either database will see the data of the other one immediately
+func (server *Server) execSwapDB(args [][]byte) redis.Reply {
+	index1, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid first DB index")
+	}
+	index2, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid second DB index")
+	}
+	if index1 >= len(server.dbSet) || index1 < 0 || index2 >= len(server.dbSet) || index2 < 0 {
+		return protocol.MakeErrReply("ERR DB index is out of range")
+	}
+	if index1 != index2 {
+		server.swapDB(index1, index2)
+	}
+	if server.persister != nil {
+		server.persister.SaveCmdLine(0, utils.ToCmdLine("SwapDB", string(args[0]), string(args[1])))
+	}
 	return &protocol.OkReply{}
 }
 
+func (server *Server) swapDB(index1, index2 int) {
+	db1 := server.mustSelectDB(index1)
+	db2 := server.mustSelectDB(index2)
+	server.loadDB(index1, db2)
+	server.loadDB(index2, db1)
+	db1.addDirty(1)
+	db2.addDirty(1)
+	if server.lockTokens != nil {
+		// 计数器属于数据库编号，交换之后 key 上的令牌可能大于新编号的计数器
+		token1 := atomic.LoadInt64(&server.lockTokens[index1])
+		token2 := atomic.LoadInt64(&server.lockTokens[index2])
+		raiseLockToken(&server.lockTokens[index1], token2)
+		raiseLockToken(&server.lockTokens[index2], token1)
+	}
+	if server.persister == nil {
+		return
+	}
+	// loadDB 会让新数据库继承槽位上旧数据库的 addAof，交换时两个槽位互为新旧，
+	// 所以重新绑定 addAof，保证 aof 中记录的是交换后的数据库编号
+	server.bindAof(db1)
+	server.bindAof(db2)
+}
+
+// bindAof 让 db 中的写命令写入 AOF，和 bindTxAof 一样使用 db 当前的编号
+func (server *Server) bindAof(db *DB) {
+	db.addAof = func(line CmdLine) {
+		if server.persister != nil {
+			server.persister.SaveCmdLine(db.index, line)
+		}
+	}
+}
+
+// bindTxAof 让 db 中提交的事务写入 AOF，写入时使用 db 当前的编号，SWAPDB 之后不需要重新绑定
+func (server *Server) bindTxAof(db *DB) {
+	db.addTxAof = func(lines []CmdLine) {
+		if server.persister != nil {
+			server.persister.SaveTransaction(db.index, lines)
+		}
+	}
+}
+
 func (server *Server) flushAll() redis.Reply {
 	for i := range server.dbSet {
 		server.flushDB(i)
@@ -270,13 +481,9 @@ func (server *Server) ForEach(dbIndex int, cb func(key string, data *database.Da
 	server.mustSelectDB(dbIndex).ForEach(cb)
 }
 
-// ExecMulti executes multi commands transaction Atomically and Isolated
-func (server *Server) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
-	selectedDB, errReply := server.selectDB(conn.GetDBIndex())
-	if errReply != nil {
-		return errReply
-	}
-	return selectedDB.ExecMulti(conn, watching, cmdLines)
+// LockToken returns the last fencing token issued by LOCK in the given database
+func (server *Server) LockToken(dbIndex int) int64 {
+	return atomic.LoadInt64(server.mustSelectDB(dbIndex).lockToken)
 }
 
 // RWLocks lock keys for writing and reading
@@ -303,14 +510,28 @@ func (server *Server) ExecWithLock(conn redis.Connection, cmdLine [][]byte) redi
 	return db.execWithLock(cmdLine)
 }
 
+// aofEnabled 返回是否开启了 AOF，只用于 CDC 的 Persister 不写入文件
+func (server *Server) aofEnabled() bool {
+	return server.persister != nil && server.persister.AppendOnly()
+}
+
 // BGRewriteAOF asynchronously rewrites Append-Only-File
 func BGRewriteAOF(db *Server, args [][]byte) redis.Reply {
+	if !db.aofEnabled() {
+		return protocol.MakeErrReply("please enable aof before using bgrewriteaof")
+	}
+	if db.persister.IsRewriting() {
+		return protocol.MakeErrReply(aof.ErrRewriteInProgress.Error())
+	}
 	go db.persister.Rewrite()
 	return protocol.MakeStatusReply("Background append only file rewriting started")
 }
 
 // RewriteAOF start Append-Only-File rewriting and blocked until it finished
 func RewriteAOF(db *Server, args [][]byte) redis.Reply {
+	if !db.aofEnabled() {
+		return protocol.MakeErrReply("please enable aof before using rewriteaof")
+	}
 	err := db.persister.Rewrite()
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
@@ -320,43 +541,40 @@ func RewriteAOF(db *Server, args [][]byte) redis.Reply {
 
 // SaveRDB start RDB writing and blocked until it finished
 func SaveRDB(db *Server, args [][]byte) redis.Reply {
-	if db.persister == nil {
-		return protocol.MakeErrReply("please enable aof before using save")
-	}
-	rdbFilename := config.Properties.RDBFilename
-	if rdbFilename == "" {
-		rdbFilename = "dump.rdb"
+	if atomic.LoadInt32(&db.bgSaving) != 0 {
+		return protocol.MakeErrReply("ERR Background save already in progress")
 	}
-	err := db.persister.Rewrite2RDB(rdbFilename)
+	snapshot, dirty, err := db.makeRDBSnapshot()
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
+	if err := db.saveRDB(snapshot, dirty); err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
 	return protocol.MakeOkReply()
 }
 
 // BGSaveRDB asynchronously save RDB
 func BGSaveRDB(db *Server, args [][]byte) redis.Reply {
-	if db.persister == nil {
-		return protocol.MakeErrReply("please enable aof before using save")
+	if err := db.bgSave(); err != nil {
+		return protocol.MakeErrReply(err.Error())
 	}
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				logger.Error(err)
-			}
-		}()
-		rdbFilename := config.Properties.RDBFilename
-		if rdbFilename == "" {
-			rdbFilename = "dump.rdb"
-		}
-		err := db.persister.Rewrite2RDB(rdbFilename)
-		if err != nil {
-			logger.Error(err)
-		}
-	}()
 	return protocol.MakeStatusReply("Background saving started")
 }
 
+// recordSave 记录一次 RDB 保存的结果，dirty 是生成快照时每个数据库的修改计数，保存期间的修改仍然计入下一次保存
+func (server *Server) recordSave(dirty []int64, err error) {
+	if err != nil {
+		atomic.StoreInt32(&server.lastSaveFailed, 1)
+		return
+	}
+	atomic.StoreInt32(&server.lastSaveFailed, 0)
+	atomic.StoreInt64(&server.lastSaveTime, time.Now().Unix())
+	for i, n := range dirty {
+		atomic.AddInt64(&server.dirty[i], -n)
+	}
+}
+
 // GetDBSize returns keys count and ttl key count
 func (server *Server) GetDBSize(dbIndex int) (int, int) {
 	db := server.mustSelectDB(dbIndex)
@@ -7,6 +7,7 @@ import (
 	"miniRedis/lib/utils"
 	"miniRedis/redis/protocol"
 	"strconv"
+	"strings"
 )
 
 func (db *DB) getAsSet(key string) (*HashSet.Set, protocol.ErrorReply) {
@@ -108,35 +109,48 @@ func execSPop(db *DB, args [][]byte) redis.Reply {
 	}
 	key := string(args[0])
 
-	set, errReply := db.getAsSet(key)
-	if errReply != nil {
-		return errReply
-	}
-	if set == nil {
-		return &protocol.NullBulkReply{}
-	}
-
 	count := 1
 	if len(args) == 2 {
 		count64, err := strconv.ParseInt(string(args[1]), 10, 64)
-		if err != nil || count64 <= 0 {
+		if err != nil || count64 < 0 {
 			return protocol.MakeErrReply("ERR value is out of range, must be positive")
 		}
 		count = int(count64)
 	}
+
+	set, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if set == nil {
+		if len(args) == 1 {
+			return &protocol.NullBulkReply{}
+		}
+		return &protocol.EmptyMultiBulkReply{}
+	}
+
 	if count > set.Len() {
 		count = set.Len()
 	}
-
 	members := set.RandomDistinctMembers(count)
 	result := make([][]byte, len(members))
 	for i, v := range members {
 		set.Remove(v)
 		result[i] = []byte(v)
 	}
+	if set.Len() == 0 {
+		db.Remove(key)
+	}
 
-	if count > 0 {
-		db.addAof(utils.ToCmdLine3("spop", args...))
+	if len(members) > 0 {
+		// popped members are random, we convert to srem command to write aof
+		db.addAof(utils.ToCmdLine3("srem", append([][]byte{args[0]}, result...)...))
+	}
+	if len(args) == 1 {
+		if len(result) == 0 {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply(result[0])
 	}
 	return protocol.MakeMultiBulkReply(result)
 }
@@ -436,6 +450,7 @@ func execSDiffStore(db *DB, args [][]byte) redis.Reply {
 }
 
 // execSRandMember gets random members from set
+// positive count returns distinct members, negative count may return the same member multiple times
 func execSRandMember(db *DB, args [][]byte) redis.Reply {
 	if len(args) != 1 && len(args) != 2 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'srandmember' command")
@@ -447,10 +462,10 @@ func execSRandMember(db *DB, args [][]byte) redis.Reply {
 	if errReply != nil {
 		return errReply
 	}
-	if set == nil {
-		return &protocol.NullBulkReply{}
-	}
 	if len(args) == 1 {
+		if set == nil {
+			return &protocol.NullBulkReply{}
+		}
 		// get a random member
 		members := set.RandomMembers(1)
 		return protocol.MakeBulkReply([]byte(members[0]))
@@ -459,37 +474,148 @@ func execSRandMember(db *DB, args [][]byte) redis.Reply {
 	if err != nil {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
-	count := int(count64)
-	if count > 0 {
-		members := set.RandomDistinctMembers(count)
-		result := make([][]byte, len(members))
-		for i, v := range members {
-			result[i] = []byte(v)
+	if set == nil || count64 == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	var members []string
+	if count64 > 0 {
+		members = set.RandomDistinctMembers(int(count64))
+	} else {
+		members = set.RandomMembers(int(-count64))
+	}
+	result := make([][]byte, len(members))
+	for i, v := range members {
+		result[i] = []byte(v)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execSMIsMember checks if the given values are members of set
+func execSMIsMember(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	members := args[1:]
+
+	set, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(members))
+	for i, member := range members {
+		if set != nil && set.Has(string(member)) {
+			result[i] = protocol.MakeIntReply(1)
+		} else {
+			result[i] = protocol.MakeIntReply(0)
 		}
-		return protocol.MakeMultiBulkReply(result)
-	} else if count < 0 {
-		members := set.RandomMembers(-count)
-		result := make([][]byte, len(members))
-		for i, v := range members {
-			result[i] = []byte(v)
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+func prepareSMove(args [][]byte) ([]string, []string) {
+	src := string(args[0])
+	dest := string(args[1])
+	return []string{src, dest}, nil
+}
+
+// execSMove moves a member from source set to destination set
+func execSMove(db *DB, args [][]byte) redis.Reply {
+	src := string(args[0])
+	dest := string(args[1])
+	member := string(args[2])
+
+	srcSet, errReply := db.getAsSet(src)
+	if errReply != nil {
+		return errReply
+	}
+	destSet, errReply := db.getAsSet(dest)
+	if errReply != nil {
+		return errReply
+	}
+	if srcSet == nil || !srcSet.Has(member) {
+		return protocol.MakeIntReply(0)
+	}
+	if src == dest {
+		return protocol.MakeIntReply(1)
+	}
+
+	srcSet.Remove(member)
+	if srcSet.Len() == 0 {
+		db.Remove(src)
+	}
+	if destSet == nil {
+		destSet, _, _ = db.getOrInitSet(dest)
+	}
+	destSet.Add(member)
+	db.addAof(utils.ToCmdLine3("smove", args...))
+	return protocol.MakeIntReply(1)
+}
+
+// execSInterCard returns the cardinality of the intersection, LIMIT 0 means unlimited
+func execSInterCard(db *DB, args [][]byte) redis.Reply {
+	keys, options, errReply := parseNumKeys(args)
+	if errReply != nil {
+		return errReply
+	}
+	limit := 0
+	if len(options) > 0 {
+		if len(options) != 2 || strings.ToUpper(string(options[0])) != "LIMIT" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		limit64, err := strconv.ParseInt(string(options[1]), 10, 64)
+		if err != nil || limit64 < 0 {
+			return protocol.MakeErrReply("ERR LIMIT can't be negative")
+		}
+		limit = int(limit64)
+	}
+
+	sets := make([]*HashSet.Set, len(keys))
+	for i, key := range keys {
+		set, errReply := db.getAsSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		if set == nil {
+			return protocol.MakeIntReply(0)
+		}
+		sets[i] = set
+	}
+
+	card := 0
+	sets[0].ForEach(func(member string) bool {
+		for _, set := range sets[1:] {
+			if !set.Has(member) {
+				return true
+			}
 		}
-		return protocol.MakeMultiBulkReply(result)
+		card++
+		// stop as soon as the limit is reached
+		return limit == 0 || card < limit
+	})
+	return protocol.MakeIntReply(int64(card))
+}
+
+func prepareSInterCard(args [][]byte) ([]string, []string) {
+	keys, _, errReply := parseNumKeys(args)
+	if errReply != nil {
+		return nil, nil
 	}
-	return &protocol.EmptyMultiBulkReply{}
+	return nil, keys
 }
 
 func init() {
-	RegisterCommand("SAdd", execSAdd, writeFirstKey, undoSetChange, -3, flagWrite)
-	RegisterCommand("SIsMember", execSIsMember, readFirstKey, nil, 3, flagReadOnly)
-	RegisterCommand("SRem", execSRem, writeFirstKey, undoSetChange, -3, flagWrite)
-	RegisterCommand("SPop", execSPop, writeFirstKey, undoSetChange, -2, flagWrite)
-	RegisterCommand("SCard", execSCard, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("SMembers", execSMembers, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("SInter", execSInter, prepareSetCalculate, nil, -2, flagReadOnly)
-	RegisterCommand("SInterStore", execSInterStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite)
-	RegisterCommand("SUnion", execSUnion, prepareSetCalculate, nil, -2, flagReadOnly)
-	RegisterCommand("SUnionStore", execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite)
-	RegisterCommand("SDiff", execSDiff, prepareSetCalculate, nil, -2, flagReadOnly)
-	RegisterCommand("SDiffStore", execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite)
-	RegisterCommand("SRandMember", execSRandMember, readFirstKey, nil, -2, flagReadOnly)
+	registerCommand("SAdd", execSAdd, writeFirstKey, undoSetChange, -3, flagWrite).attachCategory("set")
+	registerCommand("SIsMember", execSIsMember, readFirstKey, nil, 3, flagReadOnly).attachCategory("set")
+	registerCommand("SRem", execSRem, writeFirstKey, undoSetChange, -3, flagWrite).attachCategory("set")
+	registerCommand("SPop", execSPop, writeFirstKey, rollbackFirstKey, -2, flagWrite).attachCategory("set")
+	registerCommand("SCard", execSCard, readFirstKey, nil, 2, flagReadOnly).attachCategory("set")
+	registerCommand("SMembers", execSMembers, readFirstKey, nil, 2, flagReadOnly).attachCategory("set")
+	registerCommand("SInter", execSInter, prepareSetCalculate, nil, -2, flagReadOnly).attachKeys(1, -1, 1).attachCategory("set")
+	registerCommand("SInterStore", execSInterStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite).attachKeys(1, -1, 1).attachCategory("set")
+	registerCommand("SUnion", execSUnion, prepareSetCalculate, nil, -2, flagReadOnly).attachKeys(1, -1, 1).attachCategory("set")
+	registerCommand("SUnionStore", execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite).attachKeys(1, -1, 1).attachCategory("set")
+	registerCommand("SDiff", execSDiff, prepareSetCalculate, nil, -2, flagReadOnly).attachKeys(1, -1, 1).attachCategory("set")
+	registerCommand("SDiffStore", execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite).attachKeys(1, -1, 1).attachCategory("set")
+	registerCommand("SRandMember", execSRandMember, readFirstKey, nil, -2, flagReadOnly).attachCategory("set")
+	registerCommand("SMIsMember", execSMIsMember, readFirstKey, nil, -3, flagReadOnly).attachCategory("set")
+	registerCommand("SMove", execSMove, prepareSMove, undoSMove, 4, flagWrite).attachKeys(1, 2, 1).attachCategory("set")
+	registerCommand("SInterCard", execSInterCard, prepareSInterCard, nil, -3, flagReadOnly).attachMovableKeys().attachCategory("set")
 }
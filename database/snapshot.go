@@ -0,0 +1,198 @@
+package database
+
+import (
+	"errors"
+	"miniRedis/aof"
+	"miniRedis/interface/database"
+	"miniRedis/interface/redis"
+	"sync"
+	"time"
+)
+
+/*
+ * AOF 重写使用的数据快照。生成快照时记录每个编号对应的数据库对象，之后写命令第一次修改某个 key 之前，
+ * 先把它修改之前的值保存下来（以 key 为单位的写时复制）。重写时遍历快照中的数据库，已经被修改的 key 使用保存的值，
+ * 所以重写期间不需要复制整个数据库，也不需要重新加载 AOF。
+ *
+ * 写命令在修改 key 期间持有 barrier 的读锁，生成快照时持有写锁并切换 AOF 文件，
+ * 保证每个写命令要么在快照之前执行并写入旧的 AOF 文件，要么在快照之后执行并写入新的增量文件
+ */
+
+// snapshotBarrier 被一个 Server 的所有数据库共享
+type snapshotBarrier struct {
+	mu      sync.RWMutex
+	current *snapshot // 正在进行的快照，持有 mu 时读写
+}
+
+type snapshot struct {
+	barrier *snapshotBarrier
+	dbs     []*DB // 生成快照时每个编号对应的数据库
+	sizes   [][2]int
+	tables  map[*DB]*cowTable
+}
+
+// cowTable 记录一个数据库中已经输出到快照或者在快照之后被修改过的 key
+type cowTable struct {
+	mu    sync.Mutex
+	done  map[string]struct{}    // 之后的修改不再影响快照的 key
+	saved map[string]*savedEntry // 在快照之后被修改的 key 在修改之前的值
+}
+
+type savedEntry struct {
+	dump       []byte // aof.DumpEntity 序列化的值
+	expiration *time.Time
+}
+
+// enterWrite 在修改 keys 之前调用，返回的函数需要在写命令结束后调用。调用者需要持有 keys 的写锁
+func (db *DB) enterWrite(keys []string) func() {
+	barrier := db.snapshots
+	if barrier == nil {
+		return func() {}
+	}
+	barrier.mu.RLock()
+	db.saveForSnapshot(keys)
+	return barrier.mu.RUnlock
+}
+
+// saveForSnapshot 在快照之后第一次修改 key 之前保存它的值，调用者需要持有 barrier 的读锁和 keys 的写锁
+func (db *DB) saveForSnapshot(keys []string) {
+	if db.snapshots == nil || db.snapshots.current == nil {
+		return
+	}
+	table := db.snapshots.current.tables[db]
+	if table == nil { // 生成快照之后创建的数据库
+		return
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := table.done[key]; ok {
+			continue
+		}
+		table.done[key] = struct{}{}
+		raw, ok := db.data.Get(key)
+		if !ok {
+			continue
+		}
+		entry := &savedEntry{dump: aof.DumpEntity(raw.(*database.DataEntity))}
+		if rawExpire, ok := db.ttlMap.Get(key); ok {
+			expireTime := rawExpire.(time.Time)
+			entry.expiration = &expireTime
+		}
+		table.saved[key] = entry
+	}
+}
+
+// enterWrite 在执行 FLUSHDB、SWAPDB 等服务器级别的写命令之前调用，返回的函数需要在命令结束后调用。
+// 脚本在执行期间已经持有 barrier 的读锁，再次加读锁可能和等待中的写锁死锁
+func (server *Server) enterWrite(c redis.Connection) func() {
+	if _, ok := c.(*scriptConn); ok || server.snapshots == nil {
+		return func() {}
+	}
+	server.snapshots.mu.RLock()
+	return server.snapshots.mu.RUnlock
+}
+
+// MakeSnapshot 等待正在执行的写命令结束，调用 atSnapshot 之后生成快照，然后恢复执行写命令
+func (server *Server) MakeSnapshot(atSnapshot func() error) (database.Snapshot, error) {
+	barrier := server.snapshots
+	if barrier == nil {
+		return nil, errors.New("ERR snapshot is not supported")
+	}
+	barrier.mu.Lock()
+	defer barrier.mu.Unlock()
+	if barrier.current != nil {
+		return nil, errors.New("ERR another snapshot is in progress")
+	}
+	if err := atSnapshot(); err != nil {
+		return nil, err
+	}
+	s := &snapshot{
+		barrier: barrier,
+		dbs:     make([]*DB, len(server.dbSet)),
+		sizes:   make([][2]int, len(server.dbSet)),
+		tables:  make(map[*DB]*cowTable, len(server.dbSet)),
+	}
+	for i := range server.dbSet {
+		db := server.mustSelectDB(i)
+		s.dbs[i] = db
+		s.sizes[i] = [2]int{db.data.Len(), db.ttlMap.Len()}
+		s.tables[db] = &cowTable{
+			done:  make(map[string]struct{}),
+			saved: make(map[string]*savedEntry),
+		}
+	}
+	barrier.current = s
+	return s, nil
+}
+
+// GetDBSize 返回生成快照时数据库中 key 的数量和设置了过期时间的 key 的数量
+func (s *snapshot) GetDBSize(dbIndex int) (int, int) {
+	if dbIndex < 0 || dbIndex >= len(s.dbs) {
+		return 0, 0
+	}
+	return s.sizes[dbIndex][0], s.sizes[dbIndex][1]
+}
+
+// ForEach 遍历快照中 dbIndex 号数据库的所有 key，每个 key 只能遍历一次
+func (s *snapshot) ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	if dbIndex < 0 || dbIndex >= len(s.dbs) {
+		return
+	}
+	db := s.dbs[dbIndex]
+	table := s.tables[db]
+	// ConcurrentDict.ForEach 在回调期间持有分段锁，不能在回调中对 key 加锁，所以先取出所有的 key
+	for _, key := range db.data.Keys() {
+		if !s.visit(db, table, key, cb) {
+			return
+		}
+	}
+	// 遍历完成之后，生成快照时存在的 key 都已经输出或者保存，之后保存的值不再需要
+	table.mu.Lock()
+	saved := table.saved
+	table.saved = make(map[string]*savedEntry)
+	table.mu.Unlock()
+	for key, entry := range saved {
+		entity, err := aof.RestoreEntity(entry.dump)
+		if err != nil {
+			continue
+		}
+		if !cb(key, entity, entry.expiration) {
+			return
+		}
+	}
+}
+
+// visit 输出 key 的当前值，key 在快照之后被修改过时跳过
+func (s *snapshot) visit(db *DB, table *cowTable, key string,
+	cb func(key string, data *database.DataEntity, expiration *time.Time) bool) bool {
+	keys := []string{key}
+	db.RWLocks(nil, keys)
+	defer db.RWUnLocks(nil, keys)
+	table.mu.Lock()
+	_, done := table.done[key]
+	table.done[key] = struct{}{}
+	table.mu.Unlock()
+	if done {
+		return true
+	}
+	raw, ok := db.data.Get(key)
+	if !ok {
+		return true
+	}
+	var expiration *time.Time
+	if rawExpire, ok := db.ttlMap.Get(key); ok {
+		expireTime := rawExpire.(time.Time)
+		expiration = &expireTime
+	}
+	return cb(key, raw.(*database.DataEntity), expiration)
+}
+
+// Release 释放快照，之后的写命令不再需要保存 key 修改之前的值
+func (s *snapshot) Release() {
+	s.barrier.mu.Lock()
+	defer s.barrier.mu.Unlock()
+	if s.barrier.current == s {
+		s.barrier.current = nil
+	}
+}
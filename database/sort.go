@@ -0,0 +1,338 @@
+package database
+
+import (
+	"bytes"
+	"miniRedis/datastruct/dict"
+	List "miniRedis/datastruct/list"
+	HashSet "miniRedis/datastruct/set"
+	SortedSet "miniRedis/datastruct/sortedset"
+	"miniRedis/interface/database"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * SORT key [BY pattern] [LIMIT offset count] [GET pattern [GET pattern ...]] [ASC | DESC] [ALPHA] [STORE destination]
+ * pattern 中的第一个 * 会被替换为元素的值，例如 weight_* ；
+ * 使用 key->field 的形式可以引用 hash 中的字段，例如 object_*->weight ；
+ * GET # 表示元素本身；BY 的 pattern 中不包含 * 时不进行排序
+ */
+
+type sortOpts struct {
+	sortBy      string
+	dontSort    bool
+	getPatterns []string
+	offset      int
+	count       int // -1 表示不限制
+	desc        bool
+	alpha       bool
+	storeKey    string
+	store       bool
+}
+
+// sortElement 是一个待排序的元素
+type sortElement struct {
+	value  []byte
+	score  float64 // 数值排序时使用
+	weight []byte  // 按字典序排序时使用
+}
+
+// parseSortOpts parses options of SORT, args do not include command name and key
+func parseSortOpts(args [][]byte, allowStore bool) (*sortOpts, protocol.ErrorReply) {
+	opts := &sortOpts{
+		count: -1,
+	}
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		left := len(args) - i - 1
+		switch {
+		case arg == "ASC":
+			opts.desc = false
+		case arg == "DESC":
+			opts.desc = true
+		case arg == "ALPHA":
+			opts.alpha = true
+		case arg == "LIMIT" && left >= 2:
+			offset, err1 := strconv.Atoi(string(args[i+1]))
+			count, err2 := strconv.Atoi(string(args[i+2]))
+			if err1 != nil || err2 != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if offset < 0 {
+				offset = 0
+			}
+			opts.offset = offset
+			opts.count = count
+			i += 2
+		case arg == "BY" && left >= 1:
+			opts.sortBy = string(args[i+1])
+			// 没有 * 的 pattern 对所有元素都相同，不需要排序
+			if !strings.Contains(opts.sortBy, "*") {
+				opts.dontSort = true
+			}
+			i++
+		case arg == "GET" && left >= 1:
+			opts.getPatterns = append(opts.getPatterns, string(args[i+1]))
+			i++
+		case arg == "STORE" && left >= 1 && allowStore:
+			opts.store = true
+			opts.storeKey = string(args[i+1])
+			i++
+		default:
+			return nil, &protocol.SyntaxErrReply{}
+		}
+	}
+	return opts, nil
+}
+
+// findSortStoreKey returns destination of SORT ... STORE destination, args include the source key
+func findSortStoreKey(args [][]byte) (string, bool) {
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "LIMIT":
+			i += 2
+		case "BY", "GET":
+			i++
+		case "STORE":
+			if i+1 < len(args) {
+				return string(args[i+1]), true
+			}
+		}
+	}
+	return "", false
+}
+
+func prepareSort(args [][]byte) ([]string, []string) {
+	src := string(args[0])
+	if dest, ok := findSortStoreKey(args); ok {
+		return []string{dest}, []string{src}
+	}
+	return nil, []string{src}
+}
+
+// sortLookupsKeys 返回 SORT 是否会通过 BY 或 GET 的 pattern 读取其它 key，这些 key 需要在执行时才能确定
+func sortLookupsKeys(args [][]byte) bool {
+	opts, errReply := parseSortOpts(args[1:], true)
+	if errReply != nil {
+		return false
+	}
+	if opts.sortBy != "" && !opts.dontSort {
+		return true
+	}
+	for _, pattern := range opts.getPatterns {
+		if pattern != "#" && strings.Contains(pattern, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func undoSort(db *DB, args [][]byte) []CmdLine {
+	if dest, ok := findSortStoreKey(args); ok {
+		return rollbackGivenKeys(db, dest)
+	}
+	return nil
+}
+
+// lookupKeyByPattern 将 pattern 中的 * 替换为 subst 并返回对应的值，不存在或者类型不符时返回 nil。
+// 调用者需要持有整个数据库的读锁，见 sortLookupsKeys
+func lookupKeyByPattern(db *DB, pattern string, subst []byte) []byte {
+	// GET # 返回元素本身
+	if pattern == "#" {
+		return subst
+	}
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return nil
+	}
+	keyPattern := pattern
+	field := ""
+	if arrow := strings.LastIndex(pattern, "->"); arrow > star && arrow+2 < len(pattern) {
+		keyPattern = pattern[:arrow]
+		field = pattern[arrow+2:]
+	}
+	key := keyPattern[:star] + string(subst) + keyPattern[star+1:]
+
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return nil
+	}
+	if field == "" {
+		val, _ := entity.Data.([]byte)
+		return val
+	}
+	hash, ok := entity.Data.(dict.Dict)
+	if !ok {
+		return nil
+	}
+	raw, exists := hash.Get(field)
+	if !exists {
+		return nil
+	}
+	val, _ := raw.([]byte)
+	return val
+}
+
+// getSortElements 返回列表、集合或有序集合中的所有元素
+func (db *DB) getSortElements(key string) ([]*sortElement, protocol.ErrorReply) {
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return nil, nil
+	}
+	var elements []*sortElement
+	switch val := entity.Data.(type) {
+	case List.List:
+		elements = make([]*sortElement, 0, val.Len())
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			elements = append(elements, &sortElement{value: bytes})
+			return true
+		})
+	case *HashSet.Set:
+		elements = make([]*sortElement, 0, val.Len())
+		val.ForEach(func(member string) bool {
+			elements = append(elements, &sortElement{value: []byte(member)})
+			return true
+		})
+	case *SortedSet.SortedSet:
+		elements = make([]*sortElement, 0, val.Len())
+		val.ForEach(0, val.Len(), false, func(element *SortedSet.Element) bool {
+			elements = append(elements, &sortElement{value: []byte(element.Member)})
+			return true
+		})
+	default:
+		return nil, &protocol.WrongTypeErrReply{}
+	}
+	return elements, nil
+}
+
+// sortElements 计算每个元素的权重并排序
+func sortElements(db *DB, elements []*sortElement, opts *sortOpts) protocol.ErrorReply {
+	for _, element := range elements {
+		weight := element.value
+		if opts.sortBy != "" {
+			weight = lookupKeyByPattern(db, opts.sortBy, element.value)
+		}
+		if opts.alpha {
+			element.weight = weight
+			continue
+		}
+		if weight == nil {
+			// 权重不存在时视为 0
+			continue
+		}
+		score, err := strconv.ParseFloat(string(weight), 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR One or more scores can't be converted into double")
+		}
+		element.score = score
+	}
+
+	sort.SliceStable(elements, func(i, j int) bool {
+		a, b := elements[i], elements[j]
+		var cmp int
+		if opts.alpha {
+			cmp = bytes.Compare(a.weight, b.weight)
+		} else if a.score < b.score {
+			cmp = -1
+		} else if a.score > b.score {
+			cmp = 1
+		}
+		if cmp == 0 {
+			// 权重相同时按元素本身比较，保证结果是确定的
+			cmp = bytes.Compare(a.value, b.value)
+		}
+		if opts.desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+	return nil
+}
+
+func sort0(db *DB, args [][]byte, allowStore bool) redis.Reply {
+	key := string(args[0])
+	opts, errReply := parseSortOpts(args[1:], allowStore)
+	if errReply != nil {
+		return errReply
+	}
+
+	elements, errReply := db.getSortElements(key)
+	if errReply != nil {
+		return errReply
+	}
+	if !opts.dontSort {
+		errReply = sortElements(db, elements, opts)
+		if errReply != nil {
+			return errReply
+		}
+	}
+
+	// LIMIT offset count
+	start := opts.offset
+	if start > len(elements) {
+		start = len(elements)
+	}
+	end := len(elements)
+	if opts.count >= 0 && start+opts.count < end {
+		end = start + opts.count
+	}
+	elements = elements[start:end]
+
+	var result [][]byte
+	if len(opts.getPatterns) == 0 {
+		result = make([][]byte, 0, len(elements))
+		for _, element := range elements {
+			result = append(result, element.value)
+		}
+	} else {
+		result = make([][]byte, 0, len(elements)*len(opts.getPatterns))
+		for _, element := range elements {
+			for _, pattern := range opts.getPatterns {
+				result = append(result, lookupKeyByPattern(db, pattern, element.value))
+			}
+		}
+	}
+
+	if !opts.store {
+		return protocol.MakeMultiBulkReply(result)
+	}
+	db.Remove(opts.storeKey)
+	db.addAof(utils.ToCmdLine("del", opts.storeKey))
+	if len(result) > 0 {
+		list := List.NewQuickList()
+		for i, val := range result {
+			if val == nil {
+				// 不存在的值以空字符串保存
+				val = []byte{}
+				result[i] = val
+			}
+			list.Add(val)
+		}
+		db.PutEntity(opts.storeKey, &database.DataEntity{
+			Data: list,
+		})
+		db.addAof(utils.ToCmdLine3("rpush", append([][]byte{[]byte(opts.storeKey)}, result...)...))
+	}
+	return protocol.MakeIntReply(int64(len(result)))
+}
+
+// execSort sorts the elements of list, set or sorted set
+func execSort(db *DB, args [][]byte) redis.Reply {
+	return sort0(db, args, true)
+}
+
+// execSortRO is the read-only variant of SORT, which does not accept STORE option
+func execSortRO(db *DB, args [][]byte) redis.Reply {
+	return sort0(db, args, false)
+}
+
+func init() {
+	registerCommand("Sort", execSort, prepareSort, undoSort, -2, flagWrite).attachMovableKeys().attachKeys(1, 1, 1).
+		attachLockAll(sortLookupsKeys).attachCategory("keyspace")
+	registerCommand("Sort_RO", execSortRO, readFirstKey, nil, -2, flagReadOnly).attachLockAll(sortLookupsKeys).attachCategory("keyspace")
+}
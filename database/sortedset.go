@@ -1,6 +1,8 @@
 package database
 
 import (
+	"math"
+	HashSet "miniRedis/datastruct/set"
 	SortedSet "miniRedis/datastruct/sortedset"
 	"miniRedis/interface/database"
 	"miniRedis/interface/redis"
@@ -38,19 +40,66 @@ func (db *DB) getOrInitSortedSet(key string) (sortedSet *SortedSet.SortedSet, in
 	return sortedSet, inited, nil
 }
 
+const (
+	zAddFlagNX = 1 << iota
+	zAddFlagXX
+	zAddFlagGT
+	zAddFlagLT
+	zAddFlagCH
+	zAddFlagIncr
+)
+
+// parseZAddFlags 解析 ZADD 的 [NX|XX] [GT|LT] [CH] [INCR] 选项，返回选项以及第一个 score 参数的下标
+func parseZAddFlags(args [][]byte) (int, int) {
+	flags := 0
+	i := 1
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			flags |= zAddFlagNX
+		case "XX":
+			flags |= zAddFlagXX
+		case "GT":
+			flags |= zAddFlagGT
+		case "LT":
+			flags |= zAddFlagLT
+		case "CH":
+			flags |= zAddFlagCH
+		case "INCR":
+			flags |= zAddFlagIncr
+		default:
+			return flags, i
+		}
+	}
+	return flags, i
+}
+
 // execZAdd adds member into sorted set
 func execZAdd(db *DB, args [][]byte) redis.Reply {
-	if len(args)%2 != 1 {
+	key := string(args[0])
+	flags, pairStart := parseZAddFlags(args)
+	pairArgs := args[pairStart:]
+	if len(pairArgs) == 0 || len(pairArgs)%2 != 0 {
 		return protocol.MakeSyntaxErrReply()
 	}
-	key := string(args[0])
-	size := (len(args) - 1) / 2
+	if flags&zAddFlagNX > 0 && flags&zAddFlagXX > 0 {
+		return protocol.MakeErrReply("ERR XX and NX options at the same time are not compatible")
+	}
+	if (flags&zAddFlagGT > 0 && flags&zAddFlagLT > 0) ||
+		(flags&zAddFlagNX > 0 && flags&(zAddFlagGT|zAddFlagLT) > 0) {
+		return protocol.MakeErrReply("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	incr := flags&zAddFlagIncr > 0
+	if incr && len(pairArgs) != 2 {
+		return protocol.MakeErrReply("ERR INCR option supports a single increment-element pair")
+	}
+	size := len(pairArgs) / 2
 	elements := make([]*SortedSet.Element, size)
 	for i := 0; i < size; i++ {
-		scoreValue := args[2*i+1]
-		member := string(args[2*i+2])
+		scoreValue := pairArgs[2*i]
+		member := string(pairArgs[2*i+1])
 		score, err := strconv.ParseFloat(string(scoreValue), 64)
-		if err != nil {
+		if err != nil || math.IsNaN(score) {
 			return protocol.MakeErrReply("ERR value is not a valid float")
 		}
 		elements[i] = &SortedSet.Element{
@@ -59,30 +108,84 @@ func execZAdd(db *DB, args [][]byte) redis.Reply {
 		}
 	}
 
-	// get or init entity
-	sortedSet, _, errReply := db.getOrInitSortedSet(key)
+	sortedSet, errReply := db.getAsSortedSet(key)
 	if errReply != nil {
 		return errReply
 	}
 
-	i := 0
+	added := 0
+	changed := 0
+	var incrResult *float64
 	for _, e := range elements {
-		if sortedSet.Add(e.Member, e.Score) {
-			i++
+		var existed *SortedSet.Element
+		var exists bool
+		if sortedSet != nil {
+			existed, exists = sortedSet.Get(e.Member)
+		}
+		if exists && flags&zAddFlagNX > 0 {
+			continue
+		}
+		if !exists && flags&zAddFlagXX > 0 {
+			continue
+		}
+		score := e.Score
+		if incr && exists {
+			score = existed.Score + e.Score
+			if math.IsNaN(score) {
+				return protocol.MakeErrReply("ERR resulting score is not a number (NaN)")
+			}
+		}
+		if exists {
+			if flags&zAddFlagGT > 0 && score <= existed.Score {
+				continue
+			}
+			if flags&zAddFlagLT > 0 && score >= existed.Score {
+				continue
+			}
+		}
+		if sortedSet == nil {
+			// get or init entity
+			sortedSet, _, errReply = db.getOrInitSortedSet(key)
+			if errReply != nil {
+				return errReply
+			}
+		}
+		if exists {
+			if score != existed.Score {
+				changed++
+			}
+		} else {
+			added++
+		}
+		sortedSet.Add(e.Member, score)
+		if incr {
+			incrResult = &score
 		}
 	}
 
-	db.addAof(utils.ToCmdLine3("zadd", args...))
-
-	return protocol.MakeIntReply(int64(i))
+	if added > 0 || changed > 0 {
+		db.addAof(utils.ToCmdLine3("zadd", args...))
+	}
+	if incr {
+		if incrResult == nil {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply([]byte(strconv.FormatFloat(*incrResult, 'f', -1, 64)))
+	}
+	if flags&zAddFlagCH > 0 {
+		return protocol.MakeIntReply(int64(added + changed))
+	}
+	return protocol.MakeIntReply(int64(added))
 }
 
 func undoZAdd(db *DB, args [][]byte) []CmdLine {
 	key := string(args[0])
-	size := (len(args) - 1) / 2
+	_, pairStart := parseZAddFlags(args)
+	pairArgs := args[pairStart:]
+	size := len(pairArgs) / 2
 	fields := make([]string, size)
 	for i := 0; i < size; i++ {
-		fields[i] = string(args[2*i+2])
+		fields[i] = string(pairArgs[2*i+1])
 	}
 	return rollbackZSetFields(db, key, fields...)
 }
@@ -170,29 +273,20 @@ func execZCard(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(sortedSet.Len())
 }
 
-// execZRange gets members in range, sort by score in ascending order
+// execZRange gets members in range, supports BYSCORE, BYLEX, REV and LIMIT options
 func execZRange(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 && len(args) != 4 {
-		return protocol.MakeErrReply("ERR wrong number of arguments for 'zrange' command")
-	}
-	withScores := false
-	if len(args) == 4 {
-		if strings.ToUpper(string(args[3])) != "WITHSCORES" {
-			return protocol.MakeErrReply("syntax error")
-		}
-		withScores = true
+	spec, errReply := parseZRangeSpec(args, true)
+	if errReply != nil {
+		return errReply
 	}
-	key := string(args[0])
-	start, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	sortedSet, errReply := db.getAsSortedSet(spec.key)
+	if errReply != nil {
+		return errReply
 	}
-	stop, err := strconv.ParseInt(string(args[2]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	if sortedSet == nil {
+		return &protocol.EmptyMultiBulkReply{}
 	}
-	return range0(db, key, start, stop, withScores, false)
+	return elementsToReply(zRangeElements(sortedSet, spec), spec.withScores)
 }
 
 // execZRevRange gets members in range, sort by score in descending order
@@ -229,15 +323,23 @@ func range0(db *DB, key string, start int64, stop int64, withScores bool, desc b
 	if sortedSet == nil {
 		return &protocol.EmptyMultiBulkReply{}
 	}
+	slice := rangeByRank(sortedSet, start, stop, desc)
+	return elementsToReply(slice, withScores)
+}
 
+// rangeByRank returns members ranking within [start, stop], negative index means counting from the tail
+func rangeByRank(sortedSet *SortedSet.SortedSet, start int64, stop int64, desc bool) []*SortedSet.Element {
 	// compute index
-	size := sortedSet.Len() // assert: size > 0
+	size := sortedSet.Len()
+	if size == 0 {
+		return nil
+	}
 	if start < -1*size {
 		start = 0
 	} else if start < 0 {
 		start = size + start
 	} else if start >= size {
-		return &protocol.EmptyMultiBulkReply{}
+		return nil
 	}
 	if stop < -1*size {
 		stop = 0
@@ -253,26 +355,7 @@ func range0(db *DB, key string, start int64, stop int64, withScores bool, desc b
 	}
 
 	// assert: start in [0, size - 1], stop in [start, size]
-	slice := sortedSet.Range(start, stop, desc)
-	if withScores {
-		result := make([][]byte, len(slice)*2)
-		i := 0
-		for _, element := range slice {
-			result[i] = []byte(element.Member)
-			i++
-			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-			result[i] = []byte(scoreStr)
-			i++
-		}
-		return protocol.MakeMultiBulkReply(result)
-	}
-	result := make([][]byte, len(slice))
-	i := 0
-	for _, element := range slice {
-		result[i] = []byte(element.Member)
-		i++
-	}
-	return protocol.MakeMultiBulkReply(result)
+	return sortedSet.Range(start, stop, desc)
 }
 
 // execZCount gets number of members which score within given range
@@ -304,7 +387,7 @@ func execZCount(db *DB, args [][]byte) redis.Reply {
 /*
  * param limit: limit < 0 means no limit
  */
-func rangeByScore0(db *DB, key string, min *SortedSet.ScoreBorder, max *SortedSet.ScoreBorder, offset int64, limit int64, withScores bool, desc bool) redis.Reply {
+func rangeByScore0(db *DB, key string, min SortedSet.Border, max SortedSet.Border, offset int64, limit int64, withScores bool, desc bool) redis.Reply {
 	// get data
 	sortedSet, errReply := db.getAsSortedSet(key)
 	if errReply != nil {
@@ -315,25 +398,7 @@ func rangeByScore0(db *DB, key string, min *SortedSet.ScoreBorder, max *SortedSe
 	}
 
 	slice := sortedSet.RangeByScore(min, max, offset, limit, desc)
-	if withScores {
-		result := make([][]byte, len(slice)*2)
-		i := 0
-		for _, element := range slice {
-			result[i] = []byte(element.Member)
-			i++
-			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-			result[i] = []byte(scoreStr)
-			i++
-		}
-		return protocol.MakeMultiBulkReply(result)
-	}
-	result := make([][]byte, len(slice))
-	i := 0
-	for _, element := range slice {
-		result[i] = []byte(element.Member)
-		i++
-	}
-	return protocol.MakeMultiBulkReply(result)
+	return elementsToReply(slice, withScores)
 }
 
 // execZRangeByScore gets members which score within given range, in ascending order
@@ -514,15 +579,270 @@ func execZRemRangeByRank(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(removed)
 }
 
-func execZPopMin(db *DB, args [][]byte) redis.Reply {
+// parseLimit 解析 LIMIT offset count 选项，i 指向 LIMIT 所在的位置
+func parseLimit(args [][]byte, i int) (int64, int64, protocol.ErrorReply) {
+	if len(args) < i+3 {
+		return 0, 0, protocol.MakeErrReply("ERR syntax error")
+	}
+	offset, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+	if err != nil {
+		return 0, 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	limit, err := strconv.ParseInt(string(args[i+2]), 10, 64)
+	if err != nil {
+		return 0, 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return offset, limit, nil
+}
+
+// rangeByLex0 returns members within the given lex border
+func rangeByLex0(db *DB, args [][]byte, desc bool) redis.Reply {
+	key := string(args[0])
+	minArg, maxArg := args[1], args[2]
+	if desc {
+		minArg, maxArg = args[2], args[1]
+	}
+	min, err := SortedSet.ParseLexBorder(string(minArg))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	max, err := SortedSet.ParseLexBorder(string(maxArg))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+
+	var offset int64 = 0
+	var limit int64 = -1
+	if len(args) > 3 {
+		if len(args) != 6 || strings.ToUpper(string(args[3])) != "LIMIT" {
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+		var errReply protocol.ErrorReply
+		offset, limit, errReply = parseLimit(args, 3)
+		if errReply != nil {
+			return errReply
+		}
+	}
+	return rangeByScore0(db, key, min, max, offset, limit, false, desc)
+}
+
+// execZRangeByLex gets members within given lex range, in ascending order
+func execZRangeByLex(db *DB, args [][]byte) redis.Reply {
+	return rangeByLex0(db, args, false)
+}
+
+// execZRevRangeByLex gets members within given lex range, in descending order
+func execZRevRangeByLex(db *DB, args [][]byte) redis.Reply {
+	return rangeByLex0(db, args, true)
+}
+
+// execZLexCount gets number of members within given lex range
+func execZLexCount(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+
+	min, err := SortedSet.ParseLexBorder(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+
+	max, err := SortedSet.ParseLexBorder(string(args[2]))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+
+	// get data
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+
+	return protocol.MakeIntReply(sortedSet.Count(min, max))
+}
+
+// execZRemRangeByLex removes members within given lex range
+func execZRemRangeByLex(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+
+	min, err := SortedSet.ParseLexBorder(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+
+	max, err := SortedSet.ParseLexBorder(string(args[2]))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+
+	// get data
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+
+	removed := sortedSet.RemoveByScore(min, max)
+	if sortedSet.Len() == 0 {
+		db.Remove(key)
+	}
+	if removed > 0 {
+		db.addAof(utils.ToCmdLine3("zremrangebylex", args...))
+	}
+	return protocol.MakeIntReply(removed)
+}
+
+// zRangeSpec 保存了 ZRANGE 和 ZRANGESTORE 的参数
+type zRangeSpec struct {
+	key        string
+	start      []byte // BYSCORE/BYLEX 时表示 min，REV 时表示 max
+	stop       []byte
+	byScore    bool
+	byLex      bool
+	rev        bool
+	withScores bool
+	hasLimit   bool
+	offset     int64
+	limit      int64
+	startBound SortedSet.Border
+	stopBound  SortedSet.Border
+	startRank  int64
+	stopRank   int64
+}
+
+// parseZRangeSpec 解析 key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func parseZRangeSpec(args [][]byte, allowWithScores bool) (*zRangeSpec, protocol.ErrorReply) {
+	spec := &zRangeSpec{
+		key:   string(args[0]),
+		start: args[1],
+		stop:  args[2],
+		limit: -1,
+	}
+	for i := 3; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch {
+		case arg == "BYSCORE":
+			spec.byScore = true
+		case arg == "BYLEX":
+			spec.byLex = true
+		case arg == "REV":
+			spec.rev = true
+		case arg == "WITHSCORES" && allowWithScores:
+			spec.withScores = true
+		case arg == "LIMIT":
+			offset, limit, errReply := parseLimit(args, i)
+			if errReply != nil {
+				return nil, errReply
+			}
+			spec.hasLimit = true
+			spec.offset = offset
+			spec.limit = limit
+			i += 2
+		default:
+			return nil, protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+	if spec.byScore && spec.byLex {
+		return nil, protocol.MakeErrReply("ERR syntax error")
+	}
+	if spec.hasLimit && !spec.byScore && !spec.byLex {
+		return nil, protocol.MakeErrReply("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if spec.withScores && spec.byLex {
+		return nil, protocol.MakeErrReply("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	minArg, maxArg := spec.start, spec.stop
+	if spec.rev {
+		minArg, maxArg = spec.stop, spec.start
+	}
+	if spec.byScore {
+		min, err := SortedSet.ParseScoreBorder(string(minArg))
+		if err != nil {
+			return nil, protocol.MakeErrReply(err.Error())
+		}
+		max, err := SortedSet.ParseScoreBorder(string(maxArg))
+		if err != nil {
+			return nil, protocol.MakeErrReply(err.Error())
+		}
+		spec.startBound, spec.stopBound = min, max
+	} else if spec.byLex {
+		min, err := SortedSet.ParseLexBorder(string(minArg))
+		if err != nil {
+			return nil, protocol.MakeErrReply(err.Error())
+		}
+		max, err := SortedSet.ParseLexBorder(string(maxArg))
+		if err != nil {
+			return nil, protocol.MakeErrReply(err.Error())
+		}
+		spec.startBound, spec.stopBound = min, max
+	} else {
+		start, err := strconv.ParseInt(string(spec.start), 10, 64)
+		if err != nil {
+			return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		stop, err := strconv.ParseInt(string(spec.stop), 10, 64)
+		if err != nil {
+			return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		spec.startRank, spec.stopRank = start, stop
+	}
+	return spec, nil
+}
+
+// zRangeElements 按照 spec 返回有序集合中的元素
+func zRangeElements(sortedSet *SortedSet.SortedSet, spec *zRangeSpec) []*SortedSet.Element {
+	if spec.byScore || spec.byLex {
+		return sortedSet.RangeByScore(spec.startBound, spec.stopBound, spec.offset, spec.limit, spec.rev)
+	}
+	return rangeByRank(sortedSet, spec.startRank, spec.stopRank, spec.rev)
+}
+
+func prepareZRangeStore(args [][]byte) ([]string, []string) {
+	dest := string(args[0])
+	src := string(args[1])
+	return []string{dest}, []string{src}
+}
+
+// execZRangeStore stores members in range of src into dest
+func execZRangeStore(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	spec, errReply := parseZRangeSpec(args[1:], false)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(spec.key)
+	if errReply != nil {
+		return errReply
+	}
+	result := SortedSet.Make()
+	if sortedSet != nil {
+		for _, element := range zRangeElements(sortedSet, spec) {
+			result.Add(element.Member, element.Score)
+		}
+	}
+	return storeZSetResult(db, "zrangestore", dest, result, args)
+}
+
+// pop0 removes members with the lowest or highest scores
+func pop0(db *DB, args [][]byte, max bool) redis.Reply {
 	key := string(args[0])
 	count := 1
+	if len(args) > 2 {
+		return protocol.MakeSyntaxErrReply()
+	}
 	if len(args) > 1 {
 		var err error
 		count, err = strconv.Atoi(string(args[1]))
 		if err != nil {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
 		}
+		if count < 0 {
+			return protocol.MakeErrReply("ERR value is out of range, must be positive")
+		}
 	}
 
 	sortedSet, errReply := db.getAsSortedSet(key)
@@ -533,18 +853,184 @@ func execZPopMin(db *DB, args [][]byte) redis.Reply {
 		return protocol.MakeEmptyMultiBulkReply()
 	}
 
-	removed := sortedSet.PopMin(count)
+	removed := popElements(sortedSet, count, max)
+	if sortedSet.Len() == 0 {
+		db.Remove(key)
+	}
 	if len(removed) > 0 {
-		db.addAof(utils.ToCmdLine3("zpopmin", args...))
+		cmdName := "zpopmin"
+		if max {
+			cmdName = "zpopmax"
+		}
+		db.addAof(utils.ToCmdLine3(cmdName, args...))
+	}
+	return elementsToReply(removed, true)
+}
+
+func popElements(sortedSet *SortedSet.SortedSet, count int, max bool) []*SortedSet.Element {
+	if count <= 0 {
+		// PopMin treats 0 as no limit
+		return nil
+	}
+	if max {
+		return sortedSet.PopMax(count)
+	}
+	return sortedSet.PopMin(count)
+}
+
+// execZPopMin removes and returns members with the lowest scores
+func execZPopMin(db *DB, args [][]byte) redis.Reply {
+	return pop0(db, args, false)
+}
+
+// execZPopMax removes and returns members with the highest scores
+func execZPopMax(db *DB, args [][]byte) redis.Reply {
+	return pop0(db, args, true)
+}
+
+// parseZMPop 解析 numkeys key [key ...] MIN|MAX [COUNT count]
+func parseZMPop(args [][]byte) (keys []string, max bool, count int, errReply protocol.ErrorReply) {
+	keys, options, errReply := parseNumKeys(args)
+	if errReply != nil {
+		return nil, false, 0, errReply
+	}
+	if len(options) == 0 {
+		return nil, false, 0, protocol.MakeSyntaxErrReply()
+	}
+	switch strings.ToUpper(string(options[0])) {
+	case "MIN":
+		max = false
+	case "MAX":
+		max = true
+	default:
+		return nil, false, 0, protocol.MakeSyntaxErrReply()
+	}
+	count = 1
+	if len(options) > 1 {
+		if len(options) != 3 || strings.ToUpper(string(options[1])) != "COUNT" {
+			return nil, false, 0, protocol.MakeSyntaxErrReply()
+		}
+		var err error
+		count, err = strconv.Atoi(string(options[2]))
+		if err != nil || count <= 0 {
+			return nil, false, 0, protocol.MakeErrReply("ERR count should be greater than 0")
+		}
+	}
+	return keys, max, count, nil
+}
+
+func prepareZMPop(args [][]byte) ([]string, []string) {
+	keys, _, errReply := parseNumKeys(args)
+	if errReply != nil {
+		return nil, nil
+	}
+	return keys, nil
+}
+
+// execZMPop pops members from the first non-empty sorted set
+func execZMPop(db *DB, args [][]byte) redis.Reply {
+	keys, max, count, errReply := parseZMPop(args)
+	if errReply != nil {
+		return errReply
+	}
+	for _, key := range keys {
+		sortedSet, errReply := db.getAsSortedSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		if sortedSet == nil || sortedSet.Len() == 0 {
+			continue
+		}
+		removed := popElements(sortedSet, count, max)
+		if sortedSet.Len() == 0 {
+			db.Remove(key)
+		}
+		// we convert to zpopmin/zpopmax command to write aof
+		cmdName := "zpopmin"
+		if max {
+			cmdName = "zpopmax"
+		}
+		db.addAof(utils.ToCmdLine(cmdName, key, strconv.Itoa(count)))
+
+		elements := make([]redis.Reply, len(removed))
+		for i, element := range removed {
+			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
+			elements[i] = protocol.MakeMultiBulkReply([][]byte{[]byte(element.Member), []byte(scoreStr)})
+		}
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key)),
+			protocol.MakeMultiRawReply(elements),
+		})
+	}
+	return protocol.MakeNullMultiBulkReply()
+}
+
+func undoZMPop(db *DB, args [][]byte) []CmdLine {
+	keys, _ := prepareZMPop(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
+// execZMScore gets scores of the given members
+func execZMScore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
 	}
-	result := make([][]byte, 0, len(removed)*2)
-	for _, element := range removed {
-		scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-		result = append(result, []byte(element.Member), []byte(scoreStr))
+	result := make([][]byte, len(args)-1)
+	if sortedSet == nil {
+		return protocol.MakeMultiBulkReply(result)
+	}
+	for i, member := range args[1:] {
+		element, exists := sortedSet.Get(string(member))
+		if !exists {
+			continue
+		}
+		result[i] = []byte(strconv.FormatFloat(element.Score, 'f', -1, 64))
 	}
 	return protocol.MakeMultiBulkReply(result)
 }
 
+// execZRandMember gets random members from sorted set
+func execZRandMember(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 3 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	key := string(args[0])
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 1 {
+		if sortedSet == nil || sortedSet.Len() == 0 {
+			return &protocol.NullBulkReply{}
+		}
+		members := sortedSet.RandomMembers(1)
+		return protocol.MakeBulkReply([]byte(members[0].Member))
+	}
+	count64, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	withScores := false
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[2])) != "WITHSCORES" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		withScores = true
+	}
+	if sortedSet == nil || count64 == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	var members []*SortedSet.Element
+	if count64 > 0 {
+		members = sortedSet.RandomDistinctMembers(int(count64))
+	} else {
+		members = sortedSet.RandomMembers(int(-count64))
+	}
+	return elementsToReply(members, withScores)
+}
+
 // execZRem removes given members
 func execZRem(db *DB, args [][]byte) redis.Reply {
 	// parse args
@@ -621,20 +1107,426 @@ func undoZIncr(db *DB, args [][]byte) []CmdLine {
 	return rollbackZSetFields(db, key, field)
 }
 
+// getAsZSetOrSet returns the sorted set bound to the key, plain sets are treated as sorted set with score 1
+func (db *DB) getAsZSetOrSet(key string) (*SortedSet.SortedSet, protocol.ErrorReply) {
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return nil, nil
+	}
+	switch val := entity.Data.(type) {
+	case *SortedSet.SortedSet:
+		return val, nil
+	case *HashSet.Set:
+		sortedSet := SortedSet.Make()
+		val.ForEach(func(member string) bool {
+			sortedSet.Add(member, 1)
+			return true
+		})
+		return sortedSet, nil
+	}
+	return nil, &protocol.WrongTypeErrReply{}
+}
+
+const (
+	aggregateSum = iota
+	aggregateMin
+	aggregateMax
+)
+
+// zSetCalculateOpts 保存了 ZUNION/ZINTER/ZDIFF 等命令的参数
+type zSetCalculateOpts struct {
+	keys       []string
+	weights    []float64
+	aggregate  int
+	withScores bool
+	limit      int64
+}
+
+// parseNumKeys 解析 numkeys key [key ...] 部分，返回 key 列表以及剩余的参数
+func parseNumKeys(args [][]byte) ([]string, [][]byte, protocol.ErrorReply) {
+	if len(args) == 0 {
+		return nil, nil, protocol.MakeSyntaxErrReply()
+	}
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 {
+		return nil, nil, protocol.MakeErrReply("ERR at least 1 input key is needed")
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, protocol.MakeSyntaxErrReply()
+	}
+	keys := make([]string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		keys[i] = string(args[i+1])
+	}
+	return keys, args[numKeys+1:], nil
+}
+
+// parseZSetCalculateOpts 解析 numkeys key [key ...] 以及后续的选项
+// allowWeights 表示是否允许 WEIGHTS 和 AGGREGATE，allowWithScores 表示是否允许 WITHSCORES，allowLimit 表示是否允许 LIMIT
+func parseZSetCalculateOpts(args [][]byte, allowWeights bool, allowWithScores bool, allowLimit bool) (*zSetCalculateOpts, protocol.ErrorReply) {
+	keys, options, errReply := parseNumKeys(args)
+	if errReply != nil {
+		return nil, errReply
+	}
+	opts := &zSetCalculateOpts{
+		keys:      keys,
+		aggregate: aggregateSum,
+	}
+	for i := 0; i < len(options); i++ {
+		arg := strings.ToUpper(string(options[i]))
+		if arg == "WEIGHTS" && allowWeights {
+			if i+len(keys) >= len(options) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			opts.weights = make([]float64, len(keys))
+			for j := range keys {
+				weight, err := strconv.ParseFloat(string(options[i+1+j]), 64)
+				if err != nil || math.IsNaN(weight) {
+					return nil, protocol.MakeErrReply("ERR weight value is not a float")
+				}
+				opts.weights[j] = weight
+			}
+			i += len(keys)
+		} else if arg == "AGGREGATE" && allowWeights {
+			if i+1 >= len(options) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			switch strings.ToUpper(string(options[i+1])) {
+			case "SUM":
+				opts.aggregate = aggregateSum
+			case "MIN":
+				opts.aggregate = aggregateMin
+			case "MAX":
+				opts.aggregate = aggregateMax
+			default:
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			i++
+		} else if arg == "WITHSCORES" && allowWithScores {
+			opts.withScores = true
+		} else if arg == "LIMIT" && allowLimit {
+			if i+1 >= len(options) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			limit, err := strconv.ParseInt(string(options[i+1]), 10, 64)
+			if err != nil || limit < 0 {
+				return nil, protocol.MakeErrReply("ERR LIMIT can't be negative")
+			}
+			opts.limit = limit
+			i++
+		} else {
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+	}
+	return opts, nil
+}
+
+func (opts *zSetCalculateOpts) weightOf(i int) float64 {
+	if opts.weights == nil {
+		return 1
+	}
+	return opts.weights[i]
+}
+
+// aggregateScore 按照 AGGREGATE 选项合并两个分值
+func aggregateScore(aggregate int, a float64, b float64) float64 {
+	switch aggregate {
+	case aggregateMin:
+		return math.Min(a, b)
+	case aggregateMax:
+		return math.Max(a, b)
+	}
+	sum := a + b
+	if math.IsNaN(sum) {
+		// +inf + -inf, same as redis
+		return 0
+	}
+	return sum
+}
+
+// weightedScore 计算带权重的分值，避免 0 * inf 得到 NaN
+func weightedScore(score float64, weight float64) float64 {
+	result := score * weight
+	if math.IsNaN(result) {
+		return 0
+	}
+	return result
+}
+
+// forEachZSetMember 遍历有序集合中的全部元素
+func forEachZSetMember(sortedSet *SortedSet.SortedSet, consumer func(element *SortedSet.Element) bool) {
+	if sortedSet == nil || sortedSet.Len() == 0 {
+		return
+	}
+	sortedSet.ForEach(0, sortedSet.Len(), false, consumer)
+}
+
+// zSetUnion 计算多个有序集合的并集
+func zSetUnion(db *DB, opts *zSetCalculateOpts) (*SortedSet.SortedSet, protocol.ErrorReply) {
+	result := SortedSet.Make()
+	for i, key := range opts.keys {
+		sortedSet, errReply := db.getAsZSetOrSet(key)
+		if errReply != nil {
+			return nil, errReply
+		}
+		weight := opts.weightOf(i)
+		forEachZSetMember(sortedSet, func(element *SortedSet.Element) bool {
+			score := weightedScore(element.Score, weight)
+			if existed, ok := result.Get(element.Member); ok {
+				score = aggregateScore(opts.aggregate, existed.Score, score)
+			}
+			result.Add(element.Member, score)
+			return true
+		})
+	}
+	return result, nil
+}
+
+// zSetInter 计算多个有序集合的交集
+func zSetInter(db *DB, opts *zSetCalculateOpts) (*SortedSet.SortedSet, protocol.ErrorReply) {
+	sets := make([]*SortedSet.SortedSet, len(opts.keys))
+	for i, key := range opts.keys {
+		sortedSet, errReply := db.getAsZSetOrSet(key)
+		if errReply != nil {
+			return nil, errReply
+		}
+		sets[i] = sortedSet
+	}
+	result := SortedSet.Make()
+	for _, sortedSet := range sets {
+		if sortedSet == nil || sortedSet.Len() == 0 {
+			// early termination
+			return result, nil
+		}
+	}
+	forEachZSetMember(sets[0], func(element *SortedSet.Element) bool {
+		score := weightedScore(element.Score, opts.weightOf(0))
+		for i := 1; i < len(sets); i++ {
+			other, ok := sets[i].Get(element.Member)
+			if !ok {
+				return true
+			}
+			score = aggregateScore(opts.aggregate, score, weightedScore(other.Score, opts.weightOf(i)))
+		}
+		result.Add(element.Member, score)
+		return true
+	})
+	return result, nil
+}
+
+// zSetDiff 计算第一个有序集合与其余集合的差集
+func zSetDiff(db *DB, opts *zSetCalculateOpts) (*SortedSet.SortedSet, protocol.ErrorReply) {
+	sets := make([]*SortedSet.SortedSet, len(opts.keys))
+	for i, key := range opts.keys {
+		sortedSet, errReply := db.getAsZSetOrSet(key)
+		if errReply != nil {
+			return nil, errReply
+		}
+		sets[i] = sortedSet
+	}
+	result := SortedSet.Make()
+	forEachZSetMember(sets[0], func(element *SortedSet.Element) bool {
+		for i := 1; i < len(sets); i++ {
+			if sets[i] == nil {
+				continue
+			}
+			if _, ok := sets[i].Get(element.Member); ok {
+				return true
+			}
+		}
+		result.Add(element.Member, element.Score)
+		return true
+	})
+	return result, nil
+}
+
+// zSetToReply 将有序集合按分值升序转换为回复
+func zSetToReply(sortedSet *SortedSet.SortedSet, withScores bool) redis.Reply {
+	if sortedSet.Len() == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	slice := sortedSet.Range(0, sortedSet.Len(), false)
+	return elementsToReply(slice, withScores)
+}
+
+func elementsToReply(slice []*SortedSet.Element, withScores bool) redis.Reply {
+	if withScores {
+		result := make([][]byte, 0, len(slice)*2)
+		for _, element := range slice {
+			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
+			result = append(result, []byte(element.Member), []byte(scoreStr))
+		}
+		return protocol.MakeMultiBulkReply(result)
+	}
+	result := make([][]byte, len(slice))
+	for i, element := range slice {
+		result[i] = []byte(element.Member)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// storeZSetResult 将计算结果存入 dest，结果为空时删除 dest
+func storeZSetResult(db *DB, cmdName string, dest string, result *SortedSet.SortedSet, args [][]byte) redis.Reply {
+	db.Remove(dest) // clean ttl and old value
+	if result.Len() > 0 {
+		db.PutEntity(dest, &database.DataEntity{
+			Data: result,
+		})
+	}
+	db.addAof(utils.ToCmdLine3(cmdName, args...))
+	return protocol.MakeIntReply(result.Len())
+}
+
+// prepareZSetCalculate 分析 numkeys key [key ...] 形式的命令所涉及的 key
+func prepareZSetCalculate(args [][]byte) ([]string, []string) {
+	keys, _, errReply := parseNumKeys(args)
+	if errReply != nil {
+		return nil, nil
+	}
+	return nil, keys
+}
+
+// prepareZSetCalculateStore 分析 destination numkeys key [key ...] 形式的命令所涉及的 key
+func prepareZSetCalculateStore(args [][]byte) ([]string, []string) {
+	dest := string(args[0])
+	keys, _, errReply := parseNumKeys(args[1:])
+	if errReply != nil {
+		return []string{dest}, nil
+	}
+	return []string{dest}, keys
+}
+
+// execZUnion returns union of multiple sorted sets
+func execZUnion(db *DB, args [][]byte) redis.Reply {
+	opts, errReply := parseZSetCalculateOpts(args, true, true, false)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := zSetUnion(db, opts)
+	if errReply != nil {
+		return errReply
+	}
+	return zSetToReply(result, opts.withScores)
+}
+
+// execZUnionStore stores union of multiple sorted sets in destination
+func execZUnionStore(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	opts, errReply := parseZSetCalculateOpts(args[1:], true, false, false)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := zSetUnion(db, opts)
+	if errReply != nil {
+		return errReply
+	}
+	return storeZSetResult(db, "zunionstore", dest, result, args)
+}
+
+// execZInter returns intersection of multiple sorted sets
+func execZInter(db *DB, args [][]byte) redis.Reply {
+	opts, errReply := parseZSetCalculateOpts(args, true, true, false)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := zSetInter(db, opts)
+	if errReply != nil {
+		return errReply
+	}
+	return zSetToReply(result, opts.withScores)
+}
+
+// execZInterStore stores intersection of multiple sorted sets in destination
+func execZInterStore(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	opts, errReply := parseZSetCalculateOpts(args[1:], true, false, false)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := zSetInter(db, opts)
+	if errReply != nil {
+		return errReply
+	}
+	return storeZSetResult(db, "zinterstore", dest, result, args)
+}
+
+// execZInterCard returns cardinality of the intersection, LIMIT 0 means unlimited
+func execZInterCard(db *DB, args [][]byte) redis.Reply {
+	opts, errReply := parseZSetCalculateOpts(args, false, false, true)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := zSetInter(db, opts)
+	if errReply != nil {
+		return errReply
+	}
+	card := result.Len()
+	if opts.limit > 0 && card > opts.limit {
+		card = opts.limit
+	}
+	return protocol.MakeIntReply(card)
+}
+
+// execZDiff returns members of the first sorted set which not exist in the others
+func execZDiff(db *DB, args [][]byte) redis.Reply {
+	opts, errReply := parseZSetCalculateOpts(args, false, true, false)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := zSetDiff(db, opts)
+	if errReply != nil {
+		return errReply
+	}
+	return zSetToReply(result, opts.withScores)
+}
+
+// execZDiffStore stores difference of multiple sorted sets in destination
+func execZDiffStore(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	opts, errReply := parseZSetCalculateOpts(args[1:], false, false, false)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := zSetDiff(db, opts)
+	if errReply != nil {
+		return errReply
+	}
+	return storeZSetResult(db, "zdiffstore", dest, result, args)
+}
+
 func init() {
-	RegisterCommand("ZAdd", execZAdd, writeFirstKey, undoZAdd, -4, flagWrite)
-	RegisterCommand("ZScore", execZScore, readFirstKey, nil, 3, flagReadOnly)
-	RegisterCommand("ZIncrBy", execZIncrBy, writeFirstKey, undoZIncr, 4, flagWrite)
-	RegisterCommand("ZRank", execZRank, readFirstKey, nil, 3, flagReadOnly)
-	RegisterCommand("ZCount", execZCount, readFirstKey, nil, 4, flagReadOnly)
-	RegisterCommand("ZRevRank", execZRevRank, readFirstKey, nil, 3, flagReadOnly)
-	RegisterCommand("ZCard", execZCard, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("ZRange", execZRange, readFirstKey, nil, -4, flagReadOnly)
-	RegisterCommand("ZRangeByScore", execZRangeByScore, readFirstKey, nil, -4, flagReadOnly)
-	RegisterCommand("ZRevRange", execZRevRange, readFirstKey, nil, -4, flagReadOnly)
-	RegisterCommand("ZRevRangeByScore", execZRevRangeByScore, readFirstKey, nil, -4, flagReadOnly)
-	RegisterCommand("ZPopMin", execZPopMin, writeFirstKey, rollbackFirstKey, -2, flagWrite)
-	RegisterCommand("ZRem", execZRem, writeFirstKey, undoZRem, -3, flagWrite)
-	RegisterCommand("ZRemRangeByScore", execZRemRangeByScore, writeFirstKey, rollbackFirstKey, 4, flagWrite)
-	RegisterCommand("ZRemRangeByRank", execZRemRangeByRank, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	registerCommand("ZAdd", execZAdd, writeFirstKey, undoZAdd, -4, flagWrite).attachCategory("sortedset")
+	registerCommand("ZScore", execZScore, readFirstKey, nil, 3, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZIncrBy", execZIncrBy, writeFirstKey, undoZIncr, 4, flagWrite).attachCategory("sortedset")
+	registerCommand("ZRank", execZRank, readFirstKey, nil, 3, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZCount", execZCount, readFirstKey, nil, 4, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRevRank", execZRevRank, readFirstKey, nil, 3, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZCard", execZCard, readFirstKey, nil, 2, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRange", execZRange, readFirstKey, nil, -4, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRangeByScore", execZRangeByScore, readFirstKey, nil, -4, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRevRange", execZRevRange, readFirstKey, nil, -4, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRevRangeByScore", execZRevRangeByScore, readFirstKey, nil, -4, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRangeByLex", execZRangeByLex, readFirstKey, nil, -4, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRevRangeByLex", execZRevRangeByLex, readFirstKey, nil, -4, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZLexCount", execZLexCount, readFirstKey, nil, 4, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRangeStore", execZRangeStore, prepareZRangeStore, rollbackFirstKey, -5, flagWrite).attachKeys(1, 2, 1).attachCategory("sortedset")
+	registerCommand("ZPopMin", execZPopMin, writeFirstKey, rollbackFirstKey, -2, flagWrite).attachCategory("sortedset")
+	registerCommand("ZPopMax", execZPopMax, writeFirstKey, rollbackFirstKey, -2, flagWrite).attachCategory("sortedset")
+	registerCommand("ZMPop", execZMPop, prepareZMPop, undoZMPop, -4, flagWrite).attachMovableKeys().attachCategory("sortedset")
+	registerCommand("ZMScore", execZMScore, readFirstKey, nil, -3, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRandMember", execZRandMember, readFirstKey, nil, -2, flagReadOnly).attachCategory("sortedset")
+	registerCommand("ZRem", execZRem, writeFirstKey, undoZRem, -3, flagWrite).attachCategory("sortedset")
+	registerCommand("ZRemRangeByScore", execZRemRangeByScore, writeFirstKey, rollbackFirstKey, 4, flagWrite).attachCategory("sortedset")
+	registerCommand("ZRemRangeByRank", execZRemRangeByRank, writeFirstKey, rollbackFirstKey, 4, flagWrite).attachCategory("sortedset")
+	registerCommand("ZRemRangeByLex", execZRemRangeByLex, writeFirstKey, rollbackFirstKey, 4, flagWrite).attachCategory("sortedset")
+	registerCommand("ZUnion", execZUnion, prepareZSetCalculate, nil, -3, flagReadOnly).attachMovableKeys().attachCategory("sortedset")
+	registerCommand("ZUnionStore", execZUnionStore, prepareZSetCalculateStore, rollbackFirstKey, -4, flagWrite).attachMovableKeys().attachCategory("sortedset")
+	registerCommand("ZInter", execZInter, prepareZSetCalculate, nil, -3, flagReadOnly).attachMovableKeys().attachCategory("sortedset")
+	registerCommand("ZInterStore", execZInterStore, prepareZSetCalculateStore, rollbackFirstKey, -4, flagWrite).attachMovableKeys().attachCategory("sortedset")
+	registerCommand("ZInterCard", execZInterCard, prepareZSetCalculate, nil, -3, flagReadOnly).attachMovableKeys().attachCategory("sortedset")
+	registerCommand("ZDiff", execZDiff, prepareZSetCalculate, nil, -3, flagReadOnly).attachMovableKeys().attachCategory("sortedset")
+	registerCommand("ZDiffStore", execZDiffStore, prepareZSetCalculateStore, rollbackFirstKey, -4, flagWrite).attachMovableKeys().attachCategory("sortedset")
 }
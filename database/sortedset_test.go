@@ -0,0 +1,35 @@
+package database
+
+import (
+	"miniRedis/redis/connection"
+	"testing"
+)
+
+func TestZSetWeights(t *testing.T) {
+	server := NewStandaloneServer()
+	conn := connection.NewFakeConn()
+	execCmd(server, conn, "ZADD", "z1", "1", "a", "2", "b")
+	execCmd(server, conn, "ZADD", "z2", "0", "a")
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"weights", []string{"ZUNION", "2", "z1", "z2", "WEIGHTS", "2", "3", "WITHSCORES"}, "*4\r\n$1\r\na\r\n$1\r\n2\r\n$1\r\nb\r\n$1\r\n4\r\n"},
+		{"zero times inf is zero", []string{"ZINTER", "2", "z1", "z2", "WEIGHTS", "1", "inf", "WITHSCORES"}, "*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{"nan weight", []string{"ZUNION", "2", "z1", "z2", "WEIGHTS", "1", "nan"}, "-ERR weight value is not a float\r\n"},
+		{"nan weight in store", []string{"ZUNIONSTORE", "dest", "1", "z1", "WEIGHTS", "NaN"}, "-ERR weight value is not a float\r\n"},
+		{"nan weight in inter", []string{"ZINTERSTORE", "dest", "1", "z1", "WEIGHTS", "-nan"}, "-ERR weight value is not a float\r\n"},
+		{"bad weight", []string{"ZUNION", "1", "z1", "WEIGHTS", "x"}, "-ERR weight value is not a float\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(execCmd(server, conn, tt.args...).ToBytes()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := string(execCmd(server, conn, "EXISTS", "dest").ToBytes()); got != ":0\r\n" {
+		t.Errorf("dest should not be created: %q", got)
+	}
+}
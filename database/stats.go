@@ -0,0 +1,193 @@
+package database
+
+import (
+	"miniRedis/interface/redis"
+	"miniRedis/redis/protocol"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * 服务器运行时的统计信息，供 INFO 命令和 metrics 接口使用。
+ * 统计信息属于整个进程，所有的计数器都通过原子操作更新
+ */
+
+// latencyBuckets 是命令延迟直方图的上界（微秒），最后还有一个 +Inf 桶
+var latencyBuckets = []int64{10, 50, 100, 500, 1000, 5000, 10000, 50000, 100000, 500000, 1000000}
+
+// commandStat 记录一个命令的调用次数、失败次数和耗时分布
+type commandStat struct {
+	calls       int64
+	failedCalls int64
+	usec        int64
+	buckets     []int64 // 与 latencyBuckets 对应，非累计
+}
+
+// serverStats 汇总服务器级别的计数器
+type serverStats struct {
+	commands sync.Map // command name -> *commandStat
+	errors   sync.Map // error prefix -> *int64
+
+	totalCommands    int64
+	totalConnections int64
+	netInputBytes    int64
+	netOutputBytes   int64
+	keyspaceHits     int64
+	keyspaceMisses   int64
+	expiredKeys      int64
+	evictedKeys      int64 // 目前没有实现 maxmemory 淘汰，始终为 0
+
+	// 每秒的命令数和网络流量，由采样协程定期更新
+	opsSampler    *rateSampler
+	inputSampler  *rateSampler
+	outputSampler *rateSampler
+}
+
+var stats = &serverStats{
+	opsSampler:    &rateSampler{},
+	inputSampler:  &rateSampler{},
+	outputSampler: &rateSampler{},
+}
+
+const (
+	statsSampleInterval = 100 * time.Millisecond
+	statsSampleCount    = 16
+)
+
+func init() {
+	go func() {
+		ticker := time.NewTicker(statsSampleInterval)
+		for now := range ticker.C {
+			stats.opsSampler.sample(now, atomic.LoadInt64(&stats.totalCommands))
+			stats.inputSampler.sample(now, atomic.LoadInt64(&stats.netInputBytes))
+			stats.outputSampler.sample(now, atomic.LoadInt64(&stats.netOutputBytes))
+		}
+	}()
+}
+
+// rateSampler 与 redis 的 instantaneous 指标相同，保存最近若干次采样的速率并取平均值
+type rateSampler struct {
+	mu        sync.Mutex
+	samples   [statsSampleCount]float64
+	index     int
+	lastTime  time.Time
+	lastValue int64
+}
+
+func (r *rateSampler) sample(now time.Time, value int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastTime.IsZero() {
+		if elapsed := now.Sub(r.lastTime).Seconds(); elapsed > 0 {
+			r.samples[r.index] = float64(value-r.lastValue) / elapsed
+			r.index = (r.index + 1) % statsSampleCount
+		}
+	}
+	r.lastTime = now
+	r.lastValue = value
+}
+
+// rate 返回每秒的平均增量
+func (r *rateSampler) rate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sum float64
+	for _, v := range r.samples {
+		sum += v
+	}
+	return sum / statsSampleCount
+}
+
+// RecordConnection should be called when a client connection is accepted
+func RecordConnection() {
+	atomic.AddInt64(&stats.totalConnections, 1)
+}
+
+// RecordNetInput records bytes read from clients
+func RecordNetInput(n int) {
+	atomic.AddInt64(&stats.netInputBytes, int64(n))
+}
+
+// RecordNetOutput records bytes written to clients
+func RecordNetOutput(n int) {
+	atomic.AddInt64(&stats.netOutputBytes, int64(n))
+}
+
+// isKnownCommand 判断命令是否存在，未知命令不计入统计
+func isKnownCommand(name string) bool {
+	return lookupCommand(name) != nil
+}
+
+func (s *serverStats) getCommandStat(name string) *commandStat {
+	if raw, ok := s.commands.Load(name); ok {
+		return raw.(*commandStat)
+	}
+	raw, _ := s.commands.LoadOrStore(name, &commandStat{
+		buckets: make([]int64, len(latencyBuckets)+1),
+	})
+	return raw.(*commandStat)
+}
+
+// recordCommand 记录一次命令调用，进入事务队列的命令在 EXEC 时才算执行，不在这里统计
+func (s *serverStats) recordCommand(name string, elapsed time.Duration, reply redis.Reply) {
+	if _, queued := reply.(*protocol.QueuedReply); queued || !isKnownCommand(name) {
+		return
+	}
+	atomic.AddInt64(&s.totalCommands, 1)
+	stat := s.getCommandStat(name)
+	atomic.AddInt64(&stat.calls, 1)
+	usec := elapsed.Microseconds()
+	atomic.AddInt64(&stat.usec, usec)
+	bucket := sort.Search(len(latencyBuckets), func(i int) bool {
+		return usec <= latencyBuckets[i]
+	})
+	atomic.AddInt64(&stat.buckets[bucket], 1)
+	if errReply, ok := reply.(protocol.ErrorReply); ok {
+		atomic.AddInt64(&stat.failedCalls, 1)
+		s.recordError(errReply.Error())
+	}
+}
+
+// recordError 按照错误信息的第一个单词（例如 ERR、WRONGTYPE）分类统计错误
+func (s *serverStats) recordError(msg string) {
+	prefix := msg
+	if i := strings.IndexByte(msg, ' '); i > 0 {
+		prefix = msg[:i]
+	}
+	raw, ok := s.errors.Load(prefix)
+	if !ok {
+		raw, _ = s.errors.LoadOrStore(prefix, new(int64))
+	}
+	atomic.AddInt64(raw.(*int64), 1)
+}
+
+// forEachCommand 按照命令名的顺序遍历统计信息
+func (s *serverStats) forEachCommand(fn func(name string, stat *commandStat)) {
+	names := make([]string, 0)
+	s.commands.Range(func(key, value interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		fn(name, s.getCommandStat(name))
+	}
+}
+
+// forEachError 按照错误前缀的顺序遍历错误计数
+func (s *serverStats) forEachError(fn func(prefix string, count int64)) {
+	counts := make(map[string]int64)
+	prefixes := make([]string, 0)
+	s.errors.Range(func(key, value interface{}) bool {
+		prefixes = append(prefixes, key.(string))
+		counts[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		fn(prefix, counts[prefix])
+	}
+}
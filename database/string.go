@@ -121,6 +121,7 @@ func execGetEX(db *DB, args [][]byte) redis.Reply {
 }
 
 // execSet sets string value and time to live to the given key
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
 func execSet(db *DB, args [][]byte) redis.Reply {
 	/*
 			args := [][]byte{
@@ -133,59 +134,61 @@ func execSet(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	value := args[1]
 	policy := upsertPolicy
-	ttl := unlimitedTTL
+	getOld := false
+	keepTTL := false
+	hasExpire := false
+	var expireTime time.Time
 
 	// parse options
-	if len(args) > 2 {
-		//
-		for i := 2; i < len(args); i++ {
-			arg := strings.ToUpper(string(args[i]))
-			if arg == "NX" { // insert
-				if policy == updatePolicy {
-					return &protocol.SyntaxErrReply{}
-				}
-				policy = insertPolicy
-			} else if arg == "XX" { // update policy
-				if policy == insertPolicy {
-					return &protocol.SyntaxErrReply{}
-				}
-				policy = updatePolicy
-			} else if arg == "EX" { // ttl in seconds
-				if ttl != unlimitedTTL {
-					// ttl has been set
-					return &protocol.SyntaxErrReply{}
-				}
-				if i+1 >= len(args) {
-					return &protocol.SyntaxErrReply{}
-				}
-				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-				if err != nil {
-					return &protocol.SyntaxErrReply{}
-				}
-				if ttlArg <= 0 {
-					return protocol.MakeErrReply("ERR invalid expire time in set")
-				}
-				ttl = ttlArg * 1000
-				i++ // skip next arg
-			} else if arg == "PX" { // ttl in milliseconds
-				if ttl != unlimitedTTL {
-					return &protocol.SyntaxErrReply{}
-				}
-				if i+1 >= len(args) {
-					return &protocol.SyntaxErrReply{}
-				}
-				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-				if err != nil {
-					return &protocol.SyntaxErrReply{}
-				}
-				if ttlArg <= 0 {
-					return protocol.MakeErrReply("ERR invalid expire time in set")
-				}
-				ttl = ttlArg
-				i++ // skip next arg
-			} else {
+	for i := 2; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch arg {
+		case "NX": // insert
+			if policy == updatePolicy {
+				return &protocol.SyntaxErrReply{}
+			}
+			policy = insertPolicy
+		case "XX": // update policy
+			if policy == insertPolicy {
+				return &protocol.SyntaxErrReply{}
+			}
+			policy = updatePolicy
+		case "GET":
+			getOld = true
+		case "KEEPTTL":
+			if hasExpire {
+				return &protocol.SyntaxErrReply{}
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || keepTTL {
+				// ttl has been set
+				return &protocol.SyntaxErrReply{}
+			}
+			if i+1 >= len(args) {
 				return &protocol.SyntaxErrReply{}
 			}
+			ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if ttlArg <= 0 {
+				return protocol.MakeErrReply("ERR invalid expire time in 'set' command")
+			}
+			expireTime = parseExpireTime(arg, ttlArg)
+			hasExpire = true
+			i++ // skip next arg
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+
+	var old []byte
+	if getOld {
+		var errReply protocol.ErrorReply
+		old, errReply = db.getAsString(key)
+		if errReply != nil {
+			return errReply
 		}
 	}
 
@@ -199,13 +202,20 @@ func execSet(db *DB, args [][]byte) redis.Reply {
 		db.PutEntity(key, entity)
 		result = 1
 	case insertPolicy:
-		result = db.PutIfAbsent(key, entity)
+		_, exists := db.GetEntity(key) // expired key should be treated as absent
+		if !exists {
+			db.PutEntity(key, entity)
+			result = 1
+		}
 	case updatePolicy:
-		result = db.PutIfExists(key, entity)
+		_, exists := db.GetEntity(key)
+		if exists {
+			db.PutEntity(key, entity)
+			result = 1
+		}
 	}
 	if result > 0 {
-		if ttl != unlimitedTTL {
-			expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		if hasExpire {
 			// 添加到过期字典中
 			db.Expire(key, expireTime)
 			db.addAof(CmdLine{
@@ -214,28 +224,52 @@ func execSet(db *DB, args [][]byte) redis.Reply {
 				args[1],
 			})
 			db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
+		} else if keepTTL {
+			db.addAof(utils.ToCmdLine3("set", args[0], args[1], []byte("KEEPTTL")))
 		} else {
 			db.Persist(key) // override ttl
-			db.addAof(utils.ToCmdLine3("set", args...))
+			db.addAof(utils.ToCmdLine3("set", args[0], args[1]))
 		}
 	}
 
+	if getOld {
+		if old == nil {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply(old)
+	}
 	if result > 0 {
 		return &protocol.OkReply{}
 	}
 	return &protocol.NullBulkReply{}
 }
 
+// parseExpireTime 将 EX/PX/EXAT/PXAT 选项转换为绝对的过期时间
+func parseExpireTime(option string, ttlArg int64) time.Time {
+	switch option {
+	case "EX":
+		return time.Now().Add(time.Duration(ttlArg) * time.Second)
+	case "PX":
+		return time.Now().Add(time.Duration(ttlArg) * time.Millisecond)
+	case "EXAT":
+		return time.Unix(ttlArg, 0)
+	}
+	return time.Unix(0, ttlArg*int64(time.Millisecond))
+}
+
 // execSetNX sets string if not exists
 func execSetNX(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	value := args[1]
-	entity := &database.DataEntity{
-		Data: value,
+	if _, exists := db.GetEntity(key); exists {
+		return protocol.MakeIntReply(0)
 	}
-	result := db.PutIfAbsent(key, entity)
-	db.addAof(utils.ToCmdLine3("setnx", args...))
-	return protocol.MakeIntReply(int64(result))
+	db.PutEntity(key, &database.DataEntity{
+		Data: value,
+	})
+	db.Persist(key)
+	db.addAof(utils.ToCmdLine3("set", args...))
+	return protocol.MakeIntReply(1)
 }
 
 // execSetEX sets string and its ttl
@@ -245,21 +279,20 @@ func execSetEX(db *DB, args [][]byte) redis.Reply {
 
 	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return &protocol.SyntaxErrReply{}
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
 	if ttlArg <= 0 {
-		return protocol.MakeErrReply("ERR invalid expire time in setex")
+		return protocol.MakeErrReply("ERR invalid expire time in 'setex' command")
 	}
-	ttl := ttlArg * 1000
 
 	entity := &database.DataEntity{
 		Data: value,
 	}
 
 	db.PutEntity(key, entity)
-	expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	expireTime := time.Now().Add(time.Duration(ttlArg) * time.Second)
 	db.Expire(key, expireTime)
-	db.addAof(utils.ToCmdLine3("setex", args...))
+	db.addAof(utils.ToCmdLine3("set", args[0], args[2]))
 	db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
 	return &protocol.OkReply{}
 }
@@ -271,10 +304,10 @@ func execPSetEX(db *DB, args [][]byte) redis.Reply {
 
 	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return &protocol.SyntaxErrReply{}
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
 	if ttlArg <= 0 {
-		return protocol.MakeErrReply("ERR invalid expire time in setex")
+		return protocol.MakeErrReply("ERR invalid expire time in 'psetex' command")
 	}
 
 	entity := &database.DataEntity{
@@ -284,7 +317,7 @@ func execPSetEX(db *DB, args [][]byte) redis.Reply {
 	db.PutEntity(key, entity)
 	expireTime := time.Now().Add(time.Duration(ttlArg) * time.Millisecond)
 	db.Expire(key, expireTime)
-	db.addAof(utils.ToCmdLine3("setex", args...))
+	db.addAof(utils.ToCmdLine3("set", args[0], args[2]))
 	db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
 
 	return &protocol.OkReply{}
@@ -637,6 +670,7 @@ func execSetRange(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(len(bytes)))
 }
 
+// execGetRange returns the substring of the string value, SUBSTR is an alias of GETRANGE
 func execGetRange(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	startIdx, err2 := strconv.ParseInt(string(args[1]), 10, 64)
@@ -653,16 +687,159 @@ func execGetRange(db *DB, args [][]byte) redis.Reply {
 		return err
 	}
 	if bs == nil {
-		return protocol.MakeNullBulkReply()
+		return protocol.MakeBulkReply([]byte{})
 	}
 	bytesLen := int64(len(bs))
 	beg, end := utils.ConvertRange(startIdx, endIdx, bytesLen)
 	if beg < 0 {
-		return protocol.MakeNullBulkReply()
+		return protocol.MakeBulkReply([]byte{})
 	}
 	return protocol.MakeBulkReply(bs[beg:end])
 }
 
+func readAllKeysOfLCS(args [][]byte) ([]string, []string) {
+	return nil, []string{string(args[0]), string(args[1])}
+}
+
+// execLCS finds the longest common subsequence of two string keys
+// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN min-match-len] [WITHMATCHLEN]
+func execLCS(db *DB, args [][]byte) redis.Reply {
+	getLen := false
+	getIdx := false
+	withMatchLen := false
+	var minMatchLen int64 = 0
+	for i := 2; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch arg {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 >= len(args) {
+				return &protocol.SyntaxErrReply{}
+			}
+			val, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if val > 0 {
+				minMatchLen = val
+			}
+			i++
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+	if getLen && getIdx {
+		return protocol.MakeErrReply("ERR If you want both the length and indexes, please just use IDX.")
+	}
+
+	a, errReply := db.getAsString(string(args[0]))
+	if errReply != nil {
+		return protocol.MakeErrReply("WRONGTYPE The specified keys must contain string values")
+	}
+	b, errReply := db.getAsString(string(args[1]))
+	if errReply != nil {
+		return protocol.MakeErrReply("WRONGTYPE The specified keys must contain string values")
+	}
+
+	// dp[i][j] 表示 a[:i] 和 b[:j] 的最长公共子序列长度
+	aLen, bLen := len(a), len(b)
+	dp := make([][]uint32, aLen+1)
+	for i := range dp {
+		dp[i] = make([]uint32, bLen+1)
+	}
+	for i := 1; i <= aLen; i++ {
+		for j := 1; j <= bLen; j++ {
+			if a[i-1] == b[j-1] {
+				dp[i][j] = dp[i-1][j-1] + 1
+			} else if dp[i-1][j] > dp[i][j-1] {
+				dp[i][j] = dp[i-1][j]
+			} else {
+				dp[i][j] = dp[i][j-1]
+			}
+		}
+	}
+	lcsLen := int(dp[aLen][bLen])
+	if getLen {
+		return protocol.MakeIntReply(int64(lcsLen))
+	}
+
+	// 从尾部回溯得到公共子序列以及每一段连续匹配的范围，与 redis 的实现保持一致
+	result := make([]byte, lcsLen)
+	matches := make([]redis.Reply, 0)
+	idx := lcsLen
+	aRangeStart, aRangeEnd, bRangeStart, bRangeEnd := aLen, 0, 0, 0
+	i, j := aLen, bLen
+	for i > 0 && j > 0 {
+		emitRange := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if aRangeStart == aLen {
+				aRangeStart, aRangeEnd = i-1, i-1
+				bRangeStart, bRangeEnd = j-1, j-1
+			} else if aRangeStart == i && bRangeStart == j {
+				// extend the range backward since it is contiguous
+				aRangeStart--
+				bRangeStart--
+			} else {
+				emitRange = true
+			}
+			// emit the range if we matched with the first byte of one of the two strings
+			if aRangeStart == 0 || bRangeStart == 0 {
+				emitRange = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if dp[i-1][j] > dp[i][j-1] {
+				i--
+			} else {
+				j--
+			}
+			if aRangeStart != aLen {
+				emitRange = true
+			}
+		}
+
+		if emitRange {
+			matchLen := aRangeEnd - aRangeStart + 1
+			if getIdx && (minMatchLen == 0 || int64(matchLen) >= minMatchLen) {
+				match := []redis.Reply{
+					protocol.MakeMultiRawReply([]redis.Reply{
+						protocol.MakeIntReply(int64(aRangeStart)),
+						protocol.MakeIntReply(int64(aRangeEnd)),
+					}),
+					protocol.MakeMultiRawReply([]redis.Reply{
+						protocol.MakeIntReply(int64(bRangeStart)),
+						protocol.MakeIntReply(int64(bRangeEnd)),
+					}),
+				}
+				if withMatchLen {
+					match = append(match, protocol.MakeIntReply(int64(matchLen)))
+				}
+				matches = append(matches, protocol.MakeMultiRawReply(match))
+			}
+			// restart at the next match
+			aRangeStart = aLen
+		}
+	}
+
+	if getIdx {
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("matches")),
+			protocol.MakeMultiRawReply(matches),
+			protocol.MakeBulkReply([]byte("len")),
+			protocol.MakeIntReply(int64(lcsLen)),
+		})
+	}
+	return protocol.MakeBulkReply(result)
+}
+
 func execSetBit(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	offset, err := strconv.ParseInt(string(args[1]), 10, 64)
@@ -837,29 +1014,31 @@ func execBitPos(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand("Set", execSet, writeFirstKey, rollbackFirstKey, -3, flagWrite)
-	RegisterCommand("SetNx", execSetNX, writeFirstKey, rollbackFirstKey, 3, flagWrite)
-	RegisterCommand("SetEX", execSetEX, writeFirstKey, rollbackFirstKey, 4, flagWrite)
-	RegisterCommand("PSetEX", execPSetEX, writeFirstKey, rollbackFirstKey, 4, flagWrite)
-	RegisterCommand("MSet", execMSet, prepareMSet, undoMSet, -3, flagWrite)
-	RegisterCommand("MGet", execMGet, prepareMGet, nil, -2, flagReadOnly)
-	RegisterCommand("MSetNX", execMSetNX, prepareMSet, undoMSet, -3, flagWrite)
-	RegisterCommand("Get", execGet, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("GetEX", execGetEX, writeFirstKey, rollbackFirstKey, -2, flagReadOnly)
-	RegisterCommand("GetSet", execGetSet, writeFirstKey, rollbackFirstKey, 3, flagWrite)
-	RegisterCommand("GetDel", execGetDel, writeFirstKey, rollbackFirstKey, 2, flagWrite)
-	RegisterCommand("Incr", execIncr, writeFirstKey, rollbackFirstKey, 2, flagWrite)
-	RegisterCommand("IncrBy", execIncrBy, writeFirstKey, rollbackFirstKey, 3, flagWrite)
-	RegisterCommand("IncrByFloat", execIncrByFloat, writeFirstKey, rollbackFirstKey, 3, flagWrite)
-	RegisterCommand("Decr", execDecr, writeFirstKey, rollbackFirstKey, 2, flagWrite)
-	RegisterCommand("DecrBy", execDecrBy, writeFirstKey, rollbackFirstKey, 3, flagWrite)
-	RegisterCommand("StrLen", execStrLen, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("Append", execAppend, writeFirstKey, rollbackFirstKey, 3, flagWrite)
-	RegisterCommand("SetRange", execSetRange, writeFirstKey, rollbackFirstKey, 4, flagWrite)
-	RegisterCommand("GetRange", execGetRange, readFirstKey, nil, 4, flagReadOnly)
-	RegisterCommand("SetBit", execSetBit, writeFirstKey, rollbackFirstKey, 4, flagWrite)
-	RegisterCommand("GetBit", execGetBit, readFirstKey, nil, 3, flagReadOnly)
-	RegisterCommand("BitCount", execBitCount, readFirstKey, nil, -2, flagReadOnly)
-	RegisterCommand("BitPos", execBitPos, readFirstKey, nil, -3, flagReadOnly)
+	registerCommand("Set", execSet, writeFirstKey, rollbackFirstKey, -3, flagWrite).attachCategory("string")
+	registerCommand("SetNx", execSetNX, writeFirstKey, rollbackFirstKey, 3, flagWrite).attachCategory("string")
+	registerCommand("SetEX", execSetEX, writeFirstKey, rollbackFirstKey, 4, flagWrite).attachCategory("string")
+	registerCommand("PSetEX", execPSetEX, writeFirstKey, rollbackFirstKey, 4, flagWrite).attachCategory("string")
+	registerCommand("MSet", execMSet, prepareMSet, undoMSet, -3, flagWrite).attachKeys(1, -1, 2).attachCategory("string")
+	registerCommand("MGet", execMGet, prepareMGet, nil, -2, flagReadOnly).attachKeys(1, -1, 1).attachCategory("string")
+	registerCommand("MSetNX", execMSetNX, prepareMSet, undoMSet, -3, flagWrite).attachKeys(1, -1, 2).attachCategory("string")
+	registerCommand("Get", execGet, readFirstKey, nil, 2, flagReadOnly).attachCategory("string")
+	registerCommand("GetEX", execGetEX, writeFirstKey, rollbackFirstKey, -2, flagReadOnly).attachCategory("string")
+	registerCommand("GetSet", execGetSet, writeFirstKey, rollbackFirstKey, 3, flagWrite).attachCategory("string")
+	registerCommand("GetDel", execGetDel, writeFirstKey, rollbackFirstKey, 2, flagWrite).attachCategory("string")
+	registerCommand("Incr", execIncr, writeFirstKey, rollbackFirstKey, 2, flagWrite).attachCategory("string")
+	registerCommand("IncrBy", execIncrBy, writeFirstKey, rollbackFirstKey, 3, flagWrite).attachCategory("string")
+	registerCommand("IncrByFloat", execIncrByFloat, writeFirstKey, rollbackFirstKey, 3, flagWrite).attachCategory("string")
+	registerCommand("Decr", execDecr, writeFirstKey, rollbackFirstKey, 2, flagWrite).attachCategory("string")
+	registerCommand("DecrBy", execDecrBy, writeFirstKey, rollbackFirstKey, 3, flagWrite).attachCategory("string")
+	registerCommand("StrLen", execStrLen, readFirstKey, nil, 2, flagReadOnly).attachCategory("string")
+	registerCommand("Append", execAppend, writeFirstKey, rollbackFirstKey, 3, flagWrite).attachCategory("string")
+	registerCommand("SetRange", execSetRange, writeFirstKey, rollbackFirstKey, 4, flagWrite).attachCategory("string")
+	registerCommand("GetRange", execGetRange, readFirstKey, nil, 4, flagReadOnly).attachCategory("string")
+	registerCommand("SubStr", execGetRange, readFirstKey, nil, 4, flagReadOnly).attachCategory("string")
+	registerCommand("LCS", execLCS, readAllKeysOfLCS, nil, -3, flagReadOnly).attachKeys(1, 2, 1).attachCategory("string")
+	registerCommand("SetBit", execSetBit, writeFirstKey, rollbackFirstKey, 4, flagWrite).attachCategory("string")
+	registerCommand("GetBit", execGetBit, readFirstKey, nil, 3, flagReadOnly).attachCategory("string")
+	registerCommand("BitCount", execBitCount, readFirstKey, nil, -2, flagReadOnly).attachCategory("string")
+	registerCommand("BitPos", execBitPos, readFirstKey, nil, -3, flagReadOnly).attachCategory("string")
 
 }
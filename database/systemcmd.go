@@ -28,33 +28,35 @@ func Ping(c redis.Connection, args [][]byte) redis.Reply {
 	}
 }
 
-// Info 命令用于获取服务器相关信息，携带参数就获取指定信息，不携带参数就是全部信息
-func Info(c redis.Connection, args [][]byte) redis.Reply {
-	if len(args) == 1 {
-		infoCommandList := [...]string{"server", "client", "cluster"}
-		var allSection []byte
-		for _, s := range infoCommandList {
-			allSection = append(allSection, GenGodisInfoString(s)...)
+// Info 命令用于获取服务器相关信息，不携带参数时返回默认的 section，也可以指定一个或多个 section，
+// all 和 everything 表示全部的 section，未知的 section 会被忽略
+func Info(server *Server, c redis.Connection, args [][]byte) redis.Reply {
+	sections := defaultInfoSections
+	if len(args) > 1 {
+		sections = make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			switch section := strings.ToLower(string(arg)); section {
+			case "all", "everything":
+				sections = append(sections, allInfoSections...)
+			case "default":
+				sections = append(sections, defaultInfoSections...)
+			default:
+				sections = append(sections, section)
+			}
 		}
-
-		return protocol.MakeBulkReply(allSection)
-	} else if len(args) == 2 {
-		section := strings.ToLower(string(args[1]))
-		switch section {
-		case "server":
-			reply := GenGodisInfoString("server")
-			return protocol.MakeBulkReply(reply)
-		case "client":
-			return protocol.MakeBulkReply(GenGodisInfoString("client"))
-		case "cluster":
-			return protocol.MakeBulkReply(GenGodisInfoString("cluster"))
-
+	}
+	var result []byte
+	for _, section := range sections {
+		content := server.genInfoString(section)
+		if len(content) == 0 {
+			continue
 		}
-	} else {
-		return protocol.MakeErrReply("ERR wrong number of arguments for 'info' command")
+		if len(result) > 0 {
+			result = append(result, "\r\n"...)
+		}
+		result = append(result, content...)
 	}
-
-	return &protocol.NullBulkReply{}
+	return protocol.MakeBulkReply(result)
 }
 
 func GenGodisInfoString(section string) []byte {
@@ -2,17 +2,46 @@ package database
 
 import (
 	"miniRedis/interface/redis"
+	"miniRedis/lib/utils"
 	"miniRedis/redis/protocol"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 // Watch set watching keys
 func Watch(db *DB, conn redis.Connection, args [][]byte) redis.Reply {
+	if conn.InMultiState() {
+		err := protocol.MakeErrReply("ERR WATCH inside MULTI is not allowed")
+		conn.AddTxError(err)
+		return err
+	}
+	keys := make([]string, len(args))
+	for i, bkey := range args {
+		keys[i] = string(bkey)
+	}
+	db.RWLocks(nil, keys)
+	defer db.RWUnLocks(nil, keys)
 	// 使用版本号控制watch
 	watching := conn.GetWatching()
-	for _, bkey := range args {
-		key := string(bkey)
-		watching[key] = db.GetVersion(key)
+	for _, key := range keys {
+		watchKey := redis.WatchKey{DBIndex: db.index, Key: key}
+		if _, ok := watching[watchKey]; ok {
+			// 和 Redis 一样，重复 WATCH 不会更新版本
+			continue
+		}
+		// WATCH 之前已经过期的 key 先删除，之后不会因为它过期而让事务失败
+		db.IsExpired(key)
+		watching[watchKey] = db.GetVersion(key)
+	}
+	return protocol.MakeOkReply()
+}
+
+// UnWatch 取消当前连接所有的 WATCH，EXEC 和 DISCARD 也会取消 WATCH
+func UnWatch(conn redis.Connection) redis.Reply {
+	watching := conn.GetWatching()
+	for key := range watching {
+		delete(watching, key)
 	}
 	return protocol.MakeOkReply()
 }
@@ -23,13 +52,17 @@ func execGetVersion(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand("GetVer", execGetVersion, readAllKeys, nil, 2, flagReadOnly)
+	registerCommand("GetVer", execGetVersion, readAllKeys, nil, 2, flagReadOnly).attachKeys(1, -1, 1).attachCategory("transaction")
 }
 
+// isWatchingChanged 判断 WATCH 之后 key 是否被修改、删除或者过期。
 // invoker should lock watching keys
-func isWatchingChanged(db *DB, watching map[string]uint32) bool {
-	for key, ver := range watching {
-		currentVersion := db.GetVersion(key)
+func isWatchingChanged(related map[int]*txKeys, watching map[redis.WatchKey]uint32) bool {
+	for watchKey, ver := range watching {
+		db := related[watchKey.DBIndex].db
+		// 过期的 key 被删除时会增加版本
+		db.IsExpired(watchKey.Key)
+		currentVersion := db.GetVersion(watchKey.Key)
 		if ver != currentVersion {
 			return true
 		}
@@ -67,7 +100,30 @@ func EnqueueCmd(conn redis.Connection, cmdLine [][]byte) redis.Reply {
 	return protocol.MakeQueuedReply()
 }
 
-func execMulti(db *DB, conn redis.Connection) redis.Reply {
+// enqueueServerCmd 将 SELECT、MOVE、COPY 加入事务队列，它们在 EXEC 时由 Server 执行。
+// SELECT 的数据库编号在入队时检查，EXEC 之前就能确定事务涉及哪些数据库
+func (server *Server) enqueueServerCmd(conn redis.Connection, cmdLine [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	var errReply protocol.ErrorReply
+	if !validateArity(lookupCommand(cmdName).arity, cmdLine) {
+		errReply = protocol.MakeArgNumErrReply(cmdName)
+	} else if cmdName == "select" {
+		dbIndex, err := strconv.Atoi(string(cmdLine[1]))
+		if err != nil {
+			errReply = protocol.MakeErrReply("ERR invalid DB index")
+		} else if dbIndex >= len(server.dbSet) || dbIndex < 0 {
+			errReply = protocol.MakeErrReply("ERR DB index is out of range")
+		}
+	}
+	if errReply != nil {
+		conn.AddTxError(errReply)
+		return errReply
+	}
+	conn.EnqueueCmd(cmdLine)
+	return protocol.MakeQueuedReply()
+}
+
+func (server *Server) execMulti(conn redis.Connection) redis.Reply {
 	if !conn.InMultiState() {
 		return protocol.MakeErrReply("ERR EXEC without MULTI")
 	}
@@ -76,65 +132,275 @@ func execMulti(db *DB, conn redis.Connection) redis.Reply {
 		return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
 	}
 	cmdLines := conn.GetQueuedCmdLine()
-	return db.ExecMulti(conn, conn.GetWatching(), cmdLines)
+	return server.ExecMulti(conn, conn.GetWatching(), cmdLines)
 }
 
-// ExecMulti executes multi commands transaction Atomically and Isolated
-func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
-	// prepare
-	writeKeys := make([]string, 0) // may contains duplicate
-	readKeys := make([]string, 0)
+// txKeys 是事务在一个数据库中需要加锁的 key
+type txKeys struct {
+	db        *DB
+	writeKeys []string // may contains duplicate
+	readKeys  []string
+	lockAll   bool // 事务中有命令需要读取数据库中任意的 key，给所有 key 加读锁
+}
+
+func (keys *txKeys) lock() {
+	if keys.lockAll {
+		keys.db.RWLocksAll(keys.writeKeys)
+	} else {
+		keys.db.RWLocks(keys.writeKeys, keys.readKeys)
+	}
+}
+
+func (keys *txKeys) unlock() {
+	if keys.lockAll {
+		keys.db.RWUnLocksAll(keys.writeKeys)
+	} else {
+		keys.db.RWUnLocks(keys.writeKeys, keys.readKeys)
+	}
+}
+
+// prepareMulti 找出事务中每个命令在哪个数据库中读写哪些 key，返回以数据库编号为键的 txKeys。
+// WATCH 的 key 在它们所在的数据库中加读锁
+func (server *Server) prepareMulti(dbIndex int, watching map[redis.WatchKey]uint32, cmdLines []CmdLine) map[int]*txKeys {
+	related := make(map[int]*txKeys)
+	keysOf := func(index int) *txKeys {
+		keys, ok := related[index]
+		if !ok {
+			keys = &txKeys{db: server.mustSelectDB(index)}
+			related[index] = keys
+		}
+		return keys
+	}
+	keysOf(dbIndex)
+	for watchKey := range watching {
+		keys := keysOf(watchKey.DBIndex)
+		keys.readKeys = append(keys.readKeys, watchKey.Key)
+	}
 	for _, cmdLine := range cmdLines {
 		cmdName := strings.ToLower(string(cmdLine[0]))
-		cmd := cmdTable[cmdName]
-		prepare := cmd.prepare
-		write, read := prepare(cmdLine[1:])
-		writeKeys = append(writeKeys, write...)
-		readKeys = append(readKeys, read...)
-	}
-	// set watch
-	watchingKeys := make([]string, 0, len(watching))
-	for key := range watching {
-		watchingKeys = append(watchingKeys, key)
+		switch cmdName {
+		case "unwatch":
+		case "select":
+			dbIndex, _ = strconv.Atoi(string(cmdLine[1])) // 入队时已经检查过
+		case "move":
+			key := string(cmdLine[1])
+			src := keysOf(dbIndex)
+			src.writeKeys = append(src.writeKeys, key)
+			// 参数错误的命令在执行时失败，不需要加锁
+			if destIndex, errReply := server.parseMoveDB(dbIndex, cmdLine[1:]); errReply == nil {
+				dest := keysOf(destIndex)
+				dest.writeKeys = append(dest.writeKeys, key)
+			}
+		case "copy":
+			src := keysOf(dbIndex)
+			src.readKeys = append(src.readKeys, string(cmdLine[1]))
+			if destIndex, _, errReply := server.parseCopyArgs(dbIndex, cmdLine[1:]); errReply == nil {
+				dest := keysOf(destIndex)
+				dest.writeKeys = append(dest.writeKeys, string(cmdLine[2]))
+			}
+		default:
+			cmd := cmdTable[cmdName]
+			write, read := cmd.prepare(cmdLine[1:])
+			keys := keysOf(dbIndex)
+			keys.writeKeys = append(keys.writeKeys, write...)
+			keys.readKeys = append(keys.readKeys, read...)
+			if cmd.needLockAll(cmdLine[1:]) {
+				keys.lockAll = true
+			}
+		}
 	}
-	readKeys = append(readKeys, watchingKeys...)
-	db.RWLocks(writeKeys, readKeys)
-	defer db.RWUnLocks(writeKeys, readKeys)
+	return related
+}
 
-	if isWatchingChanged(db, watching) { // watching keys changed, abort
-		return protocol.MakeEmptyMultiBulkReply()
+// ExecMulti executes multi commands transaction Atomically and Isolated
+// 事务中可以用 SELECT 切换数据库，MOVE、COPY 也可以修改其它数据库。
+// 涉及的数据库按照编号从小到大的顺序加锁，避免和其它事务互相等待
+func (server *Server) ExecMulti(conn redis.Connection, watching map[redis.WatchKey]uint32, cmdLines []CmdLine) redis.Reply {
+	startIndex := conn.GetDBIndex()
+	if _, errReply := server.selectDB(startIndex); errReply != nil {
+		return errReply
+	}
+	// prepare
+	related := server.prepareMulti(startIndex, watching, cmdLines)
+	indexes := make([]int, 0, len(related))
+	hasWrite := false
+	for index, keys := range related {
+		indexes = append(indexes, index)
+		if len(keys.writeKeys) > 0 {
+			hasWrite = true
+		}
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		keys := related[index]
+		keys.lock()
+		defer keys.unlock()
+	}
+	if hasWrite {
+		defer server.enterWrite(conn)()
+		for _, keys := range related {
+			keys.db.saveForSnapshot(keys.writeKeys)
+		}
+	}
+
+	if isWatchingChanged(related, watching) { // watching keys changed, abort
+		// 和 Redis 一样返回 null 数组，客户端以此区分放弃的事务和没有命令的事务
+		return protocol.MakeNullMultiBulkReply()
+	}
+	tx := &multiTx{
+		server:  server,
+		related: related,
+		dbIndex: startIndex,
+		txDBs:   make(map[*DB]*DB),
 	}
 	// execute
 	results := make([]redis.Reply, 0, len(cmdLines))
 	aborted := false
-	undoCmdLines := make([][]CmdLine, 0, len(cmdLines))
 	for _, cmdLine := range cmdLines {
-		undoCmdLines = append(undoCmdLines, db.GetUndoLogs(cmdLine))
-		result := db.execWithLock(cmdLine)
+		undoSize := len(tx.undoLogs)
+		result := tx.exec(cmdLine)
 		if protocol.IsErrorReply(result) {
 			aborted = true
 			// don't rollback failed commands
-			undoCmdLines = undoCmdLines[:len(undoCmdLines)-1]
+			tx.undoLogs = tx.undoLogs[:undoSize]
 			break
 		}
 		results = append(results, result)
 	}
 	if !aborted { //success
-		db.addVersion(writeKeys...)
+		for _, keys := range related {
+			keys.db.addVersion(keys.writeKeys...)
+			keys.db.addDirty(len(keys.writeKeys))
+		}
+		tx.commitAof()
+		dispatchKeyspaceEvents(tx.events)
+		conn.SelectDB(tx.dbIndex)
 		return protocol.MakeMultiRawReply(results)
 	}
 	// undo if aborted
-	size := len(undoCmdLines)
-	for i := size - 1; i >= 0; i-- {
-		curCmdLines := undoCmdLines[i]
-		if len(curCmdLines) == 0 {
-			continue
+	tx.rollback()
+	return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+}
+
+// multiTx 是正在执行的事务，事务中的命令在 txDB 上执行，txDB 和对应的 db 共享数据，只是把写入 AOF 的命令和 keyspace 事件收集起来。
+// 提交成功后作为一个 MULTI ... EXEC 块写入 AOF 并通知事件，回滚的事务不写入 AOF 也不通知
+type multiTx struct {
+	server  *Server
+	related map[int]*txKeys // 已经加锁的数据库
+	dbIndex int             // 事务中当前选择的数据库
+	txDBs   map[*DB]*DB
+
+	aofLines []txAofLine
+	undoLogs []txUndoLog
+	events   []*KeyspaceEvent // 提交之后通知的 keyspace 事件，回滚时丢弃
+}
+
+type txAofLine struct {
+	db   *DB
+	line CmdLine
+}
+
+type txUndoLog struct {
+	db    *DB
+	lines []CmdLine
+}
+
+func (tx *multiTx) txDB(db *DB) *DB {
+	if txDB, ok := tx.txDBs[db]; ok {
+		return txDB
+	}
+	txDB := *db
+	txDB.addAof = func(line CmdLine) {
+		tx.aofLines = append(tx.aofLines, txAofLine{db: db, line: line})
+	}
+	txDB.pendingEvents = &tx.events
+	tx.txDBs[db] = &txDB
+	return &txDB
+}
+
+func (tx *multiTx) addUndo(db *DB, lines []CmdLine) {
+	if len(lines) > 0 {
+		tx.undoLogs = append(tx.undoLogs, txUndoLog{db: db, lines: lines})
+	}
+}
+
+// exec 执行事务中的一个命令，使用的数据库都是 prepareMulti 中加锁的数据库
+func (tx *multiTx) exec(cmdLine CmdLine) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	switch cmdName {
+	case "unwatch":
+		// EXEC 结束时会取消所有的 WATCH
+		return protocol.MakeOkReply()
+	case "select":
+		tx.dbIndex, _ = strconv.Atoi(string(cmdLine[1]))
+		return protocol.MakeOkReply()
+	case "move":
+		destIndex, errReply := tx.server.parseMoveDB(tx.dbIndex, cmdLine[1:])
+		if errReply != nil {
+			return errReply
+		}
+		srcDB, destDB := tx.related[tx.dbIndex].db, tx.related[destIndex].db
+		key := string(cmdLine[1])
+		// 回滚时先删除目标数据库中的 key，再恢复源数据库中的 key 和它的过期任务
+		tx.addUndo(srcDB, rollbackGivenKeys(srcDB, key))
+		tx.addUndo(destDB, rollbackGivenKeys(destDB, key))
+		moved, errReply := moveKey(tx.txDB(srcDB), tx.txDB(destDB), key, cmdLine[1:])
+		if errReply != nil {
+			return errReply
+		}
+		if !moved {
+			return protocol.MakeIntReply(0)
+		}
+		return protocol.MakeIntReply(1)
+	case "copy":
+		destIndex, replace, errReply := tx.server.parseCopyArgs(tx.dbIndex, cmdLine[1:])
+		if errReply != nil {
+			return errReply
+		}
+		srcDB, destDB := tx.related[tx.dbIndex].db, tx.related[destIndex].db
+		srcKey, destKey := string(cmdLine[1]), string(cmdLine[2])
+		tx.addUndo(destDB, rollbackGivenKeys(destDB, destKey))
+		copied, errReply := copyKey(tx.txDB(srcDB), tx.txDB(destDB), srcKey, destKey, replace, cmdLine[1:])
+		if errReply != nil {
+			return errReply
 		}
-		for _, cmdLine := range curCmdLines {
-			db.execWithLock(cmdLine)
+		if !copied {
+			return protocol.MakeIntReply(0)
 		}
+		return protocol.MakeIntReply(1)
 	}
-	return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	db := tx.related[tx.dbIndex].db
+	tx.addUndo(db, db.GetUndoLogs(cmdLine))
+	return tx.txDB(db).execWithLock(cmdLine)
+}
+
+// rollback 按照相反的顺序执行回滚命令
+func (tx *multiTx) rollback() {
+	for i := len(tx.undoLogs) - 1; i >= 0; i-- {
+		log := tx.undoLogs[i]
+		txDB := tx.txDB(log.db)
+		for _, cmdLine := range log.lines {
+			txDB.execWithLock(cmdLine)
+		}
+	}
+}
+
+// commitAof 将事务写入 AOF，数据库变化的地方插入 SELECT，事务块从第一个写命令所在的数据库开始
+func (tx *multiTx) commitAof() {
+	if len(tx.aofLines) == 0 {
+		return
+	}
+	first := tx.aofLines[0].db
+	current := first
+	lines := make([]CmdLine, 0, len(tx.aofLines))
+	for _, l := range tx.aofLines {
+		if l.db != current {
+			lines = append(lines, utils.ToCmdLine("SELECT", strconv.Itoa(l.db.index)))
+			current = l.db
+		}
+		lines = append(lines, l.line)
+	}
+	first.addTxAof(lines)
 }
 
 // DiscardMulti drops MULTI pending commands
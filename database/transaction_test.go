@@ -0,0 +1,27 @@
+package database
+
+import (
+	"miniRedis/redis/connection"
+	"testing"
+)
+
+func TestExecWatchAborted(t *testing.T) {
+	server := NewStandaloneServer()
+	conn := connection.NewFakeConn()
+	other := connection.NewFakeConn()
+
+	execCmd(server, conn, "WATCH", "k")
+	execCmd(server, other, "SET", "k", "1")
+	execCmd(server, conn, "MULTI")
+	execCmd(server, conn, "SET", "k", "2")
+	// 放弃的事务返回 null 数组
+	if got := string(execCmd(server, conn, "EXEC").ToBytes()); got != "*-1\r\n" {
+		t.Errorf("aborted exec: got %q", got)
+	}
+
+	// 没有命令的事务返回空数组
+	execCmd(server, conn, "MULTI")
+	if got := string(execCmd(server, conn, "EXEC").ToBytes()); got != "*0\r\n" {
+		t.Errorf("empty exec: got %q", got)
+	}
+}
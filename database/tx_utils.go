@@ -146,6 +146,26 @@ func undoSetChange(db *DB, args [][]byte) []CmdLine {
 	return rollbackSetMembers(db, key, members...)
 }
 
+// undoSMove rollbacks SMOVE command, source and destination are restored together
+func undoSMove(db *DB, args [][]byte) []CmdLine {
+	src := string(args[0])
+	dest := string(args[1])
+	member := string(args[2])
+	srcSet, errReply := db.getAsSet(src)
+	if errReply != nil {
+		return nil
+	}
+	var undoCmdLines [][][]byte
+	if srcSet != nil && srcSet.Len() == 1 && srcSet.Has(member) {
+		// source will be removed after moving its last member, restore it with ttl
+		undoCmdLines = append(undoCmdLines, rollbackGivenKeys(db, src)...)
+	} else {
+		undoCmdLines = append(undoCmdLines, rollbackSetMembers(db, src, member)...)
+	}
+	undoCmdLines = append(undoCmdLines, rollbackSetMembers(db, dest, member)...)
+	return undoCmdLines
+}
+
 func rollbackZSetFields(db *DB, key string, fields ...string) []CmdLine {
 	var undoCmdLines [][][]byte
 	zset, errReply := db.getAsSortedSet(key)
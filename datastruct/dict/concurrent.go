@@ -292,3 +292,30 @@ func (dict *ConcurrentDict) RandomDistinctKeys(limit int) []string {
 func (dict *ConcurrentDict) Clear() {
 	*dict = *MakeConcurrent(dict.shardCount)
 }
+
+// DictScan 从 cursor 指定的分片开始遍历，至少遍历完 count 个键所在的分片后返回匹配的键和下一次遍历的游标
+// 游标就是分片的下标，返回 0 表示遍历结束；遍历期间一直存在的键保证至少被返回一次
+func (dict *ConcurrentDict) DictScan(cursor int, count int, match func(key string) bool) ([]string, int) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	result := make([]string, 0)
+	scanned := 0
+	shardIndex := cursor
+	for shardIndex < len(dict.table) && scanned < count {
+		s := dict.table[shardIndex]
+		s.mutex.RLock()
+		for key := range s.m {
+			scanned++
+			if match == nil || match(key) {
+				result = append(result, key)
+			}
+		}
+		s.mutex.RUnlock()
+		shardIndex++
+	}
+	if shardIndex >= len(dict.table) {
+		shardIndex = 0
+	}
+	return result, shardIndex
+}
@@ -15,5 +15,6 @@ type Dict interface {
 	Keys() []string
 	RandomKeys(limit int) []string
 	RandomDistinctKeys(limit int) []string
+	DictScan(cursor int, count int, match func(key string) bool) ([]string, int)
 	Clear()
 }
@@ -119,3 +119,14 @@ func (dict *SimpleDict) RandomDistinctKeys(limit int) []string {
 func (dict *SimpleDict) Clear() {
 	*dict = *MakeSimple()
 }
+
+// DictScan 返回所有匹配的键，SimpleDict 一次遍历全部元素，返回的游标总是 0
+func (dict *SimpleDict) DictScan(cursor int, count int, match func(key string) bool) ([]string, int) {
+	result := make([]string, 0)
+	for k := range dict.m {
+		if match == nil || match(k) {
+			result = append(result, k)
+		}
+	}
+	return result, 0
+}
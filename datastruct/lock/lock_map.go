@@ -169,3 +169,36 @@ func (locks *Locks) RWUnLocks(writeKeys []string, readKeys []string) {
 		}
 	}
 }
+
+// RWLocksAll 给 writeKeys 所在的哈希槽加写锁，给其它所有哈希槽加读锁，
+// 和 RWLocks 一样按照下标从小到大的顺序加锁
+func (locks *Locks) RWLocksAll(writeKeys []string) {
+	writeIndexSet := make(map[uint32]struct{})
+	for _, wKey := range writeKeys {
+		idx := locks.spread(fnv32(wKey))
+		writeIndexSet[idx] = struct{}{}
+	}
+	for index, mu := range locks.table {
+		if _, w := writeIndexSet[uint32(index)]; w {
+			mu.Lock()
+		} else {
+			mu.RLock()
+		}
+	}
+}
+
+func (locks *Locks) RWUnLocksAll(writeKeys []string) {
+	writeIndexSet := make(map[uint32]struct{})
+	for _, wKey := range writeKeys {
+		idx := locks.spread(fnv32(wKey))
+		writeIndexSet[idx] = struct{}{}
+	}
+	for index := len(locks.table) - 1; index >= 0; index-- {
+		mu := locks.table[index]
+		if _, w := writeIndexSet[uint32(index)]; w {
+			mu.Unlock()
+		} else {
+			mu.RUnlock()
+		}
+	}
+}
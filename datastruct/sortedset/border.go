@@ -11,6 +11,12 @@ import (
  *   int or float value, such as 2.718, 2, -2.718, -2 ...
  *   exclusive int or float value, such as (2.718, (2, (-2.718, (-2 ...
  *   infinity: +inf, -inf， inf(same as +inf)
+ *
+ * LexBorder 是一个代表Redis命令 `ZRANGEBYLEX`的最大值（max）和最小值（min）的结构体
+ * can accept:
+ *   inclusive member, such as [a, [abc ...
+ *   exclusive member, such as (a, (abc ...
+ *   infinity: -, +
  */
 
 const (
@@ -18,6 +24,16 @@ const (
 	positiveInf int8 = 1  // 正无穷
 )
 
+// Border 表示有序集合范围查询的边界，可以是分值边界也可以是字典序边界
+type Border interface {
+	// greater 判断边界是否在元素之上，用于判断元素是否在上边界之内
+	greater(element *Element) bool
+	// less 判断边界是否在元素之下，用于判断元素是否在下边界之内
+	less(element *Element) bool
+	// isEmptyRange 判断以当前边界为下界、max为上界的范围是否为空
+	isEmptyRange(max Border) bool
+}
+
 // ScoreBorder 代表一个浮点值的边界范围: <, <=, >, >=, +inf, -inf，例如>=3、<6、(0,正无穷)等
 type ScoreBorder struct {
 	Inf     int8    //表示范围的极限
@@ -27,7 +43,8 @@ type ScoreBorder struct {
 
 // if max.greater(score) then the score is within the upper border
 // do not use min.greater()
-func (border *ScoreBorder) greater(value float64) bool {
+func (border *ScoreBorder) greater(element *Element) bool {
+	value := element.Score
 	if border.Inf == negativeInf {
 		// 如果表示负无穷，则肯定比value小，所以返回false
 		return false
@@ -42,8 +59,10 @@ func (border *ScoreBorder) greater(value float64) bool {
 	return border.Value >= value
 }
 
-// 与
-func (border *ScoreBorder) less(value float64) bool {
+// if min.less(score) then the score is within the lower border
+// do not use max.less()
+func (border *ScoreBorder) less(element *Element) bool {
+	value := element.Score
 	if border.Inf == negativeInf {
 		return true
 	} else if border.Inf == positiveInf {
@@ -55,6 +74,21 @@ func (border *ScoreBorder) less(value float64) bool {
 	return border.Value <= value
 }
 
+func (border *ScoreBorder) isEmptyRange(max Border) bool {
+	maxBorder, ok := max.(*ScoreBorder)
+	if !ok {
+		return true
+	}
+	if border.Inf == positiveInf || maxBorder.Inf == negativeInf {
+		return true
+	}
+	if border.Inf == negativeInf || maxBorder.Inf == positiveInf {
+		return false
+	}
+	return border.Value > maxBorder.Value ||
+		(border.Value == maxBorder.Value && (border.Exclude || maxBorder.Exclude))
+}
+
 var positiveInfBorder = &ScoreBorder{
 	Inf: positiveInf,
 }
@@ -71,6 +105,9 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 	if s == "-inf" {
 		return negativeInfBorder, nil
 	}
+	if s == "" {
+		return nil, errors.New("ERR min or max is not a float")
+	}
 	// (0
 	if s[0] == '(' {
 		value, err := strconv.ParseFloat(s[1:], 64)
@@ -94,3 +131,84 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 		Exclude: false,
 	}, nil
 }
+
+// LexBorder 代表一个字典序的边界范围，例如[a、(b、-、+
+// 只有在所有元素分值相同的时候字典序范围查询才有意义
+type LexBorder struct {
+	Inf     int8   // 表示范围的极限，- 表示负无穷，+ 表示正无穷
+	Value   string // 成员的取值
+	Exclude bool   // 是否是开区间
+}
+
+func (border *LexBorder) greater(element *Element) bool {
+	if border.Inf == negativeInf {
+		return false
+	} else if border.Inf == positiveInf {
+		return true
+	}
+	if border.Exclude {
+		return border.Value > element.Member
+	}
+	return border.Value >= element.Member
+}
+
+func (border *LexBorder) less(element *Element) bool {
+	if border.Inf == negativeInf {
+		return true
+	} else if border.Inf == positiveInf {
+		return false
+	}
+	if border.Exclude {
+		return border.Value < element.Member
+	}
+	return border.Value <= element.Member
+}
+
+func (border *LexBorder) isEmptyRange(max Border) bool {
+	maxBorder, ok := max.(*LexBorder)
+	if !ok {
+		return true
+	}
+	if border.Inf == positiveInf || maxBorder.Inf == negativeInf {
+		return true
+	}
+	if border.Inf == negativeInf || maxBorder.Inf == positiveInf {
+		return false
+	}
+	return border.Value > maxBorder.Value ||
+		(border.Value == maxBorder.Value && (border.Exclude || maxBorder.Exclude))
+}
+
+var positiveInfLexBorder = &LexBorder{
+	Inf: positiveInf,
+}
+
+var negativeInfLexBorder = &LexBorder{
+	Inf: negativeInf,
+}
+
+// ParseLexBorder 将Redis的参数解析为 LexBorder
+func ParseLexBorder(s string) (*LexBorder, error) {
+	if s == "+" {
+		return positiveInfLexBorder, nil
+	}
+	if s == "-" {
+		return negativeInfLexBorder, nil
+	}
+	if s == "" {
+		return nil, errors.New("ERR min or max not valid string range item")
+	}
+	switch s[0] {
+	case '(':
+		return &LexBorder{
+			Value:   s[1:],
+			Exclude: true,
+		}, nil
+	case '[':
+		return &LexBorder{
+			Value:   s[1:],
+			Exclude: false,
+		}, nil
+	}
+	return nil, errors.New("ERR min or max not valid string range item")
+}
@@ -1,6 +1,9 @@
 package sortedset
 
-import "strconv"
+import (
+	"math/rand"
+	"strconv"
+)
 
 type SortedSet struct {
 	dict     map[string]*Element
@@ -121,35 +124,25 @@ func (sortedSet *SortedSet) Range(start int64, stop int64, desc bool) []*Element
 	return slice
 }
 
-// Count 用于计算一个范围内的数量
-func (sortedSet *SortedSet) Count(min *ScoreBorder, max *ScoreBorder) int64 {
+// Count 用于计算一个范围内的数量，min 和 max 可以是 ScoreBorder 或者 LexBorder
+func (sortedSet *SortedSet) Count(min Border, max Border) int64 {
 	var i int64 = 0
-	sortedSet.ForEach(0, sortedSet.Len(), false, func(element *Element) bool {
-		gtMin := min.less(element.Score) // 判断左边界值小于当前值
-		if !gtMin {
-			// 说明当前值比最小值还小，继续遍历
-			return true
-		}
-		ltMax := max.greater(element.Score) // 判断右边界值大于当前值
-		if !ltMax {
-			// 说明超过了最大值，停止遍历
-			return false
-		}
-		// 说明当前值在最小值和最大值之间
+	sortedSet.ForEachByScore(min, max, 0, -1, false, func(element *Element) bool {
 		i++
 		return true
 	})
 	return i
 }
 
-// ForEachByScore 用于遍历分数值在给定范围内的元素，并按照一定的偏移量和限制数目进行输出
-func (sortedSet *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
+// ForEachByScore 用于遍历在给定范围内的元素，并按照一定的偏移量和限制数目进行输出
+// min 和 max 可以是 ScoreBorder 或者 LexBorder
+func (sortedSet *SortedSet) ForEachByScore(min Border, max Border, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
 	// 找到开始遍历的节点
 	var node *node
 	if desc {
-		node = sortedSet.skiplist.getLastInScoreRange(min, max)
+		node = sortedSet.skiplist.getLastInRange(min, max)
 	} else {
-		node = sortedSet.skiplist.getFirstInScoreRange(min, max)
+		node = sortedSet.skiplist.getFirstInRange(min, max)
 	}
 
 	// 根据偏移量定位到指定位置开始遍历
@@ -174,17 +167,17 @@ func (sortedSet *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, o
 		if node == nil {
 			break
 		}
-		gtMin := min.less(node.Element.Score)    //比较节点的分值是否大于最小值
-		ltMax := max.greater(node.Element.Score) //比较节点的分值是否小于最大值
+		gtMin := min.less(&node.Element)    //比较节点是否大于最小值
+		ltMax := max.greater(&node.Element) //比较节点是否小于最大值
 		if !gtMin || !ltMax {
-			break //如果分值超出范围则退出循环
+			break //如果超出范围则退出循环
 		}
 	}
 }
 
-// RangeByScore returns members which score within the given border
+// RangeByScore returns members which within the given border
 // param limit: <0 means no limit
-func (sortedSet *SortedSet) RangeByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64, desc bool) []*Element {
+func (sortedSet *SortedSet) RangeByScore(min Border, max Border, offset int64, limit int64, desc bool) []*Element {
 	if limit == 0 || offset < 0 {
 		return make([]*Element, 0)
 	}
@@ -196,8 +189,9 @@ func (sortedSet *SortedSet) RangeByScore(min *ScoreBorder, max *ScoreBorder, off
 	return slice
 }
 
-func (sortedSet *SortedSet) RemoveByScore(min *ScoreBorder, max *ScoreBorder) int64 {
-	removed := sortedSet.skiplist.RemoveRangeByScore(min, max, 0)
+// RemoveByScore removes members which within the given border
+func (sortedSet *SortedSet) RemoveByScore(min Border, max Border) int64 {
+	removed := sortedSet.skiplist.RemoveRange(min, max, 0)
 	for _, element := range removed {
 		delete(sortedSet.dict, element.Member)
 	}
@@ -205,7 +199,7 @@ func (sortedSet *SortedSet) RemoveByScore(min *ScoreBorder, max *ScoreBorder) in
 }
 
 func (sortedSet *SortedSet) PopMin(count int) []*Element {
-	first := sortedSet.skiplist.getFirstInScoreRange(negativeInfBorder, positiveInfBorder)
+	first := sortedSet.skiplist.getFirstInRange(negativeInfBorder, positiveInfBorder)
 	if first == nil {
 		return nil
 	}
@@ -213,7 +207,7 @@ func (sortedSet *SortedSet) PopMin(count int) []*Element {
 		Value:   first.Score,
 		Exclude: false,
 	}
-	removed := sortedSet.skiplist.RemoveRangeByScore(border, positiveInfBorder, count)
+	removed := sortedSet.skiplist.RemoveRange(border, positiveInfBorder, count)
 	for _, element := range removed {
 		delete(sortedSet.dict, element.Member)
 	}
@@ -229,3 +223,59 @@ func (sortedSet *SortedSet) RemoveByRank(start int64, stop int64) int64 {
 	}
 	return int64(len(removed))
 }
+
+// PopMax 移除并返回分值最大的 count 个元素，按分值从大到小排列
+func (sortedSet *SortedSet) PopMax(count int) []*Element {
+	size := sortedSet.Len()
+	if size == 0 || count <= 0 {
+		return nil
+	}
+	if int64(count) > size {
+		count = int(size)
+	}
+	removed := make([]*Element, 0, count)
+	sortedSet.ForEach(0, int64(count), true, func(element *Element) bool {
+		removed = append(removed, element)
+		return true
+	})
+	for _, element := range removed {
+		sortedSet.Remove(element.Member)
+	}
+	return removed
+}
+
+// RandomMembers 随机返回 limit 个元素，可能包含重复的元素
+func (sortedSet *SortedSet) RandomMembers(limit int) []*Element {
+	size := sortedSet.Len()
+	if size == 0 || limit <= 0 {
+		return nil
+	}
+	result := make([]*Element, limit)
+	for i := 0; i < limit; i++ {
+		rank := rand.Int63n(size) + 1
+		result[i] = &sortedSet.skiplist.getByRank(rank).Element
+	}
+	return result
+}
+
+// RandomDistinctMembers 随机返回 limit 个不重复的元素，limit 大于元素个数时返回全部元素
+func (sortedSet *SortedSet) RandomDistinctMembers(limit int) []*Element {
+	size := sortedSet.Len()
+	if size == 0 || limit <= 0 {
+		return nil
+	}
+	if int64(limit) >= size {
+		return sortedSet.Range(0, size, false)
+	}
+	ranks := make(map[int64]struct{}, limit)
+	result := make([]*Element, 0, limit)
+	for len(result) < limit {
+		rank := rand.Int63n(size) + 1
+		if _, exists := ranks[rank]; exists {
+			continue
+		}
+		ranks[rank] = struct{}{}
+		result = append(result, &sortedSet.skiplist.getByRank(rank).Element)
+	}
+	return result
+}
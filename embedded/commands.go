@@ -0,0 +1,230 @@
+package embedded
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+ * 常用命令的强类型封装，其余命令可以通过 Session.Do 执行
+ */
+
+// Z 表示有序集合中的一个成员
+type Z struct {
+	Score  float64
+	Member string
+}
+
+func (s *Session) doString(ctx context.Context, args ...interface{}) (string, error) {
+	val, err := s.Do(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	if val == nil {
+		return "", Nil
+	}
+	str, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("miniredis: unexpected reply type %T", val)
+	}
+	return str, nil
+}
+
+func (s *Session) doInt(ctx context.Context, args ...interface{}) (int64, error) {
+	val, err := s.Do(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := val.(int64)
+	if !ok {
+		return 0, fmt.Errorf("miniredis: unexpected reply type %T", val)
+	}
+	return n, nil
+}
+
+func (s *Session) doStringSlice(ctx context.Context, args ...interface{}) ([]string, error) {
+	val, err := s.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("miniredis: unexpected reply type %T", val)
+	}
+	result := make([]string, len(arr))
+	for i, v := range arr {
+		result[i], _ = v.(string)
+	}
+	return result, nil
+}
+
+func (s *Session) doStatus(ctx context.Context, args ...interface{}) error {
+	_, err := s.Do(ctx, args...)
+	return err
+}
+
+// Ping checks the database is available
+func (s *Session) Ping(ctx context.Context) error {
+	return s.doStatus(ctx, "PING")
+}
+
+// Select changes the database used by this session
+func (s *Session) Select(ctx context.Context, index int) error {
+	return s.doStatus(ctx, "SELECT", index)
+}
+
+// Get returns the string value of key, or Nil if the key does not exist
+func (s *Session) Get(ctx context.Context, key string) (string, error) {
+	return s.doString(ctx, "GET", key)
+}
+
+// Set sets key to hold the string value, ttl <= 0 means no expiration
+func (s *Session) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if ttl > 0 {
+		return s.doStatus(ctx, "SET", key, value, "PX", int64(ttl/time.Millisecond))
+	}
+	return s.doStatus(ctx, "SET", key, value)
+}
+
+// SetNX sets key only if it does not exist, returns whether the key was set
+func (s *Session) SetNX(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error) {
+	args := []interface{}{"SET", key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+	val, err := s.Do(ctx, args...)
+	if err != nil {
+		return false, err
+	}
+	return val != nil, nil
+}
+
+// Del removes the given keys, returns the number of removed keys
+func (s *Session) Del(ctx context.Context, keys ...string) (int64, error) {
+	return s.doInt(ctx, append([]interface{}{"DEL"}, toArgs(keys)...)...)
+}
+
+// Exists returns the number of existing keys among the given keys
+func (s *Session) Exists(ctx context.Context, keys ...string) (int64, error) {
+	return s.doInt(ctx, append([]interface{}{"EXISTS"}, toArgs(keys)...)...)
+}
+
+// Incr increments the integer value of key by one
+func (s *Session) Incr(ctx context.Context, key string) (int64, error) {
+	return s.doInt(ctx, "INCR", key)
+}
+
+// IncrBy increments the integer value of key by the given amount
+func (s *Session) IncrBy(ctx context.Context, key string, value int64) (int64, error) {
+	return s.doInt(ctx, "INCRBY", key, value)
+}
+
+// Expire sets a timeout on key, returns false if the key does not exist
+func (s *Session) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	n, err := s.doInt(ctx, "PEXPIRE", key, int64(ttl/time.Millisecond))
+	return n == 1, err
+}
+
+// TTL returns the remaining time to live of key.
+// Like the TTL command, it returns -1 if the key has no expiration and -2 if the key does not exist
+func (s *Session) TTL(ctx context.Context, key string) (time.Duration, error) {
+	n, err := s.doInt(ctx, "PTTL", key)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return time.Duration(n), nil
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// LPush inserts values at the head of the list, returns the length of the list
+func (s *Session) LPush(ctx context.Context, key string, values ...interface{}) (int64, error) {
+	return s.doInt(ctx, append([]interface{}{"LPUSH", key}, values...)...)
+}
+
+// RPush inserts values at the tail of the list, returns the length of the list
+func (s *Session) RPush(ctx context.Context, key string, values ...interface{}) (int64, error) {
+	return s.doInt(ctx, append([]interface{}{"RPUSH", key}, values...)...)
+}
+
+// LPop removes and returns the first element of the list, or Nil if the list does not exist
+func (s *Session) LPop(ctx context.Context, key string) (string, error) {
+	return s.doString(ctx, "LPOP", key)
+}
+
+// RPop removes and returns the last element of the list, or Nil if the list does not exist
+func (s *Session) RPop(ctx context.Context, key string) (string, error) {
+	return s.doString(ctx, "RPOP", key)
+}
+
+// LRange returns the elements of the list between start and stop
+func (s *Session) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return s.doStringSlice(ctx, "LRANGE", key, start, stop)
+}
+
+// SAdd adds members to the set, returns the number of added members
+func (s *Session) SAdd(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	return s.doInt(ctx, append([]interface{}{"SADD", key}, members...)...)
+}
+
+// SMembers returns all members of the set
+func (s *Session) SMembers(ctx context.Context, key string) ([]string, error) {
+	return s.doStringSlice(ctx, "SMEMBERS", key)
+}
+
+// ZAdd adds members to the sorted set, returns the number of added members
+func (s *Session) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	args := make([]interface{}, 0, 2+len(members)*2)
+	args = append(args, "ZADD", key)
+	for _, member := range members {
+		args = append(args, member.Score, member.Member)
+	}
+	return s.doInt(ctx, args...)
+}
+
+// ZScore returns the score of member in the sorted set, or Nil if the member does not exist
+func (s *Session) ZScore(ctx context.Context, key string, member string) (float64, error) {
+	str, err := s.doString(ctx, "ZSCORE", key, member)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+// ZRange returns the members of the sorted set between start and stop ordered by score
+func (s *Session) ZRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return s.doStringSlice(ctx, "ZRANGE", key, start, stop)
+}
+
+// ZRangeWithScores returns the members and their scores of the sorted set between start and stop
+func (s *Session) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	values, err := s.doStringSlice(ctx, "ZRANGE", key, start, stop, "WITHSCORES")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Z, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, Z{Member: values[i], Score: score})
+	}
+	return result, nil
+}
+
+// Publish posts a message to the channel, returns the number of subscribers that received it
+func (s *Session) Publish(ctx context.Context, channel string, message interface{}) (int64, error) {
+	return s.doInt(ctx, "PUBLISH", channel, message)
+}
+
+func toArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
@@ -0,0 +1,212 @@
+package embedded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"miniRedis/cdc"
+	"miniRedis/config"
+	database2 "miniRedis/database"
+	"miniRedis/interface/database"
+	"miniRedis/interface/redis"
+	"miniRedis/redis/connection"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * embedded 包将 miniRedis 以库的形式嵌入到 Go 进程中，调用方不需要经过 TCP 即可使用 miniRedis 的数据结构和命令语义。
+ * 所有命令都通过 database.Server 执行，因此 AOF 持久化、过期等行为与服务器模式完全一致。
+ */
+
+// Nil 表示命令返回了空值，例如 GET 一个不存在的 key
+var Nil = errors.New("miniredis: nil")
+
+// ErrClosed 表示数据库或会话已经关闭
+var ErrClosed = errors.New("miniredis: closed")
+
+// DB 是一个嵌入到进程内的 miniRedis 实例，DB 本身也是一个默认的会话
+type DB struct {
+	*Session
+	server    database.DB
+	sessionID uint64
+	closed    int32
+}
+
+// Session 表示一个调用方，持有独立的连接状态：选择的数据库、事务、watch 的 key 等
+// 同一个 Session 上的命令是串行执行的，不同的 Session 之间可以并发
+type Session struct {
+	db   *DB
+	conn *connection.FakeConn
+	mu   sync.Mutex
+}
+
+// Open 使用当前的全局配置 config.Properties 创建一个嵌入式的数据库
+func Open() *DB {
+	db := &DB{
+		server: database2.NewStandaloneServer(),
+	}
+	db.Session = db.NewSession()
+	return db
+}
+
+// OpenWithProperties 使用给定的配置创建一个嵌入式的数据库，配置会替换全局配置
+func OpenWithProperties(properties *config.ServerProperties) *DB {
+	config.Properties = properties
+	return Open()
+}
+
+// NewSession 创建一个新的会话
+func (db *DB) NewSession() *Session {
+	id := atomic.AddUint64(&db.sessionID, 1)
+	return &Session{
+		db:   db,
+		conn: db.newConn("embedded-"+strconv.FormatUint(id, 10), nil),
+	}
+}
+
+// newConn 创建一个内存连接，进程内的调用方是可信的，所以直接使用配置中的密码完成认证
+func (db *DB) newConn(name string, onWrite func([]byte)) *connection.FakeConn {
+	conn := connection.NewFakeConnWithWriter(name, onWrite)
+	conn.SetPassword(config.Properties.RequirePass)
+	return conn
+}
+
+// Close 关闭数据库，等待持久化完成
+func (db *DB) Close() error {
+	if !atomic.CompareAndSwapInt32(&db.closed, 0, 1) {
+		return ErrClosed
+	}
+	db.server.AfterClientClose(db.Session.conn)
+	db.server.Close()
+	return nil
+}
+
+// ChangeFeed 返回写命令的变更事件，调用方可以通过 Subscribe 从某个偏移量开始消费。
+// 需要在配置中设置 cdc-backlog-size，没有开启 CDC 时返回 nil
+func (db *DB) ChangeFeed() *cdc.Feed {
+	if server, ok := db.server.(*database2.Server); ok {
+		return server.ChangeFeed()
+	}
+	return nil
+}
+
+func (db *DB) exec(conn redis.Connection, cmdLine [][]byte) redis.Reply {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return protocol.MakeErrReply(ErrClosed.Error())
+	}
+	return db.server.Exec(conn, cmdLine)
+}
+
+// Close 关闭会话，释放会话的订阅等状态
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.server.AfterClientClose(s.conn)
+	return s.conn.Close()
+}
+
+// Do 执行任意的命令并返回 Go 类型的结果，参数可以是 string、[]byte、整数、浮点数或 bool
+// 返回值的类型：状态回复及字符串为 string，整数为 int64，数组为 []interface{}，空值为 nil，错误回复作为 error 返回
+func (s *Session) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.do(ctx, args...)
+}
+
+// do 执行命令，调用方需要持有 s.mu
+func (s *Session) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cmdLine, err := toCmdLine(args)
+	if err != nil {
+		return nil, err
+	}
+	return parseReply(s.db.exec(s.conn, cmdLine))
+}
+
+// toCmdLine 将调用方传入的参数转换为命令行
+func toCmdLine(args []interface{}) ([][]byte, error) {
+	if len(args) == 0 {
+		return nil, errors.New("miniredis: empty command")
+	}
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			cmdLine[i] = []byte(v)
+		case []byte:
+			cmdLine[i] = v
+		case int:
+			cmdLine[i] = []byte(strconv.Itoa(v))
+		case int64:
+			cmdLine[i] = []byte(strconv.FormatInt(v, 10))
+		case uint64:
+			cmdLine[i] = []byte(strconv.FormatUint(v, 10))
+		case float64:
+			cmdLine[i] = []byte(strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			if v {
+				cmdLine[i] = []byte("1")
+			} else {
+				cmdLine[i] = []byte("0")
+			}
+		case fmt.Stringer:
+			cmdLine[i] = []byte(v.String())
+		default:
+			return nil, fmt.Errorf("miniredis: can't marshal %T as command argument", arg)
+		}
+	}
+	return cmdLine, nil
+}
+
+// parseReply 将 redis.Reply 转换为 Go 类型
+func parseReply(reply redis.Reply) (interface{}, error) {
+	switch r := reply.(type) {
+	case protocol.ErrorReply:
+		return nil, errors.New(r.Error())
+	case *protocol.OkReply:
+		return "OK", nil
+	case *protocol.PongReply:
+		return "PONG", nil
+	case *protocol.QueuedReply:
+		return "QUEUED", nil
+	case *protocol.StatusReply:
+		return r.Status, nil
+	case *protocol.IntReply:
+		return r.Code, nil
+	case *protocol.BulkReply:
+		if r.Arg == nil {
+			return nil, nil
+		}
+		return string(r.Arg), nil
+	case *protocol.NullBulkReply, *protocol.NullMultiBulkReply, *protocol.NoReply:
+		return nil, nil
+	case *protocol.EmptyMultiBulkReply:
+		return []interface{}{}, nil
+	case *protocol.MultiBulkReply:
+		result := make([]interface{}, len(r.Args))
+		for i, arg := range r.Args {
+			if arg != nil {
+				result[i] = string(arg)
+			}
+		}
+		return result, nil
+	case *protocol.MultiRawReply:
+		result := make([]interface{}, len(r.Replies))
+		for i, sub := range r.Replies {
+			val, err := parseReply(sub)
+			if err != nil {
+				// 事务等场景中的子命令错误作为数组中的元素返回
+				result[i] = err
+				continue
+			}
+			result[i] = val
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("miniredis: unexpected reply %T", reply)
+}
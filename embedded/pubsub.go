@@ -0,0 +1,126 @@
+package embedded
+
+import (
+	"bytes"
+	"context"
+	"miniRedis/redis/connection"
+	"miniRedis/redis/parser"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const subscriptionChanSize = 100
+
+// messagePrefix 是 pubsub 推送的消息的 RESP 头部，订阅/取消订阅的确认消息不会投递给调用方
+var messagePrefix = []byte("*3\r\n$7\r\nmessage\r\n")
+
+// Message 是从订阅的频道收到的一条消息
+type Message struct {
+	Channel string
+	Payload string
+}
+
+// Subscription 表示一组订阅关系，收到的消息通过 Channel 投递
+// 调用方需要及时消费消息，否则发布者会被阻塞，直到消息被消费或订阅被关闭
+type Subscription struct {
+	db     *DB
+	conn   *connection.FakeConn
+	ch     chan *Message
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+var subscriptionID uint64
+
+// Subscribe 订阅给定的频道
+func (db *DB) Subscribe(ctx context.Context, channels ...string) (*Subscription, error) {
+	sub := &Subscription{
+		db:   db,
+		ch:   make(chan *Message, subscriptionChanSize),
+		done: make(chan struct{}),
+	}
+	id := atomic.AddUint64(&subscriptionID, 1)
+	sub.conn = db.newConn("embedded-sub-"+strconv.FormatUint(id, 10), sub.onWrite)
+	if len(channels) == 0 {
+		return sub, nil
+	}
+	if err := sub.Subscribe(ctx, channels...); err != nil {
+		_ = sub.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// onWrite 解析 pubsub 写入连接的数据并投递到 channel 中
+func (sub *Subscription) onWrite(data []byte) {
+	if !bytes.HasPrefix(data, messagePrefix) {
+		return
+	}
+	reply, err := parser.ParseOne(data)
+	if err != nil {
+		return
+	}
+	multiBulk, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(multiBulk.Args) != 3 {
+		return
+	}
+	msg := &Message{
+		Channel: string(multiBulk.Args[1]),
+		Payload: string(multiBulk.Args[2]),
+	}
+	select {
+	case sub.ch <- msg:
+	case <-sub.done:
+	}
+}
+
+// Channel 返回接收消息的 channel，订阅关闭后 channel 会被关闭
+func (sub *Subscription) Channel() <-chan *Message {
+	return sub.ch
+}
+
+// Subscribe 增加订阅的频道
+func (sub *Subscription) Subscribe(ctx context.Context, channels ...string) error {
+	return sub.exec(ctx, "SUBSCRIBE", channels)
+}
+
+// Unsubscribe 取消订阅给定的频道，不指定频道时取消所有订阅，但不会关闭 Subscription
+func (sub *Subscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	return sub.exec(ctx, "UNSUBSCRIBE", channels)
+}
+
+func (sub *Subscription) exec(ctx context.Context, cmd string, channels []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return ErrClosed
+	}
+	cmdLine, err := toCmdLine(append([]interface{}{cmd}, toArgs(channels)...))
+	if err != nil {
+		return err
+	}
+	_, err = parseReply(sub.db.exec(sub.conn, cmdLine))
+	return err
+}
+
+// Close 取消所有订阅并关闭 Channel
+func (sub *Subscription) Close() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return ErrClosed
+	}
+	sub.closed = true
+	// 先唤醒被阻塞的发布者，然后取消订阅，此后不会再有消息写入，可以安全地关闭 channel
+	close(sub.done)
+	sub.db.exec(sub.conn, [][]byte{[]byte("UNSUBSCRIBE")})
+	_ = sub.conn.Close()
+	close(sub.ch)
+	return nil
+}
@@ -0,0 +1,54 @@
+package embedded
+
+import (
+	"context"
+	"errors"
+	"miniRedis/redis/protocol"
+)
+
+// ErrTxFailed 表示事务因为 watch 的 key 被修改而没有执行
+var ErrTxFailed = errors.New("miniredis: transaction failed")
+
+// Tx 表示一个正在构建的事务，通过 Tx.Do 加入的命令会在 EXEC 时原子地执行
+type Tx struct {
+	session *Session
+}
+
+// Do 将命令加入事务队列，命令的结果在 Session.Transaction 返回时得到
+func (tx *Tx) Do(ctx context.Context, args ...interface{}) error {
+	_, err := tx.session.do(ctx, args...)
+	return err
+}
+
+// Transaction 使用 MULTI/EXEC 原子地执行 fn 中加入的命令，并按顺序返回每个命令的结果
+// 如果给出了 watchKeys，这些 key 在事务执行前被修改时返回 ErrTxFailed；fn 返回错误时事务会被丢弃
+func (s *Session) Transaction(ctx context.Context, fn func(tx *Tx) error, watchKeys ...string) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(watchKeys) > 0 {
+		if _, err := s.do(ctx, append([]interface{}{"WATCH"}, toArgs(watchKeys)...)...); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.do(ctx, "MULTI"); err != nil {
+		return nil, err
+	}
+	if err := fn(&Tx{session: s}); err != nil {
+		_, _ = s.do(context.Background(), "DISCARD")
+		return nil, err
+	}
+
+	cmdLine, _ := toCmdLine([]interface{}{"EXEC"})
+	reply := s.db.exec(s.conn, cmdLine)
+	// watch 的 key 被修改时 EXEC 返回 null 数组，执行成功时返回每个命令的结果，没有命令时是空数组
+	if _, aborted := reply.(*protocol.NullMultiBulkReply); aborted {
+		return nil, ErrTxFailed
+	}
+	val, err := parseReply(reply)
+	if err != nil {
+		return nil, err
+	}
+	results, _ := val.([]interface{})
+	return results, nil
+}
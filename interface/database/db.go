@@ -16,7 +16,7 @@ type DB interface {
 type DBEngine interface {
 	DB
 	ExecWithLock(conn redis.Connection, cmdLine [][]byte) redis.Reply
-	ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLines []CmdLine) redis.Reply
+	ExecMulti(conn redis.Connection, watching map[redis.WatchKey]uint32, cmdLines []CmdLine) redis.Reply
 	GetUndoLogs(dbIndex int, cmdLine [][]byte) []CmdLine
 	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
 	RWLocks(dbIndex int, writeKeys []string, readKeys []string)
@@ -24,7 +24,37 @@ type DBEngine interface {
 	GetDBSize(dbIndex int) (int, int)
 }
 
+// KeyIterator 可以遍历每个数据库中的 key，DBEngine 和 Snapshot 都实现了这个接口
+type KeyIterator interface {
+	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
+	GetDBSize(dbIndex int) (int, int)
+}
+
+// Snapshot 是某一时刻的数据快照，之后的写命令不会改变快照中的数据
+type Snapshot interface {
+	KeyIterator
+	// Release 释放快照，之后的写命令不再需要保存 key 修改之前的值
+	Release()
+}
+
+// LockTokenEngine 是支持 LOCK 命令的数据库引擎，令牌计数器不属于任何 key，重写 AOF 时需要单独保存
+type LockTokenEngine interface {
+	LockToken(dbIndex int) int64
+}
+
+// SnapshotEngine 是可以在不阻塞写命令的情况下生成数据快照的数据库引擎
+type SnapshotEngine interface {
+	DBEngine
+	// MakeSnapshot 等待正在执行的写命令结束，调用 atSnapshot 之后生成快照，然后恢复执行写命令。
+	// atSnapshot 返回错误时不生成快照
+	MakeSnapshot(atSnapshot func() error) (Snapshot, error)
+}
+
 // DataEntity 存储key的内容，包括string,list,hash等
 type DataEntity struct {
 	Data interface{}
+	// AccessTime 最近一次被访问的时间（unix 毫秒），用于 OBJECT IDLETIME，需要通过原子操作读写
+	AccessTime int64
+	// AccessFreq 对数形式的访问频率计数器，用于 OBJECT FREQ，需要通过原子操作读写
+	AccessFreq uint32
 }
@@ -4,6 +4,8 @@ package redis
 type Connection interface {
 	Write([]byte) (int, error)
 	Close() error
+	// CloseNotify 返回一个在连接关闭时被关闭的 channel
+	CloseNotify() <-chan struct{}
 
 	SetPassword(string)
 	GetPassword() string
@@ -18,7 +20,7 @@ type Connection interface {
 	GetQueuedCmdLine() [][][]byte
 	EnqueueCmd([][]byte)
 	ClearQueuedCmds()
-	GetWatching() map[string]uint32
+	GetWatching() map[WatchKey]uint32
 	AddTxError(err error)
 	GetTxErrors() []error
 
@@ -33,3 +35,9 @@ type Connection interface {
 
 	Name() string
 }
+
+// WatchKey 是一个被 WATCH 的 key，WATCH 之后切换数据库不影响已经 WATCH 的 key
+type WatchKey struct {
+	DBIndex int
+	Key     string
+}
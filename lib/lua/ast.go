@@ -0,0 +1,123 @@
+package lua
+
+/*
+ * 语法树。解释器直接遍历语法树执行，每个语句和可能出错的表达式都记录了行号，用于错误信息
+ */
+
+type expr interface{}
+
+type stmt interface{}
+
+type (
+	nilExpr    struct{}
+	trueExpr   struct{}
+	falseExpr  struct{}
+	varargExpr struct{}
+	numberExpr struct{ value float64 }
+	stringExpr struct{ value string }
+
+	nameExpr struct {
+		name string
+		line int
+	}
+	indexExpr struct {
+		obj  expr
+		key  expr
+		line int
+	}
+	callExpr struct {
+		fn   expr
+		args []expr
+		line int
+	}
+	methodCallExpr struct {
+		obj    expr
+		method string
+		args   []expr
+		line   int
+	}
+	// parenExpr 将多返回值截断为一个
+	parenExpr    struct{ inner expr }
+	functionExpr struct{ proto *funcProto }
+	tableField   struct{ key, value expr } // key 为 nil 表示数组元素
+	tableExpr    struct{ fields []tableField }
+	binaryOpExpr struct {
+		op          string
+		left, right expr
+		line        int
+	}
+	unaryOpExpr struct {
+		op      string
+		operand expr
+		line    int
+	}
+)
+
+type (
+	localStmt struct {
+		names []string
+		exprs []expr
+		line  int
+	}
+	assignStmt struct {
+		targets []expr
+		exprs   []expr
+		line    int
+	}
+	callStmt struct {
+		call expr
+		line int
+	}
+	doStmt    struct{ body *block }
+	whileStmt struct {
+		cond expr
+		body *block
+		line int
+	}
+	repeatStmt struct {
+		body *block
+		cond expr
+		line int
+	}
+	ifStmt struct {
+		conds    []expr
+		blocks   []*block
+		elseBody *block
+		line     int
+	}
+	numForStmt struct {
+		name              string
+		start, stop, step expr
+		body              *block
+		line              int
+	}
+	genForStmt struct {
+		names []string
+		exprs []expr
+		body  *block
+		line  int
+	}
+	localFunctionStmt struct {
+		name string
+		fn   *functionExpr
+		line int
+	}
+	returnStmt struct {
+		exprs []expr
+		line  int
+	}
+	breakStmt struct{ line int }
+)
+
+type block struct {
+	stmts []stmt
+}
+
+// funcProto 是函数的定义，每次执行 function 表达式时会创建一个新的闭包
+type funcProto struct {
+	name     string
+	params   []string
+	isVararg bool
+	body     *block
+	line     int
+}
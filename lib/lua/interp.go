@@ -0,0 +1,702 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	maxCallDepth = 200
+	// 每执行这么多个语句检查一次是否被中断
+	interruptCheckInterval = 1000
+)
+
+// Error 是脚本运行时抛出的错误，Value 是传给 error() 的值
+type Error struct {
+	Value Value
+}
+
+func (e *Error) Error() string {
+	return ToString(e.Value)
+}
+
+// ErrInterrupted 表示脚本被 State.Interrupt 中断，pcall 不能捕获这个错误
+var ErrInterrupted = &Error{Value: "Script killed by user"}
+
+type variable struct {
+	name  string
+	value Value
+}
+
+// scope 是一个代码块中的局部变量，闭包通过持有 scope 引用外层的局部变量
+type scope struct {
+	parent  *scope
+	vars    []*variable
+	varargs []Value
+}
+
+func newScope(parent *scope) *scope {
+	sc := &scope{parent: parent}
+	if parent != nil {
+		sc.varargs = parent.varargs
+	}
+	return sc
+}
+
+func (sc *scope) lookup(name string) *variable {
+	for s := sc; s != nil; s = s.parent {
+		for i := len(s.vars) - 1; i >= 0; i-- {
+			if s.vars[i].name == name {
+				return s.vars[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (sc *scope) declare(name string, value Value) {
+	sc.vars = append(sc.vars, &variable{name: name, value: value})
+}
+
+// State 是一个 Lua 虚拟机，不能被多个协程同时使用
+type State struct {
+	globals     *Table
+	stringLib   *Table
+	chunk       string
+	line        int // 正在执行的行号，用于错误信息
+	depth       int
+	steps       int
+	interrupted int32
+	// strictGlobals 为 true 时读取不存在的全局变量以及创建新的全局变量都会出错
+	strictGlobals bool
+}
+
+// NewState 创建一个加载了基础库、string、table 和 math 库的虚拟机
+func NewState(chunk string) *State {
+	L := &State{globals: NewTable(0, 64), chunk: chunk}
+	openBaseLib(L)
+	openStringLib(L)
+	openTableLib(L)
+	openMathLib(L)
+	openJSONLib(L)
+	return L
+}
+
+// Globals 返回全局变量表
+func (L *State) Globals() *Table {
+	return L.globals
+}
+
+// SetGlobal 设置全局变量
+func (L *State) SetGlobal(name string, value Value) {
+	_ = L.globals.Set(name, value)
+}
+
+// SetStrictGlobals 开启后脚本不能创建全局变量，也不能读取不存在的全局变量
+func (L *State) SetStrictGlobals(strict bool) {
+	L.strictGlobals = strict
+}
+
+// Interrupt 中断正在执行的脚本，可以在其它协程中调用
+func (L *State) Interrupt() {
+	atomic.StoreInt32(&L.interrupted, 1)
+}
+
+// Line 返回正在执行的行号
+func (L *State) Line() int {
+	return L.line
+}
+
+// RaiseError 抛出带有位置信息的错误
+func (L *State) RaiseError(format string, args ...interface{}) {
+	panic(&Error{Value: L.where() + fmt.Sprintf(format, args...)})
+}
+
+// Raise 抛出任意值作为错误，不添加位置信息
+func (L *State) Raise(value Value) {
+	panic(&Error{Value: value})
+}
+
+func (L *State) where() string {
+	return fmt.Sprintf("%s:%d: ", L.chunk, L.line)
+}
+
+// Run 执行编译后的代码，返回代码的返回值
+func (L *State) Run(proto *Proto, args ...Value) ([]Value, error) {
+	fn := &Function{proto: proto.proto}
+	return L.PCall(fn, args...)
+}
+
+// PCall 调用函数并捕获其中的错误
+func (L *State) PCall(fn Value, args ...Value) (rets []Value, err error) {
+	depth := L.depth
+	defer func() {
+		if r := recover(); r != nil {
+			luaErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			L.depth = depth
+			err = luaErr
+		}
+	}()
+	return L.Call(fn, args...), nil
+}
+
+// Call 调用函数，出错时 panic，只能在 GoFunction 中使用
+func (L *State) Call(fn Value, args ...Value) []Value {
+	switch f := fn.(type) {
+	case *GoFunction:
+		return f.Fn(L, args)
+	case *Function:
+		return L.callLua(f, args)
+	}
+	L.RaiseError("attempt to call a %s value", TypeName(fn))
+	return nil
+}
+
+func (L *State) callLua(fn *Function, args []Value) []Value {
+	L.depth++
+	if L.depth > maxCallDepth {
+		L.RaiseError("stack overflow")
+	}
+	line := L.line
+	proto := fn.proto
+	sc := newScope(fn.scope)
+	for i, name := range proto.params {
+		var v Value
+		if i < len(args) {
+			v = args[i]
+		}
+		sc.declare(name, v)
+	}
+	if proto.isVararg {
+		if len(args) > len(proto.params) {
+			sc.varargs = append([]Value(nil), args[len(proto.params):]...)
+		} else {
+			sc.varargs = nil
+		}
+	}
+	ctrl, rets := L.execBlockIn(proto.body, sc)
+	L.depth--
+	L.line = line
+	if ctrl == ctrlReturn {
+		return rets
+	}
+	return nil
+}
+
+const (
+	ctrlNone = iota
+	ctrlBreak
+	ctrlReturn
+)
+
+func (L *State) execBlock(b *block, parent *scope) (int, []Value) {
+	return L.execBlockIn(b, newScope(parent))
+}
+
+func (L *State) execBlockIn(b *block, sc *scope) (int, []Value) {
+	for _, s := range b.stmts {
+		if ctrl, rets := L.execStmt(s, sc); ctrl != ctrlNone {
+			return ctrl, rets
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (L *State) checkInterrupt() {
+	L.steps++
+	if L.steps%interruptCheckInterval == 0 && atomic.LoadInt32(&L.interrupted) != 0 {
+		panic(ErrInterrupted)
+	}
+}
+
+func (L *State) execStmt(s stmt, sc *scope) (int, []Value) {
+	L.checkInterrupt()
+	switch s := s.(type) {
+	case *localStmt:
+		L.line = s.line
+		values := L.evalExprList(s.exprs, sc, len(s.names))
+		for i, name := range s.names {
+			sc.declare(name, values[i])
+		}
+	case *assignStmt:
+		L.line = s.line
+		L.execAssign(s, sc)
+	case *callStmt:
+		L.line = s.line
+		L.evalMulti(s.call, sc)
+	case *doStmt:
+		return L.execBlock(s.body, sc)
+	case *whileStmt:
+		for {
+			L.line = s.line
+			if !Truthy(L.eval(s.cond, sc)) {
+				break
+			}
+			ctrl, rets := L.execBlock(s.body, sc)
+			if ctrl == ctrlBreak {
+				break
+			}
+			if ctrl == ctrlReturn {
+				return ctrl, rets
+			}
+			L.checkInterrupt()
+		}
+	case *repeatStmt:
+		for {
+			// until 的条件可以访问循环体中的局部变量
+			inner := newScope(sc)
+			ctrl, rets := L.execBlockIn(s.body, inner)
+			if ctrl == ctrlBreak {
+				break
+			}
+			if ctrl == ctrlReturn {
+				return ctrl, rets
+			}
+			L.line = s.line
+			if Truthy(L.eval(s.cond, inner)) {
+				break
+			}
+			L.checkInterrupt()
+		}
+	case *ifStmt:
+		L.line = s.line
+		for i, cond := range s.conds {
+			if Truthy(L.eval(cond, sc)) {
+				return L.execBlock(s.blocks[i], sc)
+			}
+		}
+		if s.elseBody != nil {
+			return L.execBlock(s.elseBody, sc)
+		}
+	case *numForStmt:
+		return L.execNumFor(s, sc)
+	case *genForStmt:
+		return L.execGenFor(s, sc)
+	case *localFunctionStmt:
+		// 局部函数可以递归地引用自己
+		sc.declare(s.name, nil)
+		v := sc.vars[len(sc.vars)-1]
+		v.value = &Function{proto: s.fn.proto, scope: sc}
+	case *returnStmt:
+		L.line = s.line
+		// return f() 是尾调用，直接返回被调用函数的所有返回值
+		return ctrlReturn, L.evalExprList(s.exprs, sc, -1)
+	case *breakStmt:
+		return ctrlBreak, nil
+	default:
+		L.RaiseError("unknown statement %T", s)
+	}
+	return ctrlNone, nil
+}
+
+func (L *State) execAssign(s *assignStmt, sc *scope) {
+	// 先计算所有的表达式和目标中的表、下标，再依次赋值
+	type target struct {
+		variable *variable
+		global   string
+		index    *indexExpr
+		table    Value
+		key      Value
+	}
+	targets := make([]target, len(s.targets))
+	for i, t := range s.targets {
+		switch t := t.(type) {
+		case *nameExpr:
+			if v := sc.lookup(t.name); v != nil {
+				targets[i].variable = v
+			} else {
+				targets[i].global = t.name
+			}
+		case *indexExpr:
+			targets[i].index = t
+			targets[i].table = L.eval(t.obj, sc)
+			targets[i].key = L.eval(t.key, sc)
+		}
+	}
+	values := L.evalExprList(s.exprs, sc, len(s.targets))
+	for i, t := range targets {
+		switch {
+		case t.variable != nil:
+			t.variable.value = values[i]
+		case t.index != nil:
+			L.setIndex(t.table, t.key, values[i], t.index.obj)
+		default:
+			L.setGlobal(t.global, values[i])
+		}
+	}
+}
+
+func (L *State) setGlobal(name string, value Value) {
+	if L.strictGlobals && L.globals.Get(name) == nil {
+		L.RaiseError("Script attempted to create global variable '%s'", name)
+	}
+	_ = L.globals.Set(name, value)
+}
+
+func (L *State) setIndex(obj Value, key Value, value Value, e expr) {
+	t, ok := obj.(*Table)
+	if !ok {
+		L.RaiseError("attempt to index %s", describe(obj, e))
+	}
+	if t == L.globals && L.strictGlobals && t.Get(key) == nil {
+		// 通过 _G 创建全局变量，相当于 Redis 在 _G 的元表上设置的 __newindex
+		L.RaiseError("Script attempted to create global variable '%s'", ToString(key))
+	}
+	if err := t.Set(key, value); err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+}
+
+func (L *State) execNumFor(s *numForStmt, sc *scope) (int, []Value) {
+	L.line = s.line
+	start, ok := ToNumber(L.eval(s.start, sc))
+	if !ok {
+		L.RaiseError("'for' initial value must be a number")
+	}
+	stop, ok := ToNumber(L.eval(s.stop, sc))
+	if !ok {
+		L.RaiseError("'for' limit must be a number")
+	}
+	step := 1.0
+	if s.step != nil {
+		step, ok = ToNumber(L.eval(s.step, sc))
+		if !ok {
+			L.RaiseError("'for' step must be a number")
+		}
+	}
+	for i := start; (step > 0 && i <= stop) || (step <= 0 && i >= stop); i += step {
+		inner := newScope(sc)
+		inner.declare(s.name, i)
+		ctrl, rets := L.execBlockIn(s.body, inner)
+		if ctrl == ctrlBreak {
+			break
+		}
+		if ctrl == ctrlReturn {
+			return ctrl, rets
+		}
+		// 与 Lua 5.1 一样，步长为 0 时是死循环，只能被中断
+		L.checkInterrupt()
+	}
+	return ctrlNone, nil
+}
+
+func (L *State) execGenFor(s *genForStmt, sc *scope) (int, []Value) {
+	L.line = s.line
+	init := L.evalExprList(s.exprs, sc, 3)
+	fn, state, control := init[0], init[1], init[2]
+	for {
+		L.line = s.line
+		rets := L.Call(fn, state, control)
+		var first Value
+		if len(rets) > 0 {
+			first = rets[0]
+		}
+		if first == nil {
+			break
+		}
+		control = first
+		inner := newScope(sc)
+		for i, name := range s.names {
+			var v Value
+			if i < len(rets) {
+				v = rets[i]
+			}
+			inner.declare(name, v)
+		}
+		ctrl, rets := L.execBlockIn(s.body, inner)
+		if ctrl == ctrlBreak {
+			break
+		}
+		if ctrl == ctrlReturn {
+			return ctrl, rets
+		}
+		L.checkInterrupt()
+	}
+	return ctrlNone, nil
+}
+
+// evalExprList 计算表达式列表，最后一个表达式展开为多个值。want >= 0 时结果被补齐或截断为 want 个
+func (L *State) evalExprList(exprs []expr, sc *scope, want int) []Value {
+	var values []Value
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			values = append(values, L.evalMulti(e, sc)...)
+		} else {
+			values = append(values, L.eval(e, sc))
+		}
+	}
+	if want < 0 {
+		return values
+	}
+	for len(values) < want {
+		values = append(values, nil)
+	}
+	return values[:want]
+}
+
+// evalMulti 计算可能返回多个值的表达式（函数调用和 ...）
+func (L *State) evalMulti(e expr, sc *scope) []Value {
+	switch e := e.(type) {
+	case *callExpr:
+		fn := L.eval(e.fn, sc)
+		args := L.evalExprList(e.args, sc, -1)
+		L.line = e.line
+		if _, ok := fn.(*Function); !ok {
+			if _, ok := fn.(*GoFunction); !ok {
+				L.RaiseError("attempt to call %s", describe(fn, e.fn))
+			}
+		}
+		return L.Call(fn, args...)
+	case *methodCallExpr:
+		obj := L.eval(e.obj, sc)
+		L.line = e.line
+		fn := L.index(obj, e.method, e.obj)
+		args := append([]Value{obj}, L.evalExprList(e.args, sc, -1)...)
+		L.line = e.line
+		if fn == nil {
+			L.RaiseError("attempt to call method '%s' (a nil value)", e.method)
+		}
+		return L.Call(fn, args...)
+	case *varargExpr:
+		return sc.varargs
+	}
+	return []Value{L.eval(e, sc)}
+}
+
+func (L *State) eval(e expr, sc *scope) Value {
+	switch e := e.(type) {
+	case *nilExpr:
+		return nil
+	case *trueExpr:
+		return true
+	case *falseExpr:
+		return false
+	case *numberExpr:
+		return e.value
+	case *stringExpr:
+		return e.value
+	case *varargExpr:
+		if len(sc.varargs) > 0 {
+			return sc.varargs[0]
+		}
+		return nil
+	case *nameExpr:
+		if v := sc.lookup(e.name); v != nil {
+			return v.value
+		}
+		value := L.globals.Get(e.name)
+		if value == nil && L.strictGlobals {
+			L.line = e.line
+			L.RaiseError("Script attempted to access nonexistent global variable '%s'", e.name)
+		}
+		return value
+	case *indexExpr:
+		obj := L.eval(e.obj, sc)
+		key := L.eval(e.key, sc)
+		L.line = e.line
+		return L.index(obj, key, e.obj)
+	case *callExpr, *methodCallExpr:
+		rets := L.evalMulti(e, sc)
+		if len(rets) > 0 {
+			return rets[0]
+		}
+		return nil
+	case *parenExpr:
+		return L.eval(e.inner, sc)
+	case *functionExpr:
+		return &Function{proto: e.proto, scope: sc}
+	case *tableExpr:
+		return L.evalTable(e, sc)
+	case *binaryOpExpr:
+		return L.evalBinary(e, sc)
+	case *unaryOpExpr:
+		operand := L.eval(e.operand, sc)
+		L.line = e.line
+		switch e.op {
+		case "not":
+			return !Truthy(operand)
+		case "-":
+			n, ok := ToNumber(operand)
+			if !ok {
+				L.RaiseError("attempt to perform arithmetic on %s", describe(operand, e.operand))
+			}
+			return -n
+		case "#":
+			switch v := operand.(type) {
+			case string:
+				return float64(len(v))
+			case *Table:
+				return float64(v.Len())
+			}
+			L.RaiseError("attempt to get length of %s", describe(operand, e.operand))
+		}
+	}
+	L.RaiseError("unknown expression %T", e)
+	return nil
+}
+
+func (L *State) evalTable(e *tableExpr, sc *scope) Value {
+	t := NewTable(0, 0)
+	n := 0
+	for i, field := range e.fields {
+		if field.key != nil {
+			key := L.eval(field.key, sc)
+			value := L.eval(field.value, sc)
+			if err := t.Set(key, value); err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			continue
+		}
+		if i == len(e.fields)-1 {
+			for _, v := range L.evalMulti(field.value, sc) {
+				n++
+				_ = t.Set(float64(n), v)
+			}
+			continue
+		}
+		n++
+		_ = t.Set(float64(n), L.eval(field.value, sc))
+	}
+	return t
+}
+
+func (L *State) index(obj Value, key Value, e expr) Value {
+	switch o := obj.(type) {
+	case *Table:
+		value := o.Get(key)
+		if value == nil && o == L.globals && L.strictGlobals {
+			// 通过 _G 读取全局变量，相当于 Redis 在 _G 的元表上设置的 __index。rawget 不受影响
+			L.RaiseError("Script attempted to access nonexistent global variable '%s'", ToString(key))
+		}
+		return value
+	case string:
+		// 字符串可以通过 s:upper() 的形式调用 string 库中的函数
+		return L.stringLib.Get(key)
+	}
+	L.RaiseError("attempt to index %s", describe(obj, e))
+	return nil
+}
+
+// describe 生成错误信息中对值的描述，例如 global 'x' (a nil value)
+func describe(v Value, e expr) string {
+	switch e := e.(type) {
+	case *nameExpr:
+		return fmt.Sprintf("'%s' (a %s value)", e.name, TypeName(v))
+	case *indexExpr:
+		if key, ok := e.key.(*stringExpr); ok {
+			return fmt.Sprintf("field '%s' (a %s value)", key.value, TypeName(v))
+		}
+	}
+	return "a " + TypeName(v) + " value"
+}
+
+func (L *State) evalBinary(e *binaryOpExpr, sc *scope) Value {
+	// and/or 是短路求值
+	switch e.op {
+	case "and":
+		left := L.eval(e.left, sc)
+		if !Truthy(left) {
+			return left
+		}
+		return L.eval(e.right, sc)
+	case "or":
+		left := L.eval(e.left, sc)
+		if Truthy(left) {
+			return left
+		}
+		return L.eval(e.right, sc)
+	}
+	left := L.eval(e.left, sc)
+	right := L.eval(e.right, sc)
+	L.line = e.line
+	switch e.op {
+	case "+", "-", "*", "/", "%", "^":
+		a, ok := ToNumber(left)
+		if !ok {
+			L.RaiseError("attempt to perform arithmetic on %s", describe(left, e.left))
+		}
+		b, ok := ToNumber(right)
+		if !ok {
+			L.RaiseError("attempt to perform arithmetic on %s", describe(right, e.right))
+		}
+		return arith(e.op, a, b)
+	case "..":
+		return L.concat(left, right, e)
+	case "==":
+		return rawEquals(left, right)
+	case "~=":
+		return !rawEquals(left, right)
+	case "<":
+		return L.lessThan(left, right)
+	case ">":
+		return L.lessThan(right, left)
+	case "<=":
+		return !L.lessThan(right, left)
+	case ">=":
+		return !L.lessThan(left, right)
+	}
+	L.RaiseError("unknown operator %s", e.op)
+	return nil
+}
+
+func arith(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return a - math.Floor(a/b)*b
+	}
+	return math.Pow(a, b)
+}
+
+func (L *State) concat(left, right Value, e *binaryOpExpr) Value {
+	var sb strings.Builder
+	for i, v := range []Value{left, right} {
+		switch x := v.(type) {
+		case string:
+			sb.WriteString(x)
+		case float64:
+			sb.WriteString(NumberToString(x))
+		default:
+			operand := e.left
+			if i == 1 {
+				operand = e.right
+			}
+			L.RaiseError("attempt to concatenate %s", describe(v, operand))
+		}
+	}
+	return sb.String()
+}
+
+func rawEquals(a, b Value) bool {
+	return a == b
+}
+
+func (L *State) lessThan(a, b Value) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x < y
+		}
+	}
+	if TypeName(a) == TypeName(b) {
+		L.RaiseError("attempt to compare two %s values", TypeName(a))
+	}
+	L.RaiseError("attempt to compare %s with %s", TypeName(a), TypeName(b))
+	return false
+}
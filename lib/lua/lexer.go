@@ -0,0 +1,314 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokKeyword
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	str  string // 名字、字符串内容、关键字或者运算符
+	num  float64
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "<eof>"
+	case tokNumber:
+		return NumberToString(t.num)
+	}
+	return t.str
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+// SyntaxError 表示脚本编译失败
+type SyntaxError struct {
+	Chunk string
+	Line  int
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Chunk, e.Line, e.Msg)
+}
+
+type lexer struct {
+	src   string
+	pos   int
+	line  int
+	chunk string
+}
+
+// tokenize 将源代码切分为 token，最后一个 token 总是 tokEOF
+func tokenize(src string, chunk string) ([]token, error) {
+	lx := &lexer{src: src, line: 1, chunk: chunk}
+	// 跳过第一行的 #!
+	if strings.HasPrefix(src, "#") {
+		for lx.pos < len(src) && src[lx.pos] != '\n' {
+			lx.pos++
+		}
+	}
+	var tokens []token
+	for {
+		tok, err := lx.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == tokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (lx *lexer) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Chunk: lx.chunk, Line: lx.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (lx *lexer) peekByte(offset int) byte {
+	if lx.pos+offset < len(lx.src) {
+		return lx.src[lx.pos+offset]
+	}
+	return 0
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool { return isNameStart(c) || isDigit(c) }
+
+func (lx *lexer) next() (token, error) {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			lx.pos++
+		case c == '-' && lx.peekByte(1) == '-':
+			lx.pos += 2
+			if lx.peekByte(0) == '[' {
+				if level := lx.longBracketLevel(); level >= 0 {
+					if _, err := lx.readLongString(level); err != nil {
+						return token{}, err
+					}
+					continue
+				}
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return lx.readToken()
+		}
+	}
+	return token{kind: tokEOF, line: lx.line}, nil
+}
+
+func (lx *lexer) readToken() (token, error) {
+	c := lx.src[lx.pos]
+	line := lx.line
+	switch {
+	case isNameStart(c):
+		start := lx.pos
+		for lx.pos < len(lx.src) && isNameChar(lx.src[lx.pos]) {
+			lx.pos++
+		}
+		word := lx.src[start:lx.pos]
+		if keywords[word] {
+			return token{kind: tokKeyword, str: word, line: line}, nil
+		}
+		return token{kind: tokName, str: word, line: line}, nil
+	case isDigit(c) || (c == '.' && isDigit(lx.peekByte(1))):
+		return lx.readNumber()
+	case c == '"' || c == '\'':
+		s, err := lx.readString(c)
+		return token{kind: tokString, str: s, line: line}, err
+	case c == '[':
+		if level := lx.longBracketLevel(); level >= 0 {
+			s, err := lx.readLongString(level)
+			return token{kind: tokString, str: s, line: line}, err
+		}
+	}
+	// 运算符，优先匹配较长的
+	for _, op := range []string{"...", "..", "==", "~=", "<=", ">="} {
+		if strings.HasPrefix(lx.src[lx.pos:], op) {
+			lx.pos += len(op)
+			return token{kind: tokOp, str: op, line: line}, nil
+		}
+	}
+	if strings.IndexByte("+-*/%^#<>=(){}[];:,.", c) >= 0 {
+		lx.pos++
+		return token{kind: tokOp, str: string(c), line: line}, nil
+	}
+	return token{}, lx.errorf("unexpected symbol near '%c'", c)
+}
+
+func (lx *lexer) readNumber() (token, error) {
+	start := lx.pos
+	line := lx.line
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		if (c == '+' || c == '-') && lx.pos > start {
+			prev := lx.src[lx.pos-1]
+			isHex := strings.HasPrefix(lx.src[start:], "0x") || strings.HasPrefix(lx.src[start:], "0X")
+			if (prev == 'e' || prev == 'E') && !isHex {
+				lx.pos++
+				continue
+			}
+			break
+		}
+		if !isNameChar(c) && c != '.' {
+			break
+		}
+		lx.pos++
+	}
+	text := lx.src[start:lx.pos]
+	n, ok := parseNumber(text)
+	if !ok {
+		return token{}, lx.errorf("malformed number near '%s'", text)
+	}
+	return token{kind: tokNumber, num: n, line: line}, nil
+}
+
+func (lx *lexer) readString(quote byte) (string, error) {
+	lx.pos++ // 跳过引号
+	var sb strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			return "", lx.errorf("unfinished string")
+		}
+		c := lx.src[lx.pos]
+		if c == quote {
+			lx.pos++
+			return sb.String(), nil
+		}
+		if c == '\n' {
+			return "", lx.errorf("unfinished string")
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			lx.pos++
+			continue
+		}
+		lx.pos++
+		if lx.pos >= len(lx.src) {
+			return "", lx.errorf("unfinished string")
+		}
+		e := lx.src[lx.pos]
+		switch e {
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'v':
+			sb.WriteByte('\v')
+		case '\\', '"', '\'':
+			sb.WriteByte(e)
+		case '\n':
+			sb.WriteByte('\n')
+			lx.line++
+		case 'x':
+			if lx.pos+2 >= len(lx.src) || !isHexDigit(lx.src[lx.pos+1]) || !isHexDigit(lx.src[lx.pos+2]) {
+				return "", lx.errorf("hexadecimal digit expected")
+			}
+			sb.WriteByte(hexValue(lx.src[lx.pos+1])<<4 | hexValue(lx.src[lx.pos+2]))
+			lx.pos += 2
+		default:
+			if !isDigit(e) {
+				return "", lx.errorf("invalid escape sequence '\\%c'", e)
+			}
+			n := 0
+			for i := 0; i < 3 && lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]); i++ {
+				n = n*10 + int(lx.src[lx.pos]-'0')
+				lx.pos++
+			}
+			if n > 255 {
+				return "", lx.errorf("escape sequence too large")
+			}
+			sb.WriteByte(byte(n))
+			continue
+		}
+		lx.pos++
+	}
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case isDigit(c):
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// longBracketLevel 判断当前位置是否是长括号 [=*[ 的开始，返回等号的数量，不是时返回 -1
+func (lx *lexer) longBracketLevel() int {
+	i := lx.pos + 1
+	level := 0
+	for i < len(lx.src) && lx.src[i] == '=' {
+		level++
+		i++
+	}
+	if i < len(lx.src) && lx.src[i] == '[' {
+		return level
+	}
+	return -1
+}
+
+func (lx *lexer) readLongString(level int) (string, error) {
+	lx.pos += level + 2
+	// 紧跟在开始括号后的换行会被忽略
+	if lx.peekByte(0) == '\r' {
+		lx.pos++
+	}
+	if lx.peekByte(0) == '\n' {
+		lx.line++
+		lx.pos++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		return "", lx.errorf("unfinished long string")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s, nil
+}
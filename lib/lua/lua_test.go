@@ -0,0 +1,217 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// run 编译并执行 source，返回第一个返回值的字符串形式
+func run(t *testing.T, source string) (string, error) {
+	t.Helper()
+	proto, err := Compile(source, "test")
+	if err != nil {
+		return "", err
+	}
+	L := NewState("test")
+	rets, err := L.Run(proto)
+	if err != nil {
+		return "", err
+	}
+	if len(rets) == 0 {
+		return "", nil
+	}
+	return ToString(rets[0]), nil
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"arith", "return 1 + 2 * 3 - 4 / 2", "5"},
+		{"power and unary minus", "return -2 ^ 2", "-4"},
+		{"modulo of negative", "return -7 % 3", "2"},
+		{"integer formatting", "return 10 / 2", "5"},
+		{"float formatting", "return 1 / 4", "0.25"},
+		{"concat numbers", "return 1 .. 2", "12"},
+		{"string coercion", `return "10" + 5`, "15"},
+		{"comparison", "return 1 < 2 and 'yes' or 'no'", "yes"},
+		{"and or short circuit", "return nil and error('x') or 'ok'", "ok"},
+		{"not", "return not nil", "true"},
+		{"length of string", "return #'hello'", "5"},
+		{"length of table", "return #{1, 2, 3}", "3"},
+		{"long string", "return [[a\nb]]", "a\nb"},
+		{"escapes", `return "a\tb\65"`, "a\tbA"},
+		{"numeric for", "local s = 0 for i = 1, 10 do s = s + i end return s", "55"},
+		{"numeric for with step", "local s = '' for i = 5, 1, -2 do s = s .. i end return s", "531"},
+		{"while and break", "local i = 0 while true do i = i + 1 if i == 7 then break end end return i", "7"},
+		{"repeat until sees local", "local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", "4"},
+		{"if elseif else", "local x = 5 if x < 3 then return 'a' elseif x < 6 then return 'b' else return 'c' end", "b"},
+		{"closures share upvalue", `
+			local function counter()
+				local n = 0
+				return function() n = n + 1 return n end
+			end
+			local c = counter()
+			c() c()
+			return c()`, "3"},
+		{"closure per iteration", `
+			local fns = {}
+			for i = 1, 3 do fns[i] = function() return i end end
+			return fns[1]() + fns[3]()`, "4"},
+		{"recursion", "local function fib(n) if n < 2 then return n end return fib(n-1) + fib(n-2) end return fib(15)", "610"},
+		{"varargs", "local function f(...) return select('#', ...) end return f(1, nil, 3)", "3"},
+		{"multiple assignment swap", "local a, b = 1, 2 a, b = b, a return a .. b", "21"},
+		{"multiple returns expand last", "local function f() return 1, 2 end local t = {f(), f()} return #t", "3"},
+		{"method call", "local o = {n = 2} function o:double() return self.n * 2 end return o:double()", "4"},
+		{"nested tables", "local t = {a = {b = {c = 'deep'}}} return t.a.b.c", "deep"},
+		{"pairs", "local n = 0 for k, v in pairs({a = 1, b = 2, 3}) do n = n + v end return n", "6"},
+		{"ipairs stops at nil", "local n = 0 for i, v in ipairs({1, 2, nil, 4}) do n = n + v end return n", "3"},
+		{"pcall catches error", "local ok, err = pcall(error, 'boom', 0) return tostring(ok) .. ' ' .. err", "false boom"},
+		{"pcall error table", "local ok, err = pcall(error, {code = 42}) return err.code", "42"},
+		{"tonumber hex", "return tonumber('ff', 16)", "255"},
+		{"tonumber invalid", "return tostring(tonumber('abc'))", "nil"},
+		{"unpack", "return select(2, unpack({'a', 'b', 'c'}))", "b"},
+		{"table insert remove", "local t = {} table.insert(t, 'a') table.insert(t, 1, 'b') table.remove(t) return t[1] .. #t", "b1"},
+		{"table concat", "return table.concat({1, 2, 3}, ',')", "1,2,3"},
+		{"table sort with comparator", "local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return table.concat(t)", "321"},
+		{"math", "return math.floor(3.7) + math.max(1, 5, 2) + math.abs(-1)", "9"},
+		{"string methods", "local s = 'Hello' return s:upper() .. s:len() .. s:sub(2, -2)", "HELLO5ell"},
+		{"string rep and reverse", "return string.rep('ab', 3) .. string.reverse('xyz')", "abababzyx"},
+		{"string byte char", "return string.char(string.byte('A') + 1)", "B"},
+		{"string format", "return string.format('%d-%5.2f-%s-%q', 7, 3.14159, 'x', 'a\"b')", `7- 3.14-x-"a\"b"`},
+		{"string find plain", "return string.find('a.b.c', '.', 1, true)", "2"},
+		{"string find pattern", "local s, e = string.find('key:123', '%d+') return s .. ',' .. e", "5,7"},
+		{"string match captures", "local k, v = string.match('user=alice', '(%w+)=(%w+)') return v .. k", "aliceuser"},
+		{"string match anchored", "return tostring(string.match('xabc', '^abc'))", "nil"},
+		{"gmatch", "local n = 0 for w in string.gmatch('one two three', '%a+') do n = n + 1 end return n", "3"},
+		{"gsub with count", "local s, n = string.gsub('hello world', 'o', '0') return s .. n", "hell0 w0rld2"},
+		{"gsub with function", "return (string.gsub('abc', '%w', function(c) return c:upper() end))", "ABC"},
+		{"gsub with table", "return (string.gsub('$a $b', '%$(%w)', {a = 1, b = 2}))", "1 2"},
+		{"cjson encode", "return cjson.encode({1, 2, 3})", "[1,2,3]"},
+		{"cjson decode", "return cjson.decode('{\"a\":[1,2,{\"b\":\"c\"}]}').a[3].b", "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := run(t, tt.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string // 错误信息中应当包含的内容
+	}{
+		{"syntax error", "return 1 +", "test:1:"},
+		{"unfinished string", "return 'abc", "unfinished string"},
+		{"call nil", "local x return x()", "attempt to call 'x' (a nil value)"},
+		{"index nil", "local t return t.x", "attempt to index"},
+		{"arith on table", "return {} + 1", "attempt to perform arithmetic"},
+		{"compare mixed", "return 1 < 'x'", "attempt to compare"},
+		{"error with position", "\n\nerror('boom')", "test:3: boom"},
+		{"error level 0", "error('plain', 0)", "plain"},
+		{"concat nil", "return 'a' .. nil", "attempt to concatenate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := run(t, tt.source)
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not contain %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStrictGlobals(t *testing.T) {
+	tests := []struct {
+		source string
+		ok     bool
+	}{
+		{"local x = 1 return x", true},
+		{"x = 1", false},
+		{"return undefined_global", false},
+		{"return undefined_global ~= nil", false},
+		{"return type(undefined_global)", false},
+		{"return _G.undefined_global", false},
+		{"return _G['undefined_global']", false},
+		{"_G.x = 1", false},
+		{"return rawget(_G, 'undefined_global')", true},
+		{"return _G.KEYS[1]", true},
+		{"return cjson.encode(KEYS)", true},
+		{"return KEYS[1]", true},
+	}
+	for _, tt := range tests {
+		proto, err := Compile(tt.source, "test")
+		if err != nil {
+			t.Fatalf("%q: compile error %v", tt.source, err)
+		}
+		L := NewState("test")
+		keys := NewTable(1, 0)
+		keys.Append("k")
+		L.SetGlobal("KEYS", keys)
+		L.SetStrictGlobals(true)
+		_, err = L.Run(proto)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v, want ok=%v", tt.source, err, tt.ok)
+		}
+	}
+}
+
+func TestGoFunction(t *testing.T) {
+	proto, err := Compile("return add(20, 22), add(1, 1)", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	L := NewState("test")
+	L.SetGlobal("add", &GoFunction{Name: "add", Fn: func(L *State, args []Value) []Value {
+		a, _ := ToNumber(args[0])
+		b, _ := ToNumber(args[1])
+		return []Value{a + b}
+	}})
+	rets, err := L.Run(proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rets) != 2 || rets[0] != float64(42) || rets[1] != float64(2) {
+		t.Errorf("unexpected returns %v", rets)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	proto, err := Compile("local ok = pcall(function() while true do end end) return ok", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	L := NewState("test")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		L.Interrupt()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		_, err := L.Run(proto)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		// pcall 不能捕获中断
+		if err != ErrInterrupted {
+			t.Errorf("got %v, want ErrInterrupted", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("script was not interrupted")
+	}
+}
@@ -0,0 +1,507 @@
+package lua
+
+import "fmt"
+
+// parser 是递归下降的语法分析器，语法与 Lua 5.1 相同
+type parser struct {
+	tokens []token
+	pos    int
+	chunk  string
+}
+
+// Compile 编译一段 Lua 代码，返回可以通过 State.Call 执行的函数原型
+func Compile(source string, chunk string) (*Proto, error) {
+	tokens, err := tokenize(source, chunk)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, chunk: chunk}
+	var body *block
+	err = p.protect(func() {
+		body = p.parseBlock()
+		if p.cur().kind != tokEOF {
+			p.errorf("'<eof>' expected near '%s'", p.cur())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Proto{proto: &funcProto{name: "main chunk", isVararg: true, body: body, line: 0}}, nil
+}
+
+// Proto 是编译后的代码，可以被多个 State 共享
+type Proto struct {
+	proto *funcProto
+}
+
+func (p *parser) protect(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(*SyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = syntaxErr
+		}
+	}()
+	fn()
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) {
+	panic(&SyntaxError{Chunk: p.chunk, Line: p.cur().line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) cur() token { return p.tokens[p.pos] }
+
+func (p *parser) peek() token {
+	if p.pos+1 < len(p.tokens) {
+		return p.tokens[p.pos+1]
+	}
+	return p.tokens[len(p.tokens)-1]
+}
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// is 判断当前 token 是否是给定的关键字或者运算符
+func (p *parser) is(s string) bool {
+	tok := p.cur()
+	return (tok.kind == tokKeyword || tok.kind == tokOp) && tok.str == s
+}
+
+func (p *parser) accept(s string) bool {
+	if p.is(s) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) {
+	if !p.accept(s) {
+		p.errorf("'%s' expected near '%s'", s, p.cur())
+	}
+}
+
+// expectMatch 期望 what 用于结束从 line 行开始的 who
+func (p *parser) expectMatch(what, who string, line int) {
+	if p.accept(what) {
+		return
+	}
+	if line == p.cur().line {
+		p.errorf("'%s' expected near '%s'", what, p.cur())
+	}
+	p.errorf("'%s' expected (to close '%s' at line %d) near '%s'", what, who, line, p.cur())
+}
+
+func (p *parser) expectName() string {
+	tok := p.cur()
+	if tok.kind != tokName {
+		p.errorf("<name> expected near '%s'", tok)
+	}
+	p.advance()
+	return tok.str
+}
+
+func (p *parser) blockFollow() bool {
+	tok := p.cur()
+	if tok.kind == tokEOF {
+		return true
+	}
+	if tok.kind != tokKeyword {
+		return false
+	}
+	switch tok.str {
+	case "else", "elseif", "end", "until":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseBlock() *block {
+	b := &block{}
+	for !p.blockFollow() {
+		if p.is("return") {
+			b.stmts = append(b.stmts, p.parseReturn())
+			break
+		}
+		if p.is("break") {
+			b.stmts = append(b.stmts, &breakStmt{line: p.advance().line})
+			p.accept(";")
+			break
+		}
+		b.stmts = append(b.stmts, p.parseStatement())
+		p.accept(";")
+	}
+	return b
+}
+
+func (p *parser) parseReturn() stmt {
+	line := p.advance().line
+	s := &returnStmt{line: line}
+	if !p.blockFollow() && !p.is(";") {
+		s.exprs = p.parseExprList()
+	}
+	p.accept(";")
+	if !p.blockFollow() {
+		p.errorf("'<eof>' expected near '%s'", p.cur())
+	}
+	return s
+}
+
+func (p *parser) parseStatement() stmt {
+	tok := p.cur()
+	line := tok.line
+	if tok.kind == tokKeyword {
+		switch tok.str {
+		case "do":
+			p.advance()
+			body := p.parseBlock()
+			p.expectMatch("end", "do", line)
+			return &doStmt{body: body}
+		case "while":
+			p.advance()
+			cond := p.parseExpr()
+			p.expect("do")
+			body := p.parseBlock()
+			p.expectMatch("end", "while", line)
+			return &whileStmt{cond: cond, body: body, line: line}
+		case "repeat":
+			p.advance()
+			body := p.parseBlock()
+			p.expectMatch("until", "repeat", line)
+			return &repeatStmt{body: body, cond: p.parseExpr(), line: line}
+		case "if":
+			return p.parseIf()
+		case "for":
+			return p.parseFor()
+		case "function":
+			p.advance()
+			return p.parseFunctionStat(line)
+		case "local":
+			p.advance()
+			if p.accept("function") {
+				name := p.expectName()
+				return &localFunctionStmt{name: name, fn: p.parseFunctionBody(name, false, line), line: line}
+			}
+			names := []string{p.expectName()}
+			for p.accept(",") {
+				names = append(names, p.expectName())
+			}
+			s := &localStmt{names: names, line: line}
+			if p.accept("=") {
+				s.exprs = p.parseExprList()
+			}
+			return s
+		}
+	}
+	// 赋值语句或者函数调用
+	e := p.parseSuffixedExpr()
+	if p.is("=") || p.is(",") {
+		targets := []expr{e}
+		for p.accept(",") {
+			targets = append(targets, p.parseSuffixedExpr())
+		}
+		p.expect("=")
+		for _, target := range targets {
+			switch target.(type) {
+			case *nameExpr, *indexExpr:
+			default:
+				p.errorf("syntax error near '%s'", p.cur())
+			}
+		}
+		return &assignStmt{targets: targets, exprs: p.parseExprList(), line: line}
+	}
+	switch e.(type) {
+	case *callExpr, *methodCallExpr:
+		return &callStmt{call: e, line: line}
+	}
+	p.errorf("syntax error near '%s'", p.cur())
+	return nil
+}
+
+func (p *parser) parseIf() stmt {
+	line := p.advance().line
+	s := &ifStmt{line: line}
+	s.conds = append(s.conds, p.parseExpr())
+	p.expect("then")
+	s.blocks = append(s.blocks, p.parseBlock())
+	for {
+		if p.accept("elseif") {
+			s.conds = append(s.conds, p.parseExpr())
+			p.expect("then")
+			s.blocks = append(s.blocks, p.parseBlock())
+			continue
+		}
+		if p.accept("else") {
+			s.elseBody = p.parseBlock()
+		}
+		p.expectMatch("end", "if", line)
+		return s
+	}
+}
+
+func (p *parser) parseFor() stmt {
+	line := p.advance().line
+	name := p.expectName()
+	if p.accept("=") {
+		s := &numForStmt{name: name, line: line}
+		s.start = p.parseExpr()
+		p.expect(",")
+		s.stop = p.parseExpr()
+		if p.accept(",") {
+			s.step = p.parseExpr()
+		}
+		p.expect("do")
+		s.body = p.parseBlock()
+		p.expectMatch("end", "for", line)
+		return s
+	}
+	names := []string{name}
+	for p.accept(",") {
+		names = append(names, p.expectName())
+	}
+	if !p.is("in") {
+		p.errorf("'=' or 'in' expected near '%s'", p.cur())
+	}
+	p.advance()
+	s := &genForStmt{names: names, line: line}
+	s.exprs = p.parseExprList()
+	p.expect("do")
+	s.body = p.parseBlock()
+	p.expectMatch("end", "for", line)
+	return s
+}
+
+// parseFunctionStat function a.b.c:m() end
+func (p *parser) parseFunctionStat(line int) stmt {
+	nameLine := p.cur().line
+	name := p.expectName()
+	var target expr = &nameExpr{name: name, line: nameLine}
+	fullName := name
+	isMethod := false
+	for p.is(".") || p.is(":") {
+		isMethod = p.is(":")
+		p.advance()
+		key := p.expectName()
+		fullName += "." + key
+		target = &indexExpr{obj: target, key: &stringExpr{value: key}, line: nameLine}
+		if isMethod {
+			break
+		}
+	}
+	fn := p.parseFunctionBody(fullName, isMethod, line)
+	return &assignStmt{targets: []expr{target}, exprs: []expr{fn}, line: line}
+}
+
+func (p *parser) parseFunctionBody(name string, isMethod bool, line int) *functionExpr {
+	proto := &funcProto{name: name, line: line}
+	if isMethod {
+		proto.params = append(proto.params, "self")
+	}
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				proto.isVararg = true
+				break
+			}
+			proto.params = append(proto.params, p.expectName())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	proto.body = p.parseBlock()
+	p.expectMatch("end", "function", line)
+	return &functionExpr{proto: proto}
+}
+
+func (p *parser) parseExprList() []expr {
+	exprs := []expr{p.parseExpr()}
+	for p.accept(",") {
+		exprs = append(exprs, p.parseExpr())
+	}
+	return exprs
+}
+
+// 二元运算符的左右优先级，右结合的运算符右优先级较低
+var binaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4},
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const unaryPriority = 8
+
+func (p *parser) parseExpr() expr {
+	return p.parseSubExpr(0)
+}
+
+func (p *parser) binaryOp() (string, bool) {
+	tok := p.cur()
+	if tok.kind != tokOp && tok.kind != tokKeyword {
+		return "", false
+	}
+	_, ok := binaryPriority[tok.str]
+	return tok.str, ok
+}
+
+func (p *parser) parseSubExpr(limit int) expr {
+	var left expr
+	if p.is("not") || p.is("-") || p.is("#") {
+		tok := p.advance()
+		operand := p.parseSubExpr(unaryPriority)
+		// 常量折叠负数，使 -1 这样的字面量不需要在运行时计算
+		if num, ok := operand.(*numberExpr); ok && tok.str == "-" {
+			left = &numberExpr{value: -num.value}
+		} else {
+			left = &unaryOpExpr{op: tok.str, operand: operand, line: tok.line}
+		}
+	} else {
+		left = p.parseSimpleExpr()
+	}
+	for {
+		op, ok := p.binaryOp()
+		if !ok || binaryPriority[op][0] <= limit {
+			return left
+		}
+		line := p.advance().line
+		right := p.parseSubExpr(binaryPriority[op][1])
+		left = &binaryOpExpr{op: op, left: left, right: right, line: line}
+	}
+}
+
+func (p *parser) parseSimpleExpr() expr {
+	tok := p.cur()
+	switch tok.kind {
+	case tokNumber:
+		p.advance()
+		return &numberExpr{value: tok.num}
+	case tokString:
+		p.advance()
+		return &stringExpr{value: tok.str}
+	case tokKeyword:
+		switch tok.str {
+		case "nil":
+			p.advance()
+			return &nilExpr{}
+		case "true":
+			p.advance()
+			return &trueExpr{}
+		case "false":
+			p.advance()
+			return &falseExpr{}
+		case "function":
+			p.advance()
+			return p.parseFunctionBody("anonymous", false, tok.line)
+		}
+	case tokOp:
+		switch tok.str {
+		case "...":
+			p.advance()
+			return &varargExpr{}
+		case "{":
+			return p.parseTable()
+		}
+	}
+	return p.parseSuffixedExpr()
+}
+
+func (p *parser) parsePrimaryExpr() expr {
+	tok := p.cur()
+	if tok.kind == tokName {
+		p.advance()
+		return &nameExpr{name: tok.str, line: tok.line}
+	}
+	if p.accept("(") {
+		inner := p.parseExpr()
+		p.expectMatch(")", "(", tok.line)
+		return &parenExpr{inner: inner}
+	}
+	p.errorf("unexpected symbol near '%s'", tok)
+	return nil
+}
+
+func (p *parser) parseSuffixedExpr() expr {
+	e := p.parsePrimaryExpr()
+	for {
+		tok := p.cur()
+		switch {
+		case p.is("."):
+			p.advance()
+			e = &indexExpr{obj: e, key: &stringExpr{value: p.expectName()}, line: tok.line}
+		case p.is("["):
+			p.advance()
+			key := p.parseExpr()
+			p.expect("]")
+			e = &indexExpr{obj: e, key: key, line: tok.line}
+		case p.is(":"):
+			p.advance()
+			method := p.expectName()
+			e = &methodCallExpr{obj: e, method: method, args: p.parseCallArgs(), line: tok.line}
+		case p.is("(") || p.is("{") || tok.kind == tokString:
+			e = &callExpr{fn: e, args: p.parseCallArgs(), line: tok.line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) parseCallArgs() []expr {
+	tok := p.cur()
+	switch {
+	case tok.kind == tokString:
+		p.advance()
+		return []expr{&stringExpr{value: tok.str}}
+	case p.is("{"):
+		return []expr{p.parseTable()}
+	case p.is("("):
+		p.advance()
+		var args []expr
+		if !p.is(")") {
+			args = p.parseExprList()
+		}
+		p.expectMatch(")", "(", tok.line)
+		return args
+	}
+	p.errorf("function arguments expected near '%s'", tok)
+	return nil
+}
+
+func (p *parser) parseTable() expr {
+	line := p.cur().line
+	p.expect("{")
+	t := &tableExpr{}
+	for !p.is("}") {
+		switch {
+		case p.is("["):
+			p.advance()
+			key := p.parseExpr()
+			p.expect("]")
+			p.expect("=")
+			t.fields = append(t.fields, tableField{key: key, value: p.parseExpr()})
+		case p.cur().kind == tokName && p.peek().kind == tokOp && p.peek().str == "=":
+			key := p.advance().str
+			p.advance()
+			t.fields = append(t.fields, tableField{key: &stringExpr{value: key}, value: p.parseExpr()})
+		default:
+			t.fields = append(t.fields, tableField{value: p.parseExpr()})
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expectMatch("}", "{", line)
+	return t
+}
@@ -0,0 +1,545 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * 基础库、table、math 和 cjson 库。为了保证脚本的执行结果是确定的，
+ * 没有提供 io、os、load 等函数，math.random 每次都使用相同的种子
+ */
+
+func register(t *Table, name string, fn func(L *State, args []Value) []Value) {
+	_ = t.Set(name, &GoFunction{Name: name, Fn: fn})
+}
+
+func arg(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func (L *State) checkTable(args []Value, i int, fname string) *Table {
+	t, ok := arg(args, i).(*Table)
+	if !ok {
+		L.argError(i, fname, "table expected, got "+typeNameForArg(args, i))
+	}
+	return t
+}
+
+func (L *State) checkNumber(args []Value, i int, fname string) float64 {
+	n, ok := ToNumber(arg(args, i))
+	if !ok {
+		L.argError(i, fname, "number expected, got "+typeNameForArg(args, i))
+	}
+	return n
+}
+
+func (L *State) checkInt(args []Value, i int, fname string) int {
+	return int(L.checkNumber(args, i, fname))
+}
+
+func (L *State) optInt(args []Value, i int, fname string, def int) int {
+	if arg(args, i) == nil {
+		return def
+	}
+	return L.checkInt(args, i, fname)
+}
+
+func (L *State) checkString(args []Value, i int, fname string) string {
+	switch v := arg(args, i).(type) {
+	case string:
+		return v
+	case float64:
+		return NumberToString(v)
+	}
+	L.argError(i, fname, "string expected, got "+typeNameForArg(args, i))
+	return ""
+}
+
+func typeNameForArg(args []Value, i int) string {
+	if i >= len(args) {
+		return "no value"
+	}
+	return TypeName(args[i])
+}
+
+func (L *State) argError(i int, fname string, msg string) {
+	L.RaiseError("bad argument #%d to '%s' (%s)", i+1, fname, msg)
+}
+
+func openBaseLib(L *State) {
+	g := L.globals
+	register(g, "assert", func(L *State, args []Value) []Value {
+		if !Truthy(arg(args, 0)) {
+			if len(args) > 1 {
+				L.Raise(args[1])
+			}
+			L.RaiseError("assertion failed!")
+		}
+		return args
+	})
+	register(g, "error", func(L *State, args []Value) []Value {
+		msg := arg(args, 0)
+		level := L.optInt(args, 1, "error", 1)
+		if s, ok := msg.(string); ok && level > 0 {
+			msg = L.where() + s
+		}
+		L.Raise(msg)
+		return nil
+	})
+	register(g, "pcall", func(L *State, args []Value) []Value {
+		if len(args) == 0 {
+			L.argError(0, "pcall", "value expected")
+		}
+		rets, err := L.PCall(args[0], args[1:]...)
+		if err != nil {
+			if err == ErrInterrupted {
+				panic(err)
+			}
+			return []Value{false, err.(*Error).Value}
+		}
+		return append([]Value{true}, rets...)
+	})
+	register(g, "xpcall", func(L *State, args []Value) []Value {
+		rets, err := L.PCall(arg(args, 0))
+		if err != nil {
+			if err == ErrInterrupted {
+				panic(err)
+			}
+			return append([]Value{false}, L.Call(arg(args, 1), err.(*Error).Value)...)
+		}
+		return append([]Value{true}, rets...)
+	})
+	register(g, "type", func(L *State, args []Value) []Value {
+		if len(args) == 0 {
+			L.argError(0, "type", "value expected")
+		}
+		return []Value{TypeName(args[0])}
+	})
+	register(g, "tostring", func(L *State, args []Value) []Value {
+		return []Value{ToString(arg(args, 0))}
+	})
+	register(g, "tonumber", func(L *State, args []Value) []Value {
+		base := L.optInt(args, 1, "tonumber", 10)
+		if base == 10 {
+			if n, ok := ToNumber(arg(args, 0)); ok {
+				return []Value{n}
+			}
+			return []Value{nil}
+		}
+		if base < 2 || base > 36 {
+			L.argError(1, "tonumber", "base out of range")
+		}
+		n, err := strconv.ParseInt(strings.ToLower(strings.TrimSpace(L.checkString(args, 0, "tonumber"))), base, 64)
+		if err != nil {
+			return []Value{nil}
+		}
+		return []Value{float64(n)}
+	})
+	next := &GoFunction{Name: "next", Fn: func(L *State, args []Value) []Value {
+		t := L.checkTable(args, 0, "next")
+		k, v, ok := t.Next(arg(args, 1))
+		if !ok {
+			L.RaiseError("invalid key to 'next'")
+		}
+		if k == nil {
+			return []Value{nil}
+		}
+		return []Value{k, v}
+	}}
+	_ = g.Set("next", next)
+	register(g, "pairs", func(L *State, args []Value) []Value {
+		return []Value{next, L.checkTable(args, 0, "pairs"), nil}
+	})
+	ipairsIter := &GoFunction{Name: "ipairs_iter", Fn: func(L *State, args []Value) []Value {
+		t := args[0].(*Table)
+		i := args[1].(float64) + 1
+		v := t.Get(i)
+		if v == nil {
+			return []Value{nil}
+		}
+		return []Value{i, v}
+	}}
+	register(g, "ipairs", func(L *State, args []Value) []Value {
+		return []Value{ipairsIter, L.checkTable(args, 0, "ipairs"), float64(0)}
+	})
+	register(g, "select", func(L *State, args []Value) []Value {
+		if s, ok := arg(args, 0).(string); ok && s == "#" {
+			return []Value{float64(len(args) - 1)}
+		}
+		n := L.checkInt(args, 0, "select")
+		if n < 0 {
+			n = len(args) + n
+		} else if n == 0 {
+			L.argError(0, "select", "index out of range")
+		}
+		if n < 1 {
+			L.argError(0, "select", "index out of range")
+		}
+		if n >= len(args) {
+			return nil
+		}
+		return args[n:]
+	})
+	unpack := func(L *State, args []Value) []Value {
+		t := L.checkTable(args, 0, "unpack")
+		i := L.optInt(args, 1, "unpack", 1)
+		j := L.optInt(args, 2, "unpack", t.Len())
+		if i > j {
+			return nil
+		}
+		if j-i >= 1<<20 {
+			L.RaiseError("too many results to unpack")
+		}
+		rets := make([]Value, 0, j-i+1)
+		for k := i; k <= j; k++ {
+			rets = append(rets, t.Get(float64(k)))
+		}
+		return rets
+	}
+	register(g, "unpack", unpack)
+	register(g, "rawget", func(L *State, args []Value) []Value {
+		return []Value{L.checkTable(args, 0, "rawget").Get(arg(args, 1))}
+	})
+	register(g, "rawset", func(L *State, args []Value) []Value {
+		t := L.checkTable(args, 0, "rawset")
+		if err := t.Set(arg(args, 1), arg(args, 2)); err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		return []Value{t}
+	})
+	register(g, "rawequal", func(L *State, args []Value) []Value {
+		return []Value{rawEquals(arg(args, 0), arg(args, 1))}
+	})
+	_ = g.Set("_G", g)
+	_ = g.Set("_VERSION", "Lua 5.1")
+}
+
+func openTableLib(L *State) {
+	lib := NewTable(0, 8)
+	register(lib, "insert", func(L *State, args []Value) []Value {
+		t := L.checkTable(args, 0, "insert")
+		n := t.Len()
+		switch len(args) {
+		case 2:
+			_ = t.Set(float64(n+1), args[1])
+		case 3:
+			pos := L.checkInt(args, 1, "insert")
+			if pos < 1 || pos > n+1 {
+				L.argError(1, "insert", "position out of bounds")
+			}
+			for i := n; i >= pos; i-- {
+				_ = t.Set(float64(i+1), t.Get(float64(i)))
+			}
+			_ = t.Set(float64(pos), args[2])
+		default:
+			L.RaiseError("wrong number of arguments to 'insert'")
+		}
+		return nil
+	})
+	register(lib, "remove", func(L *State, args []Value) []Value {
+		t := L.checkTable(args, 0, "remove")
+		n := t.Len()
+		pos := L.optInt(args, 1, "remove", n)
+		if n == 0 {
+			return []Value{nil}
+		}
+		if pos < 1 || pos > n {
+			return []Value{nil}
+		}
+		v := t.Get(float64(pos))
+		for i := pos; i < n; i++ {
+			_ = t.Set(float64(i), t.Get(float64(i+1)))
+		}
+		_ = t.Set(float64(n), nil)
+		return []Value{v}
+	})
+	register(lib, "concat", func(L *State, args []Value) []Value {
+		t := L.checkTable(args, 0, "concat")
+		sep := ""
+		if arg(args, 1) != nil {
+			sep = L.checkString(args, 1, "concat")
+		}
+		i := L.optInt(args, 2, "concat", 1)
+		j := L.optInt(args, 3, "concat", t.Len())
+		var sb strings.Builder
+		for k := i; k <= j; k++ {
+			switch v := t.Get(float64(k)).(type) {
+			case string:
+				sb.WriteString(v)
+			case float64:
+				sb.WriteString(NumberToString(v))
+			default:
+				L.RaiseError("invalid value (at index %d) in table for 'concat'", k)
+			}
+			if k < j {
+				sb.WriteString(sep)
+			}
+		}
+		return []Value{sb.String()}
+	})
+	register(lib, "getn", func(L *State, args []Value) []Value {
+		return []Value{float64(L.checkTable(args, 0, "getn").Len())}
+	})
+	register(lib, "maxn", func(L *State, args []Value) []Value {
+		t := L.checkTable(args, 0, "maxn")
+		max := 0.0
+		for k, _, _ := t.Next(nil); k != nil; k, _, _ = t.Next(k) {
+			if f, ok := k.(float64); ok && f > max {
+				max = f
+			}
+		}
+		return []Value{max}
+	})
+	register(lib, "sort", func(L *State, args []Value) []Value {
+		t := L.checkTable(args, 0, "sort")
+		comp := arg(args, 1)
+		n := t.Len()
+		values := make([]Value, n)
+		for i := range values {
+			values[i] = t.Get(float64(i + 1))
+		}
+		sort.SliceStable(values, func(i, j int) bool {
+			if comp != nil {
+				rets := L.Call(comp, values[i], values[j])
+				return len(rets) > 0 && Truthy(rets[0])
+			}
+			return L.lessThan(values[i], values[j])
+		})
+		for i, v := range values {
+			_ = t.Set(float64(i+1), v)
+		}
+		return nil
+	})
+	L.SetGlobal("table", lib)
+}
+
+func openMathLib(L *State) {
+	lib := NewTable(0, 32)
+	unary := map[string]func(float64) float64{
+		"abs": math.Abs, "ceil": math.Ceil, "floor": math.Floor, "sqrt": math.Sqrt,
+		"exp": math.Exp, "log10": math.Log10, "sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+		"asin": math.Asin, "acos": math.Acos, "atan": math.Atan,
+		"deg": func(x float64) float64 { return x * 180 / math.Pi },
+		"rad": func(x float64) float64 { return x * math.Pi / 180 },
+	}
+	for name, fn := range unary {
+		name, fn := name, fn
+		register(lib, name, func(L *State, args []Value) []Value {
+			return []Value{fn(L.checkNumber(args, 0, name))}
+		})
+	}
+	register(lib, "log", func(L *State, args []Value) []Value {
+		x := L.checkNumber(args, 0, "log")
+		if arg(args, 1) != nil {
+			return []Value{math.Log(x) / math.Log(L.checkNumber(args, 1, "log"))}
+		}
+		return []Value{math.Log(x)}
+	})
+	register(lib, "pow", func(L *State, args []Value) []Value {
+		return []Value{math.Pow(L.checkNumber(args, 0, "pow"), L.checkNumber(args, 1, "pow"))}
+	})
+	register(lib, "fmod", func(L *State, args []Value) []Value {
+		return []Value{math.Mod(L.checkNumber(args, 0, "fmod"), L.checkNumber(args, 1, "fmod"))}
+	})
+	register(lib, "modf", func(L *State, args []Value) []Value {
+		i, f := math.Modf(L.checkNumber(args, 0, "modf"))
+		return []Value{i, f}
+	})
+	register(lib, "max", func(L *State, args []Value) []Value {
+		max := L.checkNumber(args, 0, "max")
+		for i := 1; i < len(args); i++ {
+			max = math.Max(max, L.checkNumber(args, i, "max"))
+		}
+		return []Value{max}
+	})
+	register(lib, "min", func(L *State, args []Value) []Value {
+		min := L.checkNumber(args, 0, "min")
+		for i := 1; i < len(args); i++ {
+			min = math.Min(min, L.checkNumber(args, i, "min"))
+		}
+		return []Value{min}
+	})
+	// 与 Redis 一样使用固定的种子，保证脚本在 AOF 重放和副本上的结果一致
+	rnd := rand.New(rand.NewSource(0))
+	register(lib, "random", func(L *State, args []Value) []Value {
+		r := rnd.Float64()
+		switch len(args) {
+		case 0:
+			return []Value{r}
+		case 1:
+			m := L.checkInt(args, 0, "random")
+			if m < 1 {
+				L.argError(0, "random", "interval is empty")
+			}
+			return []Value{math.Floor(r*float64(m)) + 1}
+		}
+		m, n := L.checkInt(args, 0, "random"), L.checkInt(args, 1, "random")
+		if m > n {
+			L.argError(1, "random", "interval is empty")
+		}
+		return []Value{math.Floor(r*float64(n-m+1)) + float64(m)}
+	})
+	register(lib, "randomseed", func(L *State, args []Value) []Value {
+		rnd.Seed(int64(L.checkNumber(args, 0, "randomseed")))
+		return nil
+	})
+	_ = lib.Set("pi", math.Pi)
+	_ = lib.Set("huge", math.Inf(1))
+	L.SetGlobal("math", lib)
+}
+
+// openJSONLib 提供与 Redis 中 cjson 库兼容的 encode 和 decode
+func openJSONLib(L *State) {
+	lib := NewTable(0, 2)
+	register(lib, "encode", func(L *State, args []Value) []Value {
+		var buf bytes.Buffer
+		L.encodeJSON(&buf, arg(args, 0), 0)
+		return []Value{buf.String()}
+	})
+	register(lib, "decode", func(L *State, args []Value) []Value {
+		decoder := json.NewDecoder(strings.NewReader(L.checkString(args, 0, "decode")))
+		decoder.UseNumber()
+		var v interface{}
+		if err := decoder.Decode(&v); err != nil {
+			L.RaiseError("Expected value but found invalid token")
+		}
+		return []Value{fromJSON(v)}
+	})
+	L.SetGlobal("cjson", lib)
+}
+
+func (L *State) encodeJSON(buf *bytes.Buffer, v Value, depth int) {
+	if depth > 1000 {
+		L.RaiseError("Cannot serialise, excessive nesting (1001)")
+	}
+	switch x := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(x))
+	case float64:
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			L.RaiseError("Cannot serialise number: must not be NaN or Inf")
+		}
+		buf.WriteString(NumberToString(x))
+	case string:
+		writeJSONString(buf, x)
+	case *Table:
+		// 只包含 1..n 整数 key 的非空表编码为数组，其余编码为对象
+		n := x.Len()
+		count := 0
+		for k, _, _ := x.Next(nil); k != nil; k, _, _ = x.Next(k) {
+			count++
+		}
+		if n > 0 && count == n {
+			buf.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					buf.WriteByte(',')
+				}
+				L.encodeJSON(buf, x.Get(float64(i)), depth+1)
+			}
+			buf.WriteByte(']')
+			return
+		}
+		buf.WriteByte('{')
+		first := true
+		for k, val, _ := x.Next(nil); k != nil; k, val, _ = x.Next(k) {
+			var key string
+			switch kk := k.(type) {
+			case string:
+				key = kk
+			case float64:
+				key = NumberToString(kk)
+			default:
+				L.RaiseError("Cannot serialise %s: table key must be a number or string", TypeName(k))
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			writeJSONString(buf, key)
+			buf.WriteByte(':')
+			L.encodeJSON(buf, val, depth+1)
+		}
+		buf.WriteByte('}')
+	default:
+		L.RaiseError("Cannot serialise %s: type not supported", TypeName(v))
+	}
+}
+
+// writeJSONString 按字节转义字符串，Lua 字符串可能不是合法的 UTF-8，不能使用 encoding/json
+func writeJSONString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '/':
+			buf.WriteString(`\/`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[c>>4])
+				buf.WriteByte(hex[c&0xf])
+				continue
+			}
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+}
+
+func fromJSON(v interface{}) Value {
+	switch x := v.(type) {
+	case json.Number:
+		f, _ := strconv.ParseFloat(string(x), 64)
+		return f
+	case string:
+		return x
+	case bool:
+		return x
+	case []interface{}:
+		t := NewTable(len(x), 0)
+		for i, item := range x {
+			_ = t.Set(float64(i+1), fromJSON(item))
+		}
+		return t
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		// 保证遍历顺序是确定的
+		sort.Strings(keys)
+		t := NewTable(0, len(x))
+		for _, k := range keys {
+			_ = t.Set(k, fromJSON(x[k]))
+		}
+		return t
+	}
+	return nil
+}
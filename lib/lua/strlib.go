@@ -0,0 +1,698 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * string 库，模式匹配的实现移植自 Lua 5.1 的 lstrlib.c
+ */
+
+const (
+	maxCaptures     = 32
+	capUnfinished   = -1
+	capPosition     = -2
+	patternSpecials = "^$*+?.([%-"
+)
+
+// strIndex 将 Lua 中的字符串下标（从 1 开始，负数表示从末尾开始）转换为从 0 开始的下标
+func strIndex(i int, length int) int {
+	if i < 0 {
+		i = length + i + 1
+	}
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+func openStringLib(L *State) {
+	lib := NewTable(0, 16)
+	register(lib, "len", func(L *State, args []Value) []Value {
+		return []Value{float64(len(L.checkString(args, 0, "len")))}
+	})
+	register(lib, "lower", func(L *State, args []Value) []Value {
+		return []Value{strings.ToLower(L.checkString(args, 0, "lower"))}
+	})
+	register(lib, "upper", func(L *State, args []Value) []Value {
+		return []Value{strings.ToUpper(L.checkString(args, 0, "upper"))}
+	})
+	register(lib, "rep", func(L *State, args []Value) []Value {
+		s := L.checkString(args, 0, "rep")
+		n := L.checkInt(args, 1, "rep")
+		if n <= 0 {
+			return []Value{""}
+		}
+		if len(s)*n > 512*1024*1024 {
+			L.RaiseError("resulting string too large")
+		}
+		return []Value{strings.Repeat(s, n)}
+	})
+	register(lib, "reverse", func(L *State, args []Value) []Value {
+		s := []byte(L.checkString(args, 0, "reverse"))
+		for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+			s[i], s[j] = s[j], s[i]
+		}
+		return []Value{string(s)}
+	})
+	register(lib, "sub", func(L *State, args []Value) []Value {
+		s := L.checkString(args, 0, "sub")
+		start := strIndex(L.optInt(args, 1, "sub", 1), len(s))
+		end := strIndex(L.optInt(args, 2, "sub", -1), len(s))
+		if start < 1 {
+			start = 1
+		}
+		if end > len(s) {
+			end = len(s)
+		}
+		if start > end {
+			return []Value{""}
+		}
+		return []Value{s[start-1 : end]}
+	})
+	register(lib, "byte", func(L *State, args []Value) []Value {
+		s := L.checkString(args, 0, "byte")
+		start := strIndex(L.optInt(args, 1, "byte", 1), len(s))
+		end := strIndex(L.optInt(args, 2, "byte", start), len(s))
+		if start < 1 {
+			start = 1
+		}
+		if end > len(s) {
+			end = len(s)
+		}
+		var rets []Value
+		for i := start; i <= end; i++ {
+			rets = append(rets, float64(s[i-1]))
+		}
+		return rets
+	})
+	register(lib, "char", func(L *State, args []Value) []Value {
+		buf := make([]byte, len(args))
+		for i := range args {
+			c := L.checkInt(args, i, "char")
+			if c < 0 || c > 255 {
+				L.argError(i, "char", "invalid value")
+			}
+			buf[i] = byte(c)
+		}
+		return []Value{string(buf)}
+	})
+	register(lib, "format", strFormat)
+	register(lib, "find", func(L *State, args []Value) []Value {
+		return strFindAux(L, args, true)
+	})
+	register(lib, "match", func(L *State, args []Value) []Value {
+		return strFindAux(L, args, false)
+	})
+	register(lib, "gmatch", strGmatch)
+	register(lib, "gsub", strGsub)
+	L.stringLib = lib
+	L.SetGlobal("string", lib)
+}
+
+type capture struct {
+	init   int
+	length int
+}
+
+type matchState struct {
+	L       *State
+	src     string
+	pat     string
+	level   int
+	capture [maxCaptures]capture
+}
+
+func (ms *matchState) classEnd(p int) int {
+	c := ms.pat[p]
+	p++
+	switch c {
+	case '%':
+		if p >= len(ms.pat) {
+			ms.L.RaiseError("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	case '[':
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		for {
+			if p >= len(ms.pat) {
+				ms.L.RaiseError("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' && p < len(ms.pat) {
+				p++
+			}
+			if p >= len(ms.pat) {
+				ms.L.RaiseError("malformed pattern (missing ']')")
+			}
+			if ms.pat[p] == ']' {
+				return p + 1
+			}
+		}
+	}
+	return p
+}
+
+func isAlpha(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isLower(c byte) bool { return c >= 'a' && c <= 'z' }
+func isUpper(c byte) bool { return c >= 'A' && c <= 'Z' }
+func isSpace(c byte) bool { return c == ' ' || c >= '\t' && c <= '\r' }
+func isCntrl(c byte) bool { return c < 0x20 || c == 0x7f }
+func isPunct(c byte) bool {
+	return c > 0x20 && c < 0x7f && !isAlpha(c) && !isDigit(c)
+}
+
+func matchClass(c byte, cl byte) bool {
+	var res bool
+	switch cl | 0x20 {
+	case 'a':
+		res = isAlpha(c)
+	case 'c':
+		res = isCntrl(c)
+	case 'd':
+		res = isDigit(c)
+	case 'l':
+		res = isLower(c)
+	case 'p':
+		res = isPunct(c)
+	case 's':
+		res = isSpace(c)
+	case 'u':
+		res = isUpper(c)
+	case 'w':
+		res = isAlpha(c) || isDigit(c)
+	case 'x':
+		res = isHexDigit(c)
+	case 'z':
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if isUpper(cl) {
+		return !res
+	}
+	return res
+}
+
+// matchBracketClass 判断 c 是否属于 [p, ec] 之间的字符集合，pat[p] 为 '['，pat[ec] 为 ']'
+func (ms *matchState) matchBracketClass(c byte, p int, ec int) bool {
+	sig := true
+	if ms.pat[p+1] == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		if ms.pat[p] == '%' {
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		} else if ms.pat[p+1] == '-' && p+2 < ec {
+			p += 2
+			if ms.pat[p-2] <= c && c <= ms.pat[p] {
+				return sig
+			}
+		} else if ms.pat[p] == c {
+			return sig
+		}
+	}
+	return !sig
+}
+
+func (ms *matchState) singleMatch(s int, p int, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+// match 从 src[s:] 开始匹配 pat[p:]，返回匹配结束的位置，不匹配时返回 -1
+func (ms *matchState) match(s int, p int) int {
+	for {
+		if p == len(ms.pat) {
+			return s
+		}
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			if p+1 < len(ms.pat) {
+				switch next := ms.pat[p+1]; {
+				case next == 'b':
+					s = ms.matchBalance(s, p+2)
+					if s == -1 {
+						return -1
+					}
+					p += 4
+					continue
+				case next == 'f':
+					p += 2
+					if p >= len(ms.pat) || ms.pat[p] != '[' {
+						ms.L.RaiseError("missing '[' after '%%f' in pattern")
+					}
+					ep := ms.classEnd(p)
+					var prev, cur byte
+					if s > 0 {
+						prev = ms.src[s-1]
+					}
+					if s < len(ms.src) {
+						cur = ms.src[s]
+					}
+					if !ms.matchBracketClass(prev, p, ep-1) && ms.matchBracketClass(cur, p, ep-1) {
+						p = ep
+						continue
+					}
+					return -1
+				case isDigit(next):
+					s = ms.matchCapture(s, next)
+					if s == -1 {
+						return -1
+					}
+					p += 2
+					continue
+				}
+			}
+		}
+		// 单个字符类，后面可能跟着重复修饰符
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		if ep < len(ms.pat) {
+			switch ms.pat[ep] {
+			case '?':
+				if m {
+					if r := ms.match(s+1, ep+1); r != -1 {
+						return r
+					}
+				}
+				p = ep + 1
+				continue
+			case '*':
+				return ms.maxExpand(s, p, ep)
+			case '+':
+				if m {
+					return ms.maxExpand(s+1, p, ep)
+				}
+				return -1
+			case '-':
+				return ms.minExpand(s, p, ep)
+			}
+		}
+		if !m {
+			return -1
+		}
+		s++
+		p = ep
+	}
+}
+
+func (ms *matchState) maxExpand(s int, p int, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if r := ms.match(s+i, ep+1); r != -1 {
+			return r
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) minExpand(s int, p int, ep int) int {
+	for {
+		if r := ms.match(s, ep+1); r != -1 {
+			return r
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *matchState) startCapture(s int, p int, what int) int {
+	if ms.level >= maxCaptures {
+		ms.L.RaiseError("too many captures")
+	}
+	ms.capture[ms.level] = capture{init: s, length: what}
+	ms.level++
+	r := ms.match(s, p)
+	if r == -1 {
+		ms.level--
+	}
+	return r
+}
+
+func (ms *matchState) endCapture(s int, p int) int {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].length == capUnfinished {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		ms.L.RaiseError("invalid pattern capture")
+	}
+	ms.capture[l].length = s - ms.capture[l].init
+	r := ms.match(s, p)
+	if r == -1 {
+		ms.capture[l].length = capUnfinished
+	}
+	return r
+}
+
+func (ms *matchState) matchBalance(s int, p int) int {
+	if p+1 >= len(ms.pat) {
+		ms.L.RaiseError("missing arguments to '%%b'")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for i := s + 1; i < len(ms.src); i++ {
+		if ms.src[i] == e {
+			cont--
+			if cont == 0 {
+				return i + 1
+			}
+		} else if ms.src[i] == b {
+			cont++
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) matchCapture(s int, l byte) int {
+	idx := int(l - '1')
+	if idx < 0 || idx >= ms.level || ms.capture[idx].length == capUnfinished {
+		ms.L.RaiseError("invalid capture index")
+	}
+	c := ms.capture[idx]
+	if len(ms.src)-s >= c.length && ms.src[c.init:c.init+c.length] == ms.src[s:s+c.length] {
+		return s + c.length
+	}
+	return -1
+}
+
+// getCapture 返回第 i 个捕获，没有捕获时第 0 个捕获为整个匹配
+func (ms *matchState) getCapture(i int, s int, e int) Value {
+	if i >= ms.level {
+		if i != 0 {
+			ms.L.RaiseError("invalid capture index")
+		}
+		return ms.src[s:e]
+	}
+	c := ms.capture[i]
+	if c.length == capUnfinished {
+		ms.L.RaiseError("unfinished capture")
+	}
+	if c.length == capPosition {
+		return float64(c.init + 1)
+	}
+	return ms.src[c.init : c.init+c.length]
+}
+
+func (ms *matchState) captures(s int, e int) []Value {
+	n := ms.level
+	if n == 0 {
+		n = 1
+	}
+	rets := make([]Value, n)
+	for i := range rets {
+		rets[i] = ms.getCapture(i, s, e)
+	}
+	return rets
+}
+
+func strFindAux(L *State, args []Value, find bool) []Value {
+	fname := "match"
+	if find {
+		fname = "find"
+	}
+	s := L.checkString(args, 0, fname)
+	pat := L.checkString(args, 1, fname)
+	init := strIndex(L.optInt(args, 2, fname, 1), len(s)) - 1
+	if init < 0 {
+		init = 0
+	} else if init > len(s) {
+		return []Value{nil}
+	}
+	if find && (Truthy(arg(args, 3)) || !strings.ContainsAny(pat, patternSpecials)) {
+		if i := strings.Index(s[init:], pat); i >= 0 {
+			return []Value{float64(init + i + 1), float64(init + i + len(pat))}
+		}
+		return []Value{nil}
+	}
+	ms := &matchState{L: L, src: s, pat: pat}
+	p := 0
+	anchor := len(pat) > 0 && pat[0] == '^'
+	if anchor {
+		p = 1
+	}
+	for s1 := init; ; s1++ {
+		ms.level = 0
+		if e := ms.match(s1, p); e != -1 {
+			if find {
+				rets := []Value{float64(s1 + 1), float64(e)}
+				if ms.level > 0 {
+					rets = append(rets, ms.captures(s1, e)...)
+				}
+				return rets
+			}
+			return ms.captures(s1, e)
+		}
+		if s1 >= len(s) || anchor {
+			break
+		}
+	}
+	return []Value{nil}
+}
+
+func strGmatch(L *State, args []Value) []Value {
+	s := L.checkString(args, 0, "gmatch")
+	pat := L.checkString(args, 1, "gmatch")
+	pos := 0
+	iter := &GoFunction{Name: "gmatch_iter", Fn: func(L *State, _ []Value) []Value {
+		ms := &matchState{L: L, src: s, pat: pat}
+		for ; pos <= len(s); pos++ {
+			ms.level = 0
+			if e := ms.match(pos, 0); e != -1 {
+				start := pos
+				pos = e
+				if e == start {
+					// 空匹配时向前移动一个字符，避免死循环
+					pos++
+				}
+				return ms.captures(start, e)
+			}
+		}
+		return []Value{nil}
+	}}
+	return []Value{iter}
+}
+
+func strGsub(L *State, args []Value) []Value {
+	src := L.checkString(args, 0, "gsub")
+	pat := L.checkString(args, 1, "gsub")
+	repl := arg(args, 2)
+	switch repl.(type) {
+	case string, float64, *Table, *Function, *GoFunction:
+	default:
+		L.argError(2, "gsub", "string/function/table expected")
+	}
+	maxN := L.optInt(args, 3, "gsub", len(src)+1)
+	ms := &matchState{L: L, src: src, pat: pat}
+	p := 0
+	anchor := len(pat) > 0 && pat[0] == '^'
+	if anchor {
+		p = 1
+	}
+	var sb strings.Builder
+	s, n := 0, 0
+	for n < maxN {
+		ms.level = 0
+		e := ms.match(s, p)
+		if e != -1 {
+			n++
+			ms.addValue(&sb, s, e, repl)
+		}
+		if e != -1 && e > s {
+			s = e
+		} else if s < len(src) {
+			sb.WriteByte(src[s])
+			s++
+		} else {
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	sb.WriteString(src[s:])
+	return []Value{sb.String(), float64(n)}
+}
+
+func (ms *matchState) addValue(sb *strings.Builder, s int, e int, repl Value) {
+	var result Value
+	switch r := repl.(type) {
+	case float64:
+		repl = NumberToString(r)
+		ms.addString(sb, s, e, repl.(string))
+		return
+	case string:
+		ms.addString(sb, s, e, r)
+		return
+	case *Table:
+		result = r.Get(ms.getCapture(0, s, e))
+	default:
+		rets := ms.L.Call(repl, ms.captures(s, e)...)
+		if len(rets) > 0 {
+			result = rets[0]
+		}
+	}
+	switch v := result.(type) {
+	case nil:
+		sb.WriteString(ms.src[s:e])
+	case bool:
+		if v {
+			ms.L.RaiseError("invalid replacement value (a boolean)")
+		}
+		sb.WriteString(ms.src[s:e])
+	case string:
+		sb.WriteString(v)
+	case float64:
+		sb.WriteString(NumberToString(v))
+	default:
+		ms.L.RaiseError("invalid replacement value (a %s)", TypeName(result))
+	}
+}
+
+func (ms *matchState) addString(sb *strings.Builder, s int, e int, repl string) {
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		if c != '%' || i+1 >= len(repl) {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		c = repl[i]
+		if !isDigit(c) {
+			sb.WriteByte(c)
+		} else if c == '0' {
+			sb.WriteString(ms.src[s:e])
+		} else {
+			sb.WriteString(ToString(ms.getCapture(int(c-'1'), s, e)))
+		}
+	}
+}
+
+// strFormat 实现 string.format，格式说明符与 C 的 printf 相同
+func strFormat(L *State, args []Value) []Value {
+	format := L.checkString(args, 0, "format")
+	var sb strings.Builder
+	argIndex := 1
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(format) {
+			L.RaiseError("invalid option '%%' to 'format'")
+		}
+		if format[i] == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		// 读取 flags、宽度和精度
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && isDigit(format[i]) {
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			for i < len(format) && isDigit(format[i]) {
+				i++
+			}
+		}
+		if i >= len(format) {
+			L.RaiseError("invalid option '%%' to 'format'")
+		}
+		spec := "%" + format[start:i]
+		if argIndex >= len(args) && format[i] != '%' {
+			L.argError(argIndex, "format", "no value")
+		}
+		switch verb := format[i]; verb {
+		case 'd', 'i':
+			sb.WriteString(fmt.Sprintf(spec+"d", int64(L.checkNumber(args, argIndex, "format"))))
+		case 'u':
+			sb.WriteString(fmt.Sprintf(spec+"d", uint64(L.checkNumber(args, argIndex, "format"))))
+		case 'c':
+			sb.WriteByte(byte(L.checkInt(args, argIndex, "format")))
+		case 'x', 'X', 'o':
+			sb.WriteString(fmt.Sprintf(spec+string(verb), uint64(int64(L.checkNumber(args, argIndex, "format")))))
+		case 'e', 'E', 'f', 'g', 'G':
+			sb.WriteString(fmt.Sprintf(spec+string(verb), L.checkNumber(args, argIndex, "format")))
+		case 'q':
+			sb.WriteString(quoteString(L.checkString(args, argIndex, "format")))
+		case 's':
+			sb.WriteString(fmt.Sprintf(spec+"s", ToString(args[argIndex])))
+		default:
+			L.RaiseError("invalid option '%%%c' to 'format'", verb)
+		}
+		argIndex++
+	}
+	return []Value{sb.String()}
+}
+
+// quoteString 返回 %q 格式的字符串，结果可以被 Lua 重新读取
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '\n':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\r':
+			sb.WriteString(`\r`)
+		case 0:
+			sb.WriteString(`\000`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,334 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Lua 的值在 Go 中的表示：
+ *   nil -> nil, boolean -> bool, number -> float64, string -> string,
+ *   table -> *Table, function -> *Function（Lua 函数）或 *GoFunction
+ */
+
+// Value 是任意一个 Lua 值
+type Value interface{}
+
+// GoFunction 是由 Go 实现、可以在 Lua 中调用的函数
+type GoFunction struct {
+	Name string
+	Fn   func(L *State, args []Value) []Value
+}
+
+// Function 是 Lua 函数（闭包）
+type Function struct {
+	proto *funcProto
+	scope *scope
+}
+
+// Table 是 Lua 的表，包括数组部分和哈希部分。
+// 哈希部分按照插入顺序保存 key，使 pairs/next 的遍历顺序是确定的
+type Table struct {
+	arr   []Value
+	index map[Value]int // key -> keys/vals 中的下标
+	keys  []Value
+	vals  []Value
+	holes int // 被置为 nil 但是还占据位置的 key 的数量
+}
+
+// NewTable 创建一个空表
+func NewTable(narr, nhash int) *Table {
+	t := &Table{}
+	if narr > 0 {
+		t.arr = make([]Value, 0, narr)
+	}
+	if nhash > 0 {
+		t.index = make(map[Value]int, nhash)
+	}
+	return t
+}
+
+// arrayIndex 返回可以作为数组下标的整数 key，其它 key 返回 0
+func arrayIndex(key Value) int {
+	f, ok := key.(float64)
+	if !ok || f < 1 || f > math.MaxInt32 || f != math.Floor(f) {
+		return 0
+	}
+	return int(f)
+}
+
+// Get 返回 key 对应的值，不存在时返回 nil
+func (t *Table) Get(key Value) Value {
+	if i := arrayIndex(key); i > 0 && i <= len(t.arr) {
+		return t.arr[i-1]
+	}
+	if t.index == nil || key == nil {
+		return nil
+	}
+	if pos, ok := t.index[key]; ok {
+		return t.vals[pos]
+	}
+	return nil
+}
+
+// Set 设置 key 对应的值，value 为 nil 表示删除。key 为 nil 或者 NaN 时返回错误
+func (t *Table) Set(key Value, value Value) error {
+	switch k := key.(type) {
+	case nil:
+		return fmt.Errorf("table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			return fmt.Errorf("table index is NaN")
+		}
+	}
+	if i := arrayIndex(key); i > 0 {
+		if i <= len(t.arr) {
+			t.arr[i-1] = value
+			if value == nil && i == len(t.arr) {
+				// 保证数组部分的最后一个元素不为 nil
+				for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+					t.arr = t.arr[:len(t.arr)-1]
+				}
+			}
+			return nil
+		}
+		if i == len(t.arr)+1 && value != nil {
+			t.removeHash(key)
+			t.arr = append(t.arr, value)
+			// 将哈希部分中紧随其后的整数 key 移动到数组部分
+			for {
+				next := float64(len(t.arr) + 1)
+				v := t.removeHash(next)
+				if v == nil {
+					break
+				}
+				t.arr = append(t.arr, v)
+			}
+			return nil
+		}
+	}
+	t.setHash(key, value)
+	return nil
+}
+
+func (t *Table) setHash(key Value, value Value) {
+	if t.index == nil {
+		if value == nil {
+			return
+		}
+		t.index = make(map[Value]int)
+	}
+	if pos, ok := t.index[key]; ok {
+		if t.vals[pos] == nil && value != nil {
+			t.holes--
+		} else if t.vals[pos] != nil && value == nil {
+			t.holes++
+		}
+		t.vals[pos] = value
+		return
+	}
+	if value == nil {
+		return
+	}
+	// 新增 key 时清理被删除的位置，遍历过程中只允许修改或者删除已有的 key，因此这里可以移动元素
+	if t.holes > 16 && t.holes > len(t.keys)/2 {
+		t.compact()
+	}
+	t.index[key] = len(t.keys)
+	t.keys = append(t.keys, key)
+	t.vals = append(t.vals, value)
+}
+
+func (t *Table) removeHash(key Value) Value {
+	if t.index == nil {
+		return nil
+	}
+	pos, ok := t.index[key]
+	if !ok || t.vals[pos] == nil {
+		return nil
+	}
+	v := t.vals[pos]
+	t.vals[pos] = nil
+	t.holes++
+	return v
+}
+
+func (t *Table) compact() {
+	keys := make([]Value, 0, len(t.keys)-t.holes)
+	vals := make([]Value, 0, len(t.keys)-t.holes)
+	t.index = make(map[Value]int, len(keys))
+	for i, k := range t.keys {
+		if t.vals[i] == nil {
+			continue
+		}
+		t.index[k] = len(keys)
+		keys = append(keys, k)
+		vals = append(vals, t.vals[i])
+	}
+	t.keys, t.vals, t.holes = keys, vals, 0
+}
+
+// Len 返回表的长度，即 # 运算符的结果
+func (t *Table) Len() int {
+	if len(t.arr) > 0 {
+		return len(t.arr)
+	}
+	// 数组部分为空时，整数 key 可能全部位于哈希部分（例如从后往前赋值）
+	n := 0
+	for t.Get(float64(n+1)) != nil {
+		n++
+	}
+	return n
+}
+
+// Append 在数组末尾追加一个值
+func (t *Table) Append(value Value) {
+	_ = t.Set(float64(t.Len()+1), value)
+}
+
+// Next 返回 key 之后的下一个键值对，key 为 nil 时从头开始，遍历结束时 ok 为 true 且 nextKey 为 nil；
+// key 不在表中时 ok 为 false
+func (t *Table) Next(key Value) (nextKey Value, nextValue Value, ok bool) {
+	start := 0 // 数组部分开始查找的下标
+	hashStart := 0
+	if key != nil {
+		if pos, found := t.index[key]; found {
+			start = len(t.arr)
+			hashStart = pos + 1
+		} else if i := arrayIndex(key); i > 0 {
+			// 遍历过程中数组末尾的元素被删除时，i 可能超过数组的长度
+			start = i
+		} else {
+			return nil, nil, false
+		}
+	}
+	for i := start; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	for i := hashStart; i < len(t.keys); i++ {
+		if t.vals[i] != nil {
+			return t.keys[i], t.vals[i], true
+		}
+	}
+	return nil, nil, true
+}
+
+// TypeName 返回 Lua 中 type() 的结果
+func TypeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Function, *GoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+// Truthy 判断值在条件表达式中是否为真，只有 nil 和 false 为假
+func Truthy(v Value) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	}
+	return true
+}
+
+// NumberToString 按照 Lua 的 %.14g 格式化数字
+func NumberToString(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 14, 64)
+}
+
+// ToString 返回 tostring() 的结果
+func ToString(v Value) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if x {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return NumberToString(x)
+	case string:
+		return x
+	case *Table:
+		return fmt.Sprintf("table: %p", x)
+	case *Function:
+		return fmt.Sprintf("function: %p", x)
+	case *GoFunction:
+		return fmt.Sprintf("function: builtin: %p", x)
+	}
+	return fmt.Sprintf("userdata: %v", v)
+}
+
+// ToNumber 按照 Lua 的规则将 number 或者数字字符串转换为 number
+func ToNumber(v Value) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		return parseNumber(x)
+	}
+	return 0, false
+}
+
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	neg := false
+	body := s
+	if body[0] == '-' || body[0] == '+' {
+		neg = body[0] == '-'
+		body = body[1:]
+	}
+	if len(body) > 2 && body[0] == '0' && (body[1] == 'x' || body[1] == 'X') {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	// Lua 不接受 inf、nan 等 Go 能够解析的写法
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if !(c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-') {
+			return 0, false
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
@@ -15,3 +15,30 @@ func (b *Boolean) Set(v bool) {
 		atomic.StoreUint32((*uint32)(b), 0)
 	}
 }
+
+// CompareAndSwap 在当前值等于 old 时将其设置为 new，返回是否设置成功
+func (b *Boolean) CompareAndSwap(old, new bool) bool {
+	var o, n uint32
+	if old {
+		o = 1
+	}
+	if new {
+		n = 1
+	}
+	return atomic.CompareAndSwapUint32((*uint32)(b), o, n)
+}
+
+type Int64 int64
+
+func (i *Int64) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+func (i *Int64) Set(v int64) {
+	atomic.StoreInt64((*int64)(i), v)
+}
+
+// Add 增加 delta，返回增加之后的值
+func (i *Int64) Add(delta int64) int64 {
+	return atomic.AddInt64((*int64)(i), delta)
+}
@@ -0,0 +1,147 @@
+package wildcard
+
+import "errors"
+
+/*
+ * 实现 redis 风格的 glob 匹配，支持：
+ *  *     匹配任意长度的任意字符
+ *  ?     匹配一个任意字符
+ *  [abc] 匹配括号中的任意一个字符，[a-z] 匹配范围内的字符，[^a-z0-9] 匹配不在整个集合中的字符
+ *  \x    匹配字符 x 本身
+ */
+
+const (
+	normal    = iota
+	all       // *
+	anySymbol // ?
+	setSymbol // [abc]、[a-z]、[^a-z]
+)
+
+type item struct {
+	character byte
+	ranges    [][2]byte // 字符集合中的范围，单个字符表示为起止相同的范围
+	negate    bool      // [^...] 匹配不在集合中的字符
+	typeCode  int
+}
+
+func (i *item) contains(c byte) bool {
+	in := false
+	for _, r := range i.ranges {
+		if c >= r[0] && c <= r[1] {
+			in = true
+			break
+		}
+	}
+	return in != i.negate
+}
+
+// Pattern represents a wildcard pattern
+type Pattern struct {
+	items []*item
+}
+
+// CompilePattern convert wildcard string to Pattern
+func CompilePattern(src string) (*Pattern, error) {
+	items := make([]*item, 0)
+	for i := 0; i < len(src); i++ {
+		v := src[i]
+		switch v {
+		case '\\':
+			if i+1 >= len(src) {
+				return nil, errors.New("illegal wildcard")
+			}
+			i++
+			items = append(items, &item{typeCode: normal, character: src[i]})
+		case '*':
+			items = append(items, &item{typeCode: all})
+		case '?':
+			items = append(items, &item{typeCode: anySymbol})
+		case '[':
+			set, next, err := compileSet(src, i+1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, set)
+			i = next
+		default:
+			items = append(items, &item{typeCode: normal, character: v})
+		}
+	}
+	return &Pattern{
+		items: items,
+	}, nil
+}
+
+// compileSet 解析从 src[start] 开始的字符集合，返回集合和结尾的 ] 的位置。
+// 和 redis 一样，开头的 ^ 表示取反，a-z 表示范围（起止颠倒时交换），\x 表示字符 x 本身
+func compileSet(src string, start int) (*item, int, error) {
+	set := &item{typeCode: setSymbol}
+	i := start
+	if i < len(src) && src[i] == '^' {
+		set.negate = true
+		i++
+	}
+	for ; i < len(src); i++ {
+		c := src[i]
+		if c == ']' {
+			return set, i, nil
+		}
+		if c == '\\' {
+			if i+1 >= len(src) {
+				break
+			}
+			i++
+			c = src[i]
+		} else if i+2 < len(src) && src[i+1] == '-' && src[i+2] != ']' {
+			from, to := c, src[i+2]
+			i += 2
+			if to == '\\' {
+				if i+1 >= len(src) {
+					break
+				}
+				i++
+				to = src[i]
+			}
+			if from > to {
+				from, to = to, from
+			}
+			set.ranges = append(set.ranges, [2]byte{from, to})
+			continue
+		}
+		set.ranges = append(set.ranges, [2]byte{c, c})
+	}
+	return nil, 0, errors.New("illegal wildcard")
+}
+
+// IsMatch returns whether the given string matches pattern
+func (p *Pattern) IsMatch(s string) bool {
+	if len(p.items) == 0 {
+		return len(s) == 0
+	}
+	m := len(s)
+	n := len(p.items)
+	// table[i][j] 表示 s[:i] 与 items[:j] 是否匹配
+	table := make([][]bool, m+1)
+	for i := 0; i < m+1; i++ {
+		table[i] = make([]bool, n+1)
+	}
+	table[0][0] = true
+	for j := 1; j < n+1; j++ {
+		table[0][j] = table[0][j-1] && p.items[j-1].typeCode == all
+	}
+	for i := 1; i < m+1; i++ {
+		for j := 1; j < n+1; j++ {
+			switch p.items[j-1].typeCode {
+			case all:
+				table[i][j] = table[i-1][j] || table[i][j-1]
+			case anySymbol:
+				table[i][j] = table[i-1][j-1]
+			case normal:
+				table[i][j] = table[i-1][j-1] && s[i-1] == p.items[j-1].character
+			default:
+				table[i][j] = table[i-1][j-1] && p.items[j-1].contains(s[i-1])
+			}
+		}
+	}
+	return table[m][n]
+}
@@ -0,0 +1,192 @@
+// Package example 是一个示例模块，提供 counter 数据类型：每个 key 保存一组 item 到整数计数的映射。
+// 在 main 包中匿名导入该包即可启用，参见 module_example.go
+package example
+
+import (
+	"encoding/binary"
+	"errors"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/utils"
+	"miniRedis/module"
+	"miniRedis/redis/protocol"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Counter 是 counter 类型的值，只在持有 key 锁时访问
+type Counter struct {
+	items map[string]int64
+}
+
+var errBadPayload = errors.New("bad counter payload")
+
+// events 记录收到的 keyspace 事件数量，用于演示事件订阅
+var events int64
+
+func getCounter(db *module.DB, key string, create bool) (*Counter, redis.Reply) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		counter := &Counter{items: make(map[string]int64)}
+		db.PutEntity(key, &module.DataEntity{Data: counter})
+		return counter, nil
+	}
+	counter, ok := entity.Data.(*Counter)
+	if !ok {
+		return nil, &protocol.WrongTypeErrReply{}
+	}
+	return counter, nil
+}
+
+// execIncrBy CNT.INCRBY key item increment [item increment ...]
+// 返回每个 item 增加之后的值
+func execIncrBy(db *module.DB, args [][]byte) redis.Reply {
+	if len(args)%2 != 1 {
+		return protocol.MakeArgNumErrReply("cnt.incrby")
+	}
+	deltas := make([]int64, 0, len(args)/2)
+	for i := 2; i < len(args); i += 2 {
+		delta, err := strconv.ParseInt(string(args[i]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		deltas = append(deltas, delta)
+	}
+	counter, errReply := getCounter(db, string(args[0]), true)
+	if errReply != nil {
+		return errReply
+	}
+	replies := make([]redis.Reply, len(deltas))
+	for i, delta := range deltas {
+		item := string(args[1+i*2])
+		counter.items[item] += delta
+		replies[i] = protocol.MakeIntReply(counter.items[item])
+	}
+	db.AddAof(utils.ToCmdLine3("cnt.incrby", args...))
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// execGet CNT.GET key item，不存在的 item 返回 0
+func execGet(db *module.DB, args [][]byte) redis.Reply {
+	counter, errReply := getCounter(db, string(args[0]), false)
+	if errReply != nil {
+		return errReply
+	}
+	if counter == nil {
+		return protocol.MakeIntReply(0)
+	}
+	return protocol.MakeIntReply(counter.items[string(args[1])])
+}
+
+// execLen CNT.LEN key
+func execLen(db *module.DB, args [][]byte) redis.Reply {
+	counter, errReply := getCounter(db, string(args[0]), false)
+	if errReply != nil {
+		return errReply
+	}
+	if counter == nil {
+		return protocol.MakeIntReply(0)
+	}
+	return protocol.MakeIntReply(int64(len(counter.items)))
+}
+
+// execEvents CNT.EVENTS 返回模块收到的 keyspace 事件数量
+func execEvents(db *module.DB, args [][]byte) redis.Reply {
+	return protocol.MakeIntReply(atomic.LoadInt64(&events))
+}
+
+func sortedItems(counter *Counter) []string {
+	items := make([]string, 0, len(counter.items))
+	for item := range counter.items {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items
+}
+
+func counterToCmd(key string, data interface{}) module.CmdLine {
+	counter := data.(*Counter)
+	cmdLine := module.CmdLine{[]byte("CNT.INCRBY"), []byte(key)}
+	for _, item := range sortedItems(counter) {
+		cmdLine = append(cmdLine, []byte(item), []byte(strconv.FormatInt(counter.items[item], 10)))
+	}
+	return cmdLine
+}
+
+// marshalCounter 的格式为 item 数量，之后是每个 item 的 长度 + 内容 + 计数，均使用 varint 编码
+func marshalCounter(data interface{}) []byte {
+	counter := data.(*Counter)
+	buf := appendUvarint(nil, uint64(len(counter.items)))
+	for _, item := range sortedItems(counter) {
+		buf = appendUvarint(buf, uint64(len(item)))
+		buf = append(buf, item...)
+		buf = appendVarint(buf, counter.items[item])
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], n)]...)
+}
+
+func appendVarint(buf []byte, n int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], n)]...)
+}
+
+func unmarshalCounter(payload []byte) (interface{}, error) {
+	n, size := binary.Uvarint(payload)
+	if size <= 0 || n > uint64(len(payload)) {
+		return nil, errBadPayload
+	}
+	payload = payload[size:]
+	counter := &Counter{items: make(map[string]int64, n)}
+	for i := uint64(0); i < n; i++ {
+		itemLen, size := binary.Uvarint(payload)
+		if size <= 0 || itemLen > uint64(len(payload)-size) {
+			return nil, errBadPayload
+		}
+		item := string(payload[size : size+int(itemLen)])
+		payload = payload[size+int(itemLen):]
+		value, size := binary.Varint(payload)
+		if size <= 0 {
+			return nil, errBadPayload
+		}
+		payload = payload[size:]
+		counter.items[item] = value
+	}
+	if len(payload) > 0 {
+		return nil, errBadPayload
+	}
+	return counter, nil
+}
+
+func init() {
+	module.Register(&module.Module{
+		Name:    "counter",
+		Version: 1,
+		Commands: []*module.Command{
+			{Name: "cnt.incrby", Executor: execIncrBy, Arity: -4, FirstKey: 1, LastKey: 1, Flags: []string{"denyoom"}},
+			{Name: "cnt.get", Executor: execGet, Arity: 3, ReadOnly: true, FirstKey: 1, LastKey: 1, Flags: []string{"fast"}},
+			{Name: "cnt.len", Executor: execLen, Arity: 2, ReadOnly: true, FirstKey: 1, LastKey: 1, Flags: []string{"fast"}},
+			{Name: "cnt.events", Executor: execEvents, Arity: 1, ReadOnly: true, Flags: []string{"fast"}},
+		},
+		Types: []*module.DataType{{
+			Name: "counter",
+			Match: func(data interface{}) bool {
+				_, ok := data.(*Counter)
+				return ok
+			},
+			ToCmd:     counterToCmd,
+			Marshal:   marshalCounter,
+			Unmarshal: unmarshalCounter,
+		}},
+		OnKeyspaceEvent: func(event *module.KeyspaceEvent) {
+			atomic.AddInt64(&events, 1)
+		},
+	})
+}
@@ -0,0 +1,63 @@
+// Package module 是编写 miniRedis 模块的公开接口。
+//
+// 模块是一个普通的 Go 包，在 init 中调用 Register 注册命令、数据类型和 keyspace 事件的回调。
+// 由于 Go plugin 对编译环境要求苛刻，模块在编译时链接：在 main 包中以匿名导入的方式引入模块，
+// 通常放在带有 build tag 的单独文件中，例如 module_example.go 在使用 -tags module_example 编译时链接示例模块。
+package module
+
+import (
+	"fmt"
+	"miniRedis/aof"
+	database2 "miniRedis/database"
+	"miniRedis/interface/database"
+)
+
+type (
+	// DB 是命令执行时所在的数据库，通过 GetEntity、PutEntity 等方法读写数据，通过 AddAof 持久化修改
+	DB = database2.DB
+	// CmdLine 表示一条命令，包括命令名
+	CmdLine = database2.CmdLine
+	// ExecFunc 执行命令，args 不包括命令名
+	ExecFunc = database2.ExecFunc
+	// PreFunc 返回命令写入和读取的 key，args 不包括命令名
+	PreFunc = database2.PreFunc
+	// UndoFunc 返回事务回滚时撤销命令的命令
+	UndoFunc = database2.UndoFunc
+	// Command 描述模块提供的命令
+	Command = database2.ModuleCommand
+	// DataType 描述模块提供的数据类型以及它的 AOF 和 DUMP/RDB 序列化方式
+	DataType = aof.DataType
+	// DataEntity 是 key 对应的值，Data 字段保存具体的数据结构
+	DataEntity = database.DataEntity
+	// KeyspaceEvent 表示一次对 key 的修改
+	KeyspaceEvent = database2.KeyspaceEvent
+)
+
+// Module 描述一个模块
+type Module struct {
+	Name     string
+	Version  int
+	Commands []*Command
+	Types    []*DataType
+	// OnKeyspaceEvent 在写命令执行成功或者 key 过期后被同步调用，调用时持有 key 的锁，不能再访问数据库
+	OnKeyspaceEvent func(event *KeyspaceEvent)
+}
+
+// Register 注册模块，需要在模块包的 init 中调用。
+// 与 database/sql.Register 一样，名字冲突等错误属于编程错误，会直接 panic
+func Register(m *Module) {
+	if m == nil {
+		panic("module: Register module is nil")
+	}
+	for _, t := range m.Types {
+		if err := aof.RegisterDataType(t); err != nil {
+			panic(fmt.Sprintf("module: register %s: %v", m.Name, err))
+		}
+	}
+	if err := database2.LoadModule(m.Name, m.Version, m.Commands); err != nil {
+		panic(fmt.Sprintf("module: register %s: %v", m.Name, err))
+	}
+	if m.OnKeyspaceEvent != nil {
+		database2.SubscribeKeyspaceEvents(m.OnKeyspaceEvent)
+	}
+}
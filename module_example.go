@@ -0,0 +1,7 @@
+//go:build module_example
+// +build module_example
+
+package main
+
+// 使用 go build -tags module_example 编译时链接示例模块
+import _ "miniRedis/module/example"
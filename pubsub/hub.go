@@ -20,3 +20,8 @@ func MakeHub() *Hub {
 		subsLocker: lock.Make(16),
 	}
 }
+
+// ChannelCount returns the number of channels which have at least one subscriber
+func (hub *Hub) ChannelCount() int {
+	return hub.subs.Len()
+}
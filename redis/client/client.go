@@ -0,0 +1,320 @@
+package client
+
+import (
+	"errors"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/logger"
+	"miniRedis/lib/sync/wait"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/parser"
+	"miniRedis/redis/protocol"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Client 是一个管道（pipeline）模式的 redis 客户端：
+ * 发送协程不断地将请求写入连接，读取协程按照发送的顺序将回复与请求对应起来，
+ * 因此多个协程可以同时通过一个 Client 发送命令而不需要等待上一个命令的回复
+ */
+
+const (
+	created = iota
+	running
+	closed
+)
+
+const (
+	chanSize          = 256
+	heartbeatInterval = 10 * time.Second
+	reconnectTimes    = 3
+)
+
+// DefaultTimeout 是 Send 和 Pipeline 等待回复的时间，阻塞命令需要使用 SendWithTimeout 指定更长的时间
+const DefaultTimeout = 3 * time.Second
+
+// ErrClosed 表示客户端已经关闭
+var ErrClosed = errors.New("client closed")
+
+// Client is a pipeline mode redis client
+type Client struct {
+	addr        string
+	conn        net.Conn
+	connMu      sync.Mutex    // 保护 conn，重连时会替换 conn
+	pendingReqs chan *request // wait to send
+	waitingReqs chan *request // waiting response
+	// waitingSlots 表示 waitingReqs 中已经被占用的位置，发送协程在加 connMu 之前获取位置，
+	// 保证持有 connMu 时放入 waitingReqs 不会阻塞，否则重连时无法获取 connMu 清空 waitingReqs
+	waitingSlots chan struct{}
+	ticker       *time.Ticker
+	status       int32
+	working      *sync.WaitGroup // its counter presents unfinished requests(pending and waiting)
+	done         chan struct{}
+	closeMu      sync.RWMutex // 保证关闭 pendingReqs 之后不会再有请求放入
+}
+
+// request is a message sends to redis server
+type request struct {
+	args      [][]byte
+	timeout   time.Duration // 等待回复的时间，不大于 0 时一直等待
+	reply     redis.Reply
+	heartbeat bool
+	waiting   *wait.Wait
+	err       error
+}
+
+// MakeClient creates a new client, call Start before use it
+func MakeClient(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		addr:         addr,
+		conn:         conn,
+		pendingReqs:  make(chan *request, chanSize),
+		waitingReqs:  make(chan *request, chanSize),
+		waitingSlots: make(chan struct{}, chanSize),
+		working:      &sync.WaitGroup{},
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// Start starts asynchronous goroutines
+func (client *Client) Start() {
+	client.ticker = time.NewTicker(heartbeatInterval)
+	atomic.StoreInt32(&client.status, running)
+	go client.handleWrite()
+	go client.handleRead(client.getConn())
+	go client.heartbeat()
+}
+
+// Close stops asynchronous goroutines and close connection
+func (client *Client) Close() {
+	client.closeMu.Lock()
+	if atomic.LoadInt32(&client.status) == closed {
+		client.closeMu.Unlock()
+		return
+	}
+	atomic.StoreInt32(&client.status, closed)
+	if client.ticker != nil {
+		client.ticker.Stop()
+	}
+	// stop new request
+	close(client.pendingReqs)
+	client.closeMu.Unlock()
+
+	// wait stop process
+	client.working.Wait()
+
+	// clean
+	close(client.done)
+	_ = client.getConn().Close()
+	close(client.waitingReqs)
+}
+
+// Addr returns the address of the server
+func (client *Client) Addr() string {
+	return client.addr
+}
+
+// IsClosed returns whether the client has been closed, a client is closed when it can't reconnect to the server
+func (client *Client) IsClosed() bool {
+	return atomic.LoadInt32(&client.status) == closed
+}
+
+func (client *Client) getConn() net.Conn {
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+	return client.conn
+}
+
+// Send sends a request to redis server and waits for its reply at most DefaultTimeout
+func (client *Client) Send(args [][]byte) redis.Reply {
+	return client.SendWithTimeout(args, DefaultTimeout)
+}
+
+// SendWithTimeout sends a request and waits for its reply at most timeout, timeout <= 0 means waiting until the reply arrives.
+// 用于 BLPOP、LOCK ... WAIT 等可能阻塞很久的命令
+func (client *Client) SendWithTimeout(args [][]byte, timeout time.Duration) redis.Reply {
+	req := client.enqueue(args, false, timeout)
+	if req == nil {
+		return protocol.MakeErrReply("ERR " + ErrClosed.Error())
+	}
+	return client.await(req)
+}
+
+// Pipeline sends all the requests without waiting for replies, and returns replies in the same order
+func (client *Client) Pipeline(cmdLines [][][]byte) []redis.Reply {
+	reqs := make([]*request, len(cmdLines))
+	for i, args := range cmdLines {
+		reqs[i] = client.enqueue(args, false, DefaultTimeout)
+	}
+	replies := make([]redis.Reply, len(cmdLines))
+	for i, req := range reqs {
+		if req == nil {
+			replies[i] = protocol.MakeErrReply("ERR " + ErrClosed.Error())
+			continue
+		}
+		replies[i] = client.await(req)
+	}
+	return replies
+}
+
+// enqueue 将请求放入发送队列，客户端已经关闭时返回 nil
+func (client *Client) enqueue(args [][]byte, heartbeat bool, timeout time.Duration) *request {
+	client.closeMu.RLock()
+	defer client.closeMu.RUnlock()
+	if atomic.LoadInt32(&client.status) != running {
+		return nil
+	}
+	req := &request{
+		args:      args,
+		timeout:   timeout,
+		heartbeat: heartbeat,
+		waiting:   &wait.Wait{},
+	}
+	req.waiting.Add(1)
+	client.working.Add(1)
+	client.pendingReqs <- req
+	return req
+}
+
+func (client *Client) await(req *request) redis.Reply {
+	defer client.working.Done()
+	if req.timeout <= 0 {
+		req.waiting.Wait()
+	} else if req.waiting.WaitWithTimeout(req.timeout) {
+		return protocol.MakeErrReply("server time out")
+	}
+	if req.err != nil {
+		return protocol.MakeErrReply("request failed " + req.err.Error())
+	}
+	return req.reply
+}
+
+func (client *Client) heartbeat() {
+	for {
+		select {
+		case <-client.ticker.C:
+			req := client.enqueue(utils.ToCmdLine("PING"), true, DefaultTimeout)
+			if req != nil {
+				client.await(req)
+			}
+		case <-client.done:
+			return
+		}
+	}
+}
+
+func (client *Client) handleWrite() {
+	for req := range client.pendingReqs {
+		client.doRequest(req)
+	}
+}
+
+func (client *Client) doRequest(req *request) {
+	if req == nil || len(req.args) == 0 {
+		return
+	}
+	re := protocol.MakeMultiBulkReply(req.args)
+	bytes := re.ToBytes()
+	// 放入等待队列和写入连接需要在同一把锁中完成，避免重连时请求与回复错位。
+	// 先在锁外等待队列中的空位，只有发送协程放入 waitingReqs，所以加锁之后放入不会阻塞
+	client.waitingSlots <- struct{}{}
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+	client.waitingReqs <- req
+	var err error
+	for i := 0; i < reconnectTimes; i++ { // only retry, waiting for handleRead
+		_, err = client.conn.Write(bytes)
+		if err == nil || !isTimeoutErr(err) { // only retry timeout
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		// 连接已经断开，读取协程会在重连时让等待中的请求失败
+		logger.Warn("client write failed: " + err.Error())
+	}
+}
+
+func (client *Client) finishRequest(reply redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error(err)
+		}
+	}()
+	request := <-client.waitingReqs
+	if request == nil {
+		return
+	}
+	<-client.waitingSlots
+	request.reply = reply
+	if request.waiting != nil {
+		request.waiting.Done()
+	}
+}
+
+func (client *Client) handleRead(conn net.Conn) {
+	ch := parser.ParseStream(conn)
+	for payload := range ch {
+		if payload.Err != nil {
+			status := atomic.LoadInt32(&client.status)
+			if status == closed {
+				return
+			}
+			client.reconnect()
+			return
+		}
+		client.finishRequest(payload.Data)
+	}
+}
+
+// reconnect 重新建立连接，正在等待回复的请求都会失败；多次重连失败后关闭客户端
+func (client *Client) reconnect() {
+	logger.Info("reconnect with: " + client.addr)
+	_ = client.getConn().Close() // ignore possible errors from repeated closes
+
+	var conn net.Conn
+	for i := 0; i < reconnectTimes; i++ {
+		var err error
+		conn, err = net.Dial("tcp", client.addr)
+		if err != nil {
+			logger.Error("reconnect error: " + err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		break
+	}
+
+	client.connMu.Lock()
+	// 连接断开前已经发送的请求不会再收到回复
+	for {
+		select {
+		case req := <-client.waitingReqs:
+			<-client.waitingSlots
+			req.err = errors.New("connection closed")
+			req.waiting.Done()
+			continue
+		default:
+		}
+		break
+	}
+	if conn == nil { // reach max retry, abort
+		client.connMu.Unlock()
+		go client.Close()
+		return
+	}
+	client.conn = conn
+	client.connMu.Unlock()
+	// restart handle read
+	go client.handleRead(conn)
+}
+
+func isTimeoutErr(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"errors"
+	"miniRedis/interface/redis"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * ClusterClient 根据 key 所在的槽位将命令发送到对应的节点。
+ * 槽位与节点的对应关系从节点返回的 MOVED 错误中学习，ASK 错误只对当前命令生效，不会更新对应关系
+ */
+
+const (
+	// SlotCount 是集群中槽位的数量
+	SlotCount    = 16384
+	maxRedirects = 5
+)
+
+// ClusterClient is a client aware of MOVED and ASK redirections
+type ClusterClient struct {
+	seeds  []string
+	config PoolConfig
+	pools  map[string]*Pool
+	slots  map[uint16]string // slot -> addr
+	mu     sync.RWMutex
+}
+
+// MakeClusterClient creates a cluster client, commands whose slot is unknown are sent to the seed nodes
+func MakeClusterClient(seeds []string, config PoolConfig) (*ClusterClient, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no seed node")
+	}
+	return &ClusterClient{
+		seeds:  seeds,
+		config: config,
+		pools:  make(map[string]*Pool),
+		slots:  make(map[uint16]string),
+	}, nil
+}
+
+// Slot returns the slot of the key, only the hash tag in {} is hashed if it exists
+func Slot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(key) % SlotCount
+}
+
+// crc16 使用 CRC16-CCITT (XMODEM) 算法，与 redis cluster 一致
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (cluster *ClusterClient) getPool(addr string) *Pool {
+	cluster.mu.RLock()
+	pool, ok := cluster.pools[addr]
+	cluster.mu.RUnlock()
+	if ok {
+		return pool
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if pool, ok = cluster.pools[addr]; ok {
+		return pool
+	}
+	pool = MakePool(addr, cluster.config)
+	cluster.pools[addr] = pool
+	return pool
+}
+
+// pickNode 返回命令应该发往的节点，没有 key 或者槽位未知时使用种子节点
+func (cluster *ClusterClient) pickNode(args [][]byte) string {
+	if len(args) >= 2 {
+		cluster.mu.RLock()
+		addr, ok := cluster.slots[Slot(string(args[1]))]
+		cluster.mu.RUnlock()
+		if ok {
+			return addr
+		}
+	}
+	return cluster.seeds[0]
+}
+
+// Send sends the command to the node owning the first key, and follows MOVED/ASK redirections
+func (cluster *ClusterClient) Send(args [][]byte) redis.Reply {
+	addr := cluster.pickNode(args)
+	asking := false
+	var reply redis.Reply
+	for i := 0; i <= maxRedirects; i++ {
+		pool := cluster.getPool(addr)
+		if asking {
+			reply = pool.Pipeline([][][]byte{utils.ToCmdLine("ASKING"), args})[1]
+		} else {
+			reply = pool.Send(args)
+		}
+		errReply, ok := reply.(protocol.ErrorReply)
+		if !ok {
+			return reply
+		}
+		kind, slot, target, ok := parseRedirect(errReply.Error())
+		if !ok {
+			return reply
+		}
+		if kind == "MOVED" {
+			cluster.mu.Lock()
+			cluster.slots[slot] = target
+			cluster.mu.Unlock()
+		}
+		asking = kind == "ASK"
+		addr = target
+	}
+	return protocol.MakeErrReply("ERR too many cluster redirections")
+}
+
+// parseRedirect 解析 "MOVED <slot> <addr>" 或 "ASK <slot> <addr>" 错误
+func parseRedirect(msg string) (kind string, slot uint16, addr string, ok bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	n, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil || n >= SlotCount {
+		return "", 0, "", false
+	}
+	return fields[0], uint16(n), fields[2], true
+}
+
+// Close closes the connection pools of all nodes
+func (cluster *ClusterClient) Close() {
+	cluster.mu.Lock()
+	pools := cluster.pools
+	cluster.pools = make(map[string]*Pool)
+	cluster.mu.Unlock()
+	for _, pool := range pools {
+		pool.Close()
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"miniRedis/interface/redis"
+	"miniRedis/redis/protocol"
+	"sync"
+	"time"
+)
+
+// PoolConfig 连接池的配置
+type PoolConfig struct {
+	MaxIdle   int // 最多保留的空闲连接数
+	MaxActive int // 最多同时存在的连接数，小于等于 0 表示不限制
+}
+
+// Pool 是连接到同一个地址的客户端连接池
+// 由于 Client 本身支持多个协程并发地发送命令，连接池主要用于分摊单个连接的吞吐压力以及隔离 MULTI 等有状态的命令
+type Pool struct {
+	addr   string
+	config PoolConfig
+	idles  []*Client
+	active int // 已经创建且没有关闭的连接数，包括空闲的连接
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+// MakePool creates a connection pool for the given address
+func MakePool(addr string, config PoolConfig) *Pool {
+	pool := &Pool{
+		addr:   addr,
+		config: config,
+	}
+	pool.cond = sync.NewCond(&pool.mu)
+	return pool
+}
+
+// Get returns an idle client or creates a new one, it blocks when the number of clients reaches MaxActive
+func (pool *Pool) Get() (*Client, error) {
+	pool.mu.Lock()
+	for {
+		if pool.closed {
+			pool.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if n := len(pool.idles); n > 0 {
+			c := pool.idles[n-1]
+			pool.idles = pool.idles[:n-1]
+			if c.IsClosed() {
+				// 空闲期间重连失败的连接直接丢弃
+				pool.active--
+				continue
+			}
+			pool.mu.Unlock()
+			return c, nil
+		}
+		if pool.config.MaxActive <= 0 || pool.active < pool.config.MaxActive {
+			break
+		}
+		pool.cond.Wait()
+	}
+	pool.active++
+	pool.mu.Unlock()
+
+	c, err := MakeClient(pool.addr)
+	if err != nil {
+		pool.mu.Lock()
+		pool.active--
+		pool.cond.Signal()
+		pool.mu.Unlock()
+		return nil, err
+	}
+	c.Start()
+	return c, nil
+}
+
+// Put returns the client to the pool
+func (pool *Pool) Put(c *Client) {
+	pool.mu.Lock()
+	if pool.closed || c.IsClosed() || len(pool.idles) >= pool.config.MaxIdle {
+		pool.active--
+		pool.cond.Signal()
+		pool.mu.Unlock()
+		c.Close()
+		return
+	}
+	pool.idles = append(pool.idles, c)
+	pool.cond.Signal()
+	pool.mu.Unlock()
+}
+
+// Send gets a client from the pool, sends the request and puts the client back
+func (pool *Pool) Send(args [][]byte) redis.Reply {
+	c, err := pool.Get()
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	defer pool.Put(c)
+	return c.Send(args)
+}
+
+// SendWithTimeout is like Send but waits for the reply at most timeout, timeout <= 0 means no limit
+func (pool *Pool) SendWithTimeout(args [][]byte, timeout time.Duration) redis.Reply {
+	c, err := pool.Get()
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	defer pool.Put(c)
+	return c.SendWithTimeout(args, timeout)
+}
+
+// Pipeline sends requests through one client of the pool, and returns replies in the same order
+func (pool *Pool) Pipeline(cmdLines [][][]byte) []redis.Reply {
+	c, err := pool.Get()
+	if err != nil {
+		replies := make([]redis.Reply, len(cmdLines))
+		for i := range replies {
+			replies[i] = protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return replies
+	}
+	defer pool.Put(c)
+	return c.Pipeline(cmdLines)
+}
+
+// Close closes all idle clients, clients in use will be closed when they are put back
+func (pool *Pool) Close() {
+	pool.mu.Lock()
+	pool.closed = true
+	idles := pool.idles
+	pool.idles = nil
+	pool.active -= len(idles)
+	pool.cond.Broadcast()
+	pool.mu.Unlock()
+	for _, c := range idles {
+		c.Close()
+	}
+}
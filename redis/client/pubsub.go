@@ -0,0 +1,178 @@
+package client
+
+import (
+	"errors"
+	"miniRedis/lib/logger"
+	"miniRedis/lib/utils"
+	"miniRedis/redis/parser"
+	"miniRedis/redis/protocol"
+	"net"
+	"sync"
+	"time"
+)
+
+// Message 是从订阅的频道收到的一条消息
+type Message struct {
+	Channel string
+	Payload []byte
+}
+
+// PubSub 使用一个独立的连接订阅频道，连接断开后会自动重连并重新订阅
+// 订阅状态下连接只能执行 (UN)SUBSCRIBE 等命令，所以不与 Client 共用连接
+type PubSub struct {
+	addr     string
+	conn     net.Conn
+	channels map[string]struct{}
+	ch       chan *Message
+	closed   bool
+	mu       sync.Mutex
+}
+
+// Subscribe creates a PubSub connected to addr and subscribes the given channels
+func Subscribe(addr string, channels ...string) (*PubSub, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ps := &PubSub{
+		addr:     addr,
+		conn:     conn,
+		channels: make(map[string]struct{}),
+		ch:       make(chan *Message, chanSize),
+	}
+	go ps.receive(conn)
+	if len(channels) > 0 {
+		if err := ps.Subscribe(channels...); err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// Channel returns the channel of received messages, it is closed after the PubSub closed
+func (ps *PubSub) Channel() <-chan *Message {
+	return ps.ch
+}
+
+// Subscribe subscribes more channels
+func (ps *PubSub) Subscribe(channels ...string) error {
+	if len(channels) == 0 {
+		return nil
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	for _, channel := range channels {
+		ps.channels[channel] = struct{}{}
+	}
+	return ps.write(append([]string{"SUBSCRIBE"}, channels...))
+}
+
+// Unsubscribe unsubscribes the given channels, or all channels if no channel given
+func (ps *PubSub) Unsubscribe(channels ...string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	if len(channels) == 0 {
+		ps.channels = make(map[string]struct{})
+	}
+	for _, channel := range channels {
+		delete(ps.channels, channel)
+	}
+	return ps.write(append([]string{"UNSUBSCRIBE"}, channels...))
+}
+
+// Close closes the connection and the message channel
+func (ps *PubSub) Close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return
+	}
+	ps.closed = true
+	_ = ps.conn.Close()
+}
+
+// write 需要在持有 ps.mu 的情况下调用
+func (ps *PubSub) write(args []string) error {
+	_, err := ps.conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine(args...)).ToBytes())
+	return err
+}
+
+// receive 读取连接上推送的消息，订阅和取消订阅的确认消息会被忽略
+func (ps *PubSub) receive(conn net.Conn) {
+	for payload := range parser.ParseStream(conn) {
+		if payload.Err != nil {
+			break
+		}
+		// 推送的消息全部由 bulk string 组成，确认消息中包含订阅数量，会被解析为 MultiRawReply
+		reply, ok := payload.Data.(*protocol.MultiBulkReply)
+		if !ok || len(reply.Args) != 3 || string(reply.Args[0]) != "message" {
+			continue
+		}
+		ps.ch <- &Message{
+			Channel: string(reply.Args[1]),
+			Payload: reply.Args[2],
+		}
+	}
+	_ = conn.Close()
+	if conn, err := ps.reconnect(); err == nil {
+		go ps.receive(conn)
+		return
+	} else if !errors.Is(err, ErrClosed) {
+		logger.Error("pubsub reconnect failed: " + err.Error())
+	}
+	close(ps.ch)
+}
+
+// reconnect 重新建立连接并恢复之前的订阅，PubSub 已经关闭时返回 ErrClosed
+func (ps *PubSub) reconnect() (net.Conn, error) {
+	var lastErr error
+	for i := 0; i < reconnectTimes; i++ {
+		ps.mu.Lock()
+		if ps.closed {
+			ps.mu.Unlock()
+			return nil, ErrClosed
+		}
+		ps.mu.Unlock()
+
+		conn, err := net.Dial("tcp", ps.addr)
+		if err != nil {
+			lastErr = err
+			time.Sleep(time.Second)
+			continue
+		}
+
+		ps.mu.Lock()
+		if ps.closed {
+			ps.mu.Unlock()
+			_ = conn.Close()
+			return nil, ErrClosed
+		}
+		ps.conn = conn
+		channels := make([]string, 0, len(ps.channels))
+		for channel := range ps.channels {
+			channels = append(channels, channel)
+		}
+		if len(channels) > 0 {
+			err = ps.write(append([]string{"SUBSCRIBE"}, channels...))
+		}
+		ps.mu.Unlock()
+		if err != nil {
+			lastErr = err
+			_ = conn.Close()
+			continue
+		}
+		logger.Info("pubsub reconnected with: " + ps.addr)
+		return conn, nil
+	}
+	ps.mu.Lock()
+	ps.closed = true
+	ps.mu.Unlock()
+	return nil, lastErr
+}
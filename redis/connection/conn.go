@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"miniRedis/interface/redis"
 	"miniRedis/lib/logger"
 	"miniRedis/lib/sync/wait"
 	"net"
@@ -47,13 +48,16 @@ type Connection struct {
 	// 代表 multi 命令的排队命令。
 	queue [][][]byte
 	//代表正在观察的键。
-	watching map[string]uint32
+	watching map[redis.WatchKey]uint32
 	// 代表事务中的错误。
 	txErrors []error
 
 	// selected db
 	// 代表选择的数据库，从0-15
 	selectedDB int
+
+	// closeNotify 在连接关闭时被关闭，用于结束 CDC 推送等属于这个连接的后台任务
+	closeNotify chan struct{}
 }
 
 /*
@@ -81,6 +85,12 @@ func (c *Connection) Close() error {
 	c.watching = nil
 	c.txErrors = nil
 	c.selectedDB = 0
+	// 连接对象会被复用，不能把事务等状态带给下一个连接
+	c.flags = 0
+	if c.closeNotify != nil {
+		close(c.closeNotify)
+		c.closeNotify = nil
+	}
 	connPool.Put(c)
 	return nil
 }
@@ -92,10 +102,12 @@ func NewConn(conn net.Conn) *Connection {
 	if !ok {
 		logger.Error("connection pool make wrong type")
 		return &Connection{
-			conn: conn,
+			conn:        conn,
+			closeNotify: make(chan struct{}),
 		}
 	}
 	c.conn = conn
+	c.closeNotify = make(chan struct{})
 	return c
 }
 
@@ -112,6 +124,12 @@ func (c *Connection) Write(b []byte) (int, error) {
 	return c.conn.Write(b)
 }
 
+// CloseNotify 返回一个在连接关闭时被关闭的 channel，连接对象会被复用，所以需要在使用连接时获取。
+// 内存连接返回 nil，永远不会通知
+func (c *Connection) CloseNotify() <-chan struct{} {
+	return c.closeNotify
+}
+
 // Name 返回远程地址的地址信息 "192.0.2.1:25"
 func (c *Connection) Name() string {
 	if c.conn != nil {
@@ -176,6 +194,7 @@ func (c *Connection) SetMultiState(state bool) {
 	if !state { // 传入为false，清除事务标志
 		c.watching = nil
 		c.queue = nil
+		c.txErrors = nil
 		c.flags &= ^flagMulti // clean multi flag
 		return
 	}
@@ -205,10 +224,10 @@ func (c *Connection) AddTxError(err error) {
 	c.txErrors = append(c.txErrors, err)
 }
 
-// GetWatching 返回正在watch的key，以及其版本编号
-func (c *Connection) GetWatching() map[string]uint32 {
+// GetWatching 返回正在watch的key，以及watch时的版本编号
+func (c *Connection) GetWatching() map[redis.WatchKey]uint32 {
 	if c.watching == nil {
-		c.watching = make(map[string]uint32)
+		c.watching = make(map[redis.WatchKey]uint32)
 	}
 	return c.watching
 }
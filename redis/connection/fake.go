@@ -7,14 +7,18 @@ import (
 	"sync"
 )
 
-// FakeConn 用于实现AOF
+// FakeConn 是一个不经过网络的内存连接，用于加载AOF以及进程内的调用方
+// 它和普通的连接一样保存了选择的数据库、事务、订阅等状态，
+// 服务端写入的数据（例如订阅的消息）默认保存在缓冲区中，可以通过 Read 读取
 type FakeConn struct {
 	Connection
-	buf    []byte
-	offset int
-	waitOn chan struct{}
-	closed bool
-	mu     sync.Mutex
+	name    string
+	onWrite func([]byte) // 不为空时服务端写入的数据直接交给 onWrite 处理，不再写入缓冲区
+	buf     []byte
+	offset  int
+	waitOn  chan struct{}
+	closed  bool
+	mu      sync.Mutex
 }
 
 func NewFakeConn() *FakeConn {
@@ -22,11 +26,28 @@ func NewFakeConn() *FakeConn {
 	return c
 }
 
+// NewFakeConnWithWriter 创建一个带名称的内存连接，服务端每次写入的完整数据都会交给 onWrite 处理
+func NewFakeConnWithWriter(name string, onWrite func([]byte)) *FakeConn {
+	return &FakeConn{
+		name:    name,
+		onWrite: onWrite,
+	}
+}
+
+// Name 返回创建连接时指定的名称
+func (c *FakeConn) Name() string {
+	return c.name
+}
+
 // Write writes data to buffer
 func (c *FakeConn) Write(b []byte) (int, error) {
 	if c.closed {
 		return 0, io.EOF
 	}
+	if c.onWrite != nil {
+		c.onWrite(b)
+		return len(b), nil
+	}
 	c.mu.Lock()
 	c.buf = append(c.buf, b...)
 	c.mu.Unlock()
@@ -49,6 +70,7 @@ func (c *FakeConn) notify() {
 func (c *FakeConn) wait(offset int) {
 	c.mu.Lock()
 	if c.offset != offset { // new data during waiting lock
+		c.mu.Unlock()
 		return
 	}
 	if c.waitOn == nil {
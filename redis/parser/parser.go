@@ -166,6 +166,8 @@ func parseBulkString(header []byte, reader *bufio.Reader, ch chan<- *Payload) er
 }
 
 // 解析数组类型（*开头）
+// 客户端发送的命令是由多行字符串组成的数组，解析为 MultiBulkReply；
+// 服务端的回复中数组可能包含整数、状态、错误、空值以及嵌套的数组，此时解析为 MultiRawReply
 func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
 	/*
 		*2\r\n
@@ -174,21 +176,46 @@ func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
 		 $2\r\n
 		 k1
 	*/
+	reply, err := readArray(header, reader)
+	if err != nil {
+		if perr, ok := err.(*protocolErr); ok {
+			protocolError(ch, perr.msg)
+			return nil
+		}
+		return err
+	}
+	ch <- &Payload{
+		Data: reply,
+	}
+	return nil
+}
+
+// protocolErr 表示数据不符合 RESP 协议，解析可以跳过这部分数据继续进行
+type protocolErr struct {
+	msg string
+}
+
+func (e *protocolErr) Error() string {
+	return "protocol error: " + e.msg
+}
 
+// readArray 读取一个完整的数组，header 是已经读取的数组头部，例如 *3
+func readArray(header []byte, reader *bufio.Reader) (redis.Reply, error) {
 	//获取长度
 	nStrs, err := strconv.ParseInt(string(header[1:]), 10, 64)
-	if err != nil || nStrs < 0 {
-		protocolError(ch, "illegal array header "+string(header[1:]))
-		return nil
+	if err != nil || nStrs < -1 {
+		return nil, &protocolErr{msg: "illegal array header " + string(header[1:])}
+	} else if nStrs == -1 {
+		// 空数组，例如阻塞命令超时
+		return protocol.MakeNullMultiBulkReply(), nil
 	} else if nStrs == 0 {
-		ch <- &Payload{
-			Data: protocol.MakeEmptyMultiBulkReply(),
-		}
-		return nil
+		return protocol.MakeEmptyMultiBulkReply(), nil
 	}
 
 	// nstrs表示共有多少行，lines用于存储命令参数，是一个切片，切片元素是字节数组
 	lines := make([][]byte, 0, nStrs)
+	// replies 只有在数组中出现了字符串之外的元素时才会使用
+	var replies []redis.Reply
 	// 处理每一行
 	for i := int64(0); i < nStrs; i++ {
 		var line []byte
@@ -196,37 +223,77 @@ func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
 		// line = $3\r\n
 		line, err = reader.ReadBytes('\n')
 		if err != nil {
-			return err
+			return nil, err
 		}
 		length := len(line)
-
-		//判断是否是一行数据
-		if length < 4 || line[length-2] != '\r' || line[0] != '$' {
-			protocolError(ch, "illegal bulk string header "+string(line))
-			break
+		if length < 3 || line[length-2] != '\r' {
+			return nil, &protocolErr{msg: "illegal bulk string header " + string(line)}
 		}
-		// strlen = 3
-		strLen, err := strconv.ParseInt(string(line[1:length-2]), 10, 64)
-		if err != nil || strLen < -1 {
-			protocolError(ch, "illegal bulk string length "+string(line))
-			break
-		} else if strLen == -1 {
-			lines = append(lines, []byte{})
-		} else {
-			//strlen+2 = 5
-			body := make([]byte, strLen+2)
-			//读取一行数据 读取了get
-			_, err := io.ReadFull(reader, body)
+		line = line[:length-2]
+
+		var element redis.Reply
+		switch line[0] {
+		case '$':
+			// strlen = 3
+			strLen, err := strconv.ParseInt(string(line[1:]), 10, 64)
+			if err != nil || strLen < -1 {
+				return nil, &protocolErr{msg: "illegal bulk string length " + string(line)}
+			}
+			var body []byte
+			if strLen >= 0 {
+				//strlen+2 = 5
+				body = make([]byte, strLen+2)
+				//读取一行数据 读取了get
+				_, err := io.ReadFull(reader, body)
+				if err != nil {
+					return nil, err
+				}
+				body = body[:len(body)-2]
+			}
+			if replies == nil {
+				lines = append(lines, body)
+				continue
+			}
+			if body == nil {
+				element = protocol.MakeNullBulkReply()
+			} else {
+				element = protocol.MakeBulkReply(body)
+			}
+		case ':':
+			value, err := strconv.ParseInt(string(line[1:]), 10, 64)
+			if err != nil {
+				return nil, &protocolErr{msg: "illegal number " + string(line[1:])}
+			}
+			element = protocol.MakeIntReply(value)
+		case '+':
+			element = protocol.MakeStatusReply(string(line[1:]))
+		case '-':
+			element = protocol.MakeErrReply(string(line[1:]))
+		case '*':
+			element, err = readArray(line, reader)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			lines = append(lines, body[:len(body)-2])
+		default:
+			return nil, &protocolErr{msg: "illegal bulk string header " + string(line)}
 		}
+		if replies == nil {
+			// 将之前读取的字符串转换为 reply
+			replies = make([]redis.Reply, 0, nStrs)
+			for _, l := range lines {
+				if l == nil {
+					replies = append(replies, protocol.MakeNullBulkReply())
+				} else {
+					replies = append(replies, protocol.MakeBulkReply(l))
+				}
+			}
+		}
+		replies = append(replies, element)
 	}
-	ch <- &Payload{
-		Data: protocol.MakeMultiBulkReply(lines),
+	if replies != nil {
+		return protocol.MakeMultiRawReply(replies), nil
 	}
-	return nil
+	return protocol.MakeMultiBulkReply(lines), nil
 }
 
 func protocolError(ch chan<- *Payload, msg string) {
@@ -39,6 +39,19 @@ func MakeNullBulkReply() *NullBulkReply {
 	return &NullBulkReply{}
 }
 
+// NullMultiBulkReply 返回 null 数组，例如 ZMPOP 没有找到非空的 key、EXEC 因为 WATCH 的 key 被修改而放弃
+var nullMultiBulkBytes = []byte("*-1\r\n")
+
+type NullMultiBulkReply struct{}
+
+func (r *NullMultiBulkReply) ToBytes() []byte {
+	return nullMultiBulkBytes
+}
+
+func MakeNullMultiBulkReply() *NullMultiBulkReply {
+	return &NullMultiBulkReply{}
+}
+
 // EmptyMultiBulkReply 返回空的列表
 type EmptyMultiBulkReply struct{}
 
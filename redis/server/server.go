@@ -62,9 +62,10 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 
 	client := connection.NewConn(conn)
 	h.activeConn.Store(client, struct{}{})
+	database2.RecordConnection()
 
 	// 解析完成后得到的管道
-	ch := parser.ParseStream(conn)
+	ch := parser.ParseStream(&countingReader{reader: conn})
 
 	for payload := range ch {
 		// 处理错误结果
@@ -103,11 +104,37 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 
 		// 执行参数
 		result := h.db.Exec(client, r.Args)
+		var n int
 		if result != nil {
 			// 写回响应
-			_, _ = client.Write(result.ToBytes())
+			n, _ = client.Write(result.ToBytes())
 		} else {
-			_, _ = client.Write(unknownErrReplyBytes)
+			n, _ = client.Write(unknownErrReplyBytes)
 		}
+		database2.RecordNetOutput(n)
 	}
 }
+
+// Close 拒绝新的连接，关闭所有的客户端连接，然后关闭数据库（持久化、metrics 等）
+func (h *Handler) Close() error {
+	logger.Info("handler shutting down...")
+	h.closing.Set(true)
+	h.activeConn.Range(func(key interface{}, val interface{}) bool {
+		client := key.(*connection.Connection)
+		_ = client.Close()
+		return true
+	})
+	h.db.Close()
+	return nil
+}
+
+// countingReader 统计从客户端读取的字节数
+type countingReader struct {
+	reader io.Reader
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	database2.RecordNetInput(n)
+	return n, err
+}